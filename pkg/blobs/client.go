@@ -18,8 +18,11 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/rpc"
 	"github.com/cockroachdb/cockroach/pkg/rpc/nodedialer"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/errors"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // BlobClient provides an interface for file access on all nodes' local storage.
@@ -36,15 +39,30 @@ type BlobClient interface {
 	// it over to another node, based on the nodeID.
 	WriteFile(ctx context.Context, file string, content io.ReadSeeker) error
 
+	// WriteFileIfNotExists is like WriteFile, but fails with an error for which
+	// oserror.IsExist or status.Code(err) == codes.AlreadyExists is true,
+	// depending on whether the node is local or remote, if the file already
+	// exists.
+	WriteFileIfNotExists(ctx context.Context, file string, content io.ReadSeeker) error
+
 	// List lists the corresponding filenames from the requested node.
 	// The requested node can be the current node.
 	List(ctx context.Context, pattern string) ([]string, error)
 
+	// ListWithStats is like List, but also returns the stats of the listed
+	// files, in the same order. Files that are removed while they are listed
+	// are omitted.
+	ListWithStats(ctx context.Context, pattern string) ([]string, []*blobspb.BlobStat, error)
+
 	// Delete deletes the specified file or empty directory from a remote node.
 	Delete(ctx context.Context, file string) error
 
 	// Stat gets the size (in bytes) of a specified file from a remote node.
 	Stat(ctx context.Context, file string) (*blobspb.BlobStat, error)
+
+	// Sync flushes the specified files, and their parent directories, to disk
+	// on the requested node.
+	Sync(ctx context.Context, files []string) error
 }
 
 var _ BlobClient = &remoteClient{}
@@ -78,7 +96,17 @@ func (c *remoteClient) ReadFile(
 func (c *remoteClient) WriteFile(
 	ctx context.Context, file string, content io.ReadSeeker,
 ) (err error) {
-	ctx = metadata.AppendToOutgoingContext(ctx, "filename", file)
+	return c.putStream(metadata.AppendToOutgoingContext(ctx, "filename", file), content)
+}
+
+func (c *remoteClient) WriteFileIfNotExists(
+	ctx context.Context, file string, content io.ReadSeeker,
+) error {
+	ctx = metadata.AppendToOutgoingContext(ctx, "filename", file, "if-not-exists", "true")
+	return c.putStream(ctx, content)
+}
+
+func (c *remoteClient) putStream(ctx context.Context, content io.ReadSeeker) (err error) {
 	stream, err := c.blobClient.PutStream(ctx)
 	if err != nil {
 		return
@@ -103,6 +131,36 @@ func (c *remoteClient) List(ctx context.Context, pattern string) ([]string, erro
 	return resp.Files, nil
 }
 
+func (c *remoteClient) ListWithStats(
+	ctx context.Context, pattern string,
+) ([]string, []*blobspb.BlobStat, error) {
+	resp, err := c.blobClient.List(ctx, &blobspb.GlobRequest{
+		Pattern:   pattern,
+		WithStats: true,
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "fetching list")
+	}
+	if len(resp.Stats) == len(resp.Files) {
+		return resp.Files, resp.Stats, nil
+	}
+	// The node predates with_stats, so each file is stat'ed separately.
+	var files []string
+	var stats []*blobspb.BlobStat
+	for _, file := range resp.Files {
+		stat, err := c.Stat(ctx, file)
+		if err != nil {
+			if status.Code(err) == codes.NotFound {
+				continue
+			}
+			return nil, nil, errors.Wrapf(err, "stat of listed file %s", file)
+		}
+		files = append(files, file)
+		stats = append(stats, stat)
+	}
+	return files, stats, nil
+}
+
 func (c *remoteClient) Delete(ctx context.Context, file string) error {
 	_, err := c.blobClient.Delete(ctx, &blobspb.DeleteRequest{
 		Filename: file,
@@ -120,6 +178,13 @@ func (c *remoteClient) Stat(ctx context.Context, file string) (*blobspb.BlobStat
 	return resp, nil
 }
 
+func (c *remoteClient) Sync(ctx context.Context, files []string) error {
+	_, err := c.blobClient.Sync(ctx, &blobspb.SyncRequest{
+		Filenames: files,
+	})
+	return err
+}
+
 var _ BlobClient = &localClient{}
 
 // localClient executes the local blob service's code
@@ -129,8 +194,8 @@ type localClient struct {
 }
 
 // NewLocalClient instantiates a local blob service client.
-func NewLocalClient(externalIODir string) (BlobClient, error) {
-	storage, err := NewLocalStorage(externalIODir)
+func NewLocalClient(externalIODir string, settings *cluster.Settings) (BlobClient, error) {
+	storage, err := NewLocalStorage(externalIODir, settings)
 	if err != nil {
 		return nil, errors.Wrap(err, "creating local client")
 	}
@@ -147,10 +212,22 @@ func (c *localClient) WriteFile(ctx context.Context, file string, content io.Rea
 	return c.localStorage.WriteFile(file, content)
 }
 
+func (c *localClient) WriteFileIfNotExists(
+	ctx context.Context, file string, content io.ReadSeeker,
+) error {
+	return c.localStorage.WriteFileIfNotExists(file, content)
+}
+
 func (c *localClient) List(ctx context.Context, pattern string) ([]string, error) {
 	return c.localStorage.List(pattern)
 }
 
+func (c *localClient) ListWithStats(
+	ctx context.Context, pattern string,
+) ([]string, []*blobspb.BlobStat, error) {
+	return c.localStorage.ListWithStats(pattern)
+}
+
 func (c *localClient) Delete(ctx context.Context, file string) error {
 	return c.localStorage.Delete(file)
 }
@@ -159,16 +236,23 @@ func (c *localClient) Stat(ctx context.Context, file string) (*blobspb.BlobStat,
 	return c.localStorage.Stat(file)
 }
 
+func (c *localClient) Sync(ctx context.Context, files []string) error {
+	return c.localStorage.Sync(files)
+}
+
 // BlobClientFactory creates a blob client based on the nodeID we are dialing.
 type BlobClientFactory func(ctx context.Context, dialing roachpb.NodeID) (BlobClient, error)
 
 // NewBlobClientFactory returns a BlobClientFactory
 func NewBlobClientFactory(
-	localNodeID roachpb.NodeID, dialer *nodedialer.Dialer, externalIODir string,
+	localNodeID roachpb.NodeID,
+	dialer *nodedialer.Dialer,
+	externalIODir string,
+	settings *cluster.Settings,
 ) BlobClientFactory {
 	return func(ctx context.Context, dialing roachpb.NodeID) (BlobClient, error) {
 		if dialing == 0 || localNodeID == dialing {
-			return NewLocalClient(externalIODir)
+			return NewLocalClient(externalIODir, settings)
 		}
 		conn, err := dialer.Dial(ctx, dialing, rpc.DefaultClass)
 		if err != nil {
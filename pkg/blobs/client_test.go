@@ -25,6 +25,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/rpc"
 	"github.com/cockroachdb/cockroach/pkg/rpc/nodedialer"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
@@ -32,6 +33,9 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/netutil"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
 	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/errors/oserror"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func createTestResources(t testing.TB) (string, string, *stop.Stopper, func()) {
@@ -55,7 +59,7 @@ func setUpService(
 	remoteExternalDir string,
 ) BlobClientFactory {
 	s := rpc.NewServer(rpcContext)
-	remoteBlobServer, err := NewBlobService(remoteExternalDir)
+	remoteBlobServer, err := NewBlobService(remoteExternalDir, cluster.MakeTestingClusterSettings())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -66,7 +70,7 @@ func setUpService(
 	}
 
 	s2 := rpc.NewServer(rpcContext)
-	localBlobServer, err := NewBlobService(localExternalDir)
+	localBlobServer, err := NewBlobService(localExternalDir, cluster.MakeTestingClusterSettings())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -90,6 +94,7 @@ func setUpService(
 		localNodeID,
 		localDialer,
 		localExternalDir,
+		cluster.MakeTestingClusterSettings(),
 	)
 }
 
@@ -270,6 +275,63 @@ func TestBlobClientWriteFile(t *testing.T) {
 	}
 }
 
+func TestBlobClientWriteFileIfNotExists(t *testing.T) {
+	localNodeID := roachpb.NodeID(1)
+	remoteNodeID := roachpb.NodeID(2)
+	localExternalDir, remoteExternalDir, stopper, cleanUpFn := createTestResources(t)
+	defer cleanUpFn()
+
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	rpcContext := rpc.NewInsecureTestingContext(clock, stopper)
+	rpcContext.TestingAllowNamedRPCToAnonymousServer = true
+
+	blobClientFactory := setUpService(t, rpcContext, localNodeID, remoteNodeID, localExternalDir, remoteExternalDir)
+
+	for _, tc := range []struct {
+		name               string
+		nodeID             roachpb.NodeID
+		destinationNodeDir string
+		isExist            func(error) bool
+	}{
+		{
+			"write-remote-file",
+			remoteNodeID,
+			remoteExternalDir,
+			func(err error) bool { return status.Code(err) == codes.AlreadyExists },
+		},
+		{
+			"write-local-file",
+			localNodeID,
+			localExternalDir,
+			oserror.IsExist,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			blobClient, err := blobClientFactory(ctx, tc.nodeID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			const filename = "test/exclusive.csv"
+			if err := blobClient.WriteFileIfNotExists(ctx, filename, bytes.NewReader([]byte("first"))); err != nil {
+				t.Fatal(err)
+			}
+			err = blobClient.WriteFileIfNotExists(ctx, filename, bytes.NewReader([]byte("second")))
+			if !tc.isExist(err) {
+				t.Fatalf("expected file to already exist, got error %v", err)
+			}
+			// The first write is left intact.
+			content, err := ioutil.ReadFile(filepath.Join(tc.destinationNodeDir, filename))
+			if err != nil {
+				t.Fatal(err, "unable to read file")
+			}
+			if string(content) != "first" {
+				t.Fatalf(`file content incorrect, expected first, got %s`, content)
+			}
+		})
+	}
+}
+
 func TestBlobClientList(t *testing.T) {
 	localNodeID := roachpb.NodeID(1)
 	remoteNodeID := roachpb.NodeID(2)
@@ -385,6 +447,64 @@ func TestBlobClientList(t *testing.T) {
 	}
 }
 
+func TestBlobClientListWithStats(t *testing.T) {
+	localNodeID := roachpb.NodeID(1)
+	remoteNodeID := roachpb.NodeID(2)
+	localExternalDir, remoteExternalDir, stopper, cleanUpFn := createTestResources(t)
+	defer cleanUpFn()
+
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	rpcContext := rpc.NewInsecureTestingContext(clock, stopper)
+	rpcContext.TestingAllowNamedRPCToAnonymousServer = true
+
+	blobClientFactory := setUpService(t, rpcContext, localNodeID, remoteNodeID, localExternalDir, remoteExternalDir)
+
+	for _, tc := range []struct {
+		name   string
+		nodeID roachpb.NodeID
+		dir    string
+	}{
+		{"list-local", localNodeID, localExternalDir},
+		{"list-remote", remoteNodeID, remoteExternalDir},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			writeTestFile(t, filepath.Join(tc.dir, "stats/a.csv"), []byte("a"))
+			writeTestFile(t, filepath.Join(tc.dir, "stats/b.csv"), []byte("bbb"))
+			// A file that is removed while it is listed is omitted, as is the
+			// dangling symlink that stands in for it here.
+			if err := os.Symlink(filepath.Join(tc.dir, "stats/removed"),
+				filepath.Join(tc.dir, "stats/c.csv")); err != nil {
+				t.Fatal(err)
+			}
+			blobClient, err := blobClientFactory(ctx, tc.nodeID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, stats, err := blobClient.ListWithStats(ctx, "stats/*.csv")
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []string{"/stats/a.csv", "/stats/b.csv"}
+			if fmt.Sprint(files) != fmt.Sprint(expected) {
+				t.Fatalf("expected %v, got %v", expected, files)
+			}
+			if len(stats) != len(files) {
+				t.Fatalf("expected %d stats, got %d", len(files), len(stats))
+			}
+			for i, file := range files {
+				fi, err := os.Stat(filepath.Join(tc.dir, file))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stats[i].Filesize != fi.Size() || stats[i].ModTime != fi.ModTime().UnixNano() {
+					t.Fatalf("incorrect stat of %s: %v", file, stats[i])
+				}
+			}
+		})
+	}
+}
+
 func TestBlobClientDeleteFrom(t *testing.T) {
 	localNodeID := roachpb.NodeID(1)
 	remoteNodeID := roachpb.NodeID(2)
@@ -536,3 +656,69 @@ func TestBlobClientStat(t *testing.T) {
 		})
 	}
 }
+
+func TestBlobClientSync(t *testing.T) {
+	localNodeID := roachpb.NodeID(1)
+	remoteNodeID := roachpb.NodeID(2)
+	localExternalDir, remoteExternalDir, stopper, cleanUpFn := createTestResources(t)
+	defer cleanUpFn()
+
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	rpcContext := rpc.NewInsecureTestingContext(clock, stopper)
+	rpcContext.TestingAllowNamedRPCToAnonymousServer = true
+
+	blobClientFactory := setUpService(t, rpcContext, localNodeID, remoteNodeID, localExternalDir, remoteExternalDir)
+
+	writeTestFile(t, filepath.Join(localExternalDir, "test/local.csv"), []byte("local_file"))
+	writeTestFile(t, filepath.Join(remoteExternalDir, "test/remote.csv"), []byte("remote_file"))
+
+	for _, tc := range []struct {
+		name   string
+		nodeID roachpb.NodeID
+		files  []string
+		err    string
+	}{
+		{
+			"sync-remote-file",
+			remoteNodeID,
+			[]string{"test/remote.csv"},
+			"",
+		},
+		{
+			"sync-local-file",
+			localNodeID,
+			[]string{"test/local.csv"},
+			"",
+		},
+		{
+			"sync-remote-file-does-not-exist",
+			remoteNodeID,
+			[]string{"test/remote.csv", "test/doesnotexist"},
+			"no such file",
+		},
+		{
+			"sync-local-file-does-not-exist",
+			localNodeID,
+			[]string{"test/doesnotexist"},
+			"no such file",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			blobClient, err := blobClientFactory(ctx, tc.nodeID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = blobClient.Sync(ctx, tc.files)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !testutils.IsError(err, tc.err) {
+				t.Fatalf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
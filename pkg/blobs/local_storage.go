@@ -18,19 +18,35 @@ import (
 	"strings"
 
 	"github.com/cockroachdb/cockroach/pkg/blobs/blobspb"
-	"github.com/cockroachdb/cockroach/pkg/util/fileutil"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/errors/oserror"
+)
+
+// nodelocalFsyncEnabled controls whether files written to the external I/O
+// directory are fsync'ed (along with their parent directory) before the write
+// is reported as successful.
+var nodelocalFsyncEnabled = settings.RegisterBoolSetting(
+	"cloudstorage.nodelocal.fsync.enabled",
+	"if enabled, files written to nodelocal storage are flushed to disk before the write "+
+		"completes so they survive a crash or power loss; disabling this makes writes faster "+
+		"but can leave recently written files missing or corrupt after such a failure",
+	true,
 )
 
 // LocalStorage wraps all operations with the local file system
 // that the blob service makes.
 type LocalStorage struct {
 	externalIODir string
+	settings      *cluster.Settings
 }
 
 // NewLocalStorage creates a new LocalStorage object and returns
 // an error when we cannot take the absolute path of `externalIODir`.
-func NewLocalStorage(externalIODir string) (*LocalStorage, error) {
+// The settings may be nil, in which case the default values of the
+// settings are used.
+func NewLocalStorage(externalIODir string, settings *cluster.Settings) (*LocalStorage, error) {
 	// An empty externalIODir indicates external IO is completely disabled.
 	// Returning a nil *LocalStorage in this case and then hanldling `nil` in the
 	// prependExternalIODir helper ensures that that is respected throughout the
@@ -43,16 +59,15 @@ func NewLocalStorage(externalIODir string) (*LocalStorage, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "creating LocalStorage object")
 	}
-	return &LocalStorage{externalIODir: absPath}, nil
+	return &LocalStorage{externalIODir: absPath, settings: settings}, nil
 }
 
 // prependExternalIODir makes `path` relative to the configured external I/O directory.
 //
-// Note that we purposefully only rely on the simplified cleanup
-// performed by filepath.Join() - which is limited to stripping out
-// occurrences of "../" - because we intendedly want to allow
-// operators to "open up" their I/O directory via symlinks. Therefore,
-// a full check via filepath.Abs() would be inadequate.
+// The external I/O directory itself may be a symlink, but symlinks inside of
+// it must not lead outside of it, as that would allow access to arbitrary
+// files of the host. So the resulting path is only returned if it still lives
+// under the external I/O directory once its symlinks are resolved.
 func (l *LocalStorage) prependExternalIODir(path string) (string, error) {
 	if l == nil {
 		return "", errors.Errorf("local file access is disabled")
@@ -61,28 +76,90 @@ func (l *LocalStorage) prependExternalIODir(path string) (string, error) {
 	if !strings.HasPrefix(localBase, l.externalIODir) {
 		return "", errors.Errorf("local file access to paths outside of external-io-dir is not allowed: %s", path)
 	}
+	root, err := evalSymlinks(l.externalIODir)
+	if err != nil {
+		return "", errors.Wrap(err, "resolving external-io-dir")
+	}
+	resolved, err := evalSymlinks(localBase)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolving %s", path)
+	}
+	if !isUnderDir(root, resolved) {
+		return "", errors.Errorf("local file access to paths outside of external-io-dir is not allowed: %s", path)
+	}
 	return localBase, nil
 }
 
+// isUnderDir returns whether path is dir or a path under it. Both paths must
+// have their symlinks resolved.
+func isUnderDir(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// evalSymlinks is like filepath.EvalSymlinks, but it allows path not to exist,
+// in which case the symlinks of its longest existing parent are resolved and
+// the rest of the path is appended to it.
+func evalSymlinks(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if !oserror.IsNotExist(err) {
+		return "", err
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+	resolvedParent, err := evalSymlinks(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolvedParent, filepath.Base(path)), nil
+}
+
 // WriteFile prepends IO dir to filename and writes the content to that local file.
-func (l *LocalStorage) WriteFile(filename string, content io.Reader) (err error) {
+func (l *LocalStorage) WriteFile(filename string, content io.Reader) error {
+	return l.writeFile(filename, content, false /* exclusive */)
+}
+
+// WriteFileIfNotExists is like WriteFile, but fails with an error for which
+// oserror.IsExist is true if the file already exists. The complete file is
+// hard linked to its name, which fails if the name is taken, so of concurrent
+// writes of the same file only one succeeds.
+func (l *LocalStorage) WriteFileIfNotExists(filename string, content io.Reader) error {
+	return l.writeFile(filename, content, true /* exclusive */)
+}
+
+func (l *LocalStorage) writeFile(filename string, content io.Reader, exclusive bool) (err error) {
 	fullPath, err := l.prependExternalIODir(filename)
 	if err != nil {
 		return err
 	}
 
 	targetDir := filepath.Dir(fullPath)
-	if err = os.MkdirAll(targetDir, 0755); err != nil {
+	if err = l.mkdirAll(targetDir); err != nil {
 		return errors.Wrapf(err, "creating target local directory %q", targetDir)
 	}
 
+	if exclusive {
+		// Fail early rather than after copying the content if the file already
+		// exists. This is only an optimization, as the file could be created
+		// concurrently; the link below is what guarantees that it is not
+		// overwritten.
+		if _, statErr := os.Lstat(fullPath); statErr == nil {
+			return errors.Wrapf(&os.LinkError{Op: "create", New: fullPath, Err: os.ErrExist},
+				"creating local file %q", fullPath)
+		}
+	}
+
 	// We generate the temporary file in the desired target directory.
 	// This has two purposes:
 	// - it avoids relying on the system-wide temporary directory, which
 	//   may not be large enough to receive the file.
-	// - it avoids a cross-filesystem rename in the common case.
-	//   (There can still be cross-filesystem renames in very
-	//   exotic edge cases, hence the use fileutil.Move below.)
+	// - the file is then renamed or linked within a directory, which is
+	//   atomic, so that readers never observe a partially written file,
+	//   even if the node crashes during the write.
 	// See the explanatory comment for ioutil.TempFile to understand
 	// what the "*" in the suffix means.
 	tmpFile, err := ioutil.TempFile(targetDir, filepath.Base(fullPath)+"*.tmp")
@@ -98,7 +175,7 @@ func (l *LocalStorage) WriteFile(filename string, content io.Reader) (err error)
 			//
 			// TODO(someone): in the special case where an attempt is made
 			// to upload to a sub-directory of the ext i/o dir for the first
-			// time (MkdirAll above did create the sub-directory), and the
+			// time (mkdirAll above did create the sub-directory), and the
 			// copy/rename fails, we're now left with a newly created but empty
 			// sub-directory.
 			//
@@ -117,15 +194,110 @@ func (l *LocalStorage) WriteFile(filename string, content io.Reader) (err error)
 		if _, err := io.Copy(tmpFile, content); err != nil {
 			return errors.Wrapf(err, "writing to temporary file %q", tmpFileFullName)
 		}
+		if !l.fsyncEnabled() {
+			return nil
+		}
 		return errors.Wrapf(tmpFile.Sync(), "flushing temporary file %q", tmpFileFullName)
 	}(); err != nil {
 		return err
 	}
 
-	// Finally put the file to its final location.
-	return errors.Wrapf(
-		fileutil.Move(tmpFileFullName, fullPath),
-		"moving temporary file to final location %q", fullPath)
+	if exclusive {
+		// Publish the complete file with a hard link, which unlike a rename fails
+		// if the name is taken. The temporary file is then removed whether the
+		// link succeeded or not; failing to remove it does not fail the write,
+		// as the file has been published.
+		err = os.Link(tmpFileFullName, fullPath)
+		_ = os.Remove(tmpFileFullName)
+		if err != nil {
+			return errors.Wrapf(err, "creating local file %q", fullPath)
+		}
+	} else if err = os.Rename(tmpFileFullName, fullPath); err != nil {
+		// Finally put the file to its final location. The rename is not done
+		// with fileutil.Move, as its fallback for cross-filesystem moves copies
+		// the file in place, which would not be atomic.
+		return errors.Wrapf(err, "moving temporary file to final location %q", fullPath)
+	}
+	if !l.fsyncEnabled() {
+		return nil
+	}
+	// Flush the parent directory too, so that the rename itself is durable.
+	return errors.Wrapf(syncDir(targetDir), "flushing target local directory %q", targetDir)
+}
+
+// mkdirAll is like os.MkdirAll for a directory dir under the external I/O
+// directory, creating the missing directories with permissions 0755. They are
+// created one at a time, each in its parent once the parent's symlinks have
+// been resolved and checked to stay under the external I/O directory, so that
+// a symlink replacing a directory since the path was checked cannot make them
+// be created outside of it. The parents of the created directories are flushed
+// unless fsync is disabled, so that the new directories are durable along with
+// the file written to them.
+func (l *LocalStorage) mkdirAll(dir string) error {
+	rel, err := filepath.Rel(l.externalIODir, dir)
+	if err != nil {
+		return err
+	}
+	// The external I/O directory itself is trusted, and created if missing.
+	if err := os.MkdirAll(l.externalIODir, 0755); err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	root, err := filepath.EvalSymlinks(l.externalIODir)
+	if err != nil {
+		return errors.Wrap(err, "resolving external-io-dir")
+	}
+	// resolve returns the path with the symlinks of path resolved, checking that
+	// it is still under the external I/O directory.
+	resolve := func(path string) (string, error) {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return "", err
+		}
+		if !isUnderDir(root, resolved) {
+			return "", errors.Errorf(
+				"local file access to paths outside of external-io-dir is not allowed: %s", rel)
+		}
+		return resolved, nil
+	}
+	parent := l.externalIODir
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		resolved, err := resolve(parent)
+		if err != nil {
+			return err
+		}
+		if err := os.Mkdir(filepath.Join(resolved, name), 0755); err != nil {
+			if !oserror.IsExist(err) {
+				return err
+			}
+		} else if l.fsyncEnabled() {
+			if err := syncDir(resolved); err != nil {
+				return err
+			}
+		}
+		parent = filepath.Join(parent, name)
+	}
+	_, err = resolve(dir)
+	return err
+}
+
+func (l *LocalStorage) fsyncEnabled() bool {
+	return l.settings == nil || nodelocalFsyncEnabled.Get(&l.settings.SV)
+}
+
+// syncDir fsyncs the directory at path.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
 }
 
 // ReadFile prepends IO dir to filename and reads the content of that local file.
@@ -163,24 +335,145 @@ func (l *LocalStorage) ReadFile(
 }
 
 // List prepends IO dir to pattern and glob matches all local files against that pattern.
+// In addition to the syntax of filepath.Match, a "**" path element matches any
+// number of directories, including none, in which case only files are listed.
+// Matches that are reached through a symlink leading outside of the external
+// I/O directory are omitted.
 func (l *LocalStorage) List(pattern string) ([]string, error) {
+	files, _, err := l.list(pattern, false /* withStats */)
+	return files, err
+}
+
+// ListWithStats is like List, but also returns the stats of the listed files,
+// in the same order. Files that are removed while they are listed are omitted.
+func (l *LocalStorage) ListWithStats(pattern string) ([]string, []*blobspb.BlobStat, error) {
+	return l.list(pattern, true /* withStats */)
+}
+
+func (l *LocalStorage) list(pattern string, withStats bool) ([]string, []*blobspb.BlobStat, error) {
 	if pattern == "" {
-		return nil, errors.New("pattern cannot be empty")
+		return nil, nil, errors.New("pattern cannot be empty")
 	}
 	fullPath, err := l.prependExternalIODir(pattern)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	var matches []string
+	if segments := strings.Split(fullPath, string(filepath.Separator)); hasDoubleStar(segments) {
+		matches, err = walkGlob(segments)
+	} else {
+		matches, err = filepath.Glob(fullPath)
 	}
-	matches, err := filepath.Glob(fullPath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	// prependExternalIODir only resolved the symlinks of the leading elements of
+	// the pattern that exist as they are, so a glob element can still match a
+	// symlink that leads outside of the external I/O directory, or a directory
+	// that is one.
+	root, err := evalSymlinks(l.externalIODir)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "resolving external-io-dir")
+	}
 	var fileList []string
+	var stats []*blobspb.BlobStat
 	for _, file := range matches {
+		resolved, err := filepath.EvalSymlinks(file)
+		if err != nil {
+			if oserror.IsNotExist(err) {
+				// The file was removed since it was matched, or is a dangling
+				// symlink.
+				continue
+			}
+			return nil, nil, err
+		}
+		if !isUnderDir(root, resolved) {
+			continue
+		}
+		if withStats {
+			fi, err := os.Stat(resolved)
+			if err != nil {
+				if oserror.IsNotExist(err) {
+					continue
+				}
+				return nil, nil, err
+			}
+			stats = append(stats, &blobspb.BlobStat{
+				Filesize: fi.Size(), ModTime: fi.ModTime().UnixNano(),
+			})
+		}
 		fileList = append(fileList, strings.TrimPrefix(file, l.externalIODir))
 	}
-	return fileList, nil
+	return fileList, stats, nil
+}
+
+func hasDoubleStar(segments []string) bool {
+	for _, segment := range segments {
+		if segment == "**" {
+			return true
+		}
+	}
+	return false
+}
+
+// walkGlob returns the files that match the pattern made of the path elements
+// in segments, some of which are "**". Only the directory named by the leading
+// elements that contain no glob syntax is walked.
+func walkGlob(segments []string) ([]string, error) {
+	n := 0
+	for n < len(segments) && !strings.ContainsAny(segments[n], `*?[\`) {
+		n++
+	}
+	root := strings.Join(segments[:n], string(filepath.Separator))
+	if root == "" {
+		root = string(filepath.Separator)
+	}
+	var matches []string
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if file == root && oserror.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		ok, err := matchSegments(segments[n:], strings.Split(rel, string(filepath.Separator)))
+		if ok {
+			matches = append(matches, file)
+		}
+		return err
+	})
+	return matches, err
+}
+
+// matchSegments returns whether the path elements in name match those of the
+// pattern, where a "**" pattern element matches any number of path elements.
+func matchSegments(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if ok, err := matchSegments(pattern[1:], name[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		if ok, err := filepath.Match(pattern[0], name[0]); !ok || err != nil {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
 }
 
 // Delete prepends IO dir to filename and deletes that local file.
@@ -192,6 +485,43 @@ func (l *LocalStorage) Delete(filename string) error {
 	return os.Remove(fullPath)
 }
 
+// Sync prepends IO dir to each filename and fsyncs those local files, along
+// with their parent directories. Files are flushed regardless of
+// cloudstorage.nodelocal.fsync.enabled, as the caller explicitly asked for
+// them to be durable.
+func (l *LocalStorage) Sync(filenames []string) error {
+	dirs := make(map[string]struct{})
+	for _, filename := range filenames {
+		fullPath, err := l.prependExternalIODir(filename)
+		if err != nil {
+			return errors.Wrap(err, "syncing file")
+		}
+		if err := syncFile(fullPath); err != nil {
+			return errors.Wrapf(err, "flushing local file %q", fullPath)
+		}
+		dirs[filepath.Dir(fullPath)] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			return errors.Wrapf(err, "flushing local directory %q", dir)
+		}
+	}
+	return nil
+}
+
+// syncFile fsyncs the file at path.
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 // Stat prepends IO dir to filename and gets the Stat() of that local file.
 func (l *LocalStorage) Stat(filename string) (*blobspb.BlobStat, error) {
 	fullPath, err := l.prependExternalIODir(filename)
@@ -205,5 +535,5 @@ func (l *LocalStorage) Stat(filename string) (*blobspb.BlobStat, error) {
 	if fi.IsDir() {
 		return nil, errors.Errorf("expected a file but %q is a directory", fi.Name())
 	}
-	return &blobspb.BlobStat{Filesize: fi.Size()}, nil
+	return &blobspb.BlobStat{Filesize: fi.Size(), ModTime: fi.ModTime().UnixNano()}, nil
 }
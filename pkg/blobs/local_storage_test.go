@@ -11,14 +11,24 @@
 package blobs
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/errors/oserror"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDirectoryNormalization(t *testing.T) {
-	l, err := NewLocalStorage("././.")
+	l, err := NewLocalStorage("././.", cluster.MakeTestingClusterSettings())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -29,3 +39,270 @@ func TestDirectoryNormalization(t *testing.T) {
 
 	assert.Equal(t, expected, l.externalIODir)
 }
+
+func TestLocalStorageListDoubleStar(t *testing.T) {
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	for _, file := range []string{
+		"a.csv",
+		"a.sst",
+		"2023/b.csv",
+		"2023/01/c.csv",
+		"2023/01/02/d.csv",
+		"2023/01/02/d.sst",
+		"2024/e.csv",
+	} {
+		path := filepath.Join(dir, file)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, nil, 0644))
+	}
+	l, err := NewLocalStorage(dir, cluster.MakeTestingClusterSettings())
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		pattern  string
+		expected []string
+		err      string
+	}{
+		// Patterns without "**" also list directories, as filepath.Glob does.
+		{pattern: "*", expected: []string{"/2023", "/2024", "/a.csv", "/a.sst"}},
+		{pattern: "**", expected: []string{"/2023/01/02/d.csv", "/2023/01/02/d.sst",
+			"/2023/01/c.csv", "/2023/b.csv", "/2024/e.csv", "/a.csv", "/a.sst"}},
+		{pattern: "**/*.sst", expected: []string{"/2023/01/02/d.sst", "/a.sst"}},
+		// "**" also matches no directory at all.
+		{pattern: "2023/**/*.csv", expected: []string{"/2023/01/02/d.csv", "/2023/01/c.csv", "/2023/b.csv"}},
+		{pattern: "2023/**/02/*", expected: []string{"/2023/01/02/d.csv", "/2023/01/02/d.sst"}},
+		{pattern: "202?/**/c.csv", expected: []string{"/2023/01/c.csv"}},
+		{pattern: "**/01/**", expected: []string{"/2023/01/02/d.csv", "/2023/01/02/d.sst", "/2023/01/c.csv"}},
+		{pattern: "missing/**", expected: nil},
+		{pattern: "**/[", err: "syntax error in pattern"},
+		{pattern: "../**", err: "outside of external-io-dir is not allowed"},
+	} {
+		t.Run(tc.pattern, func(t *testing.T) {
+			files, err := l.List(tc.pattern)
+			if tc.err != "" {
+				require.True(t, testutils.IsError(err, tc.err), "%v", err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, files)
+		})
+	}
+}
+
+func TestLocalStorageSymlinkEscape(t *testing.T) {
+	tmp, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	dir := filepath.Join(tmp, "extern")
+	outside := filepath.Join(tmp, "outside")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "inside"), 0755))
+	require.NoError(t, os.MkdirAll(outside, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "inside", "file"), []byte("file"), 0644))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret"), filepath.Join(dir, "secret")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "escape")))
+	// Symlinks that stay inside of the external I/O directory are allowed, as is
+	// an external I/O directory that is itself a symlink.
+	require.NoError(t, os.Symlink(filepath.Join(dir, "inside"), filepath.Join(dir, "alias")))
+	require.NoError(t, os.Symlink(dir, filepath.Join(tmp, "link")))
+
+	for _, root := range []string{dir, filepath.Join(tmp, "link")} {
+		l, err := NewLocalStorage(root, cluster.MakeTestingClusterSettings())
+		require.NoError(t, err)
+
+		for _, path := range []string{"secret", "escape/secret", "escape/new", "escape/sub/new"} {
+			const expected = "outside of external-io-dir is not allowed"
+			_, _, err := l.ReadFile(path, 0)
+			require.True(t, testutils.IsError(err, expected), "%s: %v", path, err)
+			_, err = l.Stat(path)
+			require.True(t, testutils.IsError(err, expected), "%s: %v", path, err)
+			err = l.WriteFile(path, bytes.NewReader(nil))
+			require.True(t, testutils.IsError(err, expected), "%s: %v", path, err)
+			err = l.Delete(path)
+			require.True(t, testutils.IsError(err, expected), "%s: %v", path, err)
+		}
+		_, err = l.List("escape/*")
+		require.True(t, testutils.IsError(err, "outside of external-io-dir is not allowed"), "%v", err)
+		// Glob elements that match symlinks leading outside of the external I/O
+		// directory, or directories that are such symlinks, do not list what is
+		// outside of it.
+		for pattern, expected := range map[string][]string{
+			"*":         {"/alias", "/inside"},
+			"*/secret":  nil,
+			"*/file":    {"/alias/file", "/inside/file"},
+			"**/secret": nil,
+			"e*/*":      nil,
+		} {
+			files, err := l.List(pattern)
+			require.NoError(t, err, pattern)
+			require.Equal(t, expected, files, pattern)
+		}
+		_, err = os.Stat(filepath.Join(outside, "new"))
+		require.True(t, oserror.IsNotExist(err), "%v", err)
+
+		r, _, err := l.ReadFile("alias/file", 0)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, "file", string(data))
+		require.NoError(t, l.WriteFile("alias/new", bytes.NewReader(nil)))
+		require.NoError(t, l.Delete("alias/new"))
+		files, err := l.List("alias/*")
+		require.NoError(t, err)
+		require.Equal(t, []string{"/alias/file"}, files)
+	}
+}
+
+func TestLocalStorageWriteFileFsync(t *testing.T) {
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("fsync=%t", enabled), func(t *testing.T) {
+			st := cluster.MakeTestingClusterSettings()
+			nodelocalFsyncEnabled.Override(&st.SV, enabled)
+			l, err := NewLocalStorage(dir, st)
+			require.NoError(t, err)
+
+			filename := fmt.Sprintf("dir-%t/file", enabled)
+			require.NoError(t, l.WriteFile(filename, bytes.NewReader([]byte("content"))))
+			data, err := ioutil.ReadFile(filepath.Join(dir, filename))
+			require.NoError(t, err)
+			require.Equal(t, "content", string(data))
+		})
+	}
+}
+
+// failingReader returns the content of r, then fails instead of returning
+// io.EOF.
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("interrupted")
+	}
+	return n, err
+}
+
+func TestLocalStorageWriteFileInterrupted(t *testing.T) {
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	l, err := NewLocalStorage(dir, cluster.MakeTestingClusterSettings())
+	require.NoError(t, err)
+
+	// listDir returns the names of the files in the directory of the written
+	// files, which must not include any temporary file.
+	listDir := func() []string {
+		infos, err := ioutil.ReadDir(filepath.Join(dir, "dir"))
+		require.NoError(t, err)
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return names
+	}
+	interrupted := func() io.Reader {
+		return &failingReader{r: bytes.NewReader(bytes.Repeat([]byte("partial"), 1<<10))}
+	}
+
+	// A failed write of a new file leaves no file behind.
+	err = l.WriteFile("dir/new", interrupted())
+	require.True(t, testutils.IsError(err, "interrupted"), "%v", err)
+	_, err = os.Stat(filepath.Join(dir, "dir", "new"))
+	require.True(t, oserror.IsNotExist(err), "%v", err)
+	require.Empty(t, listDir())
+
+	err = l.WriteFileIfNotExists("dir/new", interrupted())
+	require.True(t, testutils.IsError(err, "interrupted"), "%v", err)
+	require.Empty(t, listDir())
+
+	// A failed write of an existing file leaves the file as it was.
+	require.NoError(t, l.WriteFile("dir/existing", bytes.NewReader([]byte("complete"))))
+	err = l.WriteFile("dir/existing", interrupted())
+	require.True(t, testutils.IsError(err, "interrupted"), "%v", err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "dir", "existing"))
+	require.NoError(t, err)
+	require.Equal(t, "complete", string(data))
+	require.Equal(t, []string{"existing"}, listDir())
+}
+
+// blockingReader returns the content of r once unblock is closed, signaling
+// blocked when it first waits for it.
+type blockingReader struct {
+	r                *bytes.Reader
+	blocked, unblock chan struct{}
+}
+
+func (b *blockingReader) Read(p []byte) (int, error) {
+	if b.blocked != nil {
+		close(b.blocked)
+		b.blocked = nil
+		<-b.unblock
+	}
+	return b.r.Read(p)
+}
+
+func TestLocalStorageWriteFileIfNotExistsAtomic(t *testing.T) {
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	l, err := NewLocalStorage(dir, cluster.MakeTestingClusterSettings())
+	require.NoError(t, err)
+
+	// Until the content is written, the file does not exist, rather than being
+	// seen as an empty file, and it does not prevent another write of it.
+	r := &blockingReader{
+		r: bytes.NewReader([]byte("first")), blocked: make(chan struct{}), unblock: make(chan struct{}),
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- l.WriteFileIfNotExists("dir/file", r) }()
+	<-r.blocked
+	_, err = os.Stat(filepath.Join(dir, "dir", "file"))
+	require.True(t, oserror.IsNotExist(err), "%v", err)
+	require.NoError(t, l.WriteFileIfNotExists("dir/file", bytes.NewReader([]byte("second"))))
+
+	// The write that completes last fails, and leaves the file as it was.
+	close(r.unblock)
+	err = <-errCh
+	require.True(t, oserror.IsExist(err), "%v", err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "dir", "file"))
+	require.NoError(t, err)
+	require.Equal(t, "second", string(data))
+	infos, err := ioutil.ReadDir(filepath.Join(dir, "dir"))
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+
+	// A write of a file that exists fails before its content is read.
+	err = l.WriteFileIfNotExists("dir/file", &failingReader{r: bytes.NewReader(nil)})
+	require.True(t, oserror.IsExist(err), "%v", err)
+}
+
+func TestLocalStorageWriteFileNested(t *testing.T) {
+	tmp, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	// The external I/O directory does not exist until the first write either.
+	dir := filepath.Join(tmp, "extern")
+	l, err := NewLocalStorage(dir, cluster.MakeTestingClusterSettings())
+	require.NoError(t, err)
+
+	require.NoError(t, l.WriteFile("a/b/c/d/e/f/file", bytes.NewReader([]byte("nested"))))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a", "b", "c", "d", "e", "f", "file"))
+	require.NoError(t, err)
+	require.Equal(t, "nested", string(data))
+	for p := filepath.Join(dir, "a", "b", "c", "d", "e", "f"); p != tmp; p = filepath.Dir(p) {
+		info, err := os.Stat(p)
+		require.NoError(t, err)
+		require.True(t, info.IsDir(), p)
+		require.Zero(t, info.Mode().Perm()&^0755, "%s: %s", p, info.Mode())
+	}
+
+	// Existing directories are reused, but a file cannot be one.
+	require.NoError(t, l.WriteFileIfNotExists("a/b/c/g/file", bytes.NewReader([]byte("sibling"))))
+	err = l.WriteFile("a/b/c/g/file/h/file", bytes.NewReader(nil))
+	require.True(t, testutils.IsError(err, "not a directory"), "%v", err)
+	_, err = l.Stat("a/b/c/g/file/h")
+	require.Error(t, err)
+}
@@ -29,6 +29,7 @@ import (
 	"context"
 
 	"github.com/cockroachdb/cockroach/pkg/blobs/blobspb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/errors/oserror"
 	"google.golang.org/grpc/codes"
@@ -44,8 +45,8 @@ type Service struct {
 var _ blobspb.BlobServer = &Service{}
 
 // NewBlobService instantiates a blob service server.
-func NewBlobService(externalIODir string) (*Service, error) {
-	localStorage, err := NewLocalStorage(externalIODir)
+func NewBlobService(externalIODir string, settings *cluster.Settings) (*Service, error) {
+	localStorage, err := NewLocalStorage(externalIODir, settings)
 	return &Service{localStorage: localStorage}, err
 }
 
@@ -71,6 +72,15 @@ func (s *Service) PutStream(stream blobspb.Blob_PutStreamServer) error {
 	}
 	reader := newPutStreamReader(stream)
 	defer reader.Close()
+	if ifNotExists := md.Get("if-not-exists"); len(ifNotExists) > 0 && ifNotExists[0] == "true" {
+		err := s.localStorage.WriteFileIfNotExists(filename[0], reader)
+		if oserror.IsExist(err) {
+			// As in Stat, the underlying error is replaced by a gRPC error that the
+			// client can detect.
+			return status.Error(codes.AlreadyExists, err.Error())
+		}
+		return err
+	}
 	err := s.localStorage.WriteFile(filename[0], reader)
 	return err
 }
@@ -79,6 +89,10 @@ func (s *Service) PutStream(stream blobspb.Blob_PutStreamServer) error {
 func (s *Service) List(
 	ctx context.Context, req *blobspb.GlobRequest,
 ) (*blobspb.GlobResponse, error) {
+	if req.WithStats {
+		matches, stats, err := s.localStorage.ListWithStats(req.Pattern)
+		return &blobspb.GlobResponse{Files: matches, Stats: stats}, err
+	}
 	matches, err := s.localStorage.List(req.Pattern)
 	return &blobspb.GlobResponse{Files: matches}, err
 }
@@ -100,3 +114,13 @@ func (s *Service) Stat(ctx context.Context, req *blobspb.StatRequest) (*blobspb.
 	}
 	return resp, err
 }
+
+// Sync implements the gRPC service.
+func (s *Service) Sync(ctx context.Context, req *blobspb.SyncRequest) (*blobspb.SyncResponse, error) {
+	err := s.localStorage.Sync(req.Filenames)
+	if oserror.IsNotExist(err) {
+		// As in Stat, the client can detect a missing file from the gRPC error.
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return &blobspb.SyncResponse{}, err
+}
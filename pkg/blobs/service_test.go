@@ -17,8 +17,11 @@ import (
 	"testing"
 
 	"github.com/cockroachdb/cockroach/pkg/blobs/blobspb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/errors/oserror"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestBlobServiceList(t *testing.T) {
@@ -31,7 +34,7 @@ func TestBlobServiceList(t *testing.T) {
 		writeTestFile(t, filepath.Join(tmpDir, file), fileContent)
 	}
 
-	service, err := NewBlobService(tmpDir)
+	service, err := NewBlobService(tmpDir, cluster.MakeTestingClusterSettings())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -75,7 +78,7 @@ func TestBlobServiceDelete(t *testing.T) {
 	filename := "path/to/file/content.txt"
 	writeTestFile(t, filepath.Join(tmpDir, filename), fileContent)
 
-	service, err := NewBlobService(tmpDir)
+	service, err := NewBlobService(tmpDir, cluster.MakeTestingClusterSettings())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -124,7 +127,7 @@ func TestBlobServiceStat(t *testing.T) {
 	filename := "path/to/file/content.txt"
 	writeTestFile(t, filepath.Join(tmpDir, filename), fileContent)
 
-	service, err := NewBlobService(tmpDir)
+	service, err := NewBlobService(tmpDir, cluster.MakeTestingClusterSettings())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -175,3 +178,47 @@ func TestBlobServiceStat(t *testing.T) {
 		}
 	})
 }
+
+func TestBlobServiceSync(t *testing.T) {
+	tmpDir, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+
+	filenames := []string{"path/to/file/a.txt", "path/to/file/b.txt", "path/c.txt"}
+	for _, filename := range filenames {
+		writeTestFile(t, filepath.Join(tmpDir, filename), []byte("file_content"))
+	}
+
+	service, err := NewBlobService(tmpDir, cluster.MakeTestingClusterSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	t.Run("sync-files", func(t *testing.T) {
+		if _, err := service.Sync(ctx, &blobspb.SyncRequest{Filenames: filenames}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("file-not-exist", func(t *testing.T) {
+		_, err := service.Sync(ctx, &blobspb.SyncRequest{
+			Filenames: []string{filenames[0], "file/does/not/exist"},
+		})
+		if err == nil {
+			t.Fatal("expected error but was not caught")
+		}
+		if status.Code(err) != codes.NotFound {
+			t.Fatal("incorrect error: " + err.Error())
+		}
+	})
+	t.Run("not-in-external-io-dir", func(t *testing.T) {
+		_, err := service.Sync(ctx, &blobspb.SyncRequest{
+			Filenames: []string{"file/../../content.txt"},
+		})
+		if err == nil {
+			t.Fatal("expected error but was not caught")
+		}
+		if !testutils.IsError(err, "outside of external-io-dir is not allowed") {
+			t.Fatal("incorrect error message: " + err.Error())
+		}
+	})
+}
@@ -172,7 +172,7 @@ func newBlobFactory(ctx context.Context, dialing roachpb.NodeID) (blobs.BlobClie
 	if debugBackupArgs.externalIODir == "" {
 		debugBackupArgs.externalIODir = filepath.Join(server.DefaultStorePath, "extern")
 	}
-	return blobs.NewLocalClient(debugBackupArgs.externalIODir)
+	return blobs.NewLocalClient(debugBackupArgs.externalIODir, cluster.NoSettings)
 }
 
 func externalStorageFromURIFactory(
@@ -277,14 +277,37 @@ func (es *generatorExternalStorage) WriteFile(
 	return errors.New("unsupported")
 }
 
+func (es *generatorExternalStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	return errors.New("unsupported")
+}
+
+func (es *generatorExternalStorage) Stat(
+	ctx context.Context, basename string,
+) (cloud.FileInfo, error) {
+	es.gen.maybeInitData()
+	return cloud.FileInfo{Exists: true, Size: int64(es.gen.size)}, nil
+}
+
 func (es *generatorExternalStorage) ListFiles(ctx context.Context, _ string) ([]string, error) {
 	return nil, errors.New("unsupported")
 }
 
+func (es *generatorExternalStorage) ListFilesExt(
+	ctx context.Context, _ string,
+) ([]cloud.FileEntry, error) {
+	return nil, errors.New("unsupported")
+}
+
 func (es *generatorExternalStorage) Delete(ctx context.Context, basename string) error {
 	return errors.New("unsupported")
 }
 
+func (es *generatorExternalStorage) DeleteAll(ctx context.Context, prefix string) error {
+	return errors.New("unsupported")
+}
+
 func (es *generatorExternalStorage) ExternalIOConf() base.ExternalIODirConfig {
 	return base.ExternalIODirConfig{}
 }
@@ -188,6 +188,8 @@ type externalStorageBuilder struct {
 	initCalled        bool
 	ie                *sql.InternalExecutor
 	db                *kv.DB
+	// metrics records the operations of the storages that are built.
+	metrics *cloudimpl.StorageMetrics
 }
 
 func (e *externalStorageBuilder) init(
@@ -211,8 +213,12 @@ func (e *externalStorageBuilder) makeExternalStorage(
 	if !e.initCalled {
 		return nil, errors.New("cannot create external storage before init")
 	}
-	return cloudimpl.MakeExternalStorage(ctx, dest, e.conf, e.settings, e.blobClientFactory, e.ie,
-		e.db)
+	s, err := cloudimpl.MakeExternalStorage(ctx, dest, e.conf, e.settings, e.blobClientFactory,
+		e.ie, e.db)
+	if err != nil {
+		return nil, err
+	}
+	return cloudimpl.WithMetrics(s, e.metrics), nil
 }
 
 func (e *externalStorageBuilder) makeExternalStorageFromURI(
@@ -221,7 +227,12 @@ func (e *externalStorageBuilder) makeExternalStorageFromURI(
 	if !e.initCalled {
 		return nil, errors.New("cannot create external storage before init")
 	}
-	return cloudimpl.ExternalStorageFromURI(ctx, uri, e.conf, e.settings, e.blobClientFactory, user, e.ie, e.db)
+	s, err := cloudimpl.ExternalStorageFromURI(ctx, uri, e.conf, e.settings, e.blobClientFactory,
+		user, e.ie, e.db)
+	if err != nil {
+		return nil, err
+	}
+	return cloudimpl.WithMetrics(s, e.metrics), nil
 }
 
 // NewServer creates a Server from a server.Config.
@@ -501,7 +512,9 @@ func NewServer(cfg Config, stopper *stop.Stopper) (*Server, error) {
 
 	// Create an ExternalStorageBuilder. This is only usable after Start() where
 	// we initialize all the configuration params.
-	externalStorageBuilder := &externalStorageBuilder{}
+	externalStorageBuilder := &externalStorageBuilder{
+		metrics: cloudimpl.NewStorageMetrics(registry, cfg.HistogramWindowInterval()),
+	}
 	externalStorage := func(ctx context.Context, dest roachpb.ExternalStorage) (cloud.
 		ExternalStorage, error) {
 		return externalStorageBuilder.makeExternalStorage(ctx, dest)
@@ -1182,7 +1195,7 @@ func (s *Server) PreStart(ctx context.Context) error {
 	fileTableInternalExecutor := sql.MakeInternalExecutor(ctx, s.PGServer().SQLServer, sql.MemoryMetrics{}, s.st)
 	s.externalStorageBuilder.init(s.cfg.ExternalIODirConfig, s.st,
 		blobs.NewBlobClientFactory(s.nodeIDContainer.Get(),
-			s.nodeDialer, s.st.ExternalIODir), &fileTableInternalExecutor, s.db)
+			s.nodeDialer, s.st.ExternalIODir, s.st), &fileTableInternalExecutor, s.db)
 
 	// Filter out self from the gossip bootstrap resolvers.
 	filtered := s.cfg.FilterGossipBootstrapResolvers(ctx)
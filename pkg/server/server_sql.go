@@ -254,7 +254,7 @@ func newSQLServer(ctx context.Context, cfg sqlServerArgs) (*SQLServer, error) {
 	}
 
 	// Create blob service for inter-node file sharing.
-	blobService, err := blobs.NewBlobService(cfg.Settings.ExternalIODir)
+	blobService, err := blobs.NewBlobService(cfg.Settings.ExternalIODir, cfg.Settings)
 	if err != nil {
 		return nil, errors.Wrap(err, "creating blob service")
 	}
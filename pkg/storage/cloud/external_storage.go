@@ -14,6 +14,7 @@ import (
 	"context"
 	"database/sql/driver"
 	"io"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
@@ -36,6 +37,10 @@ import (
 // will find its semantics well suited to this -- it elides empty components and
 // does not append surplus slashes.
 type ExternalStorage interface {
+	// Close releases the resources of the storage. It does not wait for the
+	// network, can be called more than once, and can be called after the context
+	// of the operations of the storage was canceled. The readers returned by the
+	// storage are closed separately.
 	io.Closer
 
 	// Conf should return the serializable configuration required to reconstruct
@@ -60,9 +65,20 @@ type ExternalStorage interface {
 	// This can be leveraged for an existence check.
 	ReadFileAt(ctx context.Context, basename string, offset int64) (io.ReadCloser, int64, error)
 
-	// WriteFile should write the content to requested name.
+	// WriteFile should write the content to requested name. Implementations
+	// that retry the write seek the content back to its start before every
+	// attempt; content that cannot seek, such as a stream, is written once.
+	// The file is durable once WriteFile returns without error, unless the
+	// storage implements Syncer, in which case it may only be durable once Sync
+	// returns.
 	WriteFile(ctx context.Context, basename string, content io.ReadSeeker) error
 
+	// WriteFileIfNotExists is like WriteFile, but fails with an error wrapping
+	// ErrFileAlreadyExists, rather than overwriting the file, if the named file
+	// already exists. Storages that cannot check and write atomically document
+	// so on their implementation.
+	WriteFileIfNotExists(ctx context.Context, basename string, content io.ReadSeeker) error
+
 	// ListFiles returns files that match a globs-style pattern. The returned
 	// results are usually relative to the base path, meaning an ExternalStorage
 	// instance can be initialized with some base path, used to query for files,
@@ -74,13 +90,125 @@ type ExternalStorage interface {
 	// and there is no clear definition of what it would mean to be relative to
 	// that, the results are fully-qualified absolute URIs. The base URI is *only*
 	// allowed to contain globs-patterns when the explicit patternSuffix is "".
+	//
+	// Every implementation returns the files sorted lexicographically by path,
+	// whatever order its backend lists them in.
 	ListFiles(ctx context.Context, patternSuffix string) ([]string, error)
 
+	// ListFilesExt is like ListFiles, but also returns the size and modification
+	// time of each file, which saves callers that need them a Stat of every
+	// file. The paths of the entries are the same as those returned by
+	// ListFiles.
+	ListFilesExt(ctx context.Context, patternSuffix string) ([]FileEntry, error)
+
 	// Delete removes the named file from the store.
 	Delete(ctx context.Context, basename string) error
 
+	// DeleteAll removes every file whose name relative to the base path starts
+	// with prefix, e.g. all the files in a directory if prefix ends in "/". An
+	// empty prefix removes every file under the base path. Deleting continues
+	// past the files that fail to be deleted, whose errors are combined in the
+	// returned error.
+	DeleteAll(ctx context.Context, prefix string) error
+
 	// Size returns the length of the named file in bytes.
 	Size(ctx context.Context, basename string) (int64, error)
+
+	// Stat returns the metadata of the named file. A file that does not exist
+	// is reported with Exists set to false rather than with an error.
+	Stat(ctx context.Context, basename string) (FileInfo, error)
+}
+
+// FileInfo describes a file in an ExternalStorage.
+type FileInfo struct {
+	// Exists is false if the file does not exist, in which case the other
+	// fields are unset.
+	Exists bool
+	// Size is the length of the file in bytes.
+	Size int64
+	// ModTime is the time the file was last modified, or the zero time if the
+	// storage does not track it.
+	ModTime time.Time
+	// ContentMD5 is the MD5 digest of the content of the file as stored by the
+	// provider, or nil if the storage does not know it, such as for S3 objects
+	// uploaded in multiple parts.
+	ContentMD5 []byte
+}
+
+// FileEntry describes a file listed in an ExternalStorage.
+type FileEntry struct {
+	// Path is the path of the file, as returned by ListFiles.
+	Path string
+	// Size is the length of the file in bytes.
+	Size int64
+	// ModTime is the time the file was last modified, or the zero time if the
+	// storage does not track it.
+	ModTime time.Time
+}
+
+// Presigner is implemented by the ExternalStorage that can generate URLs
+// through which a file can be downloaded without credentials, so that clients
+// can be handed a link rather than have the bytes proxied through a node.
+type Presigner interface {
+	// PresignedURL returns a URL from which the named file can be read with a
+	// GET request until expiry has passed.
+	PresignedURL(ctx context.Context, basename string, expiry time.Duration) (string, error)
+}
+
+// Copier is implemented by the ExternalStorage that can copy files from other
+// storage of the same provider within the provider, so that the bytes do not
+// pass through the node.
+type Copier interface {
+	// CopyFrom copies the file srcName of src to dstName in this storage. Files
+	// that cannot be copied within the provider, e.g. because src is of another
+	// provider or account, are streamed through the node instead.
+	CopyFrom(ctx context.Context, src ExternalStorage, srcName, dstName string) error
+}
+
+// Syncer is implemented by the ExternalStorage whose writes may not be durable
+// when they return, such as nodelocal storage, which may not flush its files to
+// disk. Storage that does not implement it, like the cloud providers that store
+// a file before acknowledging its upload, is durable once WriteFile returns.
+type Syncer interface {
+	// Sync makes the files written through this storage durable, so that they
+	// survive a crash or a power loss.
+	Sync(ctx context.Context) error
+}
+
+// Validator is implemented by the ExternalStorage that can check that its
+// configuration is usable, such as that its bucket exists and its credentials
+// grant access to it, without reading or writing the data of any file.
+type Validator interface {
+	// Validate returns an error if the storage cannot be used as configured.
+	// It makes at most a few cheap requests, so that a misconfiguration is
+	// reported before any data is transferred.
+	Validate(ctx context.Context) error
+}
+
+// PageLister is implemented by the ExternalStorage that can list files one page
+// at a time, so that callers can page through large buckets without all of
+// their files being listed and buffered at once.
+type PageLister interface {
+	// ListFilesPage returns up to limit of the files whose names, relative to
+	// the base path, start with prefix, sorted by path, along with the token
+	// that the page following them is listed with. An empty token lists the
+	// first page, and the token returned with the last page is empty.
+	ListFilesPage(
+		ctx context.Context, prefix, token string, limit int,
+	) (paths []string, nextToken string, err error)
+}
+
+// DelimitedLister is implemented by the ExternalStorage that can list files one
+// level at a time, like the delimiter of an S3 listing, so that callers such as
+// directory browsers do not have to list every file under a prefix.
+type DelimitedLister interface {
+	// ListFilesWithDelimiter returns the files whose names, relative to the
+	// base path, start with prefix and have no delimiter after it, and the
+	// distinct prefixes, ending with the first delimiter after prefix, of the
+	// names that do. Both are sorted.
+	ListFilesWithDelimiter(
+		ctx context.Context, prefix, delimiter string,
+	) (files []string, prefixes []string, err error)
 }
 
 // ExternalStorageFactory describes a factory function for ExternalStorage.
@@ -14,20 +14,33 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
-	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
 	"github.com/cockroachdb/cockroach/pkg/util/contextutil"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/errors"
 )
 
+var errAzureKeyAndSASToken = errors.Newf("azure uri cannot specify both %q and %q parameters",
+	AzureAccountKeyParam, AzureSASTokenParam)
+
+var errAzureManagedIdentityAndSecret = errors.Newf(
+	"azure uri cannot specify %q or %q when %q is set",
+	AzureAccountKeyParam, AzureSASTokenParam, AzureUseManagedIdentityParam)
+
 func parseAzureURL(_ ExternalStorageURIContext, uri *url.URL) (roachpb.ExternalStorage, error) {
 	conf := roachpb.ExternalStorage{}
 	conf.Provider = roachpb.ExternalStorageProvider_Azure
@@ -36,15 +49,38 @@ func parseAzureURL(_ ExternalStorageURIContext, uri *url.URL) (roachpb.ExternalS
 		Prefix:      uri.Path,
 		AccountName: uri.Query().Get(AzureAccountNameParam),
 		AccountKey:  uri.Query().Get(AzureAccountKeyParam),
+		SASToken:    uri.Query().Get(AzureSASTokenParam),
+		ContentType: uri.Query().Get(ContentTypeParam),
 		/* NB: additions here should also update azureQueryParams() serializer */
 	}
 	if conf.AzureConfig.AccountName == "" {
 		return conf, errors.Errorf("azure uri missing %q parameter", AzureAccountNameParam)
 	}
-	if conf.AzureConfig.AccountKey == "" {
-		return conf, errors.Errorf("azure uri missing %q parameter", AzureAccountKeyParam)
+	if err := validateContentType(conf.AzureConfig.ContentType); err != nil {
+		return conf, err
+	}
+	if managedIdentity := uri.Query().Get(AzureUseManagedIdentityParam); managedIdentity != "" {
+		var err error
+		conf.AzureConfig.UseManagedIdentity, err = strconv.ParseBool(managedIdentity)
+		if err != nil {
+			return conf, errors.Wrapf(err, "invalid value for %s", AzureUseManagedIdentityParam)
+		}
+	}
+	if conf.AzureConfig.UseManagedIdentity {
+		if conf.AzureConfig.AccountKey != "" || conf.AzureConfig.SASToken != "" {
+			return conf, errAzureManagedIdentityAndSecret
+		}
+	} else if conf.AzureConfig.AccountKey == "" && conf.AzureConfig.SASToken == "" {
+		return conf, errors.Errorf("azure uri missing %q or %q parameter",
+			AzureAccountKeyParam, AzureSASTokenParam)
+	}
+	if conf.AzureConfig.AccountKey != "" && conf.AzureConfig.SASToken != "" {
+		return conf, errAzureKeyAndSASToken
+	}
+	var err error
+	if conf.AzureConfig.Prefix, err = normalizeURIPath(conf.AzureConfig.Prefix); err != nil {
+		return conf, err
 	}
-	conf.AzureConfig.Prefix = strings.TrimLeft(conf.AzureConfig.Prefix, "/")
 	return conf, nil
 }
 
@@ -56,46 +92,196 @@ func azureQueryParams(conf *roachpb.ExternalStorage_Azure) string {
 	if conf.AccountKey != "" {
 		q.Set(AzureAccountKeyParam, conf.AccountKey)
 	}
+	if conf.SASToken != "" {
+		q.Set(AzureSASTokenParam, conf.SASToken)
+	}
+	if conf.UseManagedIdentity {
+		q.Set(AzureUseManagedIdentityParam, "true")
+	}
+	if conf.ContentType != "" {
+		q.Set(ContentTypeParam, conf.ContentType)
+	}
 	return q.Encode()
 }
 
+// azureServiceURLFormat is the format of the URL of the blob service of an
+// account, given its name.
+var azureServiceURLFormat = "https://%s.blob.core.windows.net"
+
+// TestingSetAzureServiceURLFormat sets the format of the URLs of the blob
+// services of accounts, such as http://127.0.0.1:10000/%s for an emulator, and
+// returns a function that restores it.
+func TestingSetAzureServiceURLFormat(format string) func() {
+	prev := azureServiceURLFormat
+	azureServiceURLFormat = format
+	return func() { azureServiceURLFormat = prev }
+}
+
+// azureStorageResource is the resource that the tokens of managed identities
+// are requested for to access blob storage.
+const azureStorageResource = "https://storage.azure.com/"
+
+// azureMSIEndpoint is the endpoint that the tokens of managed identities are
+// requested from, which adal.GetMSIEndpoint picks for the environment.
+var azureMSIEndpoint = adal.GetMSIEndpoint
+
+// TestingSetAzureMSIEndpoint sets the endpoint that the tokens of managed
+// identities are requested from, and returns a function that restores it.
+func TestingSetAzureMSIEndpoint(endpoint string) func() {
+	prev := azureMSIEndpoint
+	azureMSIEndpoint = func() (string, error) { return endpoint, nil }
+	return func() { azureMSIEndpoint = prev }
+}
+
+// azureManagedIdentityCredential returns a credential with the token of the
+// managed identity of the node, which is refreshed in the background until
+// refreshCtx is canceled. The first token is fetched here, so that a node
+// without a managed identity fails to create the storage rather than each
+// request.
+func azureManagedIdentityCredential(
+	ctx, refreshCtx context.Context, client *http.Client,
+) (azblob.Credential, error) {
+	endpoint, err := azureMSIEndpoint()
+	if err != nil {
+		return nil, errors.Wrap(err, "azure: finding managed identity endpoint")
+	}
+	spt, err := adal.NewServicePrincipalTokenFromMSI(endpoint, azureStorageResource)
+	if err != nil {
+		return nil, errors.Wrap(err, "azure: managed identity")
+	}
+	spt.SetSender(client)
+	if err := spt.RefreshWithContext(ctx); err != nil {
+		return nil, errors.Wrap(err, "azure: fetching managed identity token")
+	}
+	return azblob.NewTokenCredential(spt.Token().AccessToken,
+		func(credential azblob.TokenCredential) time.Duration {
+			if refreshCtx.Err() != nil {
+				// The storage was closed; stop refreshing.
+				return 0
+			}
+			if err := spt.EnsureFreshWithContext(refreshCtx); err != nil {
+				log.Warningf(refreshCtx, "azure: refreshing managed identity token: %v", err)
+				return time.Minute
+			}
+			credential.SetToken(spt.Token().AccessToken)
+			// EnsureFresh refreshes tokens that expire within 5 minutes.
+			if d := timeutil.Until(spt.Token().Expires()) - 5*time.Minute; d > time.Minute {
+				return d
+			}
+			return time.Minute
+		}), nil
+}
+
+// azureServiceURL returns the URL of the blob service of the account and the
+// credential with which to authenticate to it. A SAS token is sent as the query
+// of every request, so it is added to the URL, which the URLs of the container
+// and its blobs are derived from. The credential is nil for a managed identity,
+// whose token is fetched by the caller.
+func azureServiceURL(conf *roachpb.ExternalStorage_Azure) (*url.URL, azblob.Credential, error) {
+	u, err := url.Parse(fmt.Sprintf(azureServiceURLFormat, conf.AccountName))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "azure: account name is not valid")
+	}
+	switch {
+	case conf.UseManagedIdentity && (conf.AccountKey != "" || conf.SASToken != ""):
+		return nil, nil, errAzureManagedIdentityAndSecret
+	case conf.AccountKey != "" && conf.SASToken != "":
+		return nil, nil, errAzureKeyAndSASToken
+	case conf.UseManagedIdentity:
+		return u, nil, nil
+	case conf.SASToken != "":
+		// SAS tokens are often copied with their leading "?".
+		sas, err := url.ParseQuery(strings.TrimPrefix(conf.SASToken, "?"))
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "azure: %s is not valid", AzureSASTokenParam)
+		}
+		u.RawQuery = sas.Encode()
+		return u, azblob.NewAnonymousCredential(), nil
+	default:
+		credential, err := azblob.NewSharedKeyCredential(conf.AccountName, conf.AccountKey)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "azure credential")
+		}
+		return u, credential, nil
+	}
+}
+
 type azureStorage struct {
 	conf      *roachpb.ExternalStorage_Azure
 	ioConf    base.ExternalIODirConfig
 	container azblob.ContainerURL
 	prefix    string
 	settings  *cluster.Settings
+	limiters  *rateLimiters
+	// sharedKey is the account key credential of the storage, which presigned
+	// URLs are signed with. It is unset if the storage uses a SAS token or a
+	// managed identity.
+	sharedKey *azblob.SharedKeyCredential
+	// stopRefresh stops refreshing the token of the managed identity, if any.
+	stopRefresh context.CancelFunc
 }
 
 var _ cloud.ExternalStorage = &azureStorage{}
+var _ cloud.Presigner = &azureStorage{}
+var _ cloud.Copier = &azureStorage{}
 
 func makeAzureStorage(
-	_ context.Context, args ExternalStorageContext, dest roachpb.ExternalStorage,
+	ctx context.Context, args ExternalStorageContext, dest roachpb.ExternalStorage,
 ) (cloud.ExternalStorage, error) {
-	telemetry.Count("external-io.azure")
 	conf := dest.AzureConfig
 	if conf == nil {
 		return nil, errors.Errorf("azure upload requested but info missing")
 	}
-	credential, err := azblob.NewSharedKeyCredential(conf.AccountName, conf.AccountKey)
-	if err != nil {
-		return nil, errors.Wrap(err, "azure credential")
+	if conf.UseManagedIdentity && args.IOConf.DisableImplicitCredentials {
+		return nil, errors.New(
+			"implicit credentials disallowed for azure due to --external-io-disable-implicit-credentials flag")
 	}
-	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
-	u, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", conf.AccountName))
+	u, credential, err := azureServiceURL(conf)
 	if err != nil {
-		return nil, errors.Wrap(err, "azure: account name is not valid")
+		return nil, err
+	}
+	client := makeProviderHTTPClient(args.Settings)
+	// The token of a managed identity is refreshed until the storage is closed,
+	// rather than until ctx is done.
+	refreshCtx, stopRefresh := context.WithCancel(context.Background())
+	if conf.UseManagedIdentity {
+		if credential, err = azureManagedIdentityCredential(ctx, refreshCtx, client); err != nil {
+			stopRefresh()
+			return nil, err
+		}
 	}
+	p := azblob.NewPipeline(credential, azblob.PipelineOptions{
+		HTTPSender: azureHTTPSender(client),
+	})
 	serviceURL := azblob.NewServiceURL(*u, p)
+	sharedKey, _ := credential.(*azblob.SharedKeyCredential)
 	return &azureStorage{
-		conf:      conf,
-		ioConf:    args.IOConf,
-		container: serviceURL.NewContainerURL(conf.Container),
-		prefix:    conf.Prefix,
-		settings:  args.Settings,
+		conf:        conf,
+		ioConf:      args.IOConf,
+		container:   serviceURL.NewContainerURL(conf.Container),
+		prefix:      conf.Prefix,
+		settings:    args.Settings,
+		limiters:    newRateLimiters(args.Settings),
+		sharedKey:   sharedKey,
+		stopRefresh: stopRefresh,
 	}, nil
 }
 
+// azureHTTPSender returns the pipeline factory that sends the requests of an
+// azblob pipeline with client, like the pipeline's default sender does with a
+// client of its own.
+func azureHTTPSender(client *http.Client) pipeline.Factory {
+	return pipeline.FactoryFunc(func(_ pipeline.Policy, _ *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			resp, err := client.Do(request.WithContext(ctx))
+			if err != nil {
+				err = pipeline.NewError(err, "HTTP request failed")
+			}
+			return pipeline.NewHTTPResponse(resp), err
+		}
+	})
+}
+
 func (s *azureStorage) getBlob(basename string) azblob.BlockBlobURL {
 	name := path.Join(s.prefix, basename)
 	return s.container.NewBlockBlobURL(name)
@@ -118,17 +304,137 @@ func (s *azureStorage) Settings() *cluster.Settings {
 
 func (s *azureStorage) WriteFile(
 	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	return s.writeFile(ctx, basename, content, azblob.BlobAccessConditions{})
+}
+
+// WriteFileIfNotExists implements the ExternalStorage interface. The blob is
+// uploaded with an If-None-Match: * condition, so that Azure rejects the write
+// atomically.
+func (s *azureStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	err := s.writeFile(ctx, basename, content, azblob.BlobAccessConditions{
+		ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny},
+	})
+	if azerr := (azblob.StorageError)(nil); errors.As(err, &azerr) {
+		switch azerr.ServiceCode() {
+		case azblob.ServiceCodeBlobAlreadyExists, azblob.ServiceCodeConditionNotMet:
+			return errors.Wrapf(ErrFileAlreadyExists, "azure blob already exists: %s", err.Error())
+		}
+	}
+	return err
+}
+
+func (s *azureStorage) writeFile(
+	ctx context.Context,
+	basename string,
+	content io.ReadSeeker,
+	conditions azblob.BlobAccessConditions,
 ) error {
 	err := contextutil.RunWithTimeout(ctx, "write azure file", timeoutSetting.Get(&s.settings.SV),
 		func(ctx context.Context) error {
+			// Upload requires the content to be at its start, which the pipeline
+			// rewinds it to before retrying a request.
+			if err := rewindContent(content, nil /* prevErr */); err != nil {
+				return err
+			}
 			blob := s.getBlob(basename)
+			headers := azblob.BlobHTTPHeaders{ContentType: contentTypeOrDefault(s.conf.ContentType)}
+			if _, err := content.Seek(0, io.SeekEnd); err != nil {
+				// Upload measures the content by seeking to its end, so content that
+				// cannot seek there, such as compressed content, is streamed in
+				// blocks instead.
+				_, err := azblob.UploadStreamToBlockBlob(ctx, s.limiters.limitContent(ctx, content), blob,
+					azblob.UploadStreamToBlockBlobOptions{AccessConditions: conditions, BlobHTTPHeaders: headers})
+				return err
+			}
+			if _, err := content.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
 			_, err := blob.Upload(
-				ctx, content, azblob.BlobHTTPHeaders{}, azblob.Metadata{}, azblob.BlobAccessConditions{},
+				ctx, s.limiters.limitContent(ctx, content), headers, azblob.Metadata{}, conditions,
 				azblob.DefaultAccessTier, nil /* blobTagsMap */, azblob.ClientProvidedKeyOptions{},
 			)
 			return err
 		})
-	return errors.Wrapf(err, "write file: %s", basename)
+	return errors.Wrapf(markAzureError(err), "write file: %s", basename)
+}
+
+// markAzureError marks err with ErrFileDoesNotExist or ErrAccessDenied if it is
+// an Azure storage error whose status code means so, and counts it in
+// telemetry.
+func markAzureError(err error) error {
+	if azerr := (azblob.StorageError)(nil); errors.As(err, &azerr) && azerr.Response() != nil {
+		err = markStatusError(err, azerr.Response().StatusCode)
+	}
+	return countStorageError(roachpb.ExternalStorageProvider_Azure, err)
+}
+
+// azureCopyPollInterval is how often the status of a copy that is still
+// pending is checked.
+const azureCopyPollInterval = time.Second
+
+// CopyFrom implements the cloud.Copier interface. A blob of Azure storage in
+// the same account with the same credentials is copied by Azure, which can
+// then read it; the files of other storage are streamed through. Azure copies
+// asynchronously, so the copy is polled until it completes.
+func (s *azureStorage) CopyFrom(
+	ctx context.Context, src cloud.ExternalStorage, srcName, dstName string,
+) error {
+	srcConf := src.Conf()
+	c := srcConf.AzureConfig
+	if srcConf.Provider != roachpb.ExternalStorageProvider_Azure || c == nil ||
+		c.AccountName != s.conf.AccountName || c.AccountKey != s.conf.AccountKey ||
+		c.SASToken != s.conf.SASToken {
+		return copyThrough(ctx, s, src, srcName, dstName)
+	}
+	// The URL of the service carries the SAS token, if any, which the source
+	// is read with.
+	u, _, err := azureServiceURL(c)
+	if err != nil {
+		return err
+	}
+	parts := azblob.NewBlobURLParts(*u)
+	parts.ContainerName = c.Container
+	parts.BlobName = path.Join(c.Prefix, srcName)
+	source := parts.URL()
+
+	blob := s.getBlob(dstName)
+	err = contextutil.RunWithTimeout(ctx, "copy azure file", timeoutSetting.Get(&s.settings.SV),
+		func(ctx context.Context) error {
+			resp, err := blob.StartCopyFromURL(ctx, source, azblob.Metadata{},
+				azblob.ModifiedAccessConditions{}, azblob.BlobAccessConditions{},
+				azblob.DefaultAccessTier, nil /* blobTagsMap */)
+			if err != nil {
+				return err
+			}
+			status, description := resp.CopyStatus(), ""
+			for status == azblob.CopyStatusPending {
+				select {
+				case <-time.After(azureCopyPollInterval):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				props, err := blob.GetProperties(ctx, azblob.BlobAccessConditions{},
+					azblob.ClientProvidedKeyOptions{})
+				if err != nil {
+					return err
+				}
+				status, description = props.CopyStatus(), props.CopyStatusDescription()
+			}
+			if status != azblob.CopyStatusSuccess {
+				return errors.Newf("copy %s: %s", status, description)
+			}
+			return nil
+		})
+	if azerr := (azblob.StorageError)(nil); errors.As(err, &azerr) {
+		switch azerr.ServiceCode() {
+		case azblob.ServiceCodeBlobNotFound, azblob.ServiceCodeResourceNotFound:
+			return errors.Wrapf(ErrFileDoesNotExist, "azure blob does not exist: %s", err.Error())
+		}
+	}
+	return errors.Wrapf(markAzureError(err), "copy file: %s", dstName)
 }
 
 // ReadFile is shorthand for ReadFileAt with offset 0.
@@ -139,6 +445,19 @@ func (s *azureStorage) ReadFile(ctx context.Context, basename string) (io.ReadCl
 
 func (s *azureStorage) ReadFileAt(
 	ctx context.Context, basename string, offset int64,
+) (io.ReadCloser, int64, error) {
+	reader, size, err := openWithStorageTimeout(ctx, s.settings, "read azure file",
+		func(ctx context.Context) (io.ReadCloser, int64, error) {
+			return s.readFileAt(ctx, basename, offset)
+		})
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.limiters.limitReader(ctx, readAhead(s.settings, reader)), size, nil
+}
+
+func (s *azureStorage) readFileAt(
+	ctx context.Context, basename string, offset int64,
 ) (io.ReadCloser, int64, error) {
 	// https://github.com/cockroachdb/cockroach/issues/23859
 	blob := s.getBlob(basename)
@@ -153,7 +472,7 @@ func (s *azureStorage) ReadFileAt(
 				return nil, 0, errors.Wrapf(ErrFileDoesNotExist, "azure blob does not exist: %s", err.Error())
 			}
 		}
-		return nil, 0, errors.Wrap(err, "failed to create azure reader")
+		return nil, 0, errors.Wrap(markAzureError(err), "failed to create azure reader")
 	}
 	var size int64
 	if offset == 0 {
@@ -170,6 +489,13 @@ func (s *azureStorage) ReadFileAt(
 }
 
 func (s *azureStorage) ListFiles(ctx context.Context, patternSuffix string) ([]string, error) {
+	files, err := s.ListFilesExt(ctx, patternSuffix)
+	return fileEntryPaths(files), err
+}
+
+func (s *azureStorage) ListFilesExt(
+	ctx context.Context, patternSuffix string,
+) ([]cloud.FileEntry, error) {
 	pattern := s.prefix
 	if patternSuffix != "" {
 		if containsGlob(s.prefix) {
@@ -177,13 +503,18 @@ func (s *azureStorage) ListFiles(ctx context.Context, patternSuffix string) ([]s
 		}
 		pattern = path.Join(pattern, patternSuffix)
 	}
-	var fileList []string
-	response, err := s.container.ListBlobsFlatSegment(ctx,
-		azblob.Marker{},
-		azblob.ListBlobsSegmentOptions{Prefix: getPrefixBeforeWildcard(s.prefix)},
-	)
+	var fileList []cloud.FileEntry
+	var response *azblob.ListBlobsFlatSegmentResponse
+	err := runWithStorageTimeout(ctx, s.settings, "list azure files", func(ctx context.Context) error {
+		var err error
+		response, err = s.container.ListBlobsFlatSegment(ctx,
+			azblob.Marker{},
+			azblob.ListBlobsSegmentOptions{Prefix: getPrefixBeforeWildcard(s.prefix)},
+		)
+		return err
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to list files for specified blob")
+		return nil, errors.Wrap(markAzureError(err), "unable to list files for specified blob")
 	}
 
 	for _, blob := range response.Segment.BlobItems {
@@ -192,12 +523,16 @@ func (s *azureStorage) ListFiles(ctx context.Context, patternSuffix string) ([]s
 			continue
 		}
 		if matches {
+			entry := cloud.FileEntry{ModTime: blob.Properties.LastModified}
+			if blob.Properties.ContentLength != nil {
+				entry.Size = *blob.Properties.ContentLength
+			}
 			if patternSuffix != "" {
 				if !strings.HasPrefix(blob.Name, s.prefix) {
 					// TODO(dt): return a nice rel-path instead of erroring out.
 					return nil, errors.New("pattern matched file outside of path")
 				}
-				fileList = append(fileList, strings.TrimPrefix(strings.TrimPrefix(blob.Name, s.prefix), "/"))
+				entry.Path = strings.TrimPrefix(strings.TrimPrefix(blob.Name, s.prefix), "/")
 			} else {
 				azureURL := url.URL{
 					Scheme:   "azure",
@@ -205,12 +540,13 @@ func (s *azureStorage) ListFiles(ctx context.Context, patternSuffix string) ([]s
 					Path:     blob.Name,
 					RawQuery: azureQueryParams(s.conf),
 				}
-				fileList = append(fileList, azureURL.String())
+				entry.Path = azureURL.String()
 			}
+			fileList = append(fileList, entry)
 		}
 	}
 
-	return fileList, nil
+	return sortFileEntries(fileList), nil
 }
 
 func (s *azureStorage) Delete(ctx context.Context, basename string) error {
@@ -220,7 +556,67 @@ func (s *azureStorage) Delete(ctx context.Context, basename string) error {
 			_, err := blob.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
 			return err
 		})
-	return errors.Wrap(err, "delete file")
+	return errors.Wrap(markAzureError(err), "delete file")
+}
+
+// PresignedURL implements the cloud.Presigner interface, returning the URL of
+// the blob with a read-only service SAS. The SAS is signed with the account
+// key, so it is not supported if the storage uses a SAS token.
+func (s *azureStorage) PresignedURL(
+	_ context.Context, basename string, expiry time.Duration,
+) (string, error) {
+	if s.sharedKey == nil {
+		return "", errors.Mark(
+			errors.Newf("azure storage can only presign URLs when %s is set", AzureAccountKeyParam),
+			ErrUnsupported)
+	}
+	blobURL := s.getBlob(basename).URL()
+	parts := azblob.NewBlobURLParts(blobURL)
+	sas, err := azblob.BlobSASSignatureValues{
+		Protocol:      azblob.SASProtocolHTTPS,
+		ExpiryTime:    timeutil.Now().Add(expiry),
+		ContainerName: parts.ContainerName,
+		BlobName:      parts.BlobName,
+		Permissions:   azblob.BlobSASPermissions{Read: true}.String(),
+	}.NewSASQueryParameters(s.sharedKey)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to sign azure blob URL")
+	}
+	parts.SAS = sas
+	u := parts.URL()
+	return u.String(), nil
+}
+
+// DeleteAll implements the ExternalStorage interface. The listed blobs are
+// deleted one at a time, as this client does not support batch requests.
+func (s *azureStorage) DeleteAll(ctx context.Context, prefix string) error {
+	var names []string
+	err := runWithStorageTimeout(ctx, s.settings, "list azure files", func(ctx context.Context) error {
+		for marker := (azblob.Marker{}); marker.NotDone(); {
+			response, err := s.container.ListBlobsFlatSegment(ctx, marker,
+				azblob.ListBlobsSegmentOptions{Prefix: joinKeyPrefix(s.prefix, prefix)})
+			if err != nil {
+				return err
+			}
+			for _, blob := range response.Segment.BlobItems {
+				names = append(names, blob.Name)
+			}
+			marker = response.NextMarker
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(markAzureError(err), "unable to list files for specified blob")
+	}
+	return deleteEach(ctx, names, func(ctx context.Context, name string) error {
+		return markAzureError(contextutil.RunWithTimeout(ctx, "delete azure file",
+			timeoutSetting.Get(&s.settings.SV),
+			func(ctx context.Context) error {
+				_, err := s.container.NewBlockBlobURL(name).Delete(
+					ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+				return err
+			}))
+	})
 }
 
 func (s *azureStorage) Size(ctx context.Context, basename string) (int64, error) {
@@ -233,11 +629,36 @@ func (s *azureStorage) Size(ctx context.Context, basename string) (int64, error)
 			return err
 		})
 	if err != nil {
-		return 0, errors.Wrap(err, "get file properties")
+		return 0, errors.Wrap(markAzureError(err), "get file properties")
 	}
 	return props.ContentLength(), nil
 }
 
+func (s *azureStorage) Stat(ctx context.Context, basename string) (cloud.FileInfo, error) {
+	var props *azblob.BlobGetPropertiesResponse
+	err := contextutil.RunWithTimeout(ctx, "stat azure file", timeoutSetting.Get(&s.settings.SV),
+		func(ctx context.Context) error {
+			blob := s.getBlob(basename)
+			var err error
+			props, err = blob.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+			return err
+		})
+	if err != nil {
+		if azerr := (azblob.StorageError)(nil); errors.As(err, &azerr) {
+			if azerr.Response() != nil && azerr.Response().StatusCode == http.StatusNotFound {
+				return cloud.FileInfo{}, nil
+			}
+		}
+		return cloud.FileInfo{}, errors.Wrap(markAzureError(err), "get file properties")
+	}
+	return cloud.FileInfo{
+		Exists:  true,
+		Size:    props.ContentLength(),
+		ModTime: props.LastModified(),
+	}, nil
+}
+
 func (s *azureStorage) Close() error {
+	s.stopRefresh()
 	return nil
 }
@@ -0,0 +1,133 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/errors"
+)
+
+// ChecksumAlgorithm identifies the hash computed by a ChecksumReader.
+type ChecksumAlgorithm int
+
+const (
+	// ChecksumCRC32C is the CRC-32 checksum using the Castagnoli polynomial.
+	ChecksumCRC32C ChecksumAlgorithm = iota
+	// ChecksumSHA256 is the SHA-256 digest.
+	ChecksumSHA256
+	// ChecksumMD5 is the MD5 digest, which S3 and GCS store for most objects.
+	ChecksumMD5
+)
+
+func (a ChecksumAlgorithm) newHash() hash.Hash {
+	switch a {
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case ChecksumSHA256:
+		return sha256.New()
+	case ChecksumMD5:
+		return md5.New()
+	}
+	panic(errors.AssertionFailedf("unknown checksum algorithm %d", a))
+}
+
+// ChecksumReader is an io.ReadCloser that computes a checksum over the bytes
+// read through it. The checksum is complete once Read has returned io.EOF.
+//
+// If an expected checksum is set, the Read that reaches the end of the data
+// instead returns an error if the checksum does not match.
+type ChecksumReader struct {
+	r        io.ReadCloser
+	h        hash.Hash
+	expected []byte
+}
+
+var _ io.ReadCloser = &ChecksumReader{}
+
+// NewChecksumReader returns a ChecksumReader reading from r. If expected is
+// non-nil, the checksum is verified against it once r is fully read.
+func NewChecksumReader(
+	r io.ReadCloser, algorithm ChecksumAlgorithm, expected []byte,
+) *ChecksumReader {
+	return &ChecksumReader{r: r, h: algorithm.newHash(), expected: expected}
+}
+
+// ReadFileWithChecksum opens basename in es for reading, computing a checksum
+// with the given algorithm over the bytes read. If expected is non-nil, the
+// checksum is verified against it once the file is fully read.
+func ReadFileWithChecksum(
+	ctx context.Context,
+	es cloud.ExternalStorage,
+	basename string,
+	algorithm ChecksumAlgorithm,
+	expected []byte,
+) (*ChecksumReader, error) {
+	r, err := es.ReadFile(ctx, basename)
+	if err != nil {
+		return nil, err
+	}
+	return NewChecksumReader(r, algorithm, expected), nil
+}
+
+// ReadFileVerifyingMD5 opens basename in es for reading like ReadFile. If es
+// stores the MD5 digest of the file, as S3 and GCS do for most objects, the
+// Read that reaches the end of the file instead returns an error if the digest
+// of the bytes read does not match, which catches files that were corrupted at
+// rest or in transit. Files whose digest es does not know, such as S3 objects
+// uploaded in multiple parts and GCS composite objects, are not verified.
+//
+// The digest is fetched with Stat before the file is opened, so a file that is
+// replaced in between fails the verification.
+func ReadFileVerifyingMD5(
+	ctx context.Context, es cloud.ExternalStorage, basename string,
+) (io.ReadCloser, error) {
+	info, err := es.Stat(ctx, basename)
+	if err != nil {
+		return nil, err
+	}
+	if info.ContentMD5 == nil {
+		log.VEventf(ctx, 2, "no stored MD5 digest of %s; reading it without verification", basename)
+		return es.ReadFile(ctx, basename)
+	}
+	return ReadFileWithChecksum(ctx, es, basename, ChecksumMD5, info.ContentMD5)
+}
+
+// Read implements io.Reader.
+func (c *ChecksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	// Writing to a hash never returns an error.
+	_, _ = c.h.Write(p[:n])
+	if err == io.EOF && c.expected != nil {
+		if sum := c.h.Sum(nil); !bytes.Equal(sum, c.expected) {
+			return n, errors.Errorf("checksum mismatch: expected %x but got %x", c.expected, sum)
+		}
+	}
+	return n, err
+}
+
+// Checksum returns the checksum of the bytes read so far.
+func (c *ChecksumReader) Checksum() []byte {
+	return c.h.Sum(nil)
+}
+
+// Close implements io.Closer.
+func (c *ChecksumReader) Close() error {
+	return c.r.Close()
+}
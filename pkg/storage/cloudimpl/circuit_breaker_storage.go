@@ -0,0 +1,406 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+var (
+	circuitBreakerThreshold = settings.RegisterIntSetting(
+		CloudstorageCircuitBreakerThresholdSetting,
+		"the number of consecutive transient failures of the operations on a cloud storage "+
+			"destination after which its circuit breaker fails new operations, or 0 to disable "+
+			"circuit breakers",
+		10,
+		settings.NonNegativeInt,
+	)
+	circuitBreakerCooldown = settings.RegisterDurationSetting(
+		CloudstorageCircuitBreakerCooldownSetting,
+		"the duration for which a tripped cloud storage circuit breaker fails new operations "+
+			"before letting one through to probe the destination",
+		30*time.Second,
+		settings.NonNegativeDuration,
+	)
+)
+
+// ErrCircuitBreakerOpen is the error that the operations of a storage returned
+// by WithCircuitBreaker fail with while the circuit breaker of its destination
+// is open.
+var ErrCircuitBreakerOpen = errors.New("external storage circuit breaker is open")
+
+// storageBreaker is the circuit breaker of a destination. It is closed until
+// the threshold of consecutive failures is reached, at which point it opens
+// for the cooldown. Once the cooldown has passed, it is half-open: a single
+// operation is let through, which closes it if it succeeds and reopens it for
+// another cooldown if it fails.
+type storageBreaker struct {
+	name string
+
+	mu struct {
+		syncutil.Mutex
+		failures  int
+		lastErr   error
+		openUntil time.Time
+		// probing is whether the operation let through by the half-open breaker
+		// is in flight, in which case the others are still failed.
+		probing bool
+	}
+}
+
+// storageBreakers holds the circuit breakers of the destinations, keyed by
+// name, which are shared by all the storages of a destination so that they
+// trip together.
+var storageBreakers struct {
+	syncutil.Mutex
+	m map[string]*storageBreaker
+}
+
+// circuitBreakerTimeSource is the clock of the circuit breakers.
+var circuitBreakerTimeSource timeutil.TimeSource = timeutil.DefaultTimeSource{}
+
+// TestingSetCircuitBreakerTimeSource sets the clock of the circuit breakers and
+// returns a function that restores it.
+func TestingSetCircuitBreakerTimeSource(ts timeutil.TimeSource) func() {
+	prev := circuitBreakerTimeSource
+	circuitBreakerTimeSource = ts
+	return func() { circuitBreakerTimeSource = prev }
+}
+
+// ResetCircuitBreakersForTesting drops the circuit breakers of all the
+// destinations, closing them.
+func ResetCircuitBreakersForTesting() {
+	storageBreakers.Lock()
+	defer storageBreakers.Unlock()
+	storageBreakers.m = nil
+}
+
+func getStorageBreaker(name string) *storageBreaker {
+	storageBreakers.Lock()
+	defer storageBreakers.Unlock()
+	if b, ok := storageBreakers.m[name]; ok {
+		return b
+	}
+	if storageBreakers.m == nil {
+		storageBreakers.m = make(map[string]*storageBreaker)
+	}
+	b := &storageBreaker{name: name}
+	storageBreakers.m[name] = b
+	return b
+}
+
+// circuitBreakerName returns the name of the destination of conf, which
+// identifies the endpoint, bucket or host that it sends requests to but not the
+// prefix within it, nor any credentials.
+func circuitBreakerName(conf roachpb.ExternalStorage) string {
+	switch conf.Provider {
+	case roachpb.ExternalStorageProvider_S3:
+		if c := conf.S3Config; c != nil {
+			return fmt.Sprintf("s3://%s (endpoint %q)", c.Bucket, c.Endpoint)
+		}
+	case roachpb.ExternalStorageProvider_GoogleCloud:
+		if c := conf.GoogleCloudConfig; c != nil {
+			return "gs://" + c.Bucket
+		}
+	case roachpb.ExternalStorageProvider_Azure:
+		if c := conf.AzureConfig; c != nil {
+			return fmt.Sprintf("azure://%s (account %q)", c.Container, c.AccountName)
+		}
+	case roachpb.ExternalStorageProvider_Http:
+		if u, err := url.Parse(conf.HttpPath.BaseUri); err == nil {
+			return u.Scheme + "://" + u.Host
+		}
+	case roachpb.ExternalStorageProvider_LocalFile:
+		return fmt.Sprintf("nodelocal://%d", conf.LocalFile.NodeID)
+	case roachpb.ExternalStorageProvider_SFTP:
+		if c := conf.SFTPConfig; c != nil {
+			return "sftp://" + c.Host
+		}
+	case roachpb.ExternalStorageProvider_WebHDFS:
+		if c := conf.WebHDFSConfig; c != nil {
+			return "webhdfs://" + c.Host
+		}
+	case roachpb.ExternalStorageProvider_Custom:
+		if c := conf.CustomConfig; c != nil {
+			return c.Scheme + "://"
+		}
+	}
+	return conf.Provider.String()
+}
+
+// allow returns an error if the breaker is open. Otherwise, it returns whether
+// the operation is the probe of the half-open breaker, which must be passed to
+// record.
+func (b *storageBreaker) allow(threshold int) (probe bool, _ error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if threshold <= 0 || b.mu.failures < threshold {
+		return false, nil
+	}
+	if b.mu.probing || circuitBreakerTimeSource.Now().Before(b.mu.openUntil) {
+		return false, errors.Wrapf(ErrCircuitBreakerOpen,
+			"%s failed %d consecutive times, most recently with: %v", b.name, b.mu.failures, b.mu.lastErr)
+	}
+	b.mu.probing = true
+	return true, nil
+}
+
+// record records the outcome of an operation. Transient errors are failures,
+// while any other outcome, including a permanent error such as a missing file,
+// shows that the destination is reachable and closes the breaker. Canceled
+// operations are not recorded, other than to end a probe.
+func (b *storageBreaker) record(
+	ctx context.Context, err error, probe bool, threshold int, cooldown time.Duration,
+) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.mu.probing = false
+	}
+	if errors.IsAny(err, context.Canceled, context.DeadlineExceeded) {
+		return
+	}
+	if err == nil || !isRetryableStorageError(err) {
+		if b.mu.failures >= threshold && threshold > 0 {
+			log.Infof(ctx, "circuit breaker of %s closed", b.name)
+		}
+		b.mu.failures = 0
+		b.mu.lastErr = nil
+		return
+	}
+	b.mu.failures++
+	b.mu.lastErr = err
+	if threshold > 0 && b.mu.failures >= threshold {
+		if b.mu.failures == threshold || probe {
+			log.Warningf(ctx, "circuit breaker of %s opened after %d consecutive failures: %v",
+				b.name, b.mu.failures, err)
+		}
+		b.mu.openUntil = circuitBreakerTimeSource.Now().Add(cooldown)
+	}
+}
+
+// circuitBreakerStorage wraps an ExternalStorage, failing its operations fast
+// while the circuit breaker of its destination is open.
+type circuitBreakerStorage struct {
+	cloud.ExternalStorage
+	breaker  *storageBreaker
+	settings *cluster.Settings
+}
+
+var _ cloud.ExternalStorage = &circuitBreakerStorage{}
+var _ cloud.Presigner = &circuitBreakerStorage{}
+var _ cloud.Syncer = &circuitBreakerStorage{}
+var _ cloud.Copier = &circuitBreakerStorage{}
+var _ cloud.Validator = &circuitBreakerStorage{}
+var _ cloud.PageLister = &circuitBreakerStorage{}
+var _ cloud.DelimitedLister = &circuitBreakerStorage{}
+
+// WithCircuitBreaker returns an ExternalStorage whose operations go through the
+// circuit breaker of the destination of inner, which is shared by all the
+// storages of that destination. After the number of consecutive transient
+// failures of the cloudstorage.circuit_breaker.failure_threshold setting, the
+// breaker fails new operations with ErrCircuitBreakerOpen for the duration of
+// the cloudstorage.circuit_breaker.cooldown setting, after which it lets a
+// single operation through to probe the destination. This keeps many
+// concurrent operations from retrying against a destination that is down.
+//
+// ErrCircuitBreakerOpen is not retryable, so a storage returned by WithRetry
+// should wrap the storage returned here rather than the other way around, so
+// that each of its attempts is recorded and it stops retrying once the breaker
+// opens.
+func WithCircuitBreaker(inner cloud.ExternalStorage) cloud.ExternalStorage {
+	return &circuitBreakerStorage{
+		ExternalStorage: inner,
+		breaker:         getStorageBreaker(circuitBreakerName(inner.Conf())),
+		settings:        inner.Settings(),
+	}
+}
+
+func (c *circuitBreakerStorage) thresholds() (int, time.Duration) {
+	if c.settings == nil {
+		return int(circuitBreakerThreshold.Default()), circuitBreakerCooldown.Default()
+	}
+	return int(circuitBreakerThreshold.Get(&c.settings.SV)), circuitBreakerCooldown.Get(&c.settings.SV)
+}
+
+func (c *circuitBreakerStorage) call(ctx context.Context, fn func() error) error {
+	threshold, cooldown := c.thresholds()
+	probe, err := c.breaker.allow(threshold)
+	if err != nil {
+		return err
+	}
+	err = fn()
+	c.breaker.record(ctx, err, probe, threshold, cooldown)
+	return err
+}
+
+func (c *circuitBreakerStorage) ReadFile(
+	ctx context.Context, basename string,
+) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	err := c.call(ctx, func() error {
+		var err error
+		reader, err = c.ExternalStorage.ReadFile(ctx, basename)
+		return err
+	})
+	return reader, err
+}
+
+func (c *circuitBreakerStorage) ReadFileAt(
+	ctx context.Context, basename string, offset int64,
+) (io.ReadCloser, int64, error) {
+	var reader io.ReadCloser
+	var size int64
+	err := c.call(ctx, func() error {
+		var err error
+		reader, size, err = c.ExternalStorage.ReadFileAt(ctx, basename, offset)
+		return err
+	})
+	return reader, size, err
+}
+
+func (c *circuitBreakerStorage) WriteFile(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	return c.call(ctx, func() error {
+		return c.ExternalStorage.WriteFile(ctx, basename, content)
+	})
+}
+
+func (c *circuitBreakerStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	return c.call(ctx, func() error {
+		return c.ExternalStorage.WriteFileIfNotExists(ctx, basename, content)
+	})
+}
+
+func (c *circuitBreakerStorage) CopyFrom(
+	ctx context.Context, src cloud.ExternalStorage, srcName, dstName string,
+) error {
+	return c.call(ctx, func() error {
+		return CopyFrom(ctx, c.ExternalStorage, src, srcName, dstName)
+	})
+}
+
+func (c *circuitBreakerStorage) ListFiles(
+	ctx context.Context, patternSuffix string,
+) ([]string, error) {
+	var files []string
+	err := c.call(ctx, func() error {
+		var err error
+		files, err = c.ExternalStorage.ListFiles(ctx, patternSuffix)
+		return err
+	})
+	return files, err
+}
+
+func (c *circuitBreakerStorage) ListFilesExt(
+	ctx context.Context, patternSuffix string,
+) ([]cloud.FileEntry, error) {
+	var files []cloud.FileEntry
+	err := c.call(ctx, func() error {
+		var err error
+		files, err = c.ExternalStorage.ListFilesExt(ctx, patternSuffix)
+		return err
+	})
+	return files, err
+}
+
+func (c *circuitBreakerStorage) ListFilesPage(
+	ctx context.Context, prefix, token string, limit int,
+) ([]string, string, error) {
+	var paths []string
+	var nextToken string
+	err := c.call(ctx, func() error {
+		var err error
+		paths, nextToken, err = ListFilesPage(ctx, c.ExternalStorage, prefix, token, limit)
+		return err
+	})
+	return paths, nextToken, err
+}
+
+func (c *circuitBreakerStorage) ListFilesWithDelimiter(
+	ctx context.Context, prefix, delimiter string,
+) ([]string, []string, error) {
+	var files, prefixes []string
+	err := c.call(ctx, func() error {
+		var err error
+		files, prefixes, err = ListFilesWithDelimiter(ctx, c.ExternalStorage, prefix, delimiter)
+		return err
+	})
+	return files, prefixes, err
+}
+
+func (c *circuitBreakerStorage) Delete(ctx context.Context, basename string) error {
+	return c.call(ctx, func() error {
+		return c.ExternalStorage.Delete(ctx, basename)
+	})
+}
+
+func (c *circuitBreakerStorage) DeleteAll(ctx context.Context, prefix string) error {
+	return c.call(ctx, func() error {
+		return c.ExternalStorage.DeleteAll(ctx, prefix)
+	})
+}
+
+func (c *circuitBreakerStorage) Size(ctx context.Context, basename string) (int64, error) {
+	var size int64
+	err := c.call(ctx, func() error {
+		var err error
+		size, err = c.ExternalStorage.Size(ctx, basename)
+		return err
+	})
+	return size, err
+}
+
+func (c *circuitBreakerStorage) Stat(ctx context.Context, basename string) (cloud.FileInfo, error) {
+	var info cloud.FileInfo
+	err := c.call(ctx, func() error {
+		var err error
+		info, err = c.ExternalStorage.Stat(ctx, basename)
+		return err
+	})
+	return info, err
+}
+
+func (c *circuitBreakerStorage) Sync(ctx context.Context) error {
+	return c.call(ctx, func() error {
+		return Sync(ctx, c.ExternalStorage)
+	})
+}
+
+func (c *circuitBreakerStorage) Validate(ctx context.Context) error {
+	return c.call(ctx, func() error {
+		return Validate(ctx, c.ExternalStorage)
+	})
+}
+
+// PresignedURL presigns with the wrapped storage. Presigning is done locally
+// by the backends, so it does not go through the breaker.
+func (c *circuitBreakerStorage) PresignedURL(
+	ctx context.Context, basename string, expiry time.Duration,
+) (string, error) {
+	return PresignedURL(ctx, c.ExternalStorage, basename, expiry)
+}
@@ -11,15 +11,26 @@
 package cloudimpltests
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
 	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/errors"
 	"github.com/stretchr/testify/require"
 )
@@ -77,3 +88,288 @@ func TestAntagonisticAzureRead(t *testing.T) {
 
 	testAntagonisticRead(t, conf)
 }
+
+func TestAzureSASToken(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	const sas = `sv=2019-12-12&ss=b&srt=co&sp=rl&se=2021-01-01T00:00:00Z&sig=abc%2B123%3D`
+
+	t.Run("parse", func(t *testing.T) {
+		uri := `azure://container/foo?AZURE_ACCOUNT_NAME=a&AZURE_SAS_TOKEN=` + url.QueryEscape(sas)
+		conf, err := cloudimpl.ExternalStorageConfFromURI(uri, user)
+		require.NoError(t, err)
+		require.Equal(t, sas, conf.AzureConfig.SASToken)
+		require.Empty(t, conf.AzureConfig.AccountKey)
+		sanitized, err := cloudimpl.SanitizeExternalStorageURI(uri, nil)
+		require.NoError(t, err)
+		require.Equal(t, `azure://container/foo?AZURE_ACCOUNT_NAME=a&AZURE_SAS_TOKEN=redacted`, sanitized)
+
+		_, err = cloudimpl.ExternalStorageConfFromURI(`azure://container/foo?AZURE_ACCOUNT_NAME=a`, user)
+		require.EqualError(t, err,
+			`azure uri missing "AZURE_ACCOUNT_KEY" or "AZURE_SAS_TOKEN" parameter`)
+		_, err = cloudimpl.ExternalStorageConfFromURI(uri+`&AZURE_ACCOUNT_KEY=Yg==`, user)
+		require.EqualError(t, err,
+			`azure uri cannot specify both "AZURE_ACCOUNT_KEY" and "AZURE_SAS_TOKEN" parameters`)
+	})
+
+	t.Run("credential selection", func(t *testing.T) {
+		for _, tc := range []struct {
+			name          string
+			key, sasToken string
+			expectedErr   string
+		}{
+			{name: `key`, key: `Yg==`},
+			{name: `sas`, sasToken: sas},
+			{name: `sas with leading question mark`, sasToken: `?` + sas},
+			{name: `invalid key`, key: `not base64`, expectedErr: `azure credential: .*`},
+			{name: `invalid sas`, sasToken: `sig=%zz`,
+				expectedErr: `azure: AZURE_SAS_TOKEN is not valid: .*`},
+			{name: `key and sas`, key: `Yg==`, sasToken: sas,
+				expectedErr: `azure uri cannot specify both "AZURE_ACCOUNT_KEY" and ` +
+					`"AZURE_SAS_TOKEN" parameters`},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				s, err := cloudimpl.MakeExternalStorage(ctx, roachpb.ExternalStorage{
+					Provider: roachpb.ExternalStorageProvider_Azure,
+					AzureConfig: &roachpb.ExternalStorage_Azure{
+						Container:   `container`,
+						AccountName: `a`,
+						AccountKey:  tc.key,
+						SASToken:    tc.sasToken,
+					},
+				}, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+				if tc.expectedErr != `` {
+					require.Regexp(t, tc.expectedErr, err)
+					return
+				}
+				require.NoError(t, err)
+				require.NoError(t, s.Close())
+			})
+		}
+	})
+}
+
+func TestAzureManagedIdentity(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+
+	var tokenRequests []*http.Request
+	var failTokens bool
+	var mu syncutil.Mutex
+	msi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		tokenRequests = append(tokenRequests, r)
+		if failTokens {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_request","error_description":"Identity not found"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"token","expires_in":"3600","expires_on":"%d",`+
+			`"resource":%q,"token_type":"Bearer"}`,
+			timeutil.Now().Add(time.Hour).Unix(), r.URL.Query().Get(`resource`))
+	}))
+	defer msi.Close()
+	defer cloudimpl.TestingSetAzureMSIEndpoint(msi.URL)()
+
+	const uri = `azure://container/foo?AZURE_ACCOUNT_NAME=a&AZURE_USE_MANAGED_IDENTITY=true`
+
+	t.Run("parse", func(t *testing.T) {
+		conf, err := cloudimpl.ExternalStorageConfFromURI(uri, user)
+		require.NoError(t, err)
+		require.True(t, conf.AzureConfig.UseManagedIdentity)
+		explicit, _, err := cloudimpl.AccessIsWithExplicitAuth(uri)
+		require.NoError(t, err)
+		require.False(t, explicit)
+
+		expectedErr := `azure uri cannot specify "AZURE_ACCOUNT_KEY" or "AZURE_SAS_TOKEN" when ` +
+			`"AZURE_USE_MANAGED_IDENTITY" is set`
+		_, err = cloudimpl.ExternalStorageConfFromURI(uri+`&AZURE_ACCOUNT_KEY=Yg==`, user)
+		require.EqualError(t, err, expectedErr)
+		_, err = cloudimpl.ExternalStorageConfFromURI(uri+`&AZURE_SAS_TOKEN=sig%3Dabc`, user)
+		require.EqualError(t, err, expectedErr)
+		_, err = cloudimpl.ExternalStorageConfFromURI(
+			`azure://container/foo?AZURE_ACCOUNT_NAME=a&AZURE_USE_MANAGED_IDENTITY=maybe`, user)
+		require.True(t, testutils.IsError(err, `invalid value for AZURE_USE_MANAGED_IDENTITY`), "%v", err)
+	})
+
+	makeStorage := func(
+		conf *roachpb.ExternalStorage_Azure, ioConf base.ExternalIODirConfig,
+	) (cloud.ExternalStorage, error) {
+		return cloudimpl.MakeExternalStorage(ctx, roachpb.ExternalStorage{
+			Provider:    roachpb.ExternalStorageProvider_Azure,
+			AzureConfig: conf,
+		}, ioConf, testSettings, nil, nil, nil)
+	}
+
+	t.Run("credential selection", func(t *testing.T) {
+		for _, tc := range []struct {
+			name          string
+			key, sasToken string
+			expectedErr   string
+		}{
+			{name: `managed identity`},
+			{name: `managed identity and key`, key: `Yg==`,
+				expectedErr: `azure uri cannot specify .* when "AZURE_USE_MANAGED_IDENTITY" is set`},
+			{name: `managed identity and sas`, sasToken: `sig=abc`,
+				expectedErr: `azure uri cannot specify .* when "AZURE_USE_MANAGED_IDENTITY" is set`},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				mu.Lock()
+				tokenRequests = nil
+				mu.Unlock()
+				s, err := makeStorage(&roachpb.ExternalStorage_Azure{
+					Container:          `container`,
+					AccountName:        `a`,
+					AccountKey:         tc.key,
+					SASToken:           tc.sasToken,
+					UseManagedIdentity: true,
+				}, base.ExternalIODirConfig{})
+				mu.Lock()
+				defer mu.Unlock()
+				if tc.expectedErr != `` {
+					require.Regexp(t, tc.expectedErr, err)
+					require.Empty(t, tokenRequests)
+					return
+				}
+				require.NoError(t, err)
+				defer s.Close()
+				// The token is fetched for blob storage when the storage is created.
+				require.Len(t, tokenRequests, 1)
+				require.Equal(t, `https://storage.azure.com/`, tokenRequests[0].URL.Query().Get(`resource`))
+				require.Equal(t, `true`, tokenRequests[0].Header.Get(`Metadata`))
+				// Without an account key, URLs cannot be presigned.
+				_, err = cloudimpl.PresignedURL(ctx, s, `f`, time.Hour)
+				require.True(t, errors.Is(err, cloudimpl.ErrUnsupported), "%v", err)
+			})
+		}
+	})
+
+	t.Run("no managed identity", func(t *testing.T) {
+		mu.Lock()
+		failTokens = true
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			failTokens = false
+			mu.Unlock()
+		}()
+		_, err := makeStorage(&roachpb.ExternalStorage_Azure{
+			Container: `container`, AccountName: `a`, UseManagedIdentity: true,
+		}, base.ExternalIODirConfig{})
+		require.True(t, testutils.IsError(err, `azure: fetching managed identity token`), "%v", err)
+	})
+
+	t.Run("implicit credentials disabled", func(t *testing.T) {
+		_, err := makeStorage(&roachpb.ExternalStorage_Azure{
+			Container: `container`, AccountName: `a`, UseManagedIdentity: true,
+		}, base.ExternalIODirConfig{DisableImplicitCredentials: true})
+		require.True(t, testutils.IsError(err, `implicit credentials disallowed for azure`), "%v", err)
+	})
+}
+
+func TestAzureContentType(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+
+	// The blob service records the content types of the blobs that are put,
+	// keyed by path.
+	var mu syncutil.Mutex
+	contentTypes := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		mu.Lock()
+		contentTypes[r.URL.Path] = r.Header.Get(`X-Ms-Blob-Content-Type`)
+		mu.Unlock()
+		w.Header().Set(`ETag`, `"etag"`)
+		w.Header().Set(`Last-Modified`, timeutil.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	defer cloudimpl.TestingSetAzureServiceURLFormat(srv.URL + `/%s`)()
+
+	const uri = `azure://container/type?AZURE_ACCOUNT_NAME=a&AZURE_ACCOUNT_KEY=Yg==`
+	_, err := cloudimpl.ExternalStorageConfFromURI(uri+`&CONTENT_TYPE=text/`, user)
+	require.True(t, testutils.IsError(err, `invalid value for CONTENT_TYPE`), "%v", err)
+
+	for _, tc := range []struct {
+		contentType, expected string
+	}{
+		{``, `application/octet-stream`},
+		{`text/csv`, `text/csv`},
+	} {
+		t.Run(tc.expected, func(t *testing.T) {
+			u := uri
+			if tc.contentType != `` {
+				u += `&CONTENT_TYPE=` + url.QueryEscape(tc.contentType)
+			}
+			conf, err := cloudimpl.ExternalStorageConfFromURI(u, user)
+			require.NoError(t, err)
+			require.Equal(t, tc.contentType, conf.AzureConfig.ContentType)
+			s, err := cloudimpl.MakeExternalStorage(
+				ctx, conf, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+			require.NoError(t, err)
+			defer s.Close()
+
+			require.NoError(t, s.WriteFile(ctx, `f`, bytes.NewReader([]byte(`data`))))
+			mu.Lock()
+			defer mu.Unlock()
+			require.Equal(t, tc.expected, contentTypes[`/a/container/type/f`])
+		})
+	}
+}
+
+func TestAzurePresignedURL(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	makeStorage := func(t *testing.T, key, sasToken string) cloud.ExternalStorage {
+		s, err := cloudimpl.MakeExternalStorage(ctx, roachpb.ExternalStorage{
+			Provider: roachpb.ExternalStorageProvider_Azure,
+			AzureConfig: &roachpb.ExternalStorage_Azure{
+				Container:   `container`,
+				Prefix:      `prefix`,
+				AccountName: `a`,
+				AccountKey:  key,
+				SASToken:    sasToken,
+			},
+		}, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+		require.NoError(t, err)
+		return s
+	}
+
+	t.Run("sas", func(t *testing.T) {
+		s := makeStorage(t, ``, `sv=2019-12-12&ss=b&srt=co&sp=rl&sig=abc`)
+		defer s.Close()
+		_, err := cloudimpl.PresignedURL(ctx, s, `f`, time.Hour)
+		require.True(t, errors.Is(err, cloudimpl.ErrUnsupported), "%v", err)
+	})
+
+	t.Run("key", func(t *testing.T) {
+		s := makeStorage(t, `Yg==`, ``)
+		defer s.Close()
+		signed, err := cloudimpl.PresignedURL(ctx, s, `f`, time.Hour)
+		require.NoError(t, err)
+		u, err := url.Parse(signed)
+		require.NoError(t, err)
+		require.Equal(t, `https`, u.Scheme)
+		require.Equal(t, `a.blob.core.windows.net`, u.Host)
+		require.Equal(t, `/container/prefix/f`, u.Path)
+		q := u.Query()
+		require.Equal(t, `r`, q.Get(`sp`))
+		require.Equal(t, `b`, q.Get(`sr`))
+		require.NotEmpty(t, q.Get(`sig`))
+		expiry, err := time.Parse(time.RFC3339, q.Get(`se`))
+		require.NoError(t, err)
+		require.WithinDuration(t, timeutil.Now().Add(time.Hour), expiry, time.Minute)
+	})
+}
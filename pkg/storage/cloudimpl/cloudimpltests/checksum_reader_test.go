@@ -0,0 +1,182 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/blobs"
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFileWithChecksum(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	s, err := cloudimpl.ExternalStorageFromURI(ctx,
+		`workload:///csv/bank/bank?version=1.0.0&rows=100&payload-bytes=100`,
+		base.ExternalIODirConfig{}, testSettings, blobs.TestEmptyBlobClientFactory,
+		security.RootUserName(), nil, nil)
+	require.NoError(t, err)
+
+	r, err := s.ReadFile(ctx, ``)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	sha := sha256.Sum256(data)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+
+	for _, tc := range []struct {
+		algorithm cloudimpl.ChecksumAlgorithm
+		expected  []byte
+	}{
+		{cloudimpl.ChecksumSHA256, sha[:]},
+		{cloudimpl.ChecksumCRC32C, crc},
+	} {
+		// Without an expected checksum, the checksum is computed.
+		r, err := cloudimpl.ReadFileWithChecksum(ctx, s, ``, tc.algorithm, nil)
+		require.NoError(t, err)
+		read, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, read)
+		require.Equal(t, tc.expected, r.Checksum())
+		require.NoError(t, r.Close())
+
+		// A matching expected checksum reads successfully.
+		r, err = cloudimpl.ReadFileWithChecksum(ctx, s, ``, tc.algorithm, tc.expected)
+		require.NoError(t, err)
+		read, err = ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, read)
+		require.NoError(t, r.Close())
+
+		// A mismatched expected checksum errors once the data is consumed.
+		wrong := append([]byte(nil), tc.expected...)
+		wrong[0]++
+		r, err = cloudimpl.ReadFileWithChecksum(ctx, s, ``, tc.algorithm, wrong)
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(r)
+		require.EqualError(t, err,
+			fmt.Sprintf(`checksum mismatch: expected %x but got %x`, wrong, tc.expected))
+		require.NoError(t, r.Close())
+	}
+}
+
+// readVerifyingMD5 reads name from s with ReadFileVerifyingMD5.
+func readVerifyingMD5(ctx context.Context, s cloud.ExternalStorage, name string) ([]byte, error) {
+	r, err := cloudimpl.ReadFileVerifyingMD5(ctx, s, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestReadFileVerifyingMD5(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	data := []byte(`some data`)
+	sum := md5.Sum(data)
+	corrupted := []byte(`some dada`)
+	corruptedSum := md5.Sum(corrupted)
+	mismatch := fmt.Sprintf(`checksum mismatch: expected %x but got %x`, sum, corruptedSum)
+
+	t.Run("s3", func(t *testing.T) {
+		srv := newFakeS3(t)
+		defer srv.Close()
+		s, err := makeS3Storage(ctx, srv.uri(`/md5`, nil), security.RootUserName())
+		require.NoError(t, err)
+		defer s.Close()
+		require.NoError(t, s.WriteFile(ctx, `f`, bytes.NewReader(data)))
+
+		// The ETag of the object is the digest of its content.
+		read, err := readVerifyingMD5(ctx, s, `f`)
+		require.NoError(t, err)
+		require.Equal(t, data, read)
+
+		// The content no longer matches the ETag.
+		srv.mu.Lock()
+		srv.mu.etags[`/bucket/md5/f`] = fmt.Sprintf(`"%x"`, sum)
+		srv.mu.objects[`/bucket/md5/f`] = corrupted
+		srv.mu.Unlock()
+		_, err = readVerifyingMD5(ctx, s, `f`)
+		require.EqualError(t, err, mismatch)
+
+		// The ETag of a multipart upload is not a digest, so the content is not
+		// verified.
+		srv.mu.Lock()
+		srv.mu.etags[`/bucket/md5/f`] = fmt.Sprintf(`"%x-2"`, sum)
+		srv.mu.Unlock()
+		read, err = readVerifyingMD5(ctx, s, `f`)
+		require.NoError(t, err)
+		require.Equal(t, corrupted, read)
+
+		_, err = readVerifyingMD5(ctx, s, `missing`)
+		require.True(t, testutils.IsError(err, `does not exist`), "%v", err)
+	})
+
+	t.Run("gcs", func(t *testing.T) {
+		srv := newFakeGCS(t)
+		defer srv.Close()
+		u, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+		defer func(prev string) { _ = os.Setenv(`STORAGE_EMULATOR_HOST`, prev) }(
+			os.Getenv(`STORAGE_EMULATOR_HOST`))
+		require.NoError(t, os.Setenv(`STORAGE_EMULATOR_HOST`, u.Host))
+		conf, err := cloudimpl.ExternalStorageConfFromURI(
+			`gs://bucket/md5?AUTH=implicit`, security.RootUserName())
+		require.NoError(t, err)
+		s, err := cloudimpl.MakeExternalStorage(
+			ctx, conf, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+		require.NoError(t, err)
+		defer s.Close()
+		require.NoError(t, s.WriteFile(ctx, `f`, bytes.NewReader(data)))
+
+		read, err := readVerifyingMD5(ctx, s, `f`)
+		require.NoError(t, err)
+		require.Equal(t, data, read)
+
+		srv.mu.Lock()
+		srv.mu.md5s[`md5/f`] = sum[:]
+		srv.mu.objects[`md5/f`] = corrupted
+		srv.mu.Unlock()
+		_, err = readVerifyingMD5(ctx, s, `f`)
+		require.EqualError(t, err, mismatch)
+
+		// Composite objects have no digest, so the content is not verified.
+		srv.mu.Lock()
+		srv.mu.md5s[`md5/f`] = nil
+		srv.mu.Unlock()
+		read, err = readVerifyingMD5(ctx, s, `f`)
+		require.NoError(t, err)
+		require.Equal(t, corrupted, read)
+	})
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// bucketStorage is a flakyStorage with the configuration of an S3 bucket, the
+// destination of its circuit breaker.
+type bucketStorage struct {
+	*flakyStorage
+	bucket   string
+	settings *cluster.Settings
+}
+
+func (b bucketStorage) Conf() roachpb.ExternalStorage {
+	return roachpb.ExternalStorage{
+		Provider: roachpb.ExternalStorageProvider_S3,
+		S3Config: &roachpb.ExternalStorage_S3{Bucket: b.bucket, Prefix: `prefix`},
+	}
+}
+
+func (b bucketStorage) Settings() *cluster.Settings {
+	return b.settings
+}
+
+func TestCircuitBreakerStorage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer cloudimpl.ResetCircuitBreakersForTesting()
+
+	ctx := context.Background()
+	clock := timeutil.NewManualTime(timeutil.Unix(0, 0))
+	defer cloudimpl.TestingSetCircuitBreakerTimeSource(clock)()
+	settings := cluster.MakeTestingClusterSettings()
+	updater := settings.MakeUpdater()
+	require.NoError(t, updater.Set(cloudimpl.CloudstorageCircuitBreakerThresholdSetting, `3`, `i`))
+	require.NoError(t, updater.Set(cloudimpl.CloudstorageCircuitBreakerCooldownSetting, `1m`, `d`))
+
+	t.Run("opens and recovers", func(t *testing.T) {
+		inner := &flakyStorage{err: econnreset, failures: 100}
+		// The storages of a destination share its breaker.
+		s1 := cloudimpl.WithCircuitBreaker(bucketStorage{inner, `down`, settings})
+		s2 := cloudimpl.WithCircuitBreaker(bucketStorage{inner, `down`, settings})
+		other := cloudimpl.WithCircuitBreaker(
+			bucketStorage{&flakyStorage{err: econnreset}, `up`, settings})
+
+		for i := 0; i < 3; i++ {
+			_, err := s1.Size(ctx, `f`)
+			require.True(t, errors.Is(err, econnreset), "%v", err)
+		}
+		_, err := s2.ReadFile(ctx, `f`)
+		require.True(t, errors.Is(err, cloudimpl.ErrCircuitBreakerOpen), "%v", err)
+		require.True(t, testutils.IsError(err, `s3://down .* failed 3 consecutive times`), "%v", err)
+		require.Equal(t, 3, inner.calls)
+		_, err = other.Size(ctx, `f`)
+		require.NoError(t, err)
+
+		// Once the cooldown has passed, a single operation probes the
+		// destination, and its failure reopens the breaker.
+		clock.Advance(59 * time.Second)
+		_, err = s1.Size(ctx, `f`)
+		require.True(t, errors.Is(err, cloudimpl.ErrCircuitBreakerOpen), "%v", err)
+		clock.Advance(time.Second)
+		_, err = s1.Size(ctx, `f`)
+		require.True(t, errors.Is(err, econnreset), "%v", err)
+		_, err = s2.Size(ctx, `f`)
+		require.True(t, errors.Is(err, cloudimpl.ErrCircuitBreakerOpen), "%v", err)
+		require.Equal(t, 4, inner.calls)
+
+		// The success of the next probe closes the breaker.
+		inner.failures = 0
+		clock.Advance(time.Minute)
+		for _, s := range []cloud.ExternalStorage{s2, s1, s1} {
+			size, err := s.Size(ctx, `f`)
+			require.NoError(t, err)
+			require.Equal(t, int64(4), size)
+		}
+		require.Equal(t, 7, inner.calls)
+	})
+
+	t.Run("permanent errors", func(t *testing.T) {
+		inner := &flakyStorage{err: errors.Wrap(cloudimpl.ErrFileDoesNotExist, `missing`), failures: 100}
+		s := cloudimpl.WithCircuitBreaker(bucketStorage{inner, `missing`, settings})
+		for i := 0; i < 10; i++ {
+			_, err := s.ReadFile(ctx, `f`)
+			require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+		}
+		require.Equal(t, 10, inner.calls)
+	})
+
+	t.Run("retries stop when open", func(t *testing.T) {
+		inner := &flakyStorage{err: econnreset, failures: 100}
+		s := cloudimpl.WithRetry(cloudimpl.WithCircuitBreaker(bucketStorage{inner, `retried`, settings}),
+			cloudimpl.RetryOptions{MaxRetries: 10, InitialBackoff: time.Microsecond, MaxBackoff: time.Millisecond})
+		_, err := s.ListFiles(ctx, ``)
+		require.True(t, errors.Is(err, cloudimpl.ErrCircuitBreakerOpen), "%v", err)
+		require.Equal(t, 3, inner.calls)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		disabled := cluster.MakeTestingClusterSettings()
+		require.NoError(t, disabled.MakeUpdater().Set(
+			cloudimpl.CloudstorageCircuitBreakerThresholdSetting, `0`, `i`))
+		inner := &flakyStorage{err: econnreset, failures: 100}
+		s := cloudimpl.WithCircuitBreaker(bucketStorage{inner, `disabled`, disabled})
+		for i := 0; i < 20; i++ {
+			_, err := s.ReadFile(ctx, `f`)
+			require.True(t, errors.Is(err, econnreset), "%v", err)
+		}
+		require.Equal(t, 20, inner.calls)
+	})
+}
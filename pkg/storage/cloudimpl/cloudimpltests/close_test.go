@@ -0,0 +1,177 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/blobs"
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+// testCloseAfterCancel opens a reader of the file of s named basename, which
+// must exist, cancels the context it was opened and s was used with, and checks
+// that the reader and s can then each be closed twice, promptly.
+func testCloseAfterCancel(
+	t *testing.T, ctx context.Context, cancel func(), s cloud.ExternalStorage, basename string,
+) {
+	r, err := s.ReadFile(ctx, basename)
+	require.NoError(t, err)
+	cancel()
+	// The storage can still be used with the canceled context, though it can
+	// fail.
+	_, _ = s.Size(ctx, basename)
+	if r, err := s.ReadFile(ctx, basename); err == nil {
+		require.NoError(t, r.Close())
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		_ = r.Close()
+		_ = r.Close()
+		errs <- s.Close()
+		errs <- s.Close()
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			require.NoError(t, err)
+		case <-time.After(testutils.DefaultSucceedsSoonDuration):
+			t.Fatal("closing the storage did not return")
+		}
+	}
+}
+
+func TestCloseAfterCancel(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	user := security.RootUserName()
+	write := func(ctx context.Context, s cloud.ExternalStorage) {
+		require.NoError(t, s.WriteFile(ctx, `file`, bytes.NewReader([]byte(`content`))))
+	}
+
+	t.Run("memory", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		s := cloudimpl.NewMemoryStorage()
+		write(ctx, s)
+		testCloseAfterCancel(t, ctx, cancel, s, `file`)
+	})
+
+	t.Run("nodelocal", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		p, cleanupFn := testutils.TempDir(t)
+		defer cleanupFn()
+		testSettings.ExternalIODir = p
+		s, err := cloudimpl.ExternalStorageFromURI(ctx, `nodelocal://0/close`, base.ExternalIODirConfig{},
+			testSettings, blobs.TestBlobServiceClient(testSettings.ExternalIODir), user, nil, nil)
+		require.NoError(t, err)
+		write(ctx, s)
+		testCloseAfterCancel(t, ctx, cancel, s, `file`)
+	})
+
+	t.Run("workload", func(t *testing.T) {
+		for _, params := range []string{``, `&parallelism=3`, `&compress=gzip`} {
+			ctx, cancel := context.WithCancel(context.Background())
+			s, err := cloudimpl.ExternalStorageFromURI(ctx,
+				`workload:///csv/bank/bank?version=1.0.0&rows=100&batch-size=4`+params,
+				base.ExternalIODirConfig{}, testSettings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
+			require.NoError(t, err)
+			testCloseAfterCancel(t, ctx, cancel, s, ``)
+		}
+	})
+
+	t.Run("http", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`content`))
+		}))
+		defer srv.Close()
+		s, err := cloudimpl.ExternalStorageFromURI(ctx, srv.URL, base.ExternalIODirConfig{},
+			testSettings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
+		require.NoError(t, err)
+		testCloseAfterCancel(t, ctx, cancel, s, `file`)
+	})
+
+	t.Run("s3", func(t *testing.T) {
+		srv := newFakeS3(t)
+		defer srv.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		s, err := makeS3Storage(ctx, srv.uri(`/close`, nil), user)
+		require.NoError(t, err)
+		write(ctx, s)
+		testCloseAfterCancel(t, ctx, cancel, s, `file`)
+	})
+
+	t.Run("s3 with a transport of its own", func(t *testing.T) {
+		// A custom CA bundle gives the storage a transport of its own, whose
+		// connections are released when it is closed.
+		tlsSrv := httptest.NewTLSServer(http.NotFoundHandler())
+		defer tlsSrv.Close()
+		dir, cleanupFn := testutils.TempDir(t)
+		defer cleanupFn()
+		bundle := filepath.Join(dir, `ca.pem`)
+		require.NoError(t, ioutil.WriteFile(bundle,
+			pem.EncodeToMemory(&pem.Block{Type: `CERTIFICATE`, Bytes: tlsSrv.Certificate().Raw}), 0644))
+		defer setEnv(t, map[string]string{`AWS_CA_BUNDLE`: bundle})()
+
+		srv := newFakeS3(t)
+		defer srv.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		s, err := makeS3Storage(ctx, srv.uri(`/close`, nil), user)
+		require.NoError(t, err)
+		write(ctx, s)
+		testCloseAfterCancel(t, ctx, cancel, s, `file`)
+	})
+
+	t.Run("gcs", func(t *testing.T) {
+		srv := newFakeGCS(t)
+		defer srv.Close()
+		u, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+		defer func(prev string) { _ = os.Setenv(`STORAGE_EMULATOR_HOST`, prev) }(
+			os.Getenv(`STORAGE_EMULATOR_HOST`))
+		require.NoError(t, os.Setenv(`STORAGE_EMULATOR_HOST`, u.Host))
+		ctx, cancel := context.WithCancel(context.Background())
+		s, err := cloudimpl.ExternalStorageFromURI(ctx, `gs://bucket/close?AUTH=implicit`,
+			base.ExternalIODirConfig{}, testSettings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
+		require.NoError(t, err)
+		write(ctx, s)
+		testCloseAfterCancel(t, ctx, cancel, s, `file`)
+		// The storage does not panic when it is used after it was closed.
+		_, err = s.Size(context.Background(), `file`)
+		require.NoError(t, err)
+	})
+
+	t.Run("wrapped", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		s := cloudimpl.MirrorStorage(
+			cloudimpl.WithRetry(cloudimpl.NewMemoryStorage(), cloudimpl.RetryOptions{}),
+			cloudimpl.WithCircuitBreaker(cloudimpl.NewMemoryStorage()))
+		write(ctx, s)
+		testCloseAfterCancel(t, ctx, cancel, s, `file`)
+	})
+}
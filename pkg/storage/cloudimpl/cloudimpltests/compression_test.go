@@ -0,0 +1,236 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// closeCountingReader is an io.ReadCloser that counts the calls to Close.
+type closeCountingReader struct {
+	io.Reader
+	closes int
+}
+
+func (c *closeCountingReader) Close() error {
+	c.closes++
+	return nil
+}
+
+// compressed returns data compressed as configured by opts.
+func compressed(t testing.TB, data string, opts cloudimpl.CompressionOptions) []byte {
+	s := cloudimpl.NewMemoryStorage()
+	defer s.Close()
+	ctx := context.Background()
+	require.NoError(t, cloudimpl.WriteFileCompressed(ctx, s, `f`, strings.NewReader(data), opts))
+	r, err := s.ReadFile(ctx, `f`)
+	require.NoError(t, err)
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return b
+}
+
+var (
+	gzipOptions = cloudimpl.CompressionOptions{Compression: cloudimpl.CompressionGzip}
+	zstdOptions = cloudimpl.CompressionOptions{Compression: cloudimpl.CompressionZstd}
+)
+
+func TestReadFileDecompressed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	s := cloudimpl.NewMemoryStorage()
+	defer s.Close()
+
+	data := strings.Repeat(`1,some row,of csv data\n`, 1000)
+	gzipped, zstded := compressed(t, data, gzipOptions), compressed(t, data, zstdOptions)
+	require.NoError(t, s.WriteFile(ctx, `compressed.csv.gz`, bytes.NewReader(gzipped)))
+	require.NoError(t, s.WriteFile(ctx, `compressed.csv.zst`, bytes.NewReader(zstded)))
+	// The header identifies a compressed file, whatever its name.
+	require.NoError(t, s.WriteFile(ctx, `compressed.csv`, bytes.NewReader(gzipped)))
+	require.NoError(t, s.WriteFile(ctx, `plain.csv`, bytes.NewReader([]byte(data))))
+	require.NoError(t, s.WriteFile(ctx, `empty.csv`, bytes.NewReader(nil)))
+
+	for _, tc := range []struct {
+		name        string
+		compression cloudimpl.Compression
+		expected    string
+	}{
+		{name: `compressed.csv.gz`, compression: cloudimpl.CompressionGzip, expected: data},
+		{name: `compressed.csv.zst`, compression: cloudimpl.CompressionZstd, expected: data},
+		{name: `compressed.csv`, compression: cloudimpl.CompressionGzip, expected: data},
+		{name: `plain.csv`, expected: data},
+		{name: `empty.csv`, expected: ``},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := cloudimpl.ReadFileDecompressed(ctx, s, tc.name)
+			require.NoError(t, err)
+			defer r.Close()
+			require.Equal(t, tc.compression, r.Compression())
+			read, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, string(read))
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := cloudimpl.ReadFileDecompressed(ctx, s, `missing.gz`)
+		require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		for _, content := range [][]byte{gzipped, zstded} {
+			for _, n := range []int{4, 10, len(content) / 2, len(content) - 1} {
+				in := &closeCountingReader{Reader: bytes.NewReader(content[:n])}
+				r, err := cloudimpl.NewDecompressingReader(in, `truncated`)
+				if err == nil {
+					_, err = ioutil.ReadAll(r)
+					require.NoError(t, r.Close())
+					require.Equal(t, 1, in.closes)
+				}
+				require.True(t, errors.Is(err, io.ErrUnexpectedEOF), "%d bytes: %v", n, err)
+			}
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		for _, content := range [][]byte{gzipped, zstded, []byte(data)} {
+			in := &closeCountingReader{Reader: bytes.NewReader(content)}
+			r, err := cloudimpl.NewDecompressingReader(in, `file`)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.Equal(t, 1, in.closes)
+		}
+	})
+}
+
+func TestWriteFileCompressed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	rng, _ := randutil.NewPseudoRand()
+	data := string(randutil.RandBytes(rng, 100)) + strings.Repeat(`1,some row,of csv data\n`, 10000)
+
+	for _, opts := range []cloudimpl.CompressionOptions{
+		gzipOptions,
+		{Compression: cloudimpl.CompressionGzip, Level: 1},
+		{Compression: cloudimpl.CompressionGzip, Level: 9},
+		zstdOptions,
+		{Compression: cloudimpl.CompressionZstd, Level: 1},
+		{Compression: cloudimpl.CompressionZstd, Level: 22},
+	} {
+		t.Run(fmt.Sprintf("%s/%d", opts.Compression, opts.Level), func(t *testing.T) {
+			s := cloudimpl.NewMemoryStorage()
+			defer s.Close()
+			require.NoError(t, cloudimpl.WriteFileCompressed(ctx, s, `f`, strings.NewReader(data), opts))
+			size, err := s.Size(ctx, `f`)
+			require.NoError(t, err)
+			require.Less(t, size, int64(len(data)/10))
+
+			r, err := cloudimpl.ReadFileDecompressed(ctx, s, `f`)
+			require.NoError(t, err)
+			defer r.Close()
+			require.Equal(t, opts.Compression, r.Compression())
+			read, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, data, string(read))
+		})
+	}
+
+	t.Run("retried", func(t *testing.T) {
+		// A retried write compresses the content again from its start.
+		for _, opts := range []cloudimpl.CompressionOptions{gzipOptions, zstdOptions} {
+			inner := &flakyStorage{err: econnreset, failures: 1}
+			s := cloudimpl.WithRetry(inner, cloudimpl.RetryOptions{
+				MaxRetries: 1, InitialBackoff: time.Microsecond, MaxBackoff: time.Microsecond,
+			})
+			require.NoError(t, cloudimpl.WriteFileCompressed(ctx, s, `f`, strings.NewReader(data), opts))
+			require.Len(t, inner.written, 2)
+			require.Equal(t, inner.written[0], inner.written[1])
+			d, err := cloudimpl.NewDecompressingReader(
+				ioutil.NopCloser(strings.NewReader(inner.written[1])), `f`)
+			require.NoError(t, err)
+			read, err := ioutil.ReadAll(d)
+			require.NoError(t, err)
+			require.Equal(t, data, string(read))
+			require.NoError(t, d.Close())
+		}
+	})
+
+	t.Run("invalid level", func(t *testing.T) {
+		s := cloudimpl.NewMemoryStorage()
+		defer s.Close()
+		for _, opts := range []cloudimpl.CompressionOptions{
+			{Compression: cloudimpl.CompressionGzip, Level: 10},
+			{Compression: cloudimpl.CompressionZstd, Level: 23},
+			{Compression: cloudimpl.CompressionNone},
+		} {
+			require.Error(t, cloudimpl.WriteFileCompressed(ctx, s, `f`, strings.NewReader(data), opts))
+		}
+	})
+
+	t.Run("settings", func(t *testing.T) {
+		require.Equal(t, gzipOptions, cloudimpl.CompressionOptionsFromSettings(&testSettings.SV))
+	})
+}
+
+// BenchmarkWriteFileCompressed compares the speed and the ratio of the
+// compression algorithms on CSV data.
+func BenchmarkWriteFileCompressed(b *testing.B) {
+	var buf bytes.Buffer
+	rng, _ := randutil.NewPseudoRand()
+	names := []string{`alice`, `bob`, `carol`, `dave`, `erin`, `frank`, `grace`, `heidi`}
+	for i := 0; buf.Len() < 16<<20; i++ {
+		fmt.Fprintf(&buf, "%d,%d,%s,%.2f\n", i, rng.Intn(1000), names[rng.Intn(len(names))],
+			rng.Float64()*1e4)
+	}
+	data := buf.String()
+
+	ctx := context.Background()
+	var s cloud.ExternalStorage = cloudimpl.NewMemoryStorage()
+	defer s.Close()
+	for _, opts := range []cloudimpl.CompressionOptions{
+		gzipOptions,
+		{Compression: cloudimpl.CompressionGzip, Level: 1},
+		zstdOptions,
+		{Compression: cloudimpl.CompressionZstd, Level: 1},
+		{Compression: cloudimpl.CompressionZstd, Level: 10},
+	} {
+		b.Run(fmt.Sprintf("%s/%d", opts.Compression, opts.Level), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if err := cloudimpl.WriteFileCompressed(ctx, s, `f`, strings.NewReader(data), opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+			size, err := s.Size(ctx, `f`)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(len(data))/float64(size), "ratio")
+		})
+	}
+}
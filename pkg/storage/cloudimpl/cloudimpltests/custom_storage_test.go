@@ -0,0 +1,119 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/url"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/blobs"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// dummyBuckets are the memory storages of the buckets of the dummy provider.
+var dummyBuckets = map[string]cloud.ExternalStorage{}
+
+// dummyStorage is a storage of the dummy provider, backed by the memory
+// storage of its bucket.
+type dummyStorage struct {
+	cloud.ExternalStorage
+	bucket string
+}
+
+func (d dummyStorage) Conf() roachpb.ExternalStorage {
+	return cloudimpl.CustomProviderConf(`dummy`, d.bucket)
+}
+
+func init() {
+	cloudimpl.RegisterProvider(`dummy`,
+		func(_ cloudimpl.ExternalStorageURIContext, uri *url.URL) (string, error) {
+			if uri.Host == `` {
+				return ``, errors.New(`dummy storage requires a bucket`)
+			}
+			return uri.Host, nil
+		},
+		func(_ context.Context, _ cloudimpl.ExternalStorageContext, bucket string) (cloud.ExternalStorage, error) {
+			s, ok := dummyBuckets[bucket]
+			if !ok {
+				s = cloudimpl.NewMemoryStorage()
+				dummyBuckets[bucket] = s
+			}
+			return dummyStorage{s, bucket}, nil
+		})
+}
+
+func TestCustomStorageProvider(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	fromURI := func(uri string, conf base.ExternalIODirConfig) (cloud.ExternalStorage, error) {
+		return cloudimpl.ExternalStorageFromURI(ctx, uri, conf, testSettings,
+			blobs.TestEmptyBlobClientFactory, user, nil, nil)
+	}
+
+	s, err := fromURI(`dummy://bucket`, base.ExternalIODirConfig{})
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, cloudimpl.CustomProviderConf(`dummy`, `bucket`), s.Conf())
+	require.NoError(t, s.WriteFile(ctx, `a/file`, bytes.NewReader([]byte(`content`))))
+
+	// A storage recreated from the configuration, as it would be on another
+	// node, is again created by the provider.
+	same, err := cloudimpl.MakeExternalStorage(ctx, s.Conf(), base.ExternalIODirConfig{},
+		testSettings, blobs.TestEmptyBlobClientFactory, nil, nil)
+	require.NoError(t, err)
+	defer same.Close()
+	r, err := same.ReadFile(ctx, `a/file`)
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, `content`, string(content))
+	files, err := same.ListFiles(ctx, `a/`)
+	require.NoError(t, err)
+	require.Equal(t, []string{`a/file`}, files)
+
+	other, err := fromURI(`dummy://other`, base.ExternalIODirConfig{})
+	require.NoError(t, err)
+	defer other.Close()
+	_, err = other.ReadFile(ctx, `a/file`)
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+
+	_, err = fromURI(`dummy:///path`, base.ExternalIODirConfig{})
+	require.True(t, testutils.IsError(err, `dummy storage requires a bucket`), "%v", err)
+
+	// Custom providers are external storage, forbidden when it is disabled.
+	_, err = fromURI(`dummy://bucket`, base.ExternalIODirConfig{DisableOutbound: true})
+	require.True(t, errors.Is(err, cloudimpl.ErrExternalIODisabled), "%v", err)
+
+	_, err = cloudimpl.MakeExternalStorage(ctx, cloudimpl.CustomProviderConf(`unknown`, ``),
+		base.ExternalIODirConfig{}, testSettings, blobs.TestEmptyBlobClientFactory, nil, nil)
+	require.True(t, testutils.IsError(err, `no external storage provider registered for unknown`),
+		"%v", err)
+
+	for _, scheme := range []string{`dummy`, `s3`} {
+		require.Panics(t, func() {
+			cloudimpl.RegisterProvider(scheme, nil, nil)
+		}, scheme)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// unreachableStorage is an ExternalStorage whose Stat always fails.
+type unreachableStorage struct {
+	cloud.ExternalStorage
+}
+
+func (unreachableStorage) Stat(context.Context, string) (cloud.FileInfo, error) {
+	return cloud.FileInfo{}, errors.New("connection refused")
+}
+
+func TestDryRunStorage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	mem := cloudimpl.NewMemoryStorage()
+	require.NoError(t, mem.WriteFile(ctx, "existing", bytes.NewReader([]byte("data"))))
+	s := cloudimpl.WithDryRun(mem)
+
+	t.Run("write", func(t *testing.T) {
+		require.NoError(t, s.WriteFile(ctx, "new", bytes.NewReader([]byte("new data"))))
+		require.NoError(t, s.WriteFile(ctx, "existing", bytes.NewReader([]byte("overwritten"))))
+
+		files, err := mem.ListFiles(ctx, "")
+		require.NoError(t, err)
+		require.Equal(t, []string{"existing"}, files)
+		_, err = mem.ReadFile(ctx, "new")
+		require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+
+		require.NoError(t, s.WriteFileIfNotExists(ctx, "new", bytes.NewReader([]byte("new data"))))
+		err = s.WriteFileIfNotExists(ctx, "existing", bytes.NewReader([]byte("overwritten")))
+		require.True(t, errors.Is(err, cloudimpl.ErrFileAlreadyExists), "%v", err)
+		_, err = mem.ReadFile(ctx, "new")
+		require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		require.NoError(t, cloudimpl.CopyFrom(ctx, s, mem, "existing", "copy"))
+		err := cloudimpl.CopyFrom(ctx, s, mem, "missing", "copy")
+		require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+		info, err := mem.Stat(ctx, "copy")
+		require.NoError(t, err)
+		require.False(t, info.Exists)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, s.Delete(ctx, "existing"))
+		require.NoError(t, s.Delete(ctx, "missing"))
+		info, err := mem.Stat(ctx, "existing")
+		require.NoError(t, err)
+		require.True(t, info.Exists)
+	})
+
+	t.Run("reads", func(t *testing.T) {
+		r, err := s.ReadFile(ctx, "existing")
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, "data", string(data))
+
+		files, err := s.ListFiles(ctx, "")
+		require.NoError(t, err)
+		require.Equal(t, []string{"existing"}, files)
+
+		size, err := s.Size(ctx, "existing")
+		require.NoError(t, err)
+		require.Equal(t, int64(4), size)
+	})
+
+	t.Run("probe-error", func(t *testing.T) {
+		s := cloudimpl.WithDryRun(unreachableStorage{mem})
+		err := s.WriteFile(ctx, "new", bytes.NewReader(nil))
+		require.True(t, testutils.IsError(err, "dry run write of new: connection refused"), "%v", err)
+		err = s.Delete(ctx, "existing")
+		require.True(t, testutils.IsError(err, "dry run delete of existing: connection refused"), "%v", err)
+		info, err := mem.Stat(ctx, "existing")
+		require.NoError(t, err)
+		require.True(t, info.Exists)
+	})
+}
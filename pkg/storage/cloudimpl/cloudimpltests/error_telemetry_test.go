@@ -0,0 +1,179 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+var storageErrorClasses = []string{`auth`, `not-found`, `timeout`, `rate-limit`, `other`}
+
+// requireErrorCounted runs fn, which is expected to fail, and checks that it
+// increments the error counter of provider for class and none of the others.
+func requireErrorCounted(t *testing.T, provider, class string, fn func() error) {
+	t.Helper()
+	before := telemetry.GetRawFeatureCounts()
+	require.Error(t, fn())
+	after := telemetry.GetRawFeatureCounts()
+	for _, c := range storageErrorClasses {
+		counter := `external-io.` + provider + `.error.` + c
+		if c == class {
+			require.Greater(t, after[counter], before[counter], counter)
+		} else {
+			require.Equal(t, before[counter], after[counter], counter)
+		}
+	}
+}
+
+func TestHttpErrorTelemetry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var blocking *httptest.Server
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case `/auth`:
+			w.WriteHeader(http.StatusForbidden)
+		case `/missing`:
+			w.WriteHeader(http.StatusNotFound)
+		case `/limited`:
+			w.WriteHeader(http.StatusTooManyRequests)
+		case `/slow`:
+			blocking.Config.Handler.ServeHTTP(w, r)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	// The handlers that block are released before srv is closed.
+	blocking, cleanup := blockingServer()
+	defer cleanup()
+	defer setStorageTimeout(t, "50ms")()
+
+	ctx := context.Background()
+	conf := roachpb.ExternalStorage{HttpPath: roachpb.ExternalStorage_Http{BaseUri: srv.URL}}
+	s, err := cloudimpl.MakeHTTPStorage(ctx, cloudimpl.ExternalStorageContext{Settings: testSettings}, conf)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for file, class := range map[string]string{
+		`auth`:    `auth`,
+		`missing`: `not-found`,
+		`limited`: `rate-limit`,
+		`slow`:    `timeout`,
+		`broken`:  `other`,
+	} {
+		t.Run(file, func(t *testing.T) {
+			requireErrorCounted(t, `http`, class, func() error {
+				return s.WriteFile(ctx, file, bytes.NewReader([]byte(`data`)))
+			})
+		})
+	}
+
+	// Canceled operations are not failures of the storage.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	before := telemetry.GetRawFeatureCounts()
+	require.Error(t, s.WriteFile(canceled, `slow`, bytes.NewReader([]byte(`data`))))
+	require.Equal(t, before[`external-io.http.error.other`],
+		telemetry.GetRawFeatureCounts()[`external-io.http.error.other`])
+}
+
+func TestS3ErrorTelemetry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := newFakeS3(t)
+	defer srv.Close()
+	s, err := makeS3Storage(ctx, srv.uri(`/errors`, nil), security.RootUserName())
+	require.NoError(t, err)
+	defer s.Close()
+	srv.mu.Lock()
+	srv.mu.deniedObjects = map[string]bool{`/bucket/errors/denied`: true}
+	srv.mu.Unlock()
+
+	requireErrorCounted(t, `s3`, `auth`, func() error {
+		_, err := s.ReadFile(ctx, `denied`)
+		return err
+	})
+	requireErrorCounted(t, `s3`, `not-found`, func() error {
+		_, err := s.Size(ctx, `missing`)
+		return err
+	})
+}
+
+func TestGCSErrorTelemetry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := newFakeGCS(t)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	defer func(prev string) { _ = os.Setenv(`STORAGE_EMULATOR_HOST`, prev) }(
+		os.Getenv(`STORAGE_EMULATOR_HOST`))
+	require.NoError(t, os.Setenv(`STORAGE_EMULATOR_HOST`, u.Host))
+	updater := testSettings.MakeUpdater()
+	require.NoError(t, updater.Set(`cloudstorage.gs.rate_limit_max_retries`, `0`, `i`))
+	defer func() {
+		require.NoError(t, updater.Set(`cloudstorage.gs.rate_limit_max_retries`, `8`, `i`))
+	}()
+
+	conf, err := cloudimpl.ExternalStorageConfFromURI(
+		`gs://bucket/prefix?AUTH=implicit`, security.RootUserName())
+	require.NoError(t, err)
+	s, err := cloudimpl.MakeExternalStorage(
+		ctx, conf, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// The GCS client retries the write three times.
+	for _, tc := range []struct {
+		name    string
+		failure fakeGCSFailure
+		class   string
+	}{
+		{name: `denied`, failure: fakeGCSFailure{code: http.StatusForbidden, reason: `forbidden`}, class: `auth`},
+		// Per-user rate limits are reported as a 403, but are not an auth error.
+		{
+			name:    `rate limited`,
+			failure: fakeGCSFailure{code: http.StatusForbidden, reason: `userRateLimitExceeded`},
+			class:   `rate-limit`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv.mu.Lock()
+			srv.mu.failures = []fakeGCSFailure{tc.failure, tc.failure, tc.failure}
+			srv.mu.Unlock()
+			requireErrorCounted(t, `google_cloud`, tc.class, func() error {
+				return s.WriteFile(ctx, `f`, bytes.NewReader([]byte(`data`)))
+			})
+		})
+	}
+
+	requireErrorCounted(t, `google_cloud`, `not-found`, func() error {
+		_, err := s.ReadFile(ctx, `missing`)
+		return err
+	})
+}
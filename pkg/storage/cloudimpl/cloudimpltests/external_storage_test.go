@@ -12,6 +12,7 @@ package cloudimpltests
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	gosql "database/sql"
 	"encoding/base64"
@@ -33,20 +34,24 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/kv"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/tests"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
 	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
 	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding/csv"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/randutil"
 	"github.com/cockroachdb/cockroach/pkg/util/sysutil"
 	"github.com/cockroachdb/cockroach/pkg/workload"
 	"github.com/cockroachdb/cockroach/pkg/workload/bank"
+	_ "github.com/cockroachdb/cockroach/pkg/workload/tpcc"
 	"github.com/cockroachdb/errors"
 	"github.com/spf13/pflag"
 	"github.com/stretchr/testify/require"
@@ -204,6 +209,11 @@ func testExportStoreWithExternalIOConfig(
 				t.Errorf("size mismatch, got %d, expected %d", sz, len(payload))
 			}
 
+			info, err := s.Stat(ctx, name)
+			require.NoError(t, err)
+			require.True(t, info.Exists)
+			require.Equal(t, int64(len(payload)), info.Size)
+
 			r, err := s.ReadFile(ctx, name)
 			if err != nil {
 				t.Fatal(err)
@@ -219,9 +229,32 @@ func testExportStoreWithExternalIOConfig(
 			}
 
 			require.NoError(t, s.Delete(ctx, name))
+
+			info, err = s.Stat(ctx, name)
+			require.NoError(t, err)
+			require.False(t, info.Exists)
 		}
 	})
 
+	t.Run("write-if-not-exists", func(t *testing.T) {
+		const name = "write-once"
+		require.NoError(t, s.WriteFileIfNotExists(ctx, name, bytes.NewReader([]byte("first"))))
+		defer func() {
+			require.NoError(t, s.Delete(ctx, name))
+		}()
+
+		err := s.WriteFileIfNotExists(ctx, name, bytes.NewReader([]byte("second")))
+		require.True(t, errors.Is(err, cloudimpl.ErrFileAlreadyExists), "unexpected error: %v", err)
+
+		// The first write is left intact.
+		r, err := s.ReadFile(ctx, name)
+		require.NoError(t, err)
+		defer r.Close()
+		res, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, "first", string(res))
+	})
+
 	// The azure driver makes us chunk files that are greater than 4mb, so make
 	// sure that files larger than that work on all the providers.
 	t.Run("exceeds-4mb-chunk", func(t *testing.T) {
@@ -527,6 +560,30 @@ func testListFiles(
 	}
 }
 
+// testListFilesSorted checks that s lists files sorted lexicographically by
+// path, including names that a directory walk visits in another order, since
+// "a-c" sorts before "a/b" but the directory "a" is walked before "a-c".
+func testListFilesSorted(t *testing.T, s cloud.ExternalStorage, pattern string) {
+	ctx := context.Background()
+	written := []string{"a-c", "a/b", "a/a", "B", "a.d", "b/c/d", "c"}
+	for _, name := range written {
+		require.NoError(t, s.WriteFile(ctx, name, bytes.NewReader([]byte(name))))
+	}
+	expected := append([]string(nil), written...)
+	sort.Strings(expected)
+
+	files, err := s.ListFiles(ctx, pattern)
+	require.NoError(t, err)
+	require.Equal(t, expected, files)
+	entries, err := s.ListFilesExt(ctx, pattern)
+	require.NoError(t, err)
+	paths := make([]string, len(entries))
+	for i := range entries {
+		paths[i] = entries[i].Path
+	}
+	require.Equal(t, expected, paths)
+}
+
 func TestPutGoogleCloud(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
@@ -582,88 +639,481 @@ func TestPutGoogleCloud(t *testing.T) {
 	})
 }
 
+// workloadTestGen is the bank generator whose data the workload storage tests
+// read, with 4 rows of 12 byte payloads.
+var workloadTestGen = bank.FromConfig(4, 4, 12, 1)
+
+// workloadTestURL returns the URI of the csv data of the table of
+// workloadTestGen, with the flags of the generator and extraParams.
+func workloadTestURL(extraParams ...map[string]string) *url.URL {
+	gen := workloadTestGen
+	params := url.Values{`version`: []string{gen.Meta().Version}}
+	flags := gen.(workload.Flagser).Flags()
+	flags.VisitAll(func(f *pflag.Flag) {
+		if flags.Meta[f.Name].RuntimeOnly {
+			return
+		}
+		params[f.Name] = append(params[f.Name], f.Value.String())
+	})
+	for _, p := range extraParams {
+		for key, value := range p {
+			params.Add(key, value)
+		}
+	}
+	return &url.URL{
+		Scheme:   `workload`,
+		Path:     `/` + filepath.Join(`csv`, gen.Meta().Name, gen.Tables()[0].Name),
+		RawQuery: params.Encode(),
+	}
+}
+
+// openWorkloadURI returns the storage of uri.
+func openWorkloadURI(uri string) (cloud.ExternalStorage, error) {
+	return cloudimpl.ExternalStorageFromURI(context.Background(), uri, base.ExternalIODirConfig{},
+		testSettings, blobs.TestEmptyBlobClientFactory, security.RootUserName(), nil, nil)
+}
+
+// readWorkloadURI returns the data of the table named by uri.
+func readWorkloadURI(t *testing.T, uri string) string {
+	s, err := openWorkloadURI(uri)
+	require.NoError(t, err)
+	r, err := s.ReadFile(context.Background(), ``)
+	require.NoError(t, err)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return string(data)
+}
+
 func TestWorkloadStorage(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
-	settings := cluster.MakeTestingClusterSettings()
+	require.Equal(t, strings.TrimSpace(`
+0,0,initial-dTqn
+1,0,initial-Pkyk
+2,0,initial-eJkM
+3,0,initial-TlNb
+	`), strings.TrimSpace(readWorkloadURI(t, workloadTestURL().String())))
 
-	rows, payloadBytes, ranges := 4, 12, 1
-	gen := bank.FromConfig(rows, rows, payloadBytes, ranges)
-	bankTable := gen.Tables()[0]
-	bankURL := func(extraParams ...map[string]string) *url.URL {
-		params := url.Values{`version`: []string{gen.Meta().Version}}
-		flags := gen.(workload.Flagser).Flags()
-		flags.VisitAll(func(f *pflag.Flag) {
-			if flags.Meta[f.Name].RuntimeOnly {
-				return
-			}
-			params[f.Name] = append(params[f.Name], f.Value.String())
-		})
-		for _, p := range extraParams {
-			for key, value := range p {
-				params.Add(key, value)
-			}
-		}
-		return &url.URL{
-			Scheme:   `workload`,
-			Path:     `/` + filepath.Join(`csv`, gen.Meta().Name, bankTable.Name),
-			RawQuery: params.Encode(),
+	params := map[string]string{
+		`row-start`: `1`, `row-end`: `3`, `payload-bytes`: `14`, `batch-size`: `1`}
+	require.Equal(t, strings.TrimSpace(`
+1,0,initial-vOpikz
+2,0,initial-qMvoPe
+	`), strings.TrimSpace(readWorkloadURI(t, workloadTestURL(params).String())))
+
+	_, err := openWorkloadURI(`workload:///csv/bank/bank?version=1.0.0&rows=abc`)
+	require.EqualError(t, err, `parsing parameters --rows=abc: flag --rows expects a value of type int `+
+		`but got "abc": invalid argument "abc" for "--rows" flag: strconv.ParseInt: parsing "abc": invalid syntax`)
+	_, err = openWorkloadURI(`workload:///csv/bank/bank?version=1.0.0&nope=1`)
+	require.EqualError(t, err, `parsing parameters --nope=1: unknown flag: --nope`)
+
+	{
+		// Unknown parameters are passed through to the generator unless strict.
+		params := map[string]string{`batch_size`: `1`}
+		_, err := openWorkloadURI(workloadTestURL(params).String())
+		require.Contains(t, err.Error(), `unknown flag: --batch_size`)
+
+		params[`strict`] = `true`
+		params[`nope`] = `2`
+		_, err = openWorkloadURI(workloadTestURL(params).String())
+		require.EqualError(t, err, `unknown parameters for generator bank: batch_size, nope`)
+		require.Equal(t,
+			`valid parameters: batch-size, concurrency, db, method, payload-bytes, ranges, rows, seed`,
+			errors.FlattenHints(err))
+
+		strict := readWorkloadURI(t, workloadTestURL(map[string]string{`strict`: `true`}).String())
+		require.NotEmpty(t, strict)
+	}
+
+	_, err = openWorkloadURI(`workload:///nope`)
+	require.EqualError(t, err, `path must be of the form /<format>/<generator>[/<table>]: /nope`)
+	_, err = openWorkloadURI(`workload:///fmt/bank/bank?version=`)
+	require.EqualError(t, err, `unsupported format: fmt`)
+	_, err = openWorkloadURI(`workload:///csv/nope/nope?version=`)
+	require.EqualError(t, err, `unknown generator: nope`)
+	require.Contains(t, errors.FlattenHints(err), `bank`)
+	_, err = openWorkloadURI(`workload:///csv/bank/nope?version=1.0.0`)
+	require.EqualError(t, err, `unknown table nope for generator bank`)
+	require.Equal(t, `valid tables: bank`, errors.FlattenHints(err))
+	_, err = openWorkloadURI(`workload:///csv/bank/bank`)
+	require.EqualError(t, err, `parameter version is required`)
+	_, err = openWorkloadURI(`workload:///csv/bank/bank?version=`)
+	require.EqualError(t, err, `expected bank version "" but got "1.0.0"`)
+	_, err = openWorkloadURI(`workload:///csv/bank/bank?version=nope`)
+	require.EqualError(t, err, `expected bank version "nope" but got "1.0.0"`)
+	require.Contains(t, errors.FlattenHints(err), `1.x`)
+
+	// The bank generator is at version 1.0.0.
+	for v, ok := range map[string]bool{
+		`1.x`:      true,
+		`1.0.x`:    true,
+		`1.1.x`:    false,
+		`2.x`:      false,
+		`>=1.0.0`:  true,
+		`>=0.9.0`:  true,
+		`>=1.0.1`:  false,
+		`>=2.0.0`:  false,
+		`10.x`:     false,
+		`1.0.0.x`:  false,
+		`1.0.0.0`:  false,
+		`>=1.0.0x`: false,
+	} {
+		_, err := openWorkloadURI(`workload:///csv/bank/bank?version=` + url.QueryEscape(v))
+		if ok {
+			require.NoError(t, err, v)
+		} else {
+			require.Error(t, err, v)
 		}
 	}
+	for v, expected := range map[string]string{
+		`>=nope`: `invalid minimum version: >=nope`,
+		`x`:      `expected bank version "x" but got "1.0.0"`,
+		`.x`:     `invalid version range: .x`,
+		`1.x.x`:  `invalid version range: 1.x.x`,
+	} {
+		_, err := openWorkloadURI(`workload:///csv/bank/bank?version=` + url.QueryEscape(v))
+		require.EqualError(t, err, expected)
+		require.Contains(t, errors.FlattenHints(err), `>=1.0.0`)
+	}
+}
+
+func TestWorkloadStorageReadFileAt(t *testing.T) {
+	defer leaktest.AfterTest(t)()
 
 	ctx := context.Background()
-	user := security.RootUserName()
+	uri := workloadTestURL().String()
+	expected := readWorkloadURI(t, uri)
+	s, err := openWorkloadURI(uri)
+	require.NoError(t, err)
 
-	{
-		s, err := cloudimpl.ExternalStorageFromURI(ctx, bankURL().String(), base.ExternalIODirConfig{},
-			settings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
-		require.NoError(t, err)
-		r, err := s.ReadFile(ctx, ``)
+	for _, offset := range []int64{0, 1, 15, int64(len(expected)) - 1, int64(len(expected))} {
+		r, size, err := s.ReadFileAt(ctx, ``, offset)
 		require.NoError(t, err)
+		require.Equal(t, int64(len(expected)), size)
 		bytes, err := ioutil.ReadAll(r)
 		require.NoError(t, err)
-		require.Equal(t, strings.TrimSpace(`
-0,0,initial-dTqn
-1,0,initial-Pkyk
-2,0,initial-eJkM
-3,0,initial-TlNb
-		`), strings.TrimSpace(string(bytes)))
+		require.Equal(t, expected[offset:], string(bytes))
+	}
+
+	_, _, err = s.ReadFileAt(ctx, ``, -1)
+	require.EqualError(t, err, `negative offset -1 is not supported by workload storage`)
+	_, _, err = s.ReadFileAt(ctx, ``, int64(len(expected))+1)
+	require.EqualError(t, err, fmt.Sprintf(
+		`offset %d is past the end of workload data of size %d`, len(expected)+1, len(expected)))
+}
+
+func TestWorkloadStorageSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	uri := workloadTestURL().String()
+	expected := readWorkloadURI(t, uri)
+	s, err := openWorkloadURI(uri)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		size, err := s.Size(ctx, ``)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(expected)), size)
+	}
+	info, err := s.Stat(ctx, ``)
+	require.NoError(t, err)
+	require.Equal(t, cloud.FileInfo{Exists: true, Size: int64(len(expected))}, info)
+	_, err = s.Size(ctx, `nope`)
+	require.EqualError(t, err, `basenames are not supported by workload storage`)
+
+	// An empty range of rows has no data.
+	s, err = openWorkloadURI(workloadTestURL(map[string]string{`row-start`: `2`, `row-end`: `2`}).String())
+	require.NoError(t, err)
+	size, err := s.Size(ctx, ``)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), size)
+}
+
+func TestWorkloadStorageListFiles(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	gen := workloadTestGen
+	tableName := gen.Tables()[0].Name
+	genURL := workloadTestURL()
+	genURL.Path = `/` + filepath.Join(`csv`, gen.Meta().Name)
+	s, err := openWorkloadURI(genURL.String())
+	require.NoError(t, err)
+
+	files, err := s.ListFiles(ctx, `*`)
+	require.NoError(t, err)
+	require.Equal(t, []string{tableName}, files)
+	files, err = s.ListFiles(ctx, `nope*`)
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	r, err := s.ReadFile(ctx, tableName)
+	require.NoError(t, err)
+	bytes, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, readWorkloadURI(t, workloadTestURL().String()), string(bytes))
+
+	// Listing without a pattern returns URIs that each name a table.
+	uris, err := s.ListFiles(ctx, ``)
+	require.NoError(t, err)
+	require.Len(t, uris, 1)
+	require.Equal(t, string(bytes), readWorkloadURI(t, uris[0]))
+
+	_, err = s.ReadFile(ctx, `nope`)
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist))
+	info, err := s.Stat(ctx, `nope`)
+	require.NoError(t, err)
+	require.False(t, info.Exists)
+	_, err = s.ReadFile(ctx, ``)
+	require.EqualError(t, err,
+		`a table basename is required when the workload URI does not name a table`)
+
+	s, err = openWorkloadURI(workloadTestURL().String())
+	require.NoError(t, err)
+	_, err = s.ListFiles(ctx, ``)
+	require.EqualError(t, err, `workload storage does not support listing files`)
+	require.True(t, errors.Is(err, cloudimpl.ErrListingUnsupported))
+	require.True(t, errors.Is(err, cloudimpl.ErrUnsupported))
+}
+
+func TestWorkloadStorageReadOnly(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The operations that would modify the storage fail with an error that
+	// callers can detect, while the reads, listings and sizes are supported.
+	ctx := context.Background()
+	s, err := openWorkloadURI(workloadTestURL().String())
+	require.NoError(t, err)
+	for name, fn := range map[string]func() error{
+		`WriteFile`: func() error { return s.WriteFile(ctx, ``, strings.NewReader(``)) },
+		`WriteFileIfNotExists`: func() error {
+			return s.WriteFileIfNotExists(ctx, ``, strings.NewReader(``))
+		},
+		`Delete`:    func() error { return s.Delete(ctx, ``) },
+		`DeleteAll`: func() error { return s.DeleteAll(ctx, ``) },
+	} {
+		err := fn()
+		require.True(t, errors.Is(err, cloudimpl.ErrReadOnlyStorage), "%s: %v", name, err)
+		require.True(t, errors.Is(err, cloudimpl.ErrUnsupported), "%s: %v", name, err)
+		require.Contains(t, err.Error(), `workload storage does not support`, name)
+	}
+	_, err = s.Size(ctx, ``)
+	require.NoError(t, err)
+	_, err = s.ListFiles(ctx, ``)
+	require.False(t, errors.Is(err, cloudimpl.ErrReadOnlyStorage), "%v", err)
+}
+
+func TestWorkloadStorageDelimiter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	gen := workloadTestGen
+	tsvURL := workloadTestURL()
+	tsvURL.Path = `/` + filepath.Join(`tsv`, gen.Meta().Name, gen.Tables()[0].Name)
+	require.Equal(t, strings.TrimSpace(`
+0	0	initial-dTqn
+1	0	initial-Pkyk
+2	0	initial-eJkM
+3	0	initial-TlNb
+	`), strings.TrimSpace(readWorkloadURI(t, tsvURL.String())))
+
+	require.Equal(t, strings.TrimSpace(`
+0|0|initial-dTqn
+1|0|initial-Pkyk
+2|0|initial-eJkM
+3|0|initial-TlNb
+	`), strings.TrimSpace(readWorkloadURI(t, workloadTestURL(map[string]string{`delimiter`: `|`}).String())))
+
+	for _, delimiter := range []string{``, `||`, `é`} {
+		_, err := openWorkloadURI(workloadTestURL(map[string]string{`delimiter`: delimiter}).String())
+		require.EqualError(t, err, fmt.Sprintf(`delimiter must be a single byte: %q`, delimiter))
+	}
+	_, err := openWorkloadURI(workloadTestURL(map[string]string{`delimiter`: "\n"}).String())
+	require.EqualError(t, err, `invalid delimiter: "\n"`)
+}
+
+func TestWorkloadStorageRowRange(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	{
+		// With one row per batch, row=N reads exactly the Nth row.
+		read := func(params string) string {
+			return readWorkloadURI(t, `workload:///csv/bank/bank?version=1.0.0&rows=4&batch-size=1&`+params)
+		}
+		row := read(`row=2`)
+		require.Equal(t, 1, strings.Count(row, "\n"))
+		require.True(t, strings.HasPrefix(row, `2,`), row)
+		require.Equal(t, read(`row-start=2&row-end=3`), row)
 	}
 
 	{
-		params := map[string]string{
-			`row-start`: `1`, `row-end`: `3`, `payload-bytes`: `14`, `batch-size`: `1`}
-		s, err := cloudimpl.ExternalStorageFromURI(ctx, bankURL(params).String(), base.ExternalIODirConfig{},
-			settings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
+		// With several rows per batch, batch-start and batch-end select whole
+		// batches.
+		read := func(params string) string {
+			return readWorkloadURI(t, `workload:///csv/bank/bank?version=1.0.0&rows=10&batch-size=3&`+params)
+		}
+		batches := read(`batch-start=1&batch-end=3`)
+		require.Equal(t, 6, strings.Count(batches, "\n"))
+		require.True(t, strings.HasPrefix(batches, `3,`), batches)
+		require.Equal(t, read(`row-start=1&row-end=3`), batches)
+		// The last batch is partial.
+		last := read(`batch-start=3`)
+		require.Equal(t, 1, strings.Count(last, "\n"))
+		require.True(t, strings.HasPrefix(last, `9,`), last)
+		// A zero end is the end of the table.
+		require.Equal(t, last, read(`row-start=3&row-end=0`))
+		require.Equal(t, last, read(`batch-start=3&batch-end=0`))
+	}
+
+	for params, expected := range map[string]string{
+		`row=-1`:                    `row must not be negative: -1`,
+		`row=1&row-start=0`:         `row cannot be combined with row-start or row-end`,
+		`row=1&row-end=3`:           `row cannot be combined with row-start or row-end`,
+		`row-start=-1`:              `row-start must not be negative: -1`,
+		`row-end=-1`:                `row-end must not be negative: -1`,
+		`row-start=3&row-end=1`:     `row-end 1 must not be less than row-start 3`,
+		`row-start=100&row-end=10`:  `row-end 10 must not be less than row-start 100`,
+		`batch-start=-1`:            `batch-start must not be negative: -1`,
+		`batch-end=-1`:              `batch-end must not be negative: -1`,
+		`batch-start=3&batch-end=1`: `batch-end 1 must not be less than batch-start 3`,
+		`batch-start=1&row-end=3`:   `batch-start and batch-end cannot be combined with row, row-start or row-end`,
+		`batch-end=3&row-start=1`:   `batch-start and batch-end cannot be combined with row, row-start or row-end`,
+		`row=1&batch-end=3`:         `batch-start and batch-end cannot be combined with row, row-start or row-end`,
+	} {
+		_, err := openWorkloadURI(workloadTestURL().String() + `&` + params)
+		require.EqualError(t, err, expected)
+	}
+}
+
+func TestWorkloadStorageParallelism(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	params := map[string]string{`rows`: `100`, `batch-size`: `3`}
+	expected := readWorkloadURI(t, workloadTestURL(params).String())
+
+	for _, parallelism := range []string{`1`, `2`, `3`, `7`, `64`} {
+		params[`parallelism`] = parallelism
+		require.Equal(t, expected, readWorkloadURI(t, workloadTestURL(params).String()))
+		// Each batch of 3 rows is 3 lines.
+		rowRange := map[string]string{`row-start`: `5`, `row-end`: `20`}
+		lines := strings.SplitAfter(expected, "\n")
+		require.Equal(t, strings.Join(lines[5*3:20*3], ``),
+			readWorkloadURI(t, workloadTestURL(params, rowRange).String()))
+
+		// Closing before the data is fully read must not leak the generators.
+		s, err := openWorkloadURI(workloadTestURL(params).String())
 		require.NoError(t, err)
 		r, err := s.ReadFile(ctx, ``)
 		require.NoError(t, err)
-		bytes, err := ioutil.ReadAll(r)
+		_, err = r.Read(make([]byte, 16))
 		require.NoError(t, err)
-		require.Equal(t, strings.TrimSpace(`
-1,0,initial-vOpikz
-2,0,initial-qMvoPe
-		`), strings.TrimSpace(string(bytes)))
+		require.NoError(t, r.Close())
 	}
 
-	_, err := cloudimpl.ExternalStorageFromURI(ctx, `workload:///nope`, base.ExternalIODirConfig{}, settings,
-		blobs.TestEmptyBlobClientFactory, user, nil, nil)
-	require.EqualError(t, err, `path must be of the form /<format>/<generator>/<table>: /nope`)
-	_, err = cloudimpl.ExternalStorageFromURI(ctx, `workload:///fmt/bank/bank?version=`,
-		base.ExternalIODirConfig{}, settings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
-	require.EqualError(t, err, `unsupported format: fmt`)
-	_, err = cloudimpl.ExternalStorageFromURI(ctx, `workload:///csv/nope/nope?version=`,
-		base.ExternalIODirConfig{}, settings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
-	require.EqualError(t, err, `unknown generator: nope`)
-	_, err = cloudimpl.ExternalStorageFromURI(ctx, `workload:///csv/bank/bank`, base.ExternalIODirConfig{},
-		settings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
-	require.EqualError(t, err, `parameter version is required`)
-	_, err = cloudimpl.ExternalStorageFromURI(ctx, `workload:///csv/bank/bank?version=`,
-		base.ExternalIODirConfig{}, settings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
-	require.EqualError(t, err, `expected bank version "" but got "1.0.0"`)
-	_, err = cloudimpl.ExternalStorageFromURI(ctx, `workload:///csv/bank/bank?version=nope`,
-		base.ExternalIODirConfig{}, settings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
-	require.EqualError(t, err, `expected bank version "nope" but got "1.0.0"`)
+	_, err := openWorkloadURI(workloadTestURL().String() + `&parallelism=0`)
+	require.EqualError(t, err, `parallelism must be positive: 0`)
+}
+
+func TestWorkloadStorageCancel(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	for _, params := range []map[string]string{
+		{`rows`: `1000`, `batch-size`: `1`},
+		{`rows`: `1000`, `batch-size`: `1`, `parallelism`: `4`},
+		{`rows`: `1000`, `batch-size`: `1`, `compress`: `gzip`},
+	} {
+		s, err := openWorkloadURI(workloadTestURL(params).String())
+		require.NoError(t, err)
+		readCtx, cancel := context.WithCancel(ctx)
+		r, err := s.ReadFile(readCtx, ``)
+		require.NoError(t, err)
+		_, err = r.Read(make([]byte, 16))
+		require.NoError(t, err)
+		cancel()
+		_, err = r.Read(make([]byte, 16))
+		require.True(t, errors.Is(err, context.Canceled), "%+v", err)
+		_, err = ioutil.ReadAll(r)
+		require.True(t, errors.Is(err, context.Canceled), "%+v", err)
+		require.NoError(t, r.Close())
+	}
+}
+
+func TestWorkloadStorageNDJSON(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	gen := workloadTestGen
+	jsonURL := workloadTestURL()
+	jsonURL.Path = `/` + filepath.Join(`ndjson`, gen.Meta().Name, gen.Tables()[0].Name)
+	require.Equal(t, strings.TrimSpace(`
+{"id":0,"balance":0,"payload":"initial-dTqn"}
+{"id":1,"balance":0,"payload":"initial-Pkyk"}
+{"id":2,"balance":0,"payload":"initial-eJkM"}
+{"id":3,"balance":0,"payload":"initial-TlNb"}
+	`), strings.TrimSpace(readWorkloadURI(t, jsonURL.String())))
+
+	jsonURL.RawQuery += `&delimiter=|`
+	_, err := openWorkloadURI(jsonURL.String())
+	require.EqualError(t, err, `delimiter is not supported for format ndjson`)
+}
+
+func TestWorkloadStorageGzip(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	params := map[string]string{`payload-bytes`: `1024`, `batch-size`: `1000`}
+	expected := readWorkloadURI(t, workloadTestURL(params).String())
+
+	params[`compress`] = `gzip`
+	s, err := openWorkloadURI(workloadTestURL(params).String())
+	require.NoError(t, err)
+	r, err := s.ReadFile(ctx, ``)
+	require.NoError(t, err)
+	gz, err := gzip.NewReader(r)
+	require.NoError(t, err)
+	uncompressed, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, expected, string(uncompressed))
+
+	// Closing before the data is fully read must not leak the compressor.
+	r, err = s.ReadFile(ctx, ``)
+	require.NoError(t, err)
+	_, err = r.Read(make([]byte, 16))
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	_, err = openWorkloadURI(workloadTestURL(map[string]string{`compress`: `lz4`}).String())
+	require.EqualError(t, err, `unsupported compression: lz4`)
+}
+
+func BenchmarkWorkloadStorageParallelism(b *testing.B) {
+	ctx := context.Background()
+	settings := cluster.MakeTestingClusterSettings()
+	gen := bank.FromConfig(100000, 1000, 100, 1)
+	for _, parallelism := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			uri := fmt.Sprintf(`workload:///csv/bank/bank?version=%s&rows=100000&batch-size=1000`+
+				`&payload-bytes=100&parallelism=%d`, gen.Meta().Version, parallelism)
+			s, err := cloudimpl.ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{}, settings,
+				blobs.TestEmptyBlobClientFactory, security.RootUserName(), nil, nil)
+			require.NoError(b, err)
+			b.ResetTimer()
+			var bytes int64
+			for i := 0; i < b.N; i++ {
+				r, err := s.ReadFile(ctx, ``)
+				require.NoError(b, err)
+				n, err := io.Copy(ioutil.Discard, r)
+				require.NoError(b, err)
+				require.NoError(b, r.Close())
+				bytes = n
+			}
+			b.StopTimer()
+			b.SetBytes(bytes)
+		})
+	}
 }
 
 func uploadData(
@@ -806,3 +1256,1245 @@ func TestFileExistence(t *testing.T) {
 		require.NoError(t, err)
 	}
 }
+
+func TestWorkloadStorageSeek(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	rng, _ := randutil.NewPseudoRand()
+	for _, tc := range []struct {
+		format, params string
+	}{
+		{`csv`, ``},
+		{`csv`, `&row-start=3&row-end=9`},
+		{`csv`, `&parallelism=3`},
+		{`csv`, `&compress=gzip`},
+		{`csv`, `&max-bytes=1000`},
+		{`ndjson`, ``},
+	} {
+		t.Run(tc.format+tc.params, func(t *testing.T) {
+			s, err := cloudimpl.ExternalStorageFromURI(ctx, `workload:///`+tc.format+
+				`/bank/bank?version=1.0.0&rows=50&batch-size=4&payload-bytes=10`+tc.params,
+				base.ExternalIODirConfig{}, testSettings, blobs.TestEmptyBlobClientFactory,
+				security.RootUserName(), nil, nil)
+			require.NoError(t, err)
+			r, err := s.ReadFile(ctx, ``)
+			require.NoError(t, err)
+			defer r.Close()
+			data, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			size := int64(len(data))
+
+			seeker, ok := r.(io.ReadSeeker)
+			require.True(t, ok)
+			readAt := func(whence int, offset, expected int64) {
+				pos, err := seeker.Seek(offset, whence)
+				require.NoError(t, err)
+				require.Equal(t, expected, pos)
+				read, err := ioutil.ReadAll(seeker)
+				require.NoError(t, err)
+				if expected > size {
+					expected = size
+				}
+				require.Equal(t, string(data[expected:]), string(read))
+			}
+			for i := 0; i < 10; i++ {
+				offset := rng.Int63n(size + 1)
+				readAt(io.SeekStart, offset, offset)
+				readAt(io.SeekEnd, offset-size, offset)
+				readAt(io.SeekCurrent, offset-size, offset)
+			}
+			readAt(io.SeekStart, 0, 0)
+			readAt(io.SeekStart, size+10, size+10)
+			_, err = seeker.Seek(-1, io.SeekStart)
+			require.EqualError(t, err, `negative offset -1 is not supported by workload storage`)
+
+			for i := 0; i < 10; i++ {
+				offset := rng.Int63n(size + 1)
+				r, readSize, err := s.ReadFileAt(ctx, ``, offset)
+				require.NoError(t, err)
+				require.Equal(t, size, readSize)
+				read, err := ioutil.ReadAll(r)
+				require.NoError(t, err)
+				require.Equal(t, string(data[offset:]), string(read))
+				require.NoError(t, r.Close())
+			}
+		})
+	}
+}
+
+func TestWorkloadStorageCheckpoint(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	rng, _ := randutil.NewPseudoRand()
+	open := func(uri string) cloud.ExternalStorage {
+		s, err := cloudimpl.ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{}, testSettings,
+			blobs.TestEmptyBlobClientFactory, security.RootUserName(), nil, nil)
+		require.NoError(t, err)
+		return s
+	}
+	readAll := func(r io.ReadCloser) string {
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		return string(data)
+	}
+	const bank = `/bank?version=1.0.0&rows=50&batch-size=4&payload-bytes=10`
+
+	for _, tc := range []struct {
+		path, basename, params string
+	}{
+		{`/csv/bank` + bank, ``, ``},
+		{`/csv/bank` + bank, ``, `&row-start=3&row-end=9`},
+		{`/csv/bank` + bank, ``, `&parallelism=3`},
+		{`/csv/bank` + bank, ``, `&max-bytes=1000`},
+		{`/csv/bank` + bank, ``, `&header=true`},
+		{`/ndjson/bank` + bank, ``, ``},
+		{`/csv` + bank, `bank`, ``},
+	} {
+		t.Run(tc.path+tc.params, func(t *testing.T) {
+			s := open(`workload://` + tc.path + tc.params)
+			r, err := s.ReadFile(ctx, tc.basename)
+			require.NoError(t, err)
+			data := readAll(r)
+
+			offsets := []int{0, 1, len(data) - 1, len(data)}
+			for i := 0; i < 10; i++ {
+				offsets = append(offsets, rng.Intn(len(data)+1))
+			}
+			for _, n := range offsets {
+				r, err := s.ReadFile(ctx, tc.basename)
+				require.NoError(t, err)
+				read := make([]byte, n)
+				_, err = io.ReadFull(r, read)
+				require.NoError(t, err)
+				token, err := r.(cloudimpl.WorkloadCheckpointer).Checkpoint()
+				require.NoError(t, err)
+				// Taking a checkpoint does not disturb the reader.
+				require.Equal(t, data, string(read)+readAll(r))
+
+				// The data read from the checkpoint starts at a row boundary no
+				// later than where the checkpoint was taken, and is identical to
+				// the rest of the data from there.
+				resumed, err := cloudimpl.ReadFileFromCheckpoint(ctx, s, token)
+				require.NoError(t, err)
+				rest := readAll(resumed)
+				boundary := len(data) - len(rest)
+				require.LessOrEqual(t, boundary, n)
+				require.Equal(t, data[boundary:], rest, "checkpoint at %d", n)
+				if boundary > 0 {
+					require.Equal(t, byte('\n'), data[boundary-1])
+				}
+				// The token can be used again, by other storage of the same
+				// configuration.
+				resumed, err = cloudimpl.ReadFileFromCheckpoint(ctx, open(`workload://`+tc.path+tc.params), token)
+				require.NoError(t, err)
+				require.Equal(t, rest, readAll(resumed))
+			}
+		})
+	}
+
+	s := open(`workload:///csv/bank` + bank)
+	r, err := s.ReadFile(ctx, ``)
+	require.NoError(t, err)
+	defer r.Close()
+	token, err := r.(cloudimpl.WorkloadCheckpointer).Checkpoint()
+	require.NoError(t, err)
+
+	for uri, expected := range map[string]string{
+		`workload:///csv/bank/bank?version=1.0.0&rows=51&batch-size=4&payload-bytes=10`: `checkpoint token was taken from a different workload configuration`,
+		`workload:///csv/bank` + bank + `&row-start=1`:                                  `checkpoint token was taken from a different workload configuration`,
+		`workload:///csv/bank` + bank + `&header=true`:                                  `checkpoint token was taken from a different workload configuration`,
+	} {
+		_, err := cloudimpl.ReadFileFromCheckpoint(ctx, open(uri), token)
+		require.EqualError(t, err, expected, uri)
+	}
+	for _, bad := range []string{``, `garbage!`, `e30`} {
+		_, err := cloudimpl.ReadFileFromCheckpoint(ctx, s, bad)
+		require.Error(t, err, bad)
+	}
+	_, err = cloudimpl.ReadFileFromCheckpoint(ctx, s, `garbage!`)
+	require.True(t, testutils.IsError(err, `invalid checkpoint token`), "%v", err)
+
+	compressed := open(`workload:///csv/bank` + bank + `&compress=gzip`)
+	r, err = compressed.ReadFile(ctx, ``)
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = r.(cloudimpl.WorkloadCheckpointer).Checkpoint()
+	require.True(t, errors.Is(err, cloudimpl.ErrUnsupported), "%v", err)
+
+	_, err = cloudimpl.ReadFileFromCheckpoint(ctx, cloudimpl.NewMemoryStorage(), token)
+	require.True(t, errors.Is(err, cloudimpl.ErrUnsupported), "%v", err)
+}
+
+func TestWorkloadStorageMaxBytes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	read := func(uri string) string {
+		s, err := cloudimpl.ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{}, testSettings,
+			blobs.TestEmptyBlobClientFactory, user, nil, nil)
+		require.NoError(t, err)
+		r, err := s.ReadFile(ctx, ``)
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		size, err := s.Size(ctx, ``)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), size)
+		return string(data)
+	}
+
+	for _, format := range []string{`csv`, `tsv`, `ndjson`} {
+		params := []string{``, `&parallelism=2`, `&row-start=3`}
+		if format != `ndjson` {
+			params = append(params, `&header=true`)
+		}
+		for _, params := range params {
+			uri := `workload:///` + format + `/bank/bank?version=1.0.0&rows=50&batch-size=4` + params
+			full := read(uri)
+			for _, maxBytes := range []int{1, 50, 123, 1000, 1001, len(full) - 1, len(full), 1 << 20} {
+				t.Run(fmt.Sprintf(`%s%s/%d`, format, params, maxBytes), func(t *testing.T) {
+					capped := read(fmt.Sprintf(`%s&max-bytes=%d`, uri, maxBytes))
+					require.LessOrEqual(t, len(capped), maxBytes)
+					require.True(t, strings.HasPrefix(full, capped))
+					if len(capped) > 0 {
+						require.True(t, strings.HasSuffix(capped, "\n"))
+					}
+					// The next row would not have fit within the cap.
+					if rest := full[len(capped):]; len(rest) > 0 {
+						require.Greater(t, len(capped)+strings.Index(rest, "\n")+1, maxBytes)
+					}
+				})
+			}
+		}
+	}
+
+	for params, expected := range map[string]string{
+		`max-bytes=0`:                `max-bytes must be positive: 0`,
+		`max-bytes=-1`:               `max-bytes must be positive: -1`,
+		`max-bytes=10&row-end=2`:     `max-bytes cannot be combined with row-end or row`,
+		`max-bytes=10&row=2`:         `max-bytes cannot be combined with row-end or row`,
+		`max-bytes=10&row-start=2`:   ``,
+		`max-bytes=10&batch-end=2`:   `max-bytes cannot be combined with batch-end`,
+		`max-bytes=10&batch-start=2`: ``,
+	} {
+		_, err := cloudimpl.ExternalStorageFromURI(ctx, `workload:///csv/bank/bank?version=1.0.0&`+params,
+			base.ExternalIODirConfig{}, testSettings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
+		if expected == `` {
+			require.NoError(t, err)
+		} else {
+			require.EqualError(t, err, expected)
+		}
+	}
+}
+
+func TestWorkloadStorageHeaderOnly(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	open := func(uri string) (cloud.ExternalStorage, error) {
+		return cloudimpl.ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{}, testSettings,
+			blobs.TestEmptyBlobClientFactory, user, nil, nil)
+	}
+	read := func(s cloud.ExternalStorage, offset int64) string {
+		r, _, err := s.ReadFileAt(ctx, ``, offset)
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	for params, expected := range map[string]string{
+		`/csv/bank/bank?version=1.0.0&header-only=true`:               "id,balance,payload\n",
+		`/tsv/bank/bank?version=1.0.0&header-only=true`:               "id\tbalance\tpayload\n",
+		`/csv/bank/bank?version=1.0.0&header-only=true&delimiter=%7C`: "id|balance|payload\n",
+		`/csv/bank/bank?version=1.0.0&header-only=true&parallelism=2`: "id,balance,payload\n",
+	} {
+		t.Run(params, func(t *testing.T) {
+			s, err := open(`workload://` + params)
+			require.NoError(t, err)
+			defer s.Close()
+			require.Equal(t, expected, read(s, 0))
+			size, err := s.Size(ctx, ``)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(expected)), size)
+			require.Equal(t, expected[3:], read(s, 3))
+		})
+	}
+
+	// Without header-only, the data only has the rows of the table.
+	s, err := open(`workload:///csv/bank/bank?version=1.0.0&header-only=false&rows=1`)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(read(s, 0), `0,0,initial-`))
+
+	// The header is compressed like any other data.
+	s, err = open(`workload:///csv/bank/bank?version=1.0.0&header-only=true&compress=gzip`)
+	require.NoError(t, err)
+	gz, err := gzip.NewReader(strings.NewReader(read(s, 0)))
+	require.NoError(t, err)
+	header, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, "id,balance,payload\n", string(header))
+
+	// The parameter is preserved by the URIs of the tables.
+	conf := s.Conf()
+	require.Equal(t, `workload:///csv/bank/bank?compress=gzip&header-only=true&version=1.0.0`,
+		cloudimpl.WorkloadTableURI(conf.WorkloadConfig, `bank`))
+
+	for params, expected := range map[string]string{
+		`/ndjson/bank/bank?version=1.0.0&header-only=true`:            `header-only is not supported for format ndjson`,
+		`/csv/bank/bank?version=1.0.0&header-only=true&row-end=2`:     `header-only cannot be combined with a range of rows or max-bytes`,
+		`/csv/bank/bank?version=1.0.0&header-only=true&batch-start=2`: `header-only cannot be combined with a range of rows or max-bytes`,
+		`/csv/bank/bank?version=1.0.0&header-only=true&max-bytes=10`:  `header-only cannot be combined with a range of rows or max-bytes`,
+		`/csv/bank/bank?version=1.0.0&header-only=yes`:                `parsing header-only: strconv.ParseBool: parsing "yes": invalid syntax`,
+	} {
+		_, err := open(`workload://` + params)
+		require.EqualError(t, err, expected, params)
+	}
+}
+
+func TestWorkloadStorageHeader(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	open := func(uri string) (cloud.ExternalStorage, error) {
+		return cloudimpl.ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{}, testSettings,
+			blobs.TestEmptyBlobClientFactory, user, nil, nil)
+	}
+	read := func(s cloud.ExternalStorage, offset int64) string {
+		r, _, err := s.ReadFileAt(ctx, ``, offset)
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	for format, header := range map[string]string{
+		`csv`: "id,balance,payload\n",
+		`tsv`: "id\tbalance\tpayload\n",
+	} {
+		for _, params := range []string{``, `&row-start=3`, `&parallelism=2`} {
+			uri := `workload:///` + format + `/bank/bank?version=1.0.0&rows=20&batch-size=4` + params
+			t.Run(format+params, func(t *testing.T) {
+				s, err := open(uri)
+				require.NoError(t, err)
+				defer s.Close()
+				rows := read(s, 0)
+				require.False(t, strings.HasPrefix(rows, header))
+
+				// The default is no header, like header=false.
+				s, err = open(uri + `&header=false`)
+				require.NoError(t, err)
+				defer s.Close()
+				require.Equal(t, rows, read(s, 0))
+
+				s, err = open(uri + `&header=true`)
+				require.NoError(t, err)
+				defer s.Close()
+				full := read(s, 0)
+				require.Equal(t, header+rows, full)
+				size, err := s.Size(ctx, ``)
+				require.NoError(t, err)
+				require.Equal(t, int64(len(full)), size)
+				for _, offset := range []int{1, len(header) - 1, len(header), len(header) + 1, len(full) - 1} {
+					require.Equal(t, full[offset:], read(s, int64(offset)), "offset %d", offset)
+				}
+
+				// The header counts towards max-bytes.
+				s, err = open(fmt.Sprintf(`%s&header=true&max-bytes=%d`, uri, len(header)+1))
+				require.NoError(t, err)
+				defer s.Close()
+				require.Equal(t, header, read(s, 0))
+			})
+		}
+	}
+
+	// The parameter is preserved by the URIs of the tables.
+	s, err := open(`workload:///csv/bank/bank?version=1.0.0&header=true`)
+	require.NoError(t, err)
+	conf := s.Conf()
+	require.Equal(t, `workload:///csv/bank/bank?header=true&version=1.0.0`,
+		cloudimpl.WorkloadTableURI(conf.WorkloadConfig, `bank`))
+
+	for params, expected := range map[string]string{
+		`/ndjson/bank/bank?version=1.0.0&header=true`:               `header is not supported for format ndjson`,
+		`/csv/bank/bank?version=1.0.0&header=true&header-only=true`: `header cannot be combined with header-only`,
+		`/csv/bank/bank?version=1.0.0&header=1`:                     ``,
+		`/csv/bank/bank?version=1.0.0&header=yes`:                   `parsing header: strconv.ParseBool: parsing "yes": invalid syntax`,
+	} {
+		_, err := open(`workload://` + params)
+		if expected == `` {
+			require.NoError(t, err)
+		} else {
+			require.EqualError(t, err, expected, params)
+		}
+	}
+}
+
+// tableGenerator is an unversioned workload generator of a single table, for
+// tests of how the values of its columns are written.
+type tableGenerator struct {
+	meta  workload.Meta
+	table workload.Table
+}
+
+func (g tableGenerator) Meta() workload.Meta { return g.meta }
+
+func (g tableGenerator) Tables() []workload.Table { return []workload.Table{g.table} }
+
+func registerTableGenerator(name string, table workload.Table) {
+	meta := workload.Meta{Name: name, Description: `a generator of a single table for tests`}
+	meta.New = func() workload.Generator { return tableGenerator{meta: meta, table: table} }
+	workload.Register(meta)
+}
+
+func init() {
+	registerTableGenerator(`nullable-test`, workload.Table{
+		Name:   `t`,
+		Schema: `(n INT PRIMARY KEY, s STRING, f FLOAT)`,
+		InitialRows: workload.TypedTuples(4, []*types.T{types.Int, types.String, types.Float},
+			func(i int) []interface{} {
+				row := []interface{}{i, nil, nil}
+				if i%2 == 0 {
+					row[1] = fmt.Sprintf(`s%d`, i)
+				}
+				if i < 2 {
+					row[2] = float64(i) / 2
+				}
+				return row
+			}),
+	})
+	quotingValues := []string{`plain`, `a,b`, `say "hi"`, ``}
+	registerTableGenerator(`quoting-test`, workload.Table{
+		Name:   `t`,
+		Schema: `(n INT PRIMARY KEY, s STRING)`,
+		InitialRows: workload.Tuples(len(quotingValues), func(i int) []interface{} {
+			return []interface{}{i, quotingValues[i]}
+		}),
+	})
+	registerTableGenerator(`fixed-test`, workload.Table{
+		Name:   `t`,
+		Schema: `(n INT2 PRIMARY KEY, s VARCHAR(6), b BOOL)`,
+		InitialRows: workload.Tuples(3, func(i int) []interface{} {
+			return []interface{}{i - 1, []string{`a`, `héllo`, `sixsix`}[i], i%2 == 0}
+		}),
+	})
+}
+
+func TestWorkloadStorageNullAs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	open := func(uri string) (cloud.ExternalStorage, error) {
+		return cloudimpl.ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{}, testSettings,
+			blobs.TestEmptyBlobClientFactory, user, nil, nil)
+	}
+	read := func(s cloud.ExternalStorage) string {
+		r, err := s.ReadFile(ctx, ``)
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		size, err := s.Size(ctx, ``)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), size)
+		return string(data)
+	}
+
+	for _, tc := range []struct {
+		params   string
+		expected string
+	}{
+		{``, "0,s0,0\n1,NULL,0.5\n2,s2,NULL\n3,NULL,NULL\n"},
+		{`?null-as=%5CN`, "0,s0,0\n1,\\N,0.5\n2,s2,\\N\n3,\\N,\\N\n"},
+		{`?null-as=%5CN&parallelism=2`, "0,s0,0\n1,\\N,0.5\n2,s2,\\N\n3,\\N,\\N\n"},
+		{`?null-as=nil&delimiter=%7C`, "0|s0|0\n1|nil|0.5\n2|s2|nil\n3|nil|nil\n"},
+		{`?null-as=a%2Cb&delimiter=%7C`, "0|s0|0\n1|a,b|0.5\n2|s2|a,b\n3|a,b|a,b\n"},
+		// The field is quoted like any other that needs it.
+		{`?null-as=%20`, "0,s0,0\n1,\" \",0.5\n2,s2,\" \"\n3,\" \",\" \"\n"},
+	} {
+		t.Run(tc.params, func(t *testing.T) {
+			s, err := open(`workload:///csv/nullable-test/t` + tc.params)
+			require.NoError(t, err)
+			defer s.Close()
+			require.Equal(t, tc.expected, read(s))
+		})
+	}
+
+	s, err := open(`workload:///tsv/nullable-test/t?null-as=%5CN&header=true`)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, "n\ts\tf\n0\ts0\t0\n1\t\\N\t0.5\n2\ts2\t\\N\n3\t\\N\t\\N\n", read(s))
+
+	// The parameter is preserved by the URIs of the tables.
+	conf := s.Conf()
+	require.Equal(t, `workload:///tsv/nullable-test/t?header=true&null-as=%5CN&version=`,
+		cloudimpl.WorkloadTableURI(conf.WorkloadConfig, `t`))
+
+	for params, expected := range map[string]string{
+		`/csv/nullable-test/t?null-as=`:                    `null-as must not be empty`,
+		`/csv/nullable-test/t?null-as=a%2Cb`:               `null-as must not contain the delimiter or a newline: "a,b"`,
+		`/tsv/nullable-test/t?null-as=a%09b`:               `null-as must not contain the delimiter or a newline: "a\tb"`,
+		`/csv/nullable-test/t?null-as=a%7Cb&delimiter=%7C`: `null-as must not contain the delimiter or a newline: "a|b"`,
+		`/csv/nullable-test/t?null-as=a%0Ab`:               `null-as must not contain the delimiter or a newline: "a\nb"`,
+		`/csv/nullable-test/t?null-as=a%0Db`:               `null-as must not contain the delimiter or a newline: "a\rb"`,
+		`/ndjson/nullable-test/t?null-as=%5CN`:             `null-as is not supported for format ndjson`,
+	} {
+		_, err := open(`workload://` + params)
+		require.EqualError(t, err, expected, params)
+	}
+}
+
+func TestWorkloadStorageQuote(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	open := func(uri string) (cloud.ExternalStorage, error) {
+		return cloudimpl.ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{}, testSettings,
+			blobs.TestEmptyBlobClientFactory, user, nil, nil)
+	}
+	read := func(uri string) (string, error) {
+		s, err := open(uri)
+		require.NoError(t, err)
+		defer s.Close()
+		r, err := s.ReadFile(ctx, ``)
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		return string(data), err
+	}
+	values := [][]string{{`0`, `plain`}, {`1`, `a,b`}, {`2`, `say "hi"`}, {`3`, ``}}
+
+	for _, tc := range []struct {
+		params   string
+		expected string
+	}{
+		{``, "0,plain\n1,\"a,b\"\n2,\"say \"\"hi\"\"\"\n3,\n"},
+		{`?quote=minimal`, "0,plain\n1,\"a,b\"\n2,\"say \"\"hi\"\"\"\n3,\n"},
+		{`?quote=MINIMAL&parallelism=2`, "0,plain\n1,\"a,b\"\n2,\"say \"\"hi\"\"\"\n3,\n"},
+		{`?quote=always`, "\"0\",\"plain\"\n\"1\",\"a,b\"\n\"2\",\"say \"\"hi\"\"\"\n\"3\",\"\"\n"},
+		{`?quote=always&header=true`,
+			"\"n\",\"s\"\n\"0\",\"plain\"\n\"1\",\"a,b\"\n\"2\",\"say \"\"hi\"\"\"\n\"3\",\"\"\n"},
+		// Only the fields that contain the delimiter need quotes.
+		{`?quote=minimal&delimiter=%7C`, "0|plain\n1|a,b\n2|\"say \"\"hi\"\"\"\n3|\n"},
+	} {
+		t.Run(tc.params, func(t *testing.T) {
+			data, err := read(`workload:///csv/quoting-test/t` + tc.params)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, data)
+
+			// The data round-trips through a strict parser.
+			r := csv.NewReader(strings.NewReader(data))
+			if strings.Contains(tc.params, `delimiter`) {
+				r.Comma = '|'
+			}
+			records, err := r.ReadAll()
+			require.NoError(t, err)
+			if strings.Contains(tc.params, `header`) {
+				require.Equal(t, []string{`n`, `s`}, records[0])
+				records = records[1:]
+			}
+			require.Equal(t, values, records)
+		})
+	}
+
+	// Rows whose fields all can be unquoted are generated without quotes.
+	data, err := read(`workload:///csv/quoting-test/t?quote=never&row-end=1&header=true`)
+	require.NoError(t, err)
+	require.Equal(t, "n,s\n0,plain\n", data)
+	data, err = read(`workload:///csv/quoting-test/t?quote=never&row-end=2&delimiter=%7C`)
+	require.NoError(t, err)
+	require.Equal(t, "0|plain\n1|a,b\n", data)
+	// Others fail to be generated rather than being generated as invalid CSV.
+	for _, params := range []string{`?quote=never`, `?quote=never&row-start=2`} {
+		_, err = read(`workload:///csv/quoting-test/t` + params)
+		require.True(t, errors.Is(err, csv.ErrQuoteRequired), "%s: %v", params, err)
+	}
+
+	// The parameter is preserved by the URIs of the tables.
+	s, err := open(`workload:///csv/quoting-test/t?quote=always`)
+	require.NoError(t, err)
+	defer s.Close()
+	conf := s.Conf()
+	require.Equal(t, `workload:///csv/quoting-test/t?quote=always&version=`,
+		cloudimpl.WorkloadTableURI(conf.WorkloadConfig, `t`))
+
+	for params, expected := range map[string]string{
+		`/csv/quoting-test/t?quote=sometimes`: `unsupported quote: sometimes`,
+		`/ndjson/quoting-test/t?quote=always`: `quote is not supported for format ndjson`,
+	} {
+		_, err := open(`workload://` + params)
+		require.EqualError(t, err, expected, params)
+	}
+}
+
+func TestWorkloadStorageFixed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	open := func(uri string) (cloud.ExternalStorage, error) {
+		return cloudimpl.ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{}, testSettings,
+			blobs.TestEmptyBlobClientFactory, user, nil, nil)
+	}
+	read := func(uri string) (string, error) {
+		s, err := open(uri)
+		require.NoError(t, err)
+		defer s.Close()
+		r, err := s.ReadFile(ctx, ``)
+		if err != nil {
+			return ``, err
+		}
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		return string(data), err
+	}
+
+	for _, tc := range []struct {
+		uri      string
+		expected string
+	}{
+		// The widths are derived from the types of the columns.
+		{`fixed-test/t`, "-1    a     true \n0     héllo false\n1     sixsixtrue \n"},
+		{`fixed-test/t?header=true&parallelism=2`,
+			"n     s     b    \n-1    a     true \n0     héllo false\n1     sixsixtrue \n"},
+		{`fixed-test/t?header-only=true`, "n     s     b    \n"},
+		{`quoting-test/t?widths=2,8`, "0 plain   \n1 a,b     \n2 say \"hi\"\n3         \n"},
+		{`quoting-test/t?widths=1,4&truncate=true`, "0plai\n1a,b \n2say \n3    \n"},
+		{`nullable-test/t?widths=1,2,3&null-as=-&truncate=true`,
+			"0s00  \n1- 0.5\n2s2-  \n3- -  \n"},
+	} {
+		t.Run(tc.uri, func(t *testing.T) {
+			data, err := read(`workload:///fixed/` + tc.uri)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, data)
+		})
+	}
+
+	// Fields wider than their columns fail to be generated unless they are
+	// truncated.
+	for _, uri := range []string{`quoting-test/t?widths=1,5`, `fixed-test/t?widths=2,5,5`} {
+		_, err := read(`workload:///fixed/` + uri)
+		require.True(t, errors.Is(err, workload.ErrFieldTooWide), "%s: %v", uri, err)
+	}
+	_, err := read(`workload:///fixed/quoting-test/t?widths=1,5`)
+	require.EqualError(t, err, `table t: value "say \"hi\"" of column s has 8 characters `+
+		`but its width is 5: field is wider than its column`)
+
+	// The parameters are preserved by the URIs of the tables.
+	s, err := open(`workload:///fixed/quoting-test/t?widths=2,8&truncate=true`)
+	require.NoError(t, err)
+	defer s.Close()
+	conf := s.Conf()
+	require.Equal(t, `workload:///fixed/quoting-test/t?truncate=true&version=&widths=2%2C8`,
+		cloudimpl.WorkloadTableURI(conf.WorkloadConfig, `t`))
+
+	for params, expected := range map[string]string{
+		`/fixed/quoting-test/t?widths=2`:       `1 widths were given but table t has 2 columns`,
+		`/fixed/quoting-test/t?widths=2,0`:     `widths must be positive: 0`,
+		`/fixed/quoting-test/t?widths=2,x`:     `parsing widths: .*invalid syntax`,
+		`/fixed/quoting-test/t?truncate=maybe`: `parsing truncate: .*invalid syntax`,
+		`/fixed/quoting-test/t?delimiter=%7C`:  `delimiter is not supported for format fixed`,
+		`/fixed/quoting-test/t?quote=always`:   `quote is not supported for format fixed`,
+		`/csv/quoting-test/t?widths=2,8`:       `widths is not supported for format csv`,
+		`/ndjson/quoting-test/t?truncate=true`: `truncate is not supported for format ndjson`,
+		`/fixed/nullable-test/t`:               `cannot derive the width of column s .* type STRING`,
+	} {
+		_, err := open(`workload://` + params)
+		require.Error(t, err, params)
+		require.Regexp(t, `^`+expected+`$`, err.Error(), params)
+	}
+}
+
+func TestWorkloadTableSchema(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	cols, err := cloudimpl.WorkloadTableSchema(`bank`, `bank`, `1.0.0`)
+	require.NoError(t, err)
+	require.Equal(t, []cloudimpl.ColumnSpec{
+		{Name: `id`, Type: types.Int},
+		{Name: `balance`, Type: types.Int},
+		{Name: `payload`, Type: types.String},
+	}, cols)
+
+	// Version ranges are accepted as they are in workload URIs.
+	cols, err = cloudimpl.WorkloadTableSchema(`bank`, `bank`, `1.x`)
+	require.NoError(t, err)
+	require.Len(t, cols, 3)
+
+	_, err = cloudimpl.WorkloadTableSchema(`bank`, `nope`, `1.0.0`)
+	require.EqualError(t, err, `unknown table nope for generator bank`)
+	require.Equal(t, `valid tables: bank`, errors.FlattenHints(err))
+	_, err = cloudimpl.WorkloadTableSchema(`bank`, `bank`, `2.0.0`)
+	require.EqualError(t, err, `expected bank version "2.0.0" but got "1.0.0"`)
+	_, err = cloudimpl.WorkloadTableSchema(`nope`, `bank`, `1.0.0`)
+	require.Error(t, err)
+}
+
+func TestEstimateWorkloadSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		generator, table, version string
+		rowStart, rowEnd          int64
+	}{
+		{`bank`, `bank`, `1.0.0`, 0, 0},
+		{`tpcc`, `item`, `2.2.0`, 0, 0},
+		{`tpcc`, `item`, `2.2.0`, 1000, 5000},
+		{`tpcc`, `district`, `2.2.0`, 0, 0},
+		{`tpcc`, `district`, `2.2.0`, 2, 3},
+	} {
+		name := fmt.Sprintf(`%s/%s/%d-%d`, tc.generator, tc.table, tc.rowStart, tc.rowEnd)
+		t.Run(name, func(t *testing.T) {
+			estimate, err := cloudimpl.EstimateWorkloadSize(
+				tc.generator, tc.table, tc.version, tc.rowStart, tc.rowEnd)
+			require.NoError(t, err)
+
+			uri := fmt.Sprintf(`workload:///csv/%s/%s?version=%s&row-start=%d`,
+				tc.generator, tc.table, tc.version, tc.rowStart)
+			if tc.rowEnd != 0 {
+				uri += fmt.Sprintf(`&row-end=%d`, tc.rowEnd)
+			}
+			s, err := cloudimpl.ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{}, testSettings,
+				blobs.TestEmptyBlobClientFactory, security.RootUserName(), nil, nil)
+			require.NoError(t, err)
+			size, err := s.Size(ctx, ``)
+			require.NoError(t, err)
+			require.InEpsilon(t, size, estimate, 0.05, "estimate %d of size %d", estimate, size)
+		})
+	}
+
+	estimate, err := cloudimpl.EstimateWorkloadSize(`tpcc`, `item`, `2.2.0`, 7, 7)
+	require.NoError(t, err)
+	require.Zero(t, estimate)
+	_, err = cloudimpl.EstimateWorkloadSize(`tpcc`, `item`, `2.2.0`, 5, 3)
+	require.EqualError(t, err, `rows [5, 3) are not within table item, which has 100000 rows`)
+	_, err = cloudimpl.EstimateWorkloadSize(`tpcc`, `district`, `2.2.0`, 0, 11)
+	require.EqualError(t, err, `rows [0, 11) are not within table district, which has 10 rows`)
+	_, err = cloudimpl.EstimateWorkloadSize(`bank`, `nope`, `1.0.0`, 0, 0)
+	require.EqualError(t, err, `unknown table nope for generator bank`)
+	_, err = cloudimpl.EstimateWorkloadSize(`bank`, `bank`, `2.0.0`, 0, 0)
+	require.EqualError(t, err, `expected bank version "2.0.0" but got "1.0.0"`)
+}
+
+func TestListWorkloadGenerators(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	metas := make(map[string]cloudimpl.WorkloadMeta)
+	for _, meta := range cloudimpl.ListWorkloadGenerators() {
+		metas[meta.Name] = meta
+	}
+
+	bankMeta, ok := metas[`bank`]
+	require.True(t, ok)
+	require.Equal(t, `1.0.0`, bankMeta.Version)
+	require.NotEmpty(t, bankMeta.Description)
+	// bank has no statistics to take the row count from.
+	require.Equal(t, []cloudimpl.WorkloadTableMeta{{Name: `bank`, RowCount: -1}}, bankMeta.Tables)
+	var rowsFlag *cloudimpl.FlagSpec
+	for i := range bankMeta.Flags {
+		if bankMeta.Flags[i].Name == `rows` {
+			rowsFlag = &bankMeta.Flags[i]
+		}
+	}
+	require.NotNil(t, rowsFlag)
+	require.Equal(t, `int`, rowsFlag.Type)
+	require.Equal(t, `1000`, rowsFlag.Default)
+	require.False(t, rowsFlag.RuntimeOnly)
+
+	tpccMeta, ok := metas[`tpcc`]
+	require.True(t, ok)
+	rowCounts := make(map[string]int64)
+	for _, table := range tpccMeta.Tables {
+		rowCounts[table.Name] = table.RowCount
+	}
+	require.Equal(t, int64(1), rowCounts[`warehouse`])
+	require.Equal(t, int64(100000), rowCounts[`item`])
+}
+
+func TestWorkloadGeneratorFlags(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	flags, err := cloudimpl.WorkloadGeneratorFlags(`bank`, `1.0.0`)
+	require.NoError(t, err)
+	byName := make(map[string]cloudimpl.FlagSpec)
+	for i, flag := range flags {
+		byName[flag.Name] = flag
+		if i > 0 {
+			require.Less(t, flags[i-1].Name, flag.Name)
+		}
+	}
+	for _, name := range []string{`batch-size`, `payload-bytes`, `ranges`, `rows`, `seed`} {
+		require.Contains(t, byName, name)
+	}
+	require.Equal(t, cloudimpl.FlagSpec{
+		Name:    `rows`,
+		Type:    `int`,
+		Default: `1000`,
+		Usage:   `Initial number of accounts in bank table.`,
+	}, byName[`rows`])
+	require.Equal(t, `uint64`, byName[`seed`].Type)
+	require.Equal(t, `1`, byName[`seed`].Default)
+	require.True(t, byName[`batch-size`].RuntimeOnly)
+
+	// Every flag is accepted as a parameter of a workload URI.
+	user := security.RootUserName()
+	for _, flag := range flags {
+		uri := fmt.Sprintf(`workload:///csv/bank/bank?version=1.0.0&%s=%s`, flag.Name, flag.Default)
+		_, err := cloudimpl.ExternalStorageConfFromURI(uri, user)
+		require.NoError(t, err, flag.Name)
+	}
+
+	// Generators without flags have none, and the generator is resolved as it
+	// is for a workload URI.
+	flags, err = cloudimpl.WorkloadGeneratorFlags(`unversioned-test`, ``)
+	require.NoError(t, err)
+	require.Empty(t, flags)
+	_, err = cloudimpl.WorkloadGeneratorFlags(`bank`, `2.0.0`)
+	require.EqualError(t, err, `expected bank version "2.0.0" but got "1.0.0"`)
+	_, err = cloudimpl.WorkloadGeneratorFlags(`nope`, ``)
+	require.Error(t, err)
+}
+
+func TestWorkloadStorageURIEncoding(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	settings := cluster.MakeTestingClusterSettings()
+	user := security.RootUserName()
+
+	// The parts of the path are decoded, and an encoded slash is part of a name.
+	conf, err := cloudimpl.ExternalStorageConfFromURI(
+		`workload:///csv/b%61nk/my%2Ftable%20%231?version=1.0.0`, user)
+	require.NoError(t, err)
+	require.Equal(t, `csv`, conf.WorkloadConfig.Format)
+	require.Equal(t, `bank`, conf.WorkloadConfig.Generator)
+	require.Equal(t, `my/table #1`, conf.WorkloadConfig.Table)
+
+	// The URI of a table encodes its name again.
+	uri := cloudimpl.WorkloadTableURI(conf.WorkloadConfig, conf.WorkloadConfig.Table)
+	require.Equal(t, `workload:///csv/bank/my%2Ftable%20%231?version=1.0.0`, uri)
+	reparsed, err := cloudimpl.ExternalStorageConfFromURI(uri, user)
+	require.NoError(t, err)
+	require.Equal(t, conf, reparsed)
+
+	s, err := cloudimpl.ExternalStorageFromURI(ctx, `workload:///csv/b%61nk/%62ank?version=1.0.0&rows=2`,
+		base.ExternalIODirConfig{}, settings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	size, err := s.Size(ctx, ``)
+	require.NoError(t, err)
+	require.NotZero(t, size)
+
+	_, err = cloudimpl.ExternalStorageFromURI(ctx, `workload:///csv/bank/bank?version=1.0.0#frag`,
+		base.ExternalIODirConfig{}, settings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
+	require.EqualError(t, err, `workload URI must not have a fragment: #frag`)
+	_, err = cloudimpl.ExternalStorageConfFromURI(`workload:///csv/bank/bank%23frag?version=1.0.0`, user)
+	require.NoError(t, err)
+}
+
+// unversionedGenerator is a generator of a table of the numbers 0 to 2, whose
+// version is that of its meta.
+type unversionedGenerator struct {
+	meta workload.Meta
+}
+
+func (g unversionedGenerator) Meta() workload.Meta { return g.meta }
+
+func (g unversionedGenerator) Tables() []workload.Table {
+	return []workload.Table{{
+		Name:   `t`,
+		Schema: `(n INT PRIMARY KEY)`,
+		InitialRows: workload.Tuples(3, func(i int) []interface{} {
+			return []interface{}{i}
+		}),
+	}}
+}
+
+func init() {
+	for name, version := range map[string]string{
+		`unversioned-test`: ``,
+		`sentinel-test`:    workload.Unversioned,
+	} {
+		meta := workload.Meta{Name: name, Description: `an unversioned generator for tests`, Version: version}
+		meta.New = func() workload.Generator { return unversionedGenerator{meta: meta} }
+		workload.Register(meta)
+	}
+}
+
+func TestWorkloadStorageUnversioned(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	settings := cluster.MakeTestingClusterSettings()
+	user := security.RootUserName()
+
+	for _, tc := range []struct {
+		generator, version string
+	}{
+		{`unversioned-test`, ``},
+		{`sentinel-test`, workload.Unversioned},
+	} {
+		t.Run(tc.generator, func(t *testing.T) {
+			// The version of an unversioned generator may be omitted, in which case
+			// it defaults to that of the generator.
+			uri := `workload:///csv/` + tc.generator + `/t`
+			conf, err := cloudimpl.ExternalStorageConfFromURI(uri, user)
+			require.NoError(t, err)
+			require.Equal(t, tc.version, conf.WorkloadConfig.Version)
+			reparsed, err := cloudimpl.ExternalStorageConfFromURI(
+				cloudimpl.WorkloadTableURI(conf.WorkloadConfig, `t`), user)
+			require.NoError(t, err)
+			require.Equal(t, conf, reparsed)
+
+			s, err := cloudimpl.ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{}, settings,
+				blobs.TestEmptyBlobClientFactory, user, nil, nil)
+			require.NoError(t, err)
+			defer s.Close()
+			r, err := s.ReadFile(ctx, ``)
+			require.NoError(t, err)
+			defer r.Close()
+			data, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, "0\n1\n2\n", string(data))
+
+			// A version that is given must still match.
+			_, err = cloudimpl.ExternalStorageFromURI(ctx, uri+`?version=1.0.0`, base.ExternalIODirConfig{},
+				settings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
+			require.EqualError(t, err,
+				fmt.Sprintf(`expected %s version "1.0.0" but got "%s"`, tc.generator, tc.version))
+		})
+	}
+
+	// The version of a versioned generator is still required.
+	_, err := cloudimpl.ExternalStorageConfFromURI(`workload:///csv/bank/bank`, user)
+	require.EqualError(t, err, `parameter version is required`)
+}
+
+func TestWorkloadStorageValidate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	settings := cluster.MakeTestingClusterSettings()
+	user := security.RootUserName()
+
+	for _, tc := range []struct {
+		uri string
+		err string
+	}{
+		{uri: `workload:///csv/bank/bank?version=1.0.0&rows=10&batch-size=1&row-end=10`},
+		{uri: `workload:///csv/bank?version=1.0.0&rows=10&ranges=2`},
+		{
+			uri: `workload:///csv/bank/bank?version=1.0.0&rows=2&ranges=10`,
+			err: `must be greater than or equal to value of 'ranges'`,
+		},
+		{
+			uri: `workload:///csv/bank/bank?version=1.0.0&rows=10&batch-size=1&row-end=11`,
+			err: `the range ends at batch 11, past the end of table bank, which has 10 batches`,
+		},
+	} {
+		t.Run(tc.uri, func(t *testing.T) {
+			s, err := cloudimpl.ExternalStorageFromURI(ctx, tc.uri, base.ExternalIODirConfig{},
+				settings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
+			require.NoError(t, err)
+			defer s.Close()
+			err = cloudimpl.Validate(ctx, s)
+			if tc.err == `` {
+				require.NoError(t, err)
+			} else {
+				require.True(t, testutils.IsError(err, tc.err), "%v", err)
+			}
+		})
+	}
+}
+
+func TestWorkloadStorageTelemetry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	s, err := cloudimpl.ExternalStorageFromURI(ctx,
+		`workload:///csv/bank/bank?version=1.0.0&rows=40&batch-size=7&payload-bytes=10`,
+		base.ExternalIODirConfig{}, testSettings, blobs.TestEmptyBlobClientFactory,
+		security.RootUserName(), nil, nil)
+	require.NoError(t, err)
+
+	// Sizing the data generates it but does not count as reading it.
+	size, err := s.Size(ctx, ``)
+	require.NoError(t, err)
+	bytesFeature := fmt.Sprintf(`external-io.workload.read-bytes.%d`, telemetry.Bucket10(size))
+	rowsFeature := fmt.Sprintf(`external-io.workload.read-rows.%d`, telemetry.Bucket10(40))
+	before := telemetry.GetRawFeatureCounts()
+
+	r, err := s.ReadFile(ctx, ``)
+	require.NoError(t, err)
+	_, err = io.Copy(ioutil.Discard, r)
+	require.NoError(t, err)
+	require.Equal(t, before, telemetry.GetRawFeatureCounts())
+	require.NoError(t, r.Close())
+	// Closing again does not count the read twice.
+	require.NoError(t, r.Close())
+
+	after := telemetry.GetRawFeatureCounts()
+	require.Equal(t, before[bytesFeature]+1, after[bytesFeature])
+	require.Equal(t, before[rowsFeature]+1, after[rowsFeature])
+}
+
+func TestMakeExternalStorageFromContext(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	args := cloudimpl.ExternalStorageContext{
+		Settings:          testSettings,
+		BlobClientFactory: blobs.TestBlobServiceClient(dir),
+	}
+
+	for _, tc := range []struct {
+		provider roachpb.ExternalStorageProvider
+		dest     roachpb.ExternalStorage
+		counter  string
+		err      string
+	}{
+		{
+			provider: roachpb.ExternalStorageProvider_Azure,
+			counter:  "external-io.azure",
+			err:      "azure upload requested but info missing",
+		},
+		{
+			provider: roachpb.ExternalStorageProvider_GoogleCloud,
+			counter:  "external-io.google_cloud",
+			err:      "google cloud storage upload requested but info missing",
+		},
+		{
+			provider: roachpb.ExternalStorageProvider_Http,
+			counter:  "external-io.http",
+			err:      "HTTP storage requested but prefix path not provided",
+		},
+		{
+			provider: roachpb.ExternalStorageProvider_Http,
+			dest:     roachpb.ExternalStorage{HttpPath: roachpb.ExternalStorage_Http{BaseUri: "http://localhost"}},
+			counter:  "external-io.http",
+		},
+		{
+			provider: roachpb.ExternalStorageProvider_LocalFile,
+			counter:  "external-io.nodelocal",
+			err:      "local storage requested but path not provided",
+		},
+		{
+			provider: roachpb.ExternalStorageProvider_LocalFile,
+			dest:     roachpb.ExternalStorage{LocalFile: roachpb.ExternalStorage_LocalFilePath{Path: "foo"}},
+			counter:  "external-io.nodelocal",
+		},
+		{
+			provider: roachpb.ExternalStorageProvider_NullSink,
+			counter:  "external-io.nullsink",
+		},
+		{
+			provider: roachpb.ExternalStorageProvider_S3,
+			counter:  "external-io.s3",
+			err:      "s3 upload requested but info missing",
+		},
+		{
+			provider: roachpb.ExternalStorageProvider_FileTable,
+			counter:  "external-io.filetable",
+			err:      "FileTable storage requested but username or qualified table name not provided",
+		},
+		{
+			provider: roachpb.ExternalStorageProvider_Workload,
+			counter:  "external-io.workload",
+			err:      "workload upload requested but info missing",
+		},
+		{
+			provider: roachpb.ExternalStorageProvider_Workload,
+			dest: roachpb.ExternalStorage{WorkloadConfig: &roachpb.ExternalStorage_Workload{
+				Generator: "bank", Version: "1.0.0", Table: "bank", Format: "csv",
+				BatchBegin: 0, BatchEnd: 1, Flags: []string{"--rows=1"},
+			}},
+			counter: "external-io.workload",
+		},
+		{
+			provider: roachpb.ExternalStorageProvider_SFTP,
+			counter:  "external-io.sftp",
+			err:      "sftp storage requested but info missing",
+		},
+		{
+			provider: roachpb.ExternalStorageProvider_WebHDFS,
+			counter:  "external-io.webhdfs",
+			err:      "webhdfs storage requested but info missing",
+		},
+		{
+			provider: roachpb.ExternalStorageProvider_Custom,
+			counter:  "external-io.custom",
+			err:      "custom storage requested but info missing",
+		},
+		{
+			provider: roachpb.ExternalStorageProvider_Unknown,
+			err:      "unsupported external destination type: Unknown",
+		},
+	} {
+		name := tc.provider.String()
+		if tc.err != "" {
+			name += "/error"
+		}
+		t.Run(name, func(t *testing.T) {
+			dest := tc.dest
+			dest.Provider = tc.provider
+			before := telemetry.GetRawFeatureCounts()
+			s, err := cloudimpl.MakeExternalStorageFromContext(ctx, dest, args)
+			if tc.err != "" {
+				require.True(t, testutils.IsError(err, tc.err), "%v", err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.provider, s.Conf().Provider)
+				require.NoError(t, s.Close())
+			}
+			if tc.counter != "" {
+				require.Equal(t, before[tc.counter]+1, telemetry.GetRawFeatureCounts()[tc.counter])
+			}
+		})
+	}
+}
+
+func TestExternalIODirConfigRestrictions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	outbound := base.ExternalIODirConfig{DisableOutbound: true}
+	noHTTP := base.ExternalIODirConfig{DisableHTTP: true}
+
+	for _, tc := range []struct {
+		uri        string
+		disallowed []base.ExternalIODirConfig
+		allowed    []base.ExternalIODirConfig
+	}{
+		{uri: `nodelocal://1/foo`, disallowed: []base.ExternalIODirConfig{outbound},
+			allowed: []base.ExternalIODirConfig{noHTTP}},
+		{uri: `http://localhost/foo`, disallowed: []base.ExternalIODirConfig{outbound, noHTTP}},
+		{uri: `s3://bucket/foo?AUTH=implicit`, disallowed: []base.ExternalIODirConfig{outbound},
+			allowed: []base.ExternalIODirConfig{noHTTP}},
+		{uri: `s3://bucket/foo?AUTH=implicit&AWS_ENDPOINT=http://localhost`,
+			disallowed: []base.ExternalIODirConfig{outbound, noHTTP}},
+		{uri: `gs://bucket/foo?AUTH=implicit`, disallowed: []base.ExternalIODirConfig{outbound},
+			allowed: []base.ExternalIODirConfig{noHTTP}},
+		{uri: `azure://container/foo?AZURE_ACCOUNT_NAME=a&AZURE_ACCOUNT_KEY=Yg==`,
+			disallowed: []base.ExternalIODirConfig{outbound}, allowed: []base.ExternalIODirConfig{noHTTP}},
+		{uri: `workload:///csv/bank/bank?version=1.0.0`,
+			disallowed: []base.ExternalIODirConfig{outbound}, allowed: []base.ExternalIODirConfig{noHTTP}},
+		{uri: `null:///foo`, disallowed: []base.ExternalIODirConfig{outbound},
+			allowed: []base.ExternalIODirConfig{noHTTP}},
+		{uri: `webhdfs://user@namenode/foo`, disallowed: []base.ExternalIODirConfig{outbound, noHTTP}},
+		// The path fails validation before the storage needs a cluster to talk to.
+		{uri: `userfile:///foo/./bar`, allowed: []base.ExternalIODirConfig{outbound, noHTTP}},
+	} {
+		t.Run(tc.uri, func(t *testing.T) {
+			conf, err := cloudimpl.ExternalStorageConfFromURI(tc.uri, user)
+			require.NoError(t, err)
+			for _, ioConf := range tc.disallowed {
+				s, err := cloudimpl.MakeExternalStorage(ctx, conf, ioConf, testSettings,
+					blobs.TestEmptyBlobClientFactory, nil, nil)
+				require.Nil(t, s)
+				require.True(t, errors.Is(err, cloudimpl.ErrExternalIODisabled), "%+v: %v", ioConf, err)
+			}
+			// Allowed storage may still fail to be created in this test, e.g. due
+			// to missing credentials, but not because of the configuration.
+			for _, ioConf := range tc.allowed {
+				_, err := cloudimpl.MakeExternalStorage(ctx, conf, ioConf, testSettings,
+					blobs.TestEmptyBlobClientFactory, nil, nil)
+				require.False(t, errors.Is(err, cloudimpl.ErrExternalIODisabled), "%+v: %v", ioConf, err)
+			}
+		})
+	}
+
+	// Constructors that can be called directly enforce the restrictions too.
+	_, err := cloudimpl.MakeS3Storage(ctx, cloudimpl.ExternalStorageContext{IOConf: noHTTP},
+		roachpb.ExternalStorage{S3Config: &roachpb.ExternalStorage_S3{Endpoint: `http://localhost`}})
+	require.True(t, errors.Is(err, cloudimpl.ErrExternalIODisabled), "%v", err)
+	_, err = cloudimpl.MakeHTTPStorage(ctx, cloudimpl.ExternalStorageContext{IOConf: noHTTP},
+		roachpb.ExternalStorage{HttpPath: roachpb.ExternalStorage_Http{BaseUri: `http://localhost`}})
+	require.True(t, errors.Is(err, cloudimpl.ErrExternalIODisabled), "%v", err)
+}
+
+func TestURIPathNormalization(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	user := security.RootUserName()
+	const s3Params = `?AUTH=implicit`
+	const azureParams = `?AZURE_ACCOUNT_NAME=a&AZURE_ACCOUNT_KEY=Yg==`
+
+	// confPath returns the path that the parsed URI stores.
+	confPath := func(conf roachpb.ExternalStorage) string {
+		switch conf.Provider {
+		case roachpb.ExternalStorageProvider_S3:
+			return conf.S3Config.Prefix
+		case roachpb.ExternalStorageProvider_GoogleCloud:
+			return conf.GoogleCloudConfig.Prefix
+		case roachpb.ExternalStorageProvider_Azure:
+			return conf.AzureConfig.Prefix
+		case roachpb.ExternalStorageProvider_LocalFile:
+			return conf.LocalFile.Path
+		case roachpb.ExternalStorageProvider_FileTable:
+			return conf.FileTableConfig.Path
+		case roachpb.ExternalStorageProvider_Workload:
+			c := conf.WorkloadConfig
+			return strings.Join([]string{c.Format, c.Generator, c.Table}, `|`)
+		}
+		t.Fatalf("unexpected provider %s", conf.Provider)
+		return ``
+	}
+
+	for _, tc := range []struct {
+		uri, expected, expectedErr string
+	}{
+		// Leading slashes are dropped from prefixes within buckets, and trailing
+		// slashes are kept.
+		{uri: `s3://bucket` + s3Params, expected: ``},
+		{uri: `s3://bucket/` + s3Params, expected: ``},
+		{uri: `s3://bucket///a/b/` + s3Params, expected: `a/b/`},
+		{uri: `gs://bucket//a/b` + s3Params, expected: `a/b`},
+		{uri: `azure://container//a/` + azureParams, expected: `a/`},
+		// Local paths stay absolute.
+		{uri: `nodelocal://1`, expected: ``},
+		{uri: `nodelocal://1/`, expected: `/`},
+		{uri: `nodelocal://1//a/b/`, expected: `/a/b/`},
+		{uri: `userfile:///a.csv`, expected: `/a.csv`},
+		{uri: `userfile:////a.csv`, expected: `/a.csv`},
+		// The segments of workload paths may be surrounded by slashes.
+		{uri: `workload:///csv/bank/bank/?version=1.0.0`, expected: `csv|bank|bank`},
+		{uri: `workload:////csv/bank?version=1.0.0`, expected: `csv|bank|`},
+		// Empty segments within a path are errors for every backend.
+		{uri: `s3://bucket//a//b/` + s3Params, expectedErr: `path //a//b/ must not contain empty segments`},
+		{uri: `s3://bucket/a//` + s3Params, expectedErr: `path /a// must not contain empty segments`},
+		{uri: `gs://bucket/a//b` + s3Params, expectedErr: `path /a//b must not contain empty segments`},
+		{uri: `azure://container/a//b` + azureParams,
+			expectedErr: `path /a//b must not contain empty segments`},
+		{uri: `nodelocal://1/a//b`, expectedErr: `path /a//b must not contain empty segments`},
+		{uri: `userfile:///a//b.csv`, expectedErr: `path /a//b.csv must not contain empty segments`},
+		{uri: `workload:///csv//bank?version=1.0.0`,
+			expectedErr: `path /csv//bank must not contain empty segments`},
+		{uri: `workload:///?version=1.0.0`,
+			expectedErr: `path must be of the form /<format>/<generator>[/<table>]: /`},
+	} {
+		t.Run(tc.uri, func(t *testing.T) {
+			conf, err := cloudimpl.ExternalStorageConfFromURI(tc.uri, user)
+			if tc.expectedErr != `` {
+				require.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, confPath(conf))
+		})
+	}
+}
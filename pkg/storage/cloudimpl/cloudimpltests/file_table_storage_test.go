@@ -14,7 +14,10 @@ import (
 	"context"
 	gosql "database/sql"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
@@ -28,6 +31,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -75,6 +79,76 @@ func TestPutUserFileTable(t *testing.T) {
 	})
 }
 
+func TestUserfileQuota(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	params, _ := tests.CreateTestServerParams()
+	s, _, kvDB := serverutils.StartServer(t, params)
+	defer s.Stopper().Stop(ctx)
+
+	st := cluster.MakeTestingClusterSettings()
+	require.NoError(t, st.MakeUpdater().Set(cloudimpl.CloudstorageUserfileQuotaSetting, "100", "z"))
+
+	ie := s.InternalExecutor().(*sql.InternalExecutor)
+	store, err := cloudimpl.ExternalStorageFromURI(ctx, "userfile://defaultdb.public.quota_test/",
+		base.ExternalIODirConfig{}, st, blobs.TestEmptyBlobClientFactory,
+		security.RootUserName(), ie, kvDB)
+	require.NoError(t, err)
+	defer store.Close()
+
+	readFile := func(name string) string {
+		r, err := store.ReadFile(ctx, name)
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		return string(data)
+	}
+	const quotaErr = "userfile quota exceeded"
+
+	// Under the limit.
+	require.NoError(t, store.WriteFile(ctx, "a", bytes.NewReader(bytes.Repeat([]byte("a"), 60))))
+	// At the limit.
+	require.NoError(t, store.WriteFile(ctx, "b", bytes.NewReader(bytes.Repeat([]byte("b"), 40))))
+
+	// Over the limit: the write is rejected and the file is not created.
+	err = store.WriteFile(ctx, "c", bytes.NewReader([]byte("c")))
+	require.True(t, testutils.IsError(err, quotaErr), "%v", err)
+	_, err = store.ReadFile(ctx, "c")
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+
+	// Overwriting a file only counts the size of the new contents.
+	require.NoError(t, store.WriteFile(ctx, "a", bytes.NewReader(bytes.Repeat([]byte("A"), 60))))
+	require.Equal(t, strings.Repeat("A", 60), readFile("a"))
+	err = store.WriteFile(ctx, "a", bytes.NewReader(bytes.Repeat([]byte("x"), 61)))
+	require.True(t, testutils.IsError(err, quotaErr), "%v", err)
+	require.Equal(t, strings.Repeat("A", 60), readFile("a"))
+
+	// Content whose size is not known upfront is checked as it is written.
+	err = store.WriteFile(ctx, "c", &unseekableReader{bytes.NewReader(bytes.Repeat([]byte("c"), 41))})
+	require.True(t, testutils.IsError(err, quotaErr), "%v", err)
+	_, err = store.ReadFile(ctx, "c")
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+	require.NoError(t, store.WriteFile(ctx, "c", &unseekableReader{bytes.NewReader(nil)}))
+
+	// Deleting files frees up quota, and disabling the quota lifts the limit.
+	require.NoError(t, store.Delete(ctx, "b"))
+	require.NoError(t, store.WriteFile(ctx, "c", bytes.NewReader(bytes.Repeat([]byte("c"), 40))))
+	require.NoError(t, st.MakeUpdater().Set(cloudimpl.CloudstorageUserfileQuotaSetting, "0", "z"))
+	require.NoError(t, store.WriteFile(ctx, "d", bytes.NewReader(bytes.Repeat([]byte("d"), 1000))))
+}
+
+// unseekableReader is an io.ReadSeeker which cannot seek, like the content
+// streamed by userfile upload.
+type unseekableReader struct {
+	io.Reader
+}
+
+func (unseekableReader) Seek(int64, int) (int64, error) {
+	return 0, errors.New("illegal seek")
+}
+
 func createUserGrantAllPrivieleges(
 	username security.SQLUsername, database string, sqlDB *gosql.DB,
 ) error {
@@ -11,15 +11,40 @@
 package cloudimpltests
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
 	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/errors"
 	"github.com/stretchr/testify/require"
 )
@@ -115,3 +140,812 @@ func TestCompressedGCS(t *testing.T) {
 
 	require.Equal(t, string(content1), string(content2))
 }
+
+// fakeGCSFailure is an error response of fakeGCS.
+type fakeGCSFailure struct {
+	code   int
+	reason string
+}
+
+// fakeGCSSession is a resumable upload session of fakeGCS.
+type fakeGCSSession struct {
+	name string
+	data []byte
+}
+
+// fakeGCS is an in-memory stand-in for the GCS API which the GCS client uses
+// in place of the real service when STORAGE_EMULATOR_HOST is set. It fails
+// uploads with the responses queued in failures before serving them.
+type fakeGCS struct {
+	*httptest.Server
+	mu struct {
+		syncutil.Mutex
+		uploads  int
+		rewrites int
+		failures []fakeGCSFailure
+		objects  map[string][]byte
+		// attrs holds the JSON object metadata of the multipart uploads of
+		// objects, keyed by name.
+		attrs map[string][]byte
+		// acls holds the predefined ACLs that objects were last written or
+		// rewritten with, keyed by name.
+		acls     map[string]string
+		sessions map[string]*fakeGCSSession
+		// chunkOffsets are the offsets of the chunks received by resumable
+		// upload sessions, in order.
+		chunkOffsets []int64
+		// failChunkAt, if positive, fails the first chunk received at that
+		// offset.
+		failChunkAt int64
+		// md5s overrides the MD5 digests of objects, which are otherwise
+		// computed from their content. A nil digest is omitted from the
+		// attributes of the object, like that of composite objects.
+		md5s map[string][]byte
+	}
+}
+
+func newFakeGCS(t *testing.T) *fakeGCS {
+	f := &fakeGCS{}
+	f.mu.objects = make(map[string][]byte)
+	f.mu.attrs = make(map[string][]byte)
+	f.mu.acls = make(map[string]string)
+	f.mu.sessions = make(map[string]*fakeGCSSession)
+	f.mu.md5s = make(map[string][]byte)
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Query().Get(`uploadType`) == `resumable`:
+			id := fmt.Sprintf(`session-%d`, len(f.mu.sessions))
+			f.mu.sessions[id] = &fakeGCSSession{name: r.URL.Query().Get(`name`)}
+			f.mu.acls[r.URL.Query().Get(`name`)] = r.URL.Query().Get(`predefinedAcl`)
+			w.Header().Set(`Location`, f.URL+`/upload/`+id)
+		case strings.HasPrefix(r.URL.Path, `/upload/session-`):
+			f.serveChunk(t, w, r)
+		case r.Method == http.MethodPost && strings.Contains(r.URL.Path, `/rewriteTo/`):
+			f.serveRewrite(t, w, r)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, `/b/bucket/o`):
+			f.mu.uploads++
+			if len(f.mu.failures) > 0 {
+				failure := f.mu.failures[0]
+				f.mu.failures = f.mu.failures[1:]
+				w.Header().Set(`Content-Type`, `application/json`)
+				w.WriteHeader(failure.code)
+				fmt.Fprintf(w, `{"error":{"code":%d,"message":"injected","errors":[{"reason":%q}]}}`,
+					failure.code, failure.reason)
+				return
+			}
+			name := r.URL.Query().Get(`name`)
+			attrs, data, err := readMultipartUpload(r)
+			if err != nil {
+				t.Errorf("reading upload: %v", err)
+			}
+			f.mu.objects[name] = data
+			f.mu.attrs[name] = attrs
+			f.mu.acls[name] = r.URL.Query().Get(`predefinedAcl`)
+			w.Header().Set(`Content-Type`, `application/json`)
+			fmt.Fprintf(w, `{"bucket":"bucket","name":%q,"size":"%d"}`, name, len(data))
+		case strings.Contains(r.URL.Path, `/b/`) && !strings.Contains(r.URL.Path, `/b/bucket`):
+			// Only the bucket named "bucket" exists.
+			w.Header().Set(`Content-Type`, `application/json`)
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":404,"message":"Not Found","errors":[{"reason":"notFound"}]}}`)
+		case r.Method == http.MethodGet && strings.Contains(r.URL.Path, `/b/bucket/o/`):
+			name := r.URL.Path[strings.Index(r.URL.Path, `/b/bucket/o/`)+len(`/b/bucket/o/`):]
+			data, ok := f.mu.objects[name]
+			w.Header().Set(`Content-Type`, `application/json`)
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error":{"code":404,"message":"No such object"}}`)
+				return
+			}
+			sum, ok := f.mu.md5s[name]
+			if !ok {
+				digest := md5.Sum(data)
+				sum = digest[:]
+			}
+			var md5Hash string
+			if sum != nil {
+				md5Hash = fmt.Sprintf(`,"md5Hash":%q`, base64.StdEncoding.EncodeToString(sum))
+			}
+			fmt.Fprintf(w, `{"bucket":"bucket","name":%q,"size":"%d"%s}`, name, len(data), md5Hash)
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, `/b/bucket/o`):
+			f.serveList(w, r)
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, `/b/bucket`):
+			// The attributes of the bucket, which fail with the queued failures.
+			w.Header().Set(`Content-Type`, `application/json`)
+			if len(f.mu.failures) > 0 {
+				failure := f.mu.failures[0]
+				f.mu.failures = f.mu.failures[1:]
+				w.WriteHeader(failure.code)
+				fmt.Fprintf(w, `{"error":{"code":%d,"message":"injected","errors":[{"reason":%q}]}}`,
+					failure.code, failure.reason)
+				return
+			}
+			fmt.Fprint(w, `{"name":"bucket"}`)
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, `/bucket/`):
+			data, ok := f.mu.objects[strings.TrimPrefix(r.URL.Path, `/bucket/`)]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set(`Content-Length`, strconv.Itoa(len(data)))
+			_, _ = w.Write(data)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	return f
+}
+
+// serveList serves a listing of the objects with the prefix of the request,
+// paged by maxResults, with the last name of a page as the token of the next.
+func (f *fakeGCS) serveList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var names []string
+	for name := range f.mu.objects {
+		if strings.HasPrefix(name, q.Get(`prefix`)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if token := q.Get(`pageToken`); token != `` {
+		names = names[sort.SearchStrings(names, token+"\x00"):]
+	}
+	var next string
+	if max, err := strconv.Atoi(q.Get(`maxResults`)); err == nil && max < len(names) {
+		names = names[:max]
+		next = names[max-1]
+	}
+	items := make([]string, len(names))
+	for i, name := range names {
+		items[i] = fmt.Sprintf(`{"bucket":"bucket","name":%q,"size":"%d"}`, name, len(f.mu.objects[name]))
+	}
+	w.Header().Set(`Content-Type`, `application/json`)
+	fmt.Fprintf(w, `{"items":[%s],"nextPageToken":%q}`, strings.Join(items, `,`), next)
+}
+
+// serveChunk serves the upload of a chunk of a resumable upload session, whose
+// Content-Range is "bytes <first>-<last>/<total>", where the total is "*"
+// for all but the last chunk.
+func (f *fakeGCS) serveChunk(t *testing.T, w http.ResponseWriter, r *http.Request) {
+	session, ok := f.mu.sessions[strings.TrimPrefix(r.URL.Path, `/upload/`)]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var first, last int64
+	var total string
+	if _, err := fmt.Sscanf(strings.Replace(r.Header.Get(`Content-Range`), `/`, ` `, 1),
+		`bytes %d-%d %s`, &first, &last, &total); err != nil {
+		t.Errorf("unsupported content range %q: %v", r.Header.Get(`Content-Range`), err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.mu.chunkOffsets = append(f.mu.chunkOffsets, first)
+	if f.mu.failChunkAt > 0 && first == f.mu.failChunkAt {
+		f.mu.failChunkAt = 0
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Errorf("reading chunk: %v", err)
+	}
+	if first != int64(len(session.data)) || int64(len(data)) != last-first+1 {
+		t.Errorf("chunk %d-%d does not follow the %d bytes uploaded", first, last, len(session.data))
+	}
+	session.data = append(session.data[:first], data...)
+	if total == `*` {
+		// The client asks for chunks that are not the last to be acknowledged
+		// with a 200 in place of a 308.
+		w.Header().Set(`X-Http-Status-Code-Override`, `308`)
+		w.Header().Set(`Range`, fmt.Sprintf(`bytes=0-%d`, last))
+		return
+	}
+	f.mu.objects[session.name] = session.data
+	w.Header().Set(`Content-Type`, `application/json`)
+	fmt.Fprintf(w, `{"bucket":"bucket","name":%q,"size":"%d"}`, session.name, len(session.data))
+}
+
+// serveRewrite serves the rewrite of an object of the bucket to another object
+// of it, which is completed in a single response.
+func (f *fakeGCS) serveRewrite(t *testing.T, w http.ResponseWriter, r *http.Request) {
+	// The path is /b/<bucket>/o/<object>/rewriteTo/b/<bucket>/o/<object> with
+	// escaped object names.
+	parts := strings.Split(r.URL.EscapedPath(), `/`)
+	if len(parts) != 10 {
+		t.Errorf("unexpected rewrite path %s", r.URL.EscapedPath())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	src, err := url.PathUnescape(parts[4])
+	if err != nil {
+		t.Errorf("invalid source object: %v", err)
+	}
+	dst, err := url.PathUnescape(parts[9])
+	if err != nil {
+		t.Errorf("invalid destination object: %v", err)
+	}
+	data, ok := f.mu.objects[src]
+	if !ok {
+		w.Header().Set(`Content-Type`, `application/json`)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":{"code":404,"message":"No such object"}}`)
+		return
+	}
+	attrs, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Errorf("reading rewrite: %v", err)
+	}
+	f.mu.rewrites++
+	f.mu.objects[dst] = data
+	f.mu.attrs[dst] = attrs
+	f.mu.acls[dst] = r.URL.Query().Get(`destinationPredefinedAcl`)
+	w.Header().Set(`Content-Type`, `application/json`)
+	fmt.Fprintf(w, `{"done":true,"objectSize":"%[1]d","totalBytesRewritten":"%[1]d",`+
+		`"resource":{"bucket":"bucket","name":%[2]q,"size":"%[1]d"}}`, len(data), dst)
+}
+
+// readMultipartUpload returns the object metadata and the media of a multipart
+// upload, which are its two parts.
+func readMultipartUpload(r *http.Request) (attrs, media []byte, _ error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get(`Content-Type`))
+	if err != nil {
+		return nil, nil, err
+	}
+	mr := multipart.NewReader(r.Body, params[`boundary`])
+	attrsPart, err := mr.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+	if attrs, err = ioutil.ReadAll(attrsPart); err != nil {
+		return nil, nil, err
+	}
+	mediaPart, err := mr.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+	media, err = ioutil.ReadAll(mediaPart)
+	return attrs, media, err
+}
+
+func TestGCSRateLimitRetries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := newFakeGCS(t)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	defer func(prev string) { _ = os.Setenv(`STORAGE_EMULATOR_HOST`, prev) }(
+		os.Getenv(`STORAGE_EMULATOR_HOST`))
+	require.NoError(t, os.Setenv(`STORAGE_EMULATOR_HOST`, u.Host))
+	defer func(prev retry.Options) { cloudimpl.GCSRateLimitRetryOptions = prev }(
+		cloudimpl.GCSRateLimitRetryOptions)
+
+	conf, err := cloudimpl.ExternalStorageConfFromURI(
+		`gs://bucket/prefix?AUTH=implicit`, security.RootUserName())
+	require.NoError(t, err)
+	s, err := cloudimpl.MakeExternalStorage(
+		ctx, conf, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	t.Run("rate limited then succeeds", func(t *testing.T) {
+		cloudimpl.GCSRateLimitRetryOptions.InitialBackoff = time.Millisecond
+		srv.mu.Lock()
+		srv.mu.uploads = 0
+		srv.mu.failures = []fakeGCSFailure{
+			{code: http.StatusTooManyRequests, reason: `rateLimitExceeded`},
+			{code: http.StatusServiceUnavailable, reason: `backendError`},
+			// Per-user rate limits are reported as a 403, so they are identified
+			// by their reason.
+			{code: http.StatusForbidden, reason: `userRateLimitExceeded`},
+		}
+		srv.mu.Unlock()
+
+		require.NoError(t, s.WriteFile(ctx, `f`, bytes.NewReader([]byte(`data`))))
+		srv.mu.Lock()
+		require.Equal(t, 4, srv.mu.uploads)
+		srv.mu.Unlock()
+
+		r, err := s.ReadFile(ctx, `f`)
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, `data`, string(data))
+	})
+
+	t.Run("retries respect cancellation", func(t *testing.T) {
+		// The backoff outlasts the context, so only its cancellation can end
+		// the retries. The GCS client retries a 429 itself, so a 403 is used.
+		cloudimpl.GCSRateLimitRetryOptions.InitialBackoff = time.Hour
+		srv.mu.Lock()
+		srv.mu.failures = []fakeGCSFailure{{code: http.StatusForbidden, reason: `rateLimitExceeded`}}
+		srv.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		err := s.WriteFile(ctx, `f`, bytes.NewReader([]byte(`data`)))
+		require.True(t, errors.Is(err, context.DeadlineExceeded), "%+v", err)
+	})
+}
+
+func TestGCSErrorMapping(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := newFakeGCS(t)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	defer func(prev string) { _ = os.Setenv(`STORAGE_EMULATOR_HOST`, prev) }(
+		os.Getenv(`STORAGE_EMULATOR_HOST`))
+	require.NoError(t, os.Setenv(`STORAGE_EMULATOR_HOST`, u.Host))
+
+	conf, err := cloudimpl.ExternalStorageConfFromURI(
+		`gs://bucket/prefix?AUTH=implicit`, security.RootUserName())
+	require.NoError(t, err)
+	s, err := cloudimpl.MakeExternalStorage(
+		ctx, conf, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.ReadFile(ctx, `missing`)
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+	_, err = s.Size(ctx, `missing`)
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+
+	// The write is attempted up to three times.
+	srv.mu.Lock()
+	for i := 0; i < 3; i++ {
+		srv.mu.failures = append(srv.mu.failures,
+			fakeGCSFailure{code: http.StatusForbidden, reason: `forbidden`})
+	}
+	srv.mu.Unlock()
+	err = s.WriteFile(ctx, `denied`, bytes.NewReader([]byte(`data`)))
+	require.True(t, errors.Is(err, cloudimpl.ErrAccessDenied), "%v", err)
+}
+
+func TestGCSResumableUpload(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := newFakeGCS(t)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	defer func(prev string) { _ = os.Setenv(`STORAGE_EMULATOR_HOST`, prev) }(
+		os.Getenv(`STORAGE_EMULATOR_HOST`))
+	require.NoError(t, os.Setenv(`STORAGE_EMULATOR_HOST`, u.Host))
+
+	const chunkSize = 256 << 10
+	up := testSettings.MakeUpdater()
+	require.NoError(t, up.Set(cloudimpl.CloudstorageGSChunkSizeSetting, strconv.Itoa(chunkSize), `z`))
+	defer func() {
+		require.NoError(t, up.Set(cloudimpl.CloudstorageGSChunkSizeSetting, strconv.Itoa(16<<20), `z`))
+	}()
+
+	conf, err := cloudimpl.ExternalStorageConfFromURI(
+		`gs://bucket/prefix?AUTH=implicit`, security.RootUserName())
+	require.NoError(t, err)
+	s, err := cloudimpl.MakeExternalStorage(
+		ctx, conf, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	data := make([]byte, 4*chunkSize+10)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	srv.mu.Lock()
+	srv.mu.failChunkAt = 2 * chunkSize
+	srv.mu.Unlock()
+	require.NoError(t, s.WriteFile(ctx, `f`, bytes.NewReader(data)))
+
+	// The failed chunk is retried in the same session, without uploading the
+	// chunks before it again.
+	srv.mu.Lock()
+	require.Len(t, srv.mu.sessions, 1)
+	require.Equal(t, []int64{0, chunkSize, 2 * chunkSize, 2 * chunkSize, 3 * chunkSize, 4 * chunkSize},
+		srv.mu.chunkOffsets)
+	srv.mu.Unlock()
+
+	r, err := s.ReadFile(ctx, `f`)
+	require.NoError(t, err)
+	defer r.Close()
+	read, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+}
+
+func TestGCSObjectAttrs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := newFakeGCS(t)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	defer func(prev string) { _ = os.Setenv(`STORAGE_EMULATOR_HOST`, prev) }(
+		os.Getenv(`STORAGE_EMULATOR_HOST`))
+	require.NoError(t, os.Setenv(`STORAGE_EMULATOR_HOST`, u.Host))
+	user := security.RootUserName()
+
+	_, err = cloudimpl.ExternalStorageConfFromURI(
+		`gs://bucket/prefix?AUTH=implicit&GOOGLE_OBJECT_METADATA=novalue`, user)
+	require.True(t, testutils.IsError(err,
+		`invalid value for GOOGLE_OBJECT_METADATA: "novalue" is not a key=value pair`), "%v", err)
+
+	conf, err := cloudimpl.ExternalStorageConfFromURI(
+		`gs://bucket/prefix?AUTH=implicit&GOOGLE_STORAGE_CLASS=CHEAP`, user)
+	require.NoError(t, err)
+	_, err = cloudimpl.MakeExternalStorage(
+		ctx, conf, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+	require.True(t, testutils.IsError(err, `unsupported value CHEAP for GOOGLE_STORAGE_CLASS`), "%v", err)
+
+	conf, err = cloudimpl.ExternalStorageConfFromURI(`gs://bucket/prefix?AUTH=implicit`+
+		`&GOOGLE_STORAGE_CLASS=COLDLINE&GOOGLE_OBJECT_METADATA=`+
+		url.QueryEscape(`retention=archive,backup-id=12`), user)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{`retention`: `archive`, `backup-id`: `12`},
+		conf.GoogleCloudConfig.Metadata)
+	s, err := cloudimpl.MakeExternalStorage(
+		ctx, conf, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.WriteFile(ctx, `f`, bytes.NewReader([]byte(`data`))))
+	srv.mu.Lock()
+	rawAttrs := srv.mu.attrs[`prefix/f`]
+	srv.mu.Unlock()
+	var attrs struct {
+		StorageClass string            `json:"storageClass"`
+		Metadata     map[string]string `json:"metadata"`
+	}
+	require.NoError(t, json.Unmarshal(rawAttrs, &attrs), "%s", rawAttrs)
+	require.Equal(t, `COLDLINE`, attrs.StorageClass)
+	require.Equal(t, conf.GoogleCloudConfig.Metadata, attrs.Metadata)
+}
+
+func TestGCSPredefinedACL(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := newFakeGCS(t)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	defer func(prev string) { _ = os.Setenv(`STORAGE_EMULATOR_HOST`, prev) }(
+		os.Getenv(`STORAGE_EMULATOR_HOST`))
+	require.NoError(t, os.Setenv(`STORAGE_EMULATOR_HOST`, u.Host))
+	user := security.RootUserName()
+
+	conf, err := cloudimpl.ExternalStorageConfFromURI(
+		`gs://bucket/prefix?AUTH=implicit&GOOGLE_PREDEFINED_ACL=everyone`, user)
+	require.NoError(t, err)
+	_, err = cloudimpl.MakeExternalStorage(
+		ctx, conf, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+	require.True(t, testutils.IsError(err, `unsupported value everyone for GOOGLE_PREDEFINED_ACL`), "%v", err)
+
+	for _, acl := range []string{``, `bucketOwnerFullControl`, `publicRead`} {
+		t.Run(acl, func(t *testing.T) {
+			uri := `gs://bucket/acl?AUTH=implicit`
+			if acl != `` {
+				uri += `&GOOGLE_PREDEFINED_ACL=` + acl
+			}
+			conf, err := cloudimpl.ExternalStorageConfFromURI(uri, user)
+			require.NoError(t, err)
+			require.Equal(t, acl, conf.GoogleCloudConfig.PredefinedACL)
+			s, err := cloudimpl.MakeExternalStorage(
+				ctx, conf, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+			require.NoError(t, err)
+			defer s.Close()
+
+			// Copies are given the ACL too, rather than keeping that of their source.
+			require.NoError(t, s.WriteFile(ctx, `f`, bytes.NewReader([]byte(`data`))))
+			require.NoError(t, cloudimpl.CopyFrom(ctx, s, s, `f`, `copy`))
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			require.Equal(t, 1, srv.mu.rewrites)
+			srv.mu.rewrites = 0
+			for _, name := range []string{`f`, `copy`} {
+				require.Equal(t, acl, srv.mu.acls[conf.GoogleCloudConfig.Prefix+`/`+name], name)
+			}
+		})
+	}
+}
+
+func TestGCSContentType(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := newFakeGCS(t)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	defer func(prev string) { _ = os.Setenv(`STORAGE_EMULATOR_HOST`, prev) }(
+		os.Getenv(`STORAGE_EMULATOR_HOST`))
+	require.NoError(t, os.Setenv(`STORAGE_EMULATOR_HOST`, u.Host))
+	user := security.RootUserName()
+
+	_, err = cloudimpl.ExternalStorageConfFromURI(`gs://bucket/type?AUTH=implicit&CONTENT_TYPE=text/`, user)
+	require.True(t, testutils.IsError(err, `invalid value for CONTENT_TYPE`), "%v", err)
+
+	for _, tc := range []struct {
+		contentType, expected string
+	}{
+		{``, `application/octet-stream`},
+		{`text/csv`, `text/csv`},
+	} {
+		t.Run(tc.expected, func(t *testing.T) {
+			uri := `gs://bucket/type?AUTH=implicit`
+			if tc.contentType != `` {
+				uri += `&CONTENT_TYPE=` + url.QueryEscape(tc.contentType)
+			}
+			conf, err := cloudimpl.ExternalStorageConfFromURI(uri, user)
+			require.NoError(t, err)
+			require.Equal(t, tc.contentType, conf.GoogleCloudConfig.ContentType)
+			s, err := cloudimpl.MakeExternalStorage(
+				ctx, conf, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+			require.NoError(t, err)
+			defer s.Close()
+
+			require.NoError(t, s.WriteFile(ctx, `f`, bytes.NewReader([]byte(`data`))))
+			srv.mu.Lock()
+			rawAttrs := srv.mu.attrs[`type/f`]
+			srv.mu.Unlock()
+			var attrs struct {
+				ContentType string `json:"contentType"`
+			}
+			require.NoError(t, json.Unmarshal(rawAttrs, &attrs), "%s", rawAttrs)
+			require.Equal(t, tc.expected, attrs.ContentType)
+		})
+	}
+}
+
+// makeGCSServiceAccountKey returns the base64-encoded JSON key of a service
+// account whose email is signer@project.iam.gserviceaccount.com, as the
+// CREDENTIALS param of a gs URI.
+func makeGCSServiceAccountKey(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type: `RSA PRIVATE KEY`, Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	credentials, err := json.Marshal(map[string]string{
+		`type`:         `service_account`,
+		`client_email`: `signer@project.iam.gserviceaccount.com`,
+		`private_key`:  string(keyPEM),
+	})
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(credentials)
+}
+
+func TestGCSImplicitAuthFallback(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	// The application default credentials are looked up when the client is
+	// created, and only they fail to be found, which tells them apart from the
+	// credentials of the URI.
+	defer setEnv(t, map[string]string{
+		`STORAGE_EMULATOR_HOST`:          ``,
+		`GOOGLE_APPLICATION_CREDENTIALS`: filepath.Join(dir, `missing.json`),
+	})()
+	const adcErr = `GOOGLE_APPLICATION_CREDENTIALS`
+	key := makeGCSServiceAccountKey(t)
+
+	makeStorage := func(uri string, ioConf base.ExternalIODirConfig) (cloud.ExternalStorage, error) {
+		conf, err := cloudimpl.ExternalStorageConfFromURI(uri, user)
+		if err != nil {
+			return nil, err
+		}
+		return cloudimpl.MakeExternalStorage(ctx, conf, ioConf, testSettings, nil, nil, nil)
+	}
+
+	t.Run("application default", func(t *testing.T) {
+		uri := `gs://bucket/prefix?GOOGLE_USE_IMPLICIT_AUTH=true`
+		_, err := makeStorage(uri, base.ExternalIODirConfig{})
+		require.True(t, testutils.IsError(err, adcErr), "%v", err)
+		_, err = makeStorage(uri, base.ExternalIODirConfig{DisableImplicitCredentials: true})
+		require.True(t, testutils.IsError(err, `implicit credentials disallowed`), "%v", err)
+		explicit, _, err := cloudimpl.AccessIsWithExplicitAuth(uri)
+		require.NoError(t, err)
+		require.False(t, explicit)
+	})
+
+	t.Run("uri", func(t *testing.T) {
+		uri := `gs://bucket/prefix?GOOGLE_USE_IMPLICIT_AUTH=true&CREDENTIALS=` + url.QueryEscape(key)
+		s, err := makeStorage(uri, base.ExternalIODirConfig{DisableImplicitCredentials: true})
+		require.NoError(t, err)
+		defer s.Close()
+		require.True(t, s.Conf().GoogleCloudConfig.UseImplicitAuth)
+		// The URI's key signs the URLs, which implicit credentials cannot.
+		signed, err := cloudimpl.PresignedURL(ctx, s, `f`, time.Hour)
+		require.NoError(t, err)
+		require.Contains(t, signed, `signer%40project.iam.gserviceaccount.com`)
+		explicit, _, err := cloudimpl.AccessIsWithExplicitAuth(uri)
+		require.NoError(t, err)
+		require.True(t, explicit)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := cloudimpl.ExternalStorageConfFromURI(`gs://bucket/prefix?GOOGLE_USE_IMPLICIT_AUTH=maybe`, user)
+		require.True(t, testutils.IsError(err, `invalid value for GOOGLE_USE_IMPLICIT_AUTH`), "%v", err)
+	})
+}
+
+func TestGCSPresignedURL(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	makeStorage := func(t *testing.T, auth, credentials string) cloud.ExternalStorage {
+		s, err := cloudimpl.MakeExternalStorage(ctx, roachpb.ExternalStorage{
+			Provider: roachpb.ExternalStorageProvider_GoogleCloud,
+			GoogleCloudConfig: &roachpb.ExternalStorage_GCS{
+				Bucket:      `bucket`,
+				Prefix:      `prefix`,
+				Auth:        auth,
+				Credentials: credentials,
+			},
+		}, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+		require.NoError(t, err)
+		return s
+	}
+
+	t.Run("implicit", func(t *testing.T) {
+		// The emulator stands in for the implicit credentials, which are not
+		// available in tests.
+		srv := newFakeGCS(t)
+		defer srv.Close()
+		u, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+		defer func(prev string) { _ = os.Setenv(`STORAGE_EMULATOR_HOST`, prev) }(
+			os.Getenv(`STORAGE_EMULATOR_HOST`))
+		require.NoError(t, os.Setenv(`STORAGE_EMULATOR_HOST`, u.Host))
+
+		s := makeStorage(t, cloudimpl.AuthParamImplicit, ``)
+		defer s.Close()
+		_, err = cloudimpl.PresignedURL(ctx, s, `f`, time.Hour)
+		require.True(t, errors.Is(err, cloudimpl.ErrUnsupported), "%v", err)
+	})
+
+	t.Run("specified", func(t *testing.T) {
+		s := makeStorage(t, cloudimpl.AuthParamSpecified, makeGCSServiceAccountKey(t))
+		defer s.Close()
+
+		signed, err := cloudimpl.PresignedURL(ctx, s, `f`, time.Hour)
+		require.NoError(t, err)
+		u, err := url.Parse(signed)
+		require.NoError(t, err)
+		require.Equal(t, `/bucket/prefix/f`, u.Path)
+		q := u.Query()
+		// The expiry is relative to the signing time, which is taken after the
+		// absolute expiry is computed.
+		expires, err := strconv.Atoi(q.Get(`X-Goog-Expires`))
+		require.NoError(t, err)
+		require.InDelta(t, 3600, expires, 60)
+		require.True(t, strings.HasPrefix(q.Get(`X-Goog-Credential`), `signer@project.iam.gserviceaccount.com/`),
+			q.Get(`X-Goog-Credential`))
+		require.NotEmpty(t, q.Get(`X-Goog-Signature`))
+	})
+}
+
+func TestGCSCopyFrom(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := newFakeGCS(t)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	defer func(prev string) { _ = os.Setenv(`STORAGE_EMULATOR_HOST`, prev) }(
+		os.Getenv(`STORAGE_EMULATOR_HOST`))
+	require.NoError(t, os.Setenv(`STORAGE_EMULATOR_HOST`, u.Host))
+
+	makeStorage := func(t *testing.T, uri string) cloud.ExternalStorage {
+		conf, err := cloudimpl.ExternalStorageConfFromURI(uri, security.RootUserName())
+		require.NoError(t, err)
+		s, err := cloudimpl.MakeExternalStorage(
+			ctx, conf, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+		require.NoError(t, err)
+		return s
+	}
+	dst := makeStorage(t, `gs://bucket/dst?AUTH=implicit&GOOGLE_STORAGE_CLASS=NEARLINE`)
+	defer dst.Close()
+	// The client only sends the requests of the JSON API, which rewrites are,
+	// to the emulator once it has written an object.
+	require.NoError(t, dst.WriteFile(ctx, `first`, bytes.NewReader(nil)))
+	counts := func() (uploads, rewrites int) {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return srv.mu.uploads, srv.mu.rewrites
+	}
+
+	t.Run("server-side", func(t *testing.T) {
+		src := makeStorage(t, `gs://bucket/src?AUTH=implicit`)
+		defer src.Close()
+		require.NoError(t, src.WriteFile(ctx, `f`, bytes.NewReader([]byte(`same account`))))
+
+		uploads, rewrites := counts()
+		require.NoError(t, cloudimpl.CopyFrom(ctx, dst, src, `f`, `copy`))
+		afterUploads, afterRewrites := counts()
+		require.Equal(t, uploads, afterUploads)
+		require.Equal(t, rewrites+1, afterRewrites)
+		srv.mu.Lock()
+		require.Equal(t, `same account`, string(srv.mu.objects[`dst/copy`]))
+		require.Contains(t, string(srv.mu.attrs[`dst/copy`]), `"storageClass":"NEARLINE"`)
+		srv.mu.Unlock()
+
+		err := cloudimpl.CopyFrom(ctx, dst, src, `missing`, `copy`)
+		require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+	})
+
+	t.Run("other provider", func(t *testing.T) {
+		src := cloudimpl.NewMemoryStorage()
+		defer src.Close()
+		require.NoError(t, src.WriteFile(ctx, `f`, bytes.NewReader([]byte(`in memory`))))
+
+		uploads, rewrites := counts()
+		require.NoError(t, cloudimpl.CopyFrom(ctx, dst, src, `f`, `copy`))
+		afterUploads, afterRewrites := counts()
+		require.Equal(t, uploads+1, afterUploads)
+		require.Equal(t, rewrites, afterRewrites)
+		srv.mu.Lock()
+		require.Equal(t, `in memory`, string(srv.mu.objects[`dst/copy`]))
+		srv.mu.Unlock()
+	})
+}
+
+func TestGCSValidate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := newFakeGCS(t)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	defer func(prev string) { _ = os.Setenv(`STORAGE_EMULATOR_HOST`, prev) }(
+		os.Getenv(`STORAGE_EMULATOR_HOST`))
+	require.NoError(t, os.Setenv(`STORAGE_EMULATOR_HOST`, u.Host))
+
+	makeStorage := func(uri string) cloud.ExternalStorage {
+		conf, err := cloudimpl.ExternalStorageConfFromURI(uri, security.RootUserName())
+		require.NoError(t, err)
+		s, err := cloudimpl.MakeExternalStorage(
+			ctx, conf, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+		require.NoError(t, err)
+		return s
+	}
+
+	// The GCS client only sends the requests of its JSON API to the emulator
+	// once it has opened a writer, so a file is written first.
+	s := makeStorage(`gs://bucket/prefix?AUTH=implicit`)
+	defer s.Close()
+	require.NoError(t, s.WriteFile(ctx, `f`, bytes.NewReader([]byte(`data`))))
+	require.NoError(t, cloudimpl.Validate(ctx, s))
+
+	missing := makeStorage(`gs://missing/prefix?AUTH=implicit`)
+	defer missing.Close()
+	err = missing.WriteFile(ctx, `f`, bytes.NewReader([]byte(`data`)))
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+	err = cloudimpl.Validate(ctx, missing)
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+
+	srv.mu.Lock()
+	srv.mu.failures = []fakeGCSFailure{{code: http.StatusForbidden, reason: `forbidden`}}
+	srv.mu.Unlock()
+	err = cloudimpl.Validate(ctx, s)
+	require.True(t, errors.Is(err, cloudimpl.ErrAccessDenied), "%v", err)
+
+	// Validating transfers no data.
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	require.Equal(t, 1, srv.mu.uploads)
+}
@@ -13,6 +13,7 @@ package cloudimpltests
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"io"
@@ -25,6 +26,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -32,11 +34,15 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/blobs"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
 	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/util/ctxgroup"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -55,6 +61,12 @@ func TestPutHttp(t *testing.T) {
 			localfile := filepath.Join(tmp, filepath.Base(r.URL.Path))
 			switch r.Method {
 			case "PUT":
+				if r.Header.Get("If-None-Match") == "*" {
+					if _, err := os.Stat(localfile); err == nil {
+						http.Error(w, "file exists", http.StatusPreconditionFailed)
+						return
+					}
+				}
 				f, err := os.Create(localfile)
 				if err != nil {
 					http.Error(w, err.Error(), 500)
@@ -114,7 +126,7 @@ func TestPutHttp(t *testing.T) {
 		srv, files, cleanup := makeServer()
 		defer cleanup()
 		testExportStore(t, srv.String(), false, user, nil, nil)
-		if expected, actual := 14, files(); expected != actual {
+		if expected, actual := 15, files(); expected != actual {
 			t.Fatalf("expected %d files to be written to single http store, got %d", expected, actual)
 		}
 	})
@@ -137,7 +149,7 @@ func TestPutHttp(t *testing.T) {
 		if expected, actual := 4, files2(); expected != actual {
 			t.Fatalf("expected %d files written to http host 2, got %d", expected, actual)
 		}
-		if expected, actual := 4, files3(); expected != actual {
+		if expected, actual := 5, files3(); expected != actual {
 			t.Fatalf("expected %d files written to http host 3, got %d", expected, actual)
 		}
 	})
@@ -277,6 +289,291 @@ func TestHttpGet(t *testing.T) {
 	}
 }
 
+func TestHttpReadFileAt(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	data := []byte("to serve, or not to serve.  c'est la question")
+
+	for _, tc := range []struct {
+		name string
+		// honorRange is whether the server responds to range requests with
+		// partial content instead of the whole file.
+		honorRange bool
+	}{
+		{name: "partial content", honorRange: true},
+		{name: "range ignored", honorRange: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var ranges []string
+			var mu syncutil.Mutex
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				ranges = append(ranges, r.Header.Get("Range"))
+				mu.Unlock()
+				start, err := rangeStart(r.Header.Get("Range"))
+				if err != nil {
+					t.Errorf("invalid range header %q: %v", r.Header.Get("Range"), err)
+				}
+				if !tc.honorRange || start == 0 {
+					w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+					_, _ = w.Write(data)
+					return
+				}
+				if start >= len(data) {
+					w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+					return
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)-start))
+				w.Header().Set("Content-Range",
+					fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+				w.WriteHeader(http.StatusPartialContent)
+				_, _ = w.Write(data[start:])
+			}))
+			defer srv.Close()
+
+			conf := roachpb.ExternalStorage{HttpPath: roachpb.ExternalStorage_Http{BaseUri: srv.URL}}
+			store, err := cloudimpl.MakeHTTPStorage(ctx,
+				cloudimpl.ExternalStorageContext{Settings: testSettings}, conf)
+			require.NoError(t, err)
+			defer store.Close()
+
+			for _, offset := range []int64{0, 1, 10, int64(len(data)) - 1} {
+				r, size, err := store.ReadFileAt(ctx, "/file", offset)
+				require.NoError(t, err)
+				require.Equal(t, int64(len(data)), size)
+				b, err := ioutil.ReadAll(r)
+				require.NoError(t, err)
+				require.NoError(t, r.Close())
+				require.Equal(t, string(data[offset:]), string(b))
+			}
+			require.Equal(t, []string{"", "bytes=1-", "bytes=10-", fmt.Sprintf("bytes=%d-", len(data)-1)},
+				ranges)
+
+			_, _, err = store.ReadFileAt(ctx, "/file", int64(len(data))+1)
+			if tc.honorRange {
+				require.True(t, testutils.IsError(err, "416 Requested Range Not Satisfiable"), "%v", err)
+			} else {
+				require.True(t, testutils.IsError(err, "skipping to offset"), "%v", err)
+			}
+		})
+	}
+}
+
+func TestHttpReadFileSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	data := []byte("to serve, or not to serve.  c'est la question")
+
+	for _, tc := range []struct {
+		name string
+		// chunked is whether the server streams files with chunked transfer
+		// encoding, omitting their Content-Length.
+		chunked      bool
+		expectedSize int64
+	}{
+		{name: "content length", expectedSize: int64(len(data))},
+		{name: "chunked", chunked: true, expectedSize: -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var heads int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.Method {
+				case http.MethodHead:
+					atomic.AddInt32(&heads, 1)
+					w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				case http.MethodGet:
+					if tc.chunked {
+						// Flushing before the body is written makes the server stream it.
+						w.(http.Flusher).Flush()
+					} else {
+						w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+					}
+					_, _ = w.Write(data)
+				case http.MethodPut:
+					_, _ = io.Copy(ioutil.Discard, r.Body)
+				}
+			}))
+			defer srv.Close()
+
+			conf := roachpb.ExternalStorage{HttpPath: roachpb.ExternalStorage_Http{BaseUri: srv.URL}}
+			store, err := cloudimpl.MakeHTTPStorage(ctx,
+				cloudimpl.ExternalStorageContext{Settings: testSettings}, conf)
+			require.NoError(t, err)
+			defer store.Close()
+
+			r, size, err := store.ReadFileAt(ctx, "/file", 0)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedSize, size)
+			b, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.Equal(t, data, b)
+
+			// The size of a file that was read with its Content-Length is known
+			// without a HEAD request, while that of a streamed file is not.
+			var expectedHeads int32
+			if tc.chunked {
+				expectedHeads++
+			}
+			size, err = store.Size(ctx, "/file")
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), size)
+			require.Equal(t, expectedHeads, atomic.LoadInt32(&heads))
+
+			// Writing the file forgets its size.
+			require.NoError(t, store.WriteFile(ctx, "/file", bytes.NewReader(data)))
+			size, err = store.Size(ctx, "/file")
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), size)
+			require.Equal(t, expectedHeads+1, atomic.LoadInt32(&heads))
+		})
+	}
+}
+
+func TestHttpCustomCA(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "4")
+	}))
+	defer srv.Close()
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+
+	u := testSettings.MakeUpdater()
+	set := func(key, value, typ string) {
+		require.NoError(t, u.Set(key, value, typ))
+	}
+	defer set(cloudimpl.CloudstorageHTTPCASetting, "", "s")
+	defer set(cloudimpl.CloudstorageHTTPInsecureSkipVerifySetting, "false", "b")
+
+	for _, tc := range []struct {
+		name          string
+		ca            string
+		skipVerify    bool
+		expectedErrRE string
+	}{
+		{name: "untrusted", expectedErrRE: "certificate signed by unknown authority"},
+		{name: "custom ca", ca: caPEM},
+		{name: "insecure skip verify", skipVerify: true},
+		{name: "invalid ca", ca: "not a certificate", expectedErrRE: "failed to parse root CA certificate"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			set(cloudimpl.CloudstorageHTTPCASetting, tc.ca, "s")
+			set(cloudimpl.CloudstorageHTTPInsecureSkipVerifySetting, strconv.FormatBool(tc.skipVerify), "b")
+
+			conf := roachpb.ExternalStorage{HttpPath: roachpb.ExternalStorage_Http{BaseUri: srv.URL}}
+			store, err := cloudimpl.MakeHTTPStorage(ctx,
+				cloudimpl.ExternalStorageContext{Settings: testSettings}, conf)
+			if err == nil {
+				defer store.Close()
+				_, err = store.Size(ctx, "/file")
+			}
+			if tc.expectedErrRE != "" {
+				require.True(t, testutils.IsError(err, tc.expectedErrRE), "%v", err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestHttpAuth(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	data := []byte("authenticated")
+
+	var mu syncutil.Mutex
+	var requests []*http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+		start, err := rangeStart(r.Header.Get("Range"))
+		if err != nil {
+			t.Errorf("invalid range header %q: %v", r.Header.Get("Range"), err)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)-start))
+		if start > 0 {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data[start:])
+		}
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name     string
+		params   string
+		expected string
+	}{
+		{name: "none", params: "", expected: ""},
+		{name: "basic", params: "AUTH_BASIC_USER=alice&AUTH_BASIC_PASSWORD=s%3Dcret",
+			expected: "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:s=cret"))},
+		{name: "bearer", params: "AUTH_BEARER_TOKEN=tok%2Fen", expected: "Bearer tok/en"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mu.Lock()
+			requests = nil
+			mu.Unlock()
+
+			uri := srv.URL + "/dir?sig=abc"
+			if tc.params != "" {
+				uri += "&" + tc.params
+			}
+			conf, err := cloudimpl.ExternalStorageConfFromURI(uri, user)
+			require.NoError(t, err)
+			require.Equal(t, srv.URL+"/dir?sig=abc", conf.HttpPath.BaseUri)
+			s, err := cloudimpl.MakeExternalStorage(ctx, conf, base.ExternalIODirConfig{},
+				testSettings, blobs.TestEmptyBlobClientFactory, nil, nil)
+			require.NoError(t, err)
+			defer s.Close()
+			require.Equal(t, conf, s.Conf())
+
+			r, err := s.ReadFile(ctx, "f")
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			r, _, err = s.ReadFileAt(ctx, "f", 2)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			// Unlike Size, which knows the size of a file that was read, Stat always
+			// sends a HEAD request.
+			info, err := s.Stat(ctx, "f")
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), info.Size)
+			require.NoError(t, s.WriteFile(ctx, "f", bytes.NewReader(data)))
+			// HTTP storage does not support listing, so it makes no request.
+			_, err = s.ListFiles(ctx, "*")
+			require.True(t, errors.Is(err, cloudimpl.ErrListingUnsupported), "%v", err)
+
+			mu.Lock()
+			defer mu.Unlock()
+			require.Len(t, requests, 4)
+			for _, req := range requests {
+				require.Equal(t, tc.expected, req.Header.Get("Authorization"), "%s %s", req.Method, req.URL)
+				require.Equal(t, "sig=abc", req.URL.RawQuery)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		params, expectedErr string
+	}{
+		{params: "AUTH_BASIC_PASSWORD=p", expectedErr: "AUTH_BASIC_PASSWORD is set, but AUTH_BASIC_USER is not set"},
+		{params: "AUTH_BASIC_USER=u&AUTH_BEARER_TOKEN=t",
+			expectedErr: "AUTH_BASIC_USER and AUTH_BEARER_TOKEN cannot both be set"},
+	} {
+		_, err := cloudimpl.ExternalStorageConfFromURI(srv.URL+"/dir?"+tc.params, user)
+		require.EqualError(t, err, tc.expectedErr)
+	}
+}
+
 func TestHttpGetWithCancelledContext(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
@@ -297,6 +594,160 @@ func TestHttpGetWithCancelledContext(t *testing.T) {
 	require.Error(t, context.Canceled, err)
 }
 
+// blockingServer returns a server whose handler does not respond until the
+// client gives up on the request, and a function to release any still-blocked
+// handlers and close the server.
+func blockingServer() (*httptest.Server, func()) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	return srv, func() {
+		close(release)
+		srv.Close()
+	}
+}
+
+// isTimeout returns whether err is the result of an operation timing out.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// setStorageTimeout sets the cloudstorage.timeout, returning a function that
+// restores the default.
+func setStorageTimeout(t *testing.T, timeout string) func() {
+	u := testSettings.MakeUpdater()
+	require.NoError(t, u.Set("cloudstorage.timeout", timeout, "d"))
+	return func() {
+		require.NoError(t, u.Set("cloudstorage.timeout", "10m", "d"))
+	}
+}
+
+func TestHttpStorageTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s, cleanup := blockingServer()
+	defer cleanup()
+	defer setStorageTimeout(t, "50ms")()
+
+	ctx := context.Background()
+	conf := roachpb.ExternalStorage{HttpPath: roachpb.ExternalStorage_Http{BaseUri: s.URL}}
+	store, err := cloudimpl.MakeHTTPStorage(ctx, cloudimpl.ExternalStorageContext{Settings: testSettings}, conf)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, store.Close())
+	}()
+
+	for name, fn := range map[string]func() error{
+		"read": func() error {
+			_, err := store.ReadFile(ctx, "f")
+			return err
+		},
+		"write": func() error {
+			return store.WriteFile(ctx, "f", bytes.NewReader([]byte("data")))
+		},
+		"delete": func() error {
+			return store.Delete(ctx, "f")
+		},
+		"size": func() error {
+			_, err := store.Size(ctx, "f")
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := fn()
+			require.True(t, isTimeout(err), "unexpected error: %+v", err)
+		})
+	}
+}
+
+func TestHttpSharedTransport(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var newConns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	ctx := context.Background()
+	conf := roachpb.ExternalStorage{HttpPath: roachpb.ExternalStorage_Http{BaseUri: srv.URL}}
+	var stores [2]cloud.ExternalStorage
+	for i := range stores {
+		var err error
+		stores[i], err = cloudimpl.MakeHTTPStorage(ctx,
+			cloudimpl.ExternalStorageContext{Settings: testSettings}, conf)
+		require.NoError(t, err)
+		defer stores[i].Close()
+	}
+	write := func(s cloud.ExternalStorage) {
+		require.NoError(t, s.WriteFile(ctx, "f", bytes.NewReader([]byte("data"))))
+	}
+
+	// The second storage reuses the idle connection of the first.
+	write(stores[0])
+	write(stores[1])
+	require.Equal(t, int32(1), atomic.LoadInt32(&newConns))
+
+	// Changing the limits switches the storages that exist to another transport.
+	u := testSettings.MakeUpdater()
+	require.NoError(t, u.Set("cloudstorage.idle_conn_timeout", "10ms", "d"))
+	defer func() {
+		require.NoError(t, u.Set("cloudstorage.idle_conn_timeout", "90s", "d"))
+	}()
+	write(stores[0])
+	require.Equal(t, int32(2), atomic.LoadInt32(&newConns))
+	// The idle connection is closed after the timeout.
+	time.Sleep(50 * time.Millisecond)
+	write(stores[1])
+	require.Equal(t, int32(3), atomic.LoadInt32(&newConns))
+}
+
+func TestHttpSharedTransportPerLimits(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var newConns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	ctx := context.Background()
+	conf := roachpb.ExternalStorage{HttpPath: roachpb.ExternalStorage_Http{BaseUri: srv.URL}}
+	var stores [2]cloud.ExternalStorage
+	for i, perHost := range []string{"10", "20"} {
+		settings := cluster.MakeTestingClusterSettings()
+		u := settings.MakeUpdater()
+		require.NoError(t, u.Set("cloudstorage.max_idle_conns_per_host", perHost, "i"))
+		var err error
+		stores[i], err = cloudimpl.MakeHTTPStorage(ctx,
+			cloudimpl.ExternalStorageContext{Settings: settings}, conf)
+		require.NoError(t, err)
+		defer stores[i].Close()
+	}
+
+	// Storages with different limits use transports of their own, which keep
+	// their idle connections as the storages are used in turns.
+	for i := 0; i < 5; i++ {
+		for _, s := range stores {
+			require.NoError(t, s.WriteFile(ctx, "f", bytes.NewReader([]byte("data"))))
+		}
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&newConns))
+}
+
 func TestCanDisableHttp(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	conf := base.ExternalIODirConfig{
@@ -344,8 +795,10 @@ func TestExternalStorageCanUseHTTPProxy(t *testing.T) {
 	http.DefaultTransport.(*http.Transport).Proxy = func(_ *http.Request) (*url.URL, error) {
 		return url.Parse(proxy.URL)
 	}
+	cloudimpl.ResetSharedHTTPTransportsForTesting()
 	defer func() {
 		http.DefaultTransport.(*http.Transport).Proxy = nil
+		cloudimpl.ResetSharedHTTPTransportsForTesting()
 	}()
 
 	conf, err := cloudimpl.ExternalStorageConfFromURI("http://my-server", security.RootUserName())
@@ -385,9 +838,11 @@ func TestExhaustRetries(t *testing.T) {
 		func(ctx context.Context, network, addr string) (net.Conn, error) {
 			return dialer.DialContext(ctx, network, addr)
 		}
+	cloudimpl.ResetSharedHTTPTransportsForTesting()
 
 	defer func() {
 		transport.DialContext = nil
+		cloudimpl.ResetSharedHTTPTransportsForTesting()
 	}()
 
 	// Override retry options to retry faster.
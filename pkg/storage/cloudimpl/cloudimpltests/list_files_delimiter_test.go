@@ -0,0 +1,100 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/blobs"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// testListFilesWithDelimiter writes a nested structure of files to s and
+// checks that listing it with a delimiter only returns one level of it.
+func testListFilesWithDelimiter(t *testing.T, s cloud.ExternalStorage) {
+	ctx := context.Background()
+	for _, name := range []string{
+		`top`, `a/file`, `a/b/file`, `a/b/c/file`, `a/b/c/d/file`, `a/b2/file`, `a/b-file`, `ab/file`,
+	} {
+		require.NoError(t, s.WriteFile(ctx, name, bytes.NewReader([]byte(`data`))))
+	}
+
+	for _, tc := range []struct {
+		prefix, delimiter string
+		files, prefixes   []string
+	}{
+		{``, `/`, []string{`top`}, []string{`a/`, `ab/`}},
+		{`a/`, `/`, []string{`a/b-file`, `a/file`}, []string{`a/b/`, `a/b2/`}},
+		{`a/b`, `/`, []string{`a/b-file`}, []string{`a/b/`, `a/b2/`}},
+		{`a/b/`, `/`, []string{`a/b/file`}, []string{`a/b/c/`}},
+		{`a/b/c/d/`, `/`, []string{`a/b/c/d/file`}, nil},
+		{`missing/`, `/`, nil, nil},
+		// The delimiter need not be a slash, nor a single character.
+		{`a/`, `b/`, []string{`a/b-file`, `a/b2/file`, `a/file`}, []string{`a/b/`}},
+	} {
+		files, prefixes, err := cloudimpl.ListFilesWithDelimiter(ctx, s, tc.prefix, tc.delimiter)
+		require.NoError(t, err)
+		require.Equal(t, tc.files, files, "prefix %q delimiter %q", tc.prefix, tc.delimiter)
+		require.Equal(t, tc.prefixes, prefixes, "prefix %q delimiter %q", tc.prefix, tc.delimiter)
+	}
+
+	_, _, err := cloudimpl.ListFilesWithDelimiter(ctx, s, `a/`, ``)
+	require.True(t, testutils.IsError(err, `delimiter must not be empty`), "%v", err)
+}
+
+func TestListFilesWithDelimiter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+
+	t.Run("memory", func(t *testing.T) {
+		s := cloudimpl.NewMemoryStorage()
+		defer s.Close()
+		testListFilesWithDelimiter(t, s)
+	})
+
+	t.Run("nodelocal", func(t *testing.T) {
+		p, cleanupFn := testutils.TempDir(t)
+		defer cleanupFn()
+		testSettings.ExternalIODir = p
+		s, err := cloudimpl.ExternalStorageFromURI(ctx, `nodelocal://0/list`, base.ExternalIODirConfig{},
+			testSettings, blobs.TestBlobServiceClient(testSettings.ExternalIODir), security.RootUserName(),
+			nil, nil)
+		require.NoError(t, err)
+		defer s.Close()
+		testListFilesWithDelimiter(t, s)
+	})
+
+	t.Run("wrapped", func(t *testing.T) {
+		s := cloudimpl.WithRetry(cloudimpl.NewMemoryStorage(), cloudimpl.RetryOptions{})
+		defer s.Close()
+		testListFilesWithDelimiter(t, s)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		conf := roachpb.ExternalStorage{HttpPath: roachpb.ExternalStorage_Http{BaseUri: `http://localhost`}}
+		s, err := cloudimpl.MakeHTTPStorage(ctx, cloudimpl.ExternalStorageContext{Settings: testSettings}, conf)
+		require.NoError(t, err)
+		defer s.Close()
+		_, _, err = cloudimpl.ListFilesWithDelimiter(ctx, s, ``, `/`)
+		require.True(t, errors.Is(err, cloudimpl.ErrListingUnsupported), "%v", err)
+	})
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/blobs"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// testListFilesPage writes files to s and checks that listing them in pages
+// returns all of them, in order, and ends with an empty token.
+func testListFilesPage(t *testing.T, s cloud.ExternalStorage) {
+	ctx := context.Background()
+	files := []string{`page/a`, `page/b`, `page/c`, `page/d`, `page/e`}
+	for _, name := range append([]string{`other`}, files...) {
+		require.NoError(t, s.WriteFile(ctx, name, bytes.NewReader([]byte(`data`))))
+	}
+
+	for _, limit := range []int{1, 2, 5, 10} {
+		var listed []string
+		var pages int
+		token := ``
+		for {
+			page, next, err := cloudimpl.ListFilesPage(ctx, s, `page/`, token, limit)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(page), limit)
+			listed = append(listed, page...)
+			pages++
+			if next == `` {
+				break
+			}
+			token = next
+		}
+		require.Equal(t, files, listed, "limit %d", limit)
+		require.Equal(t, (len(files)+limit-1)/limit, pages, "limit %d", limit)
+	}
+
+	_, _, err := cloudimpl.ListFilesPage(ctx, s, `page/`, ``, 0)
+	require.True(t, testutils.IsError(err, `page limit must be positive`), "%v", err)
+}
+
+func TestListFilesPage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+
+	t.Run("memory", func(t *testing.T) {
+		s := cloudimpl.NewMemoryStorage()
+		defer s.Close()
+		testListFilesPage(t, s)
+	})
+
+	t.Run("nodelocal", func(t *testing.T) {
+		p, cleanupFn := testutils.TempDir(t)
+		defer cleanupFn()
+		testSettings.ExternalIODir = p
+		s, err := cloudimpl.ExternalStorageFromURI(ctx, `nodelocal://0/list`, base.ExternalIODirConfig{},
+			testSettings, blobs.TestBlobServiceClient(testSettings.ExternalIODir), security.RootUserName(),
+			nil, nil)
+		require.NoError(t, err)
+		defer s.Close()
+		testListFilesPage(t, s)
+	})
+
+	t.Run("s3", func(t *testing.T) {
+		srv := newFakeS3(t)
+		defer srv.Close()
+		s, err := makeS3Storage(ctx, srv.uri(`/list`, nil), security.RootUserName())
+		require.NoError(t, err)
+		defer s.Close()
+		testListFilesPage(t, s)
+	})
+
+	t.Run("gcs", func(t *testing.T) {
+		srv := newFakeGCS(t)
+		defer srv.Close()
+		u, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+		defer func(prev string) { _ = os.Setenv(`STORAGE_EMULATOR_HOST`, prev) }(
+			os.Getenv(`STORAGE_EMULATOR_HOST`))
+		require.NoError(t, os.Setenv(`STORAGE_EMULATOR_HOST`, u.Host))
+		conf, err := cloudimpl.ExternalStorageConfFromURI(
+			`gs://bucket/list?AUTH=implicit`, security.RootUserName())
+		require.NoError(t, err)
+		s, err := cloudimpl.MakeExternalStorage(
+			ctx, conf, base.ExternalIODirConfig{}, testSettings, nil, nil, nil)
+		require.NoError(t, err)
+		defer s.Close()
+		testListFilesPage(t, s)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		conf := roachpb.ExternalStorage{HttpPath: roachpb.ExternalStorage_Http{BaseUri: `http://localhost`}}
+		s, err := cloudimpl.MakeHTTPStorage(ctx, cloudimpl.ExternalStorageContext{Settings: testSettings}, conf)
+		require.NoError(t, err)
+		defer s.Close()
+		_, _, err = cloudimpl.ListFilesPage(ctx, s, ``, ``, 10)
+		require.True(t, errors.Is(err, cloudimpl.ErrListingUnsupported), "%v", err)
+	})
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/util/ctxgroup"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	s := cloudimpl.NewMemoryStorage()
+	defer s.Close()
+
+	_, err := s.ReadFile(ctx, `missing`)
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%+v", err)
+	_, err = s.Size(ctx, `missing`)
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%+v", err)
+	info, err := s.Stat(ctx, `missing`)
+	require.NoError(t, err)
+	require.False(t, info.Exists)
+
+	require.NoError(t, s.WriteFile(ctx, `a/1`, bytes.NewReader([]byte(`hello`))))
+	require.NoError(t, s.WriteFile(ctx, `a/2`, bytes.NewReader([]byte(`world`))))
+	require.NoError(t, s.WriteFile(ctx, `b/1`, bytes.NewReader([]byte(`other`))))
+	err = s.WriteFileIfNotExists(ctx, `b/1`, bytes.NewReader([]byte(`again`)))
+	require.True(t, errors.Is(err, cloudimpl.ErrFileAlreadyExists), "%+v", err)
+
+	r, size, err := s.ReadFileAt(ctx, `a/1`, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), size)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, `llo`, string(data))
+	_, _, err = s.ReadFileAt(ctx, `a/1`, 6)
+	require.EqualError(t, err, `offset 6 is out of range for file a/1 of size 5`)
+
+	size, err = s.Size(ctx, `a/2`)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), size)
+	info, err = s.Stat(ctx, `a/2`)
+	require.NoError(t, err)
+	require.True(t, info.Exists)
+	require.Equal(t, int64(5), info.Size)
+
+	files, err := s.ListFiles(ctx, `a/`)
+	require.NoError(t, err)
+	require.Equal(t, []string{`a/1`, `a/2`}, files)
+	files, err = s.ListFiles(ctx, ``)
+	require.NoError(t, err)
+	require.Equal(t, []string{`a/1`, `a/2`, `b/1`}, files)
+
+	entries, err := s.ListFilesExt(ctx, `a/`)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	for i, name := range []string{`a/1`, `a/2`} {
+		info, err := s.Stat(ctx, name)
+		require.NoError(t, err)
+		require.Equal(t, cloud.FileEntry{Path: name, Size: info.Size, ModTime: info.ModTime}, entries[i])
+	}
+
+	require.NoError(t, s.Delete(ctx, `a/1`))
+	files, err = s.ListFiles(ctx, `a/`)
+	require.NoError(t, err)
+	require.Equal(t, []string{`a/2`}, files)
+
+	require.NoError(t, s.WriteFile(ctx, `a/sub/3`, bytes.NewReader([]byte(`nested`))))
+	require.NoError(t, s.DeleteAll(ctx, `a/`))
+	files, err = s.ListFiles(ctx, ``)
+	require.NoError(t, err)
+	require.Equal(t, []string{`b/1`}, files)
+
+	// Memory storage is not a cloud.Copier, so the file is streamed through.
+	other := cloudimpl.NewMemoryStorage()
+	require.NoError(t, cloudimpl.CopyFrom(ctx, other, s, `b/1`, `copy`))
+	r, err = other.ReadFile(ctx, `copy`)
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, `other`, string(data))
+
+	_, err = cloudimpl.PresignedURL(ctx, s, `b/1`, time.Hour)
+	require.True(t, errors.Is(err, cloudimpl.ErrUnsupported), "%+v", err)
+
+	t.Run("concurrent", func(t *testing.T) {
+		s := cloudimpl.NewMemoryStorage()
+		const workers, filesPerWorker = 8, 20
+		g := ctxgroup.WithContext(ctx)
+		for w := 0; w < workers; w++ {
+			w := w
+			g.GoCtx(func(ctx context.Context) error {
+				for i := 0; i < filesPerWorker; i++ {
+					name := fmt.Sprintf(`%d/%d`, w, i)
+					if err := s.WriteFile(ctx, name, bytes.NewReader([]byte(name))); err != nil {
+						return err
+					}
+					r, err := s.ReadFile(ctx, name)
+					if err != nil {
+						return err
+					}
+					data, err := ioutil.ReadAll(r)
+					if err != nil {
+						return err
+					}
+					if string(data) != name {
+						return errors.Errorf(`read %q from %s`, data, name)
+					}
+					if _, err := s.ListFiles(ctx, ``); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		require.NoError(t, g.Wait())
+		files, err := s.ListFiles(ctx, ``)
+		require.NoError(t, err)
+		require.Len(t, files, workers*filesPerWorker)
+	})
+}
+
+func TestMemoryStorageListFilesSorted(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s := cloudimpl.NewMemoryStorage()
+	defer s.Close()
+	testListFilesSorted(t, s, ``)
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/stretchr/testify/require"
+)
+
+// providerStorage is an ExternalStorage whose Conf is that of provider, and
+// whose Delete fails with err.
+type providerStorage struct {
+	cloud.ExternalStorage
+	provider roachpb.ExternalStorageProvider
+	err      error
+}
+
+func (s *providerStorage) Conf() roachpb.ExternalStorage {
+	return roachpb.ExternalStorage{Provider: s.provider}
+}
+
+func (s *providerStorage) Delete(ctx context.Context, basename string) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.ExternalStorage.Delete(ctx, basename)
+}
+
+func TestMetricsStorage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	registry := metric.NewRegistry()
+	m := cloudimpl.NewStorageMetrics(registry, time.Minute)
+
+	// The metrics of a provider are added once a storage of it is wrapped.
+	registry.Each(func(name string, _ interface{}) { t.Fatalf("unexpected metric %s", name) })
+	inner := &providerStorage{
+		ExternalStorage: cloudimpl.NewMemoryStorage(), provider: roachpb.ExternalStorageProvider_S3,
+	}
+	s := cloudimpl.WithMetrics(inner, m)
+	gcs := cloudimpl.WithMetrics(&providerStorage{
+		ExternalStorage: cloudimpl.NewMemoryStorage(),
+		provider:        roachpb.ExternalStorageProvider_GoogleCloud,
+	}, m)
+	// Storages of the same provider share its metrics.
+	other := cloudimpl.WithMetrics(inner, m)
+
+	require.NoError(t, s.WriteFile(ctx, "a", bytes.NewReader([]byte("content"))))
+	require.NoError(t, other.WriteFileIfNotExists(ctx, "b", bytes.NewReader([]byte("content"))))
+	r, err := s.ReadFile(ctx, "a")
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	_, err = s.ReadFile(ctx, "missing")
+	require.Error(t, err)
+	_, err = s.ListFiles(ctx, "")
+	require.NoError(t, err)
+	_, err = s.Size(ctx, "a")
+	require.NoError(t, err)
+	_, err = s.Stat(ctx, "a")
+	require.NoError(t, err)
+	require.NoError(t, s.Delete(ctx, "a"))
+	// Canceled operations are not errors of the storage.
+	inner.err = context.Canceled
+	require.Error(t, s.Delete(ctx, "b"))
+	require.NoError(t, gcs.WriteFile(ctx, "a", bytes.NewReader(nil)))
+
+	counters := map[string]int64{}
+	latencies := map[string]int64{}
+	registry.Each(func(name string, v interface{}) {
+		switch v := v.(type) {
+		case *metric.Counter:
+			counters[name] = v.Count()
+		case *metric.Histogram:
+			latencies[name] = v.TotalCount()
+			labels := v.GetLabels()
+			require.Len(t, labels, 2, name)
+			require.Equal(t, "provider", labels[0].GetName())
+			require.Equal(t, "op", labels[1].GetName())
+		default:
+			t.Fatalf("unexpected metric %s of type %T", name, v)
+		}
+	})
+	require.Equal(t, map[string]int64{
+		"cloudstorage.s3.read.requests":             2,
+		"cloudstorage.s3.read.errors":               1,
+		"cloudstorage.s3.write.requests":            2,
+		"cloudstorage.s3.write.errors":              0,
+		"cloudstorage.s3.list.requests":             1,
+		"cloudstorage.s3.list.errors":               0,
+		"cloudstorage.s3.delete.requests":           2,
+		"cloudstorage.s3.delete.errors":             0,
+		"cloudstorage.s3.size.requests":             2,
+		"cloudstorage.s3.size.errors":               0,
+		"cloudstorage.google_cloud.read.requests":   0,
+		"cloudstorage.google_cloud.read.errors":     0,
+		"cloudstorage.google_cloud.write.requests":  1,
+		"cloudstorage.google_cloud.write.errors":    0,
+		"cloudstorage.google_cloud.list.requests":   0,
+		"cloudstorage.google_cloud.list.errors":     0,
+		"cloudstorage.google_cloud.delete.requests": 0,
+		"cloudstorage.google_cloud.delete.errors":   0,
+		"cloudstorage.google_cloud.size.requests":   0,
+		"cloudstorage.google_cloud.size.errors":     0,
+	}, counters)
+	require.Equal(t, map[string]int64{
+		"cloudstorage.s3.read.latency":             2,
+		"cloudstorage.s3.write.latency":            2,
+		"cloudstorage.s3.list.latency":             1,
+		"cloudstorage.s3.delete.latency":           2,
+		"cloudstorage.s3.size.latency":             2,
+		"cloudstorage.google_cloud.read.latency":   0,
+		"cloudstorage.google_cloud.write.latency":  1,
+		"cloudstorage.google_cloud.list.latency":   0,
+		"cloudstorage.google_cloud.delete.latency": 0,
+		"cloudstorage.google_cloud.size.latency":   0,
+	}, latencies)
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+var errInjectedWrite = errors.New("injected write failure")
+
+// failingWriteStorage wraps an ExternalStorage, failing its writes after
+// reading the first 1 KiB of their content.
+type failingWriteStorage struct {
+	cloud.ExternalStorage
+}
+
+func (f *failingWriteStorage) WriteFile(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	if _, err := io.CopyN(ioutil.Discard, content, 1<<10); err != nil {
+		return err
+	}
+	return errInjectedWrite
+}
+
+func readStorageFile(ctx context.Context, t *testing.T, s cloud.ExternalStorage, name string) []byte {
+	t.Helper()
+	r, err := s.ReadFile(ctx, name)
+	require.NoError(t, err)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return data
+}
+
+func TestMirrorStorage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	rng, _ := randutil.NewPseudoRand()
+	data := randutil.RandBytes(rng, 1<<20+100)
+
+	primary, secondary := cloudimpl.NewMemoryStorage(), cloudimpl.NewMemoryStorage()
+	s := cloudimpl.MirrorStorage(primary, secondary)
+	defer s.Close()
+
+	t.Run("write", func(t *testing.T) {
+		require.NoError(t, s.WriteFile(ctx, `file`, bytes.NewReader(data)))
+		require.Equal(t, data, readStorageFile(ctx, t, primary, `file`))
+		require.Equal(t, data, readStorageFile(ctx, t, secondary, `file`))
+	})
+
+	t.Run("write if not exists", func(t *testing.T) {
+		require.NoError(t, s.WriteFileIfNotExists(ctx, `new`, bytes.NewReader(data)))
+		require.Equal(t, data, readStorageFile(ctx, t, secondary, `new`))
+		err := s.WriteFileIfNotExists(ctx, `new`, bytes.NewReader(data))
+		require.True(t, errors.Is(err, cloudimpl.ErrFileAlreadyExists), "%v", err)
+	})
+
+	t.Run("read falls back to secondary", func(t *testing.T) {
+		require.NoError(t, secondary.WriteFile(ctx, `only-secondary`, bytes.NewReader([]byte(`data`))))
+		require.Equal(t, []byte(`data`), readStorageFile(ctx, t, s, `only-secondary`))
+		r, size, err := s.ReadFileAt(ctx, `only-secondary`, 2)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, int64(4), size)
+
+		_, err = s.ReadFile(ctx, `missing`)
+		require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, s.Delete(ctx, `file`))
+		for _, es := range []cloud.ExternalStorage{primary, secondary} {
+			info, err := es.Stat(ctx, `file`)
+			require.NoError(t, err)
+			require.False(t, info.Exists)
+		}
+	})
+}
+
+func TestMirrorStorageWriteFailure(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	rng, _ := randutil.NewPseudoRand()
+	data := randutil.RandBytes(rng, 1<<20)
+
+	for _, tc := range []struct {
+		name            string
+		primaryFails    bool
+		secondaryFails  bool
+		expectedErrRE   string
+		unexpectedErrRE string
+	}{
+		{name: `primary`, primaryFails: true, expectedErrRE: `writing file to primary storage`,
+			unexpectedErrRE: `secondary`},
+		{name: `secondary`, secondaryFails: true, expectedErrRE: `writing file to secondary storage`,
+			unexpectedErrRE: `primary`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			primary, secondary := cloudimpl.NewMemoryStorage(), cloudimpl.NewMemoryStorage()
+			dests := []cloud.ExternalStorage{primary, secondary}
+			if tc.primaryFails {
+				dests[0] = &failingWriteStorage{primary}
+			}
+			if tc.secondaryFails {
+				dests[1] = &failingWriteStorage{secondary}
+			}
+			s := cloudimpl.MirrorStorage(dests[0], dests[1])
+			defer s.Close()
+
+			err := s.WriteFile(ctx, `file`, bytes.NewReader(data))
+			require.True(t, errors.Is(err, errInjectedWrite), "%v", err)
+			require.True(t, testutils.IsError(err, tc.expectedErrRE), "%v", err)
+			require.False(t, testutils.IsError(err, tc.unexpectedErrRE), "%v", err)
+			// The write to the other destination is aborted.
+			for _, es := range []cloud.ExternalStorage{primary, secondary} {
+				info, err := es.Stat(ctx, `file`)
+				require.NoError(t, err)
+				require.False(t, info.Exists)
+			}
+		})
+	}
+}
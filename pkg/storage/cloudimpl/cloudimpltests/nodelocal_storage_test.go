@@ -11,16 +11,26 @@
 package cloudimpltests
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/blobs"
+	"github.com/cockroachdb/cockroach/pkg/blobs/blobspb"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
 	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
 )
 
 func TestPutLocal(t *testing.T) {
@@ -81,3 +91,242 @@ func TestLocalIOLimits(t *testing.T) {
 		}
 	}
 }
+
+func TestLocalStorageListFilesDoubleStar(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+	testSettings.ExternalIODir = p
+	clientFactory := blobs.TestBlobServiceClient(testSettings.ExternalIODir)
+
+	s, err := cloudimpl.ExternalStorageFromURI(ctx, "nodelocal://0/backup", base.ExternalIODirConfig{},
+		testSettings, clientFactory, security.RootUserName(), nil, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	for _, file := range []string{"a.sst", "2023/b.csv", "2023/01/c.csv", "2023/01/c.sst"} {
+		require.NoError(t, s.WriteFile(ctx, file, bytes.NewReader(nil)))
+	}
+
+	files, err := s.ListFiles(ctx, "**/*.sst")
+	require.NoError(t, err)
+	require.Equal(t, []string{"2023/01/c.sst", "a.sst"}, files)
+	files, err = s.ListFiles(ctx, "2023/**/*.csv")
+	require.NoError(t, err)
+	require.Equal(t, []string{"2023/01/c.csv", "2023/b.csv"}, files)
+
+	_, err = s.ListFiles(ctx, "../../**")
+	require.True(t, testutils.IsError(err, "outside of external-io-dir is not allowed"), "%v", err)
+}
+
+func TestLocalStorageListFilesSorted(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+	testSettings.ExternalIODir = p
+
+	s, err := cloudimpl.ExternalStorageFromURI(ctx, "nodelocal://0/backup", base.ExternalIODirConfig{},
+		testSettings, blobs.TestBlobServiceClient(testSettings.ExternalIODir), security.RootUserName(),
+		nil, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	testListFilesSorted(t, s, "**")
+}
+
+func TestLocalStorageDeleteAll(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+	testSettings.ExternalIODir = p
+
+	s, err := cloudimpl.ExternalStorageFromURI(ctx, "nodelocal://0/backup", base.ExternalIODirConfig{},
+		testSettings, blobs.TestBlobServiceClient(testSettings.ExternalIODir), security.RootUserName(),
+		nil, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for _, file := range []string{"2021/a.sst", "2021/sub/b.sst", "2021.txt", "2022/c.sst"} {
+		require.NoError(t, s.WriteFile(ctx, file, bytes.NewReader([]byte(file))))
+	}
+	// A file outside of the base path is not deleted.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(p, "other.sst"), nil, 0644))
+
+	require.NoError(t, s.DeleteAll(ctx, "2021/"))
+	files, err := s.ListFiles(ctx, "**")
+	require.NoError(t, err)
+	require.Equal(t, []string{"2021.txt", "2022/c.sst"}, files)
+
+	require.NoError(t, s.DeleteAll(ctx, ""))
+	files, err = s.ListFiles(ctx, "**")
+	require.NoError(t, err)
+	require.Empty(t, files)
+	_, err = os.Stat(filepath.Join(p, "other.sst"))
+	require.NoError(t, err)
+}
+
+func TestLocalStorageErrorMapping(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+	testSettings.ExternalIODir = p
+
+	s, err := cloudimpl.ExternalStorageFromURI(ctx, "nodelocal://0/backup", base.ExternalIODirConfig{},
+		testSettings, blobs.TestBlobServiceClient(testSettings.ExternalIODir), security.RootUserName(),
+		nil, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.ReadFile(ctx, "missing")
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+	_, err = s.Size(ctx, "missing")
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+	err = s.Delete(ctx, "missing")
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+}
+
+// statCountingBlobClient is a BlobClient that counts the calls to Stat.
+type statCountingBlobClient struct {
+	blobs.BlobClient
+	stats int
+}
+
+func (c *statCountingBlobClient) Stat(ctx context.Context, file string) (*blobspb.BlobStat, error) {
+	c.stats++
+	return c.BlobClient.Stat(ctx, file)
+}
+
+func TestLocalStorageListFilesExt(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+	testSettings.ExternalIODir = p
+	client := &statCountingBlobClient{}
+	clientFactory := func(ctx context.Context, dialing roachpb.NodeID) (blobs.BlobClient, error) {
+		var err error
+		client.BlobClient, err = blobs.TestBlobServiceClient(testSettings.ExternalIODir)(ctx, dialing)
+		return client, err
+	}
+
+	s, err := cloudimpl.ExternalStorageFromURI(ctx, "nodelocal://0/backup", base.ExternalIODirConfig{},
+		testSettings, clientFactory, security.RootUserName(), nil, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	modTime := timeutil.Unix(1600000000, 0)
+	for file, content := range map[string]string{"a.sst": "hello", "b.sst": "worlds", "c.csv": ""} {
+		require.NoError(t, s.WriteFile(ctx, file, bytes.NewReader([]byte(content))))
+		require.NoError(t, os.Chtimes(filepath.Join(p, "backup", file), modTime, modTime))
+	}
+
+	entries, err := s.ListFilesExt(ctx, "*.sst")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	// The files are listed along with their stats rather than stat'ed one by
+	// one, which for another node would each be a request.
+	require.Equal(t, 0, client.stats)
+	for i, expected := range []cloud.FileEntry{
+		{Path: "a.sst", Size: 5, ModTime: modTime},
+		{Path: "b.sst", Size: 6, ModTime: modTime},
+	} {
+		require.Equal(t, expected.Path, entries[i].Path)
+		require.Equal(t, expected.Size, entries[i].Size)
+		require.True(t, expected.ModTime.Equal(entries[i].ModTime),
+			"expected %s, got %s", expected.ModTime, entries[i].ModTime)
+	}
+	files, err := s.ListFiles(ctx, "*.sst")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.sst", "b.sst"}, files)
+
+	// An empty pattern suffix lists the absolute URIs matching the base.
+	g, err := cloudimpl.ExternalStorageFromURI(ctx, "nodelocal://0/backup/*.csv",
+		base.ExternalIODirConfig{}, testSettings, clientFactory, security.RootUserName(), nil, nil)
+	require.NoError(t, err)
+	defer g.Close()
+	entries, err = g.ListFilesExt(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "nodelocal://0/backup/c.csv", entries[0].Path)
+	require.Equal(t, int64(0), entries[0].Size)
+}
+
+func TestLocalStorageSync(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+	testSettings.ExternalIODir = p
+
+	s, err := cloudimpl.ExternalStorageFromURI(ctx, "nodelocal://0/backup", base.ExternalIODirConfig{},
+		testSettings, blobs.TestBlobServiceClient(testSettings.ExternalIODir), security.RootUserName(),
+		nil, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Implements(t, (*cloud.Syncer)(nil), s)
+
+	// Nothing was written yet.
+	require.NoError(t, cloudimpl.Sync(ctx, s))
+
+	for _, file := range []string{"a", "dir/b", "dir/c"} {
+		require.NoError(t, s.WriteFile(ctx, file, bytes.NewReader([]byte(file))))
+	}
+	require.NoError(t, s.Delete(ctx, "dir/c"))
+	require.NoError(t, cloudimpl.Sync(ctx, cloudimpl.WithRetry(s, cloudimpl.RetryOptions{})))
+
+	// The written files are flushed on the node, so Sync fails if one of them is
+	// removed behind the storage's back before it is synced.
+	require.NoError(t, s.WriteFileIfNotExists(ctx, "d", bytes.NewReader([]byte("d"))))
+	require.NoError(t, os.Remove(filepath.Join(p, "backup", "d")))
+	err = cloudimpl.Sync(ctx, s)
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+
+	// Files are no longer synced once they are deleted.
+	require.NoError(t, s.WriteFile(ctx, "d", bytes.NewReader([]byte("d"))))
+	require.NoError(t, s.Delete(ctx, "d"))
+	require.NoError(t, cloudimpl.Sync(ctx, s))
+}
+
+func TestLocalStorageValidate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+	testSettings.ExternalIODir = p
+	require.NoError(t, ioutil.WriteFile(filepath.Join(p, "file"), []byte("file"), 0644))
+
+	makeStorage := func(uri string) cloud.ExternalStorage {
+		s, err := cloudimpl.ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{},
+			testSettings, blobs.TestBlobServiceClient(testSettings.ExternalIODir), security.RootUserName(),
+			nil, nil)
+		require.NoError(t, err)
+		return s
+	}
+
+	// The path is created, and no file is left in it.
+	s := makeStorage("nodelocal://0/backup")
+	defer s.Close()
+	require.NoError(t, cloudimpl.Validate(ctx, s))
+	files, err := ioutil.ReadDir(filepath.Join(p, "backup"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	// A file is in the way of the path.
+	blocked := makeStorage("nodelocal://0/file/backup")
+	defer blocked.Close()
+	require.Error(t, cloudimpl.Validate(ctx, blocked))
+
+	// The path is outside of the external IO directory.
+	outside := makeStorage("nodelocal://0/../backup")
+	defer outside.Close()
+	require.Error(t, cloudimpl.Validate(ctx, outside))
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// pageListingStorage wraps an ExternalStorage whose listings are slow, tracking
+// the number of pages that are listed concurrently. Its pages contain each
+// file twice if duplicate is set, and fail if they start with failPrefix.
+type pageListingStorage struct {
+	cloud.ExternalStorage
+	duplicate  bool
+	failPrefix string
+
+	inFlight, maxInFlight int32
+}
+
+func (s *pageListingStorage) ListFilesPage(
+	ctx context.Context, prefix, token string, limit int,
+) ([]string, string, error) {
+	n := atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&s.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&s.maxInFlight, max, n) {
+			break
+		}
+	}
+	if s.failPrefix != `` && strings.HasPrefix(prefix, s.failPrefix) {
+		return nil, ``, errors.New(`injected failure`)
+	}
+	select {
+	case <-time.After(5 * time.Millisecond):
+	case <-ctx.Done():
+		return nil, ``, ctx.Err()
+	}
+	files, next, err := cloudimpl.ListFilesPage(ctx, s.ExternalStorage, prefix, token, limit)
+	if s.duplicate {
+		files = append(files, files...)
+	}
+	return files, next, err
+}
+
+func (s *pageListingStorage) ListFilesWithDelimiter(
+	ctx context.Context, prefix, delimiter string,
+) ([]string, []string, error) {
+	return cloudimpl.ListFilesWithDelimiter(ctx, s.ExternalStorage, prefix, delimiter)
+}
+
+func TestListFilesParallel(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	mem := cloudimpl.NewMemoryStorage()
+	var expected []string
+	write := func(name string) {
+		require.NoError(t, mem.WriteFile(ctx, name, bytes.NewReader(nil)))
+		expected = append(expected, name)
+	}
+	write(`top-a`)
+	write(`top-b`)
+	for i := 0; i < 40; i++ {
+		for _, name := range []string{`1`, `2`, `sub/3`, `sub/deeper/4`} {
+			write(fmt.Sprintf(`dir-%02d/%s`, i, name))
+		}
+	}
+	sort.Strings(expected)
+
+	t.Run("bounded concurrency", func(t *testing.T) {
+		s := &pageListingStorage{ExternalStorage: mem}
+		files, err := cloudimpl.ListFilesParallel(ctx, s, ``,
+			cloudimpl.ParallelListOptions{Parallelism: 4, PageSize: 3})
+		require.NoError(t, err)
+		require.Equal(t, expected, files)
+		require.LessOrEqual(t, int(s.maxInFlight), 4)
+		require.Greater(t, int(s.maxInFlight), 1)
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		files, err := cloudimpl.ListFilesParallel(ctx, &pageListingStorage{ExternalStorage: mem},
+			`dir-1`, cloudimpl.ParallelListOptions{})
+		require.NoError(t, err)
+		require.Len(t, files, 40)
+		for _, f := range files {
+			require.True(t, strings.HasPrefix(f, `dir-1`), f)
+		}
+		// The prefix need not end with the delimiter.
+		files, err = cloudimpl.ListFilesParallel(ctx, &pageListingStorage{ExternalStorage: mem},
+			`dir-07/s`, cloudimpl.ParallelListOptions{})
+		require.NoError(t, err)
+		require.Equal(t, []string{`dir-07/sub/3`, `dir-07/sub/deeper/4`}, files)
+	})
+
+	t.Run("duplicates", func(t *testing.T) {
+		s := &pageListingStorage{ExternalStorage: mem, duplicate: true}
+		files, err := cloudimpl.ListFilesParallel(ctx, s, ``, cloudimpl.ParallelListOptions{})
+		require.NoError(t, err)
+		require.Equal(t, expected, files)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		s := &pageListingStorage{ExternalStorage: mem, failPrefix: `dir-13/`}
+		_, err := cloudimpl.ListFilesParallel(ctx, s, ``,
+			cloudimpl.ParallelListOptions{Parallelism: 2})
+		require.True(t, testutils.IsError(err, `listing files with prefix dir-13/: injected failure`),
+			"%v", err)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		s := struct{ cloud.ExternalStorage }{mem}
+		_, err := cloudimpl.ListFilesParallel(ctx, s, ``, cloudimpl.ParallelListOptions{})
+		require.True(t, errors.Is(err, cloudimpl.ErrListingUnsupported), "%v", err)
+	})
+}
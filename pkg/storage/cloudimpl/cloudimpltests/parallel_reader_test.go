@@ -0,0 +1,201 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// latencyStorage wraps an ExternalStorage, waiting for latency before opening a
+// file, whose reads are then limited to bytesPerSec, like a single connection
+// to a distant storage. It records the offsets that files are opened at.
+type latencyStorage struct {
+	cloud.ExternalStorage
+	latency     time.Duration
+	bytesPerSec int64
+
+	mu struct {
+		syncutil.Mutex
+		offsets []int64
+	}
+}
+
+func (s *latencyStorage) ReadFileAt(
+	ctx context.Context, basename string, offset int64,
+) (io.ReadCloser, int64, error) {
+	s.mu.Lock()
+	s.mu.offsets = append(s.mu.offsets, offset)
+	s.mu.Unlock()
+	time.Sleep(s.latency)
+	r, size, err := s.ExternalStorage.ReadFileAt(ctx, basename, offset)
+	if err != nil || s.bytesPerSec == 0 {
+		return r, size, err
+	}
+	return &throttledReader{ReadCloser: r, bytesPerSec: s.bytesPerSec}, size, nil
+}
+
+// throttledReader is a reader whose reads wait for as long as reading their
+// bytes takes at bytesPerSec.
+type throttledReader struct {
+	io.ReadCloser
+	bytesPerSec int64
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > 64<<10 {
+		p = p[:64<<10]
+	}
+	n, err := r.ReadCloser.Read(p)
+	time.Sleep(time.Duration(int64(n) * int64(time.Second) / r.bytesPerSec))
+	return n, err
+}
+
+func TestParallelReader(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	rng, _ := randutil.NewPseudoRand()
+	s := cloudimpl.NewMemoryStorage()
+	defer s.Close()
+	data := randutil.RandBytes(rng, 1<<20+17)
+	require.NoError(t, s.WriteFile(ctx, `file`, bytes.NewReader(data)))
+	require.NoError(t, s.WriteFile(ctx, `empty`, bytes.NewReader(nil)))
+
+	for _, opts := range []cloudimpl.ParallelReadOptions{
+		{},
+		{RangeSize: 1 << 10, Parallelism: 1},
+		{RangeSize: 100 << 10, Parallelism: 3},
+		{RangeSize: 1 << 20, Parallelism: 8},
+		{RangeSize: 4 << 20, Parallelism: 2},
+	} {
+		t.Run(fmt.Sprintf("%d/%d", opts.RangeSize, opts.Parallelism), func(t *testing.T) {
+			r, err := cloudimpl.NewParallelReader(ctx, s, `file`, opts)
+			require.NoError(t, err)
+			read, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(data, read))
+			require.NoError(t, r.Close())
+		})
+	}
+
+	t.Run("ranges", func(t *testing.T) {
+		ls := &latencyStorage{ExternalStorage: s}
+		r, err := cloudimpl.NewParallelReader(ctx, ls, `file`,
+			cloudimpl.ParallelReadOptions{RangeSize: 256 << 10, Parallelism: 2})
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.ElementsMatch(t, []int64{0, 256 << 10, 512 << 10, 768 << 10, 1 << 20}, ls.mu.offsets)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		r, err := cloudimpl.NewParallelReader(ctx, s, `empty`, cloudimpl.ParallelReadOptions{})
+		require.NoError(t, err)
+		read, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Empty(t, read)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := cloudimpl.NewParallelReader(ctx, s, `missing`, cloudimpl.ParallelReadOptions{})
+		require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		// The file shrinks after its size was looked up.
+		r, err := cloudimpl.NewParallelReader(ctx, &latencyStorage{
+			ExternalStorage: s, latency: 10 * time.Millisecond,
+		}, `file`, cloudimpl.ParallelReadOptions{RangeSize: 256 << 10})
+		require.NoError(t, err)
+		require.NoError(t, s.WriteFile(ctx, `file`, bytes.NewReader(data[:300<<10])))
+		defer func() {
+			require.NoError(t, s.WriteFile(ctx, `file`, bytes.NewReader(data)))
+		}()
+		_, err = ioutil.ReadAll(r)
+		require.True(t, errors.Is(err, io.ErrUnexpectedEOF), "%v", err)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("close early", func(t *testing.T) {
+		r, err := cloudimpl.NewParallelReader(ctx, &latencyStorage{
+			ExternalStorage: s, bytesPerSec: 1 << 20,
+		}, `file`, cloudimpl.ParallelReadOptions{RangeSize: 64 << 10})
+		require.NoError(t, err)
+		buf := make([]byte, 10)
+		_, err = io.ReadFull(r, buf)
+		require.NoError(t, err)
+		require.Equal(t, data[:10], buf)
+		require.NoError(t, r.Close())
+		_, err = r.Read(buf)
+		require.Error(t, err)
+	})
+}
+
+// BenchmarkParallelReader compares reading a file from a storage with a high
+// latency and a limited bandwidth per request, sequentially and in parallel.
+func BenchmarkParallelReader(b *testing.B) {
+	ctx := context.Background()
+	rng, _ := randutil.NewPseudoRand()
+	data := randutil.RandBytes(rng, 8<<20)
+	s := cloudimpl.NewMemoryStorage()
+	defer s.Close()
+	if err := s.WriteFile(ctx, `file`, bytes.NewReader(data)); err != nil {
+		b.Fatal(err)
+	}
+	ls := &latencyStorage{ExternalStorage: s, latency: 20 * time.Millisecond, bytesPerSec: 32 << 20}
+
+	b.Run("sequential", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			r, _, err := ls.ReadFileAt(ctx, `file`, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(ioutil.Discard, r); err != nil {
+				b.Fatal(err)
+			}
+			_ = r.Close()
+		}
+	})
+	for _, parallelism := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				r, err := cloudimpl.NewParallelReader(ctx, ls, `file`, cloudimpl.ParallelReadOptions{
+					RangeSize: 512 << 10, Parallelism: parallelism,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(ioutil.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+				_ = r.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/blobs"
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/stretchr/testify/require"
+)
+
+// progressReports records the calls of a cloudimpl.ProgressFunc.
+type progressReports struct {
+	done, total []int64
+}
+
+func (p *progressReports) report(bytesDone, bytesTotal int64) {
+	p.done = append(p.done, bytesDone)
+	p.total = append(p.total, bytesTotal)
+}
+
+// requireProgress checks that the bytes done were reported in increasing order
+// up to last, not more often than every 256 KiB, with the given total.
+func (p *progressReports) requireProgress(t *testing.T, last, total int64) {
+	t.Helper()
+	require.NotEmpty(t, p.done)
+	for i := range p.done {
+		require.Equal(t, total, p.total[i])
+		if i > 0 {
+			require.Greater(t, p.done[i], p.done[i-1])
+		}
+		if i < len(p.done)-1 {
+			require.GreaterOrEqual(t, p.done[i], int64(i+1)*256<<10)
+		}
+	}
+	require.Equal(t, last, p.done[len(p.done)-1])
+}
+
+// readInSmallChunks reads all of r in reads of 100 bytes.
+func readInSmallChunks(t *testing.T, r io.Reader) []byte {
+	data, err := readInChunks(r, 100)
+	require.NoError(t, err)
+	return data
+}
+
+func TestProgressStorage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	rng, _ := randutil.NewPseudoRand()
+	data := randutil.RandBytes(rng, 1<<20+100)
+	size := int64(len(data))
+
+	var reports progressReports
+	s := cloudimpl.WithProgress(cloudimpl.NewMemoryStorage(), reports.report)
+	defer s.Close()
+
+	t.Run("write", func(t *testing.T) {
+		reports = progressReports{}
+		require.NoError(t, s.WriteFile(ctx, `file`, bytes.NewReader(data)))
+		reports.requireProgress(t, size, size)
+	})
+
+	t.Run("read", func(t *testing.T) {
+		reports = progressReports{}
+		r, err := s.ReadFile(ctx, `file`)
+		require.NoError(t, err)
+		require.Equal(t, data, readInSmallChunks(t, r))
+		require.NoError(t, r.Close())
+		reports.requireProgress(t, size, size)
+		// There are at most as many reports as 256 KiB chunks, despite the
+		// thousands of small reads.
+		require.LessOrEqual(t, len(reports.done), int(size/(256<<10))+1)
+	})
+
+	t.Run("read at", func(t *testing.T) {
+		reports = progressReports{}
+		r, _, err := s.ReadFileAt(ctx, `file`, 1<<20)
+		require.NoError(t, err)
+		require.Equal(t, data[1<<20:], readInSmallChunks(t, r))
+		require.NoError(t, r.Close())
+		require.Equal(t, []int64{size}, reports.done)
+	})
+
+	t.Run("close early", func(t *testing.T) {
+		reports = progressReports{}
+		r, err := s.ReadFile(ctx, `file`)
+		require.NoError(t, err)
+		_, err = r.Read(make([]byte, 10))
+		require.NoError(t, err)
+		require.Empty(t, reports.done)
+		require.NoError(t, r.Close())
+		require.Equal(t, []int64{10}, reports.done)
+	})
+
+	t.Run("unknown total", func(t *testing.T) {
+		reports = progressReports{}
+		content := strings.Repeat(`1,some row,of csv data\n`, 100000)
+		require.NoError(t, cloudimpl.WriteFileCompressed(
+			ctx, s, `file.gz`, strings.NewReader(content), gzipOptions))
+		require.NotEmpty(t, reports.done)
+		for _, total := range reports.total {
+			require.Equal(t, int64(-1), total)
+		}
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		reports = progressReports{}
+		src := cloudimpl.NewMemoryStorage()
+		defer src.Close()
+		require.NoError(t, src.WriteFile(ctx, `file`, bytes.NewReader(data)))
+		require.NoError(t, cloudimpl.CopyFrom(ctx, s, src, `file`, `copy`))
+		reports.requireProgress(t, size, size)
+	})
+}
+
+func TestProgressStorageWorkload(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	inner, err := cloudimpl.ExternalStorageFromURI(ctx,
+		`workload:///csv/bank/bank?version=1.0.0&rows=20000&payload-bytes=100`,
+		base.ExternalIODirConfig{}, testSettings, blobs.TestEmptyBlobClientFactory,
+		security.RootUserName(), nil, nil)
+	require.NoError(t, err)
+	defer inner.Close()
+	size, err := inner.Size(ctx, ``)
+	require.NoError(t, err)
+
+	// The total of generated data is computed from the generator.
+	var reports progressReports
+	s := cloudimpl.WithProgress(inner, reports.report)
+	r, err := s.ReadFile(ctx, ``)
+	require.NoError(t, err)
+	read, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, size, int64(len(read)))
+	reports.requireProgress(t, size, size)
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/blobs"
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/ctxgroup"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/quotapool"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// requireDuration checks that a transfer limited to rate with a burst of burst
+// bytes took about as long as moving n bytes at that rate should.
+func requireDuration(t *testing.T, elapsed time.Duration, n, rate, burst int64) {
+	t.Helper()
+	expected := time.Duration(float64(n-burst) / float64(rate) * float64(time.Second))
+	require.GreaterOrEqual(t, int64(elapsed), int64(expected*8/10),
+		"transfer of %d bytes took %s, expected about %s", n, elapsed, expected)
+	require.Less(t, int64(elapsed), int64(expected*5),
+		"transfer of %d bytes took %s, expected about %s", n, elapsed, expected)
+}
+
+func TestRateLimitReaderWriter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	const rate, burst, n = 256 << 10, 64 << 10, 192 << 10
+	data := bytes.Repeat([]byte("x"), n)
+
+	t.Run("reader", func(t *testing.T) {
+		limiter := quotapool.NewRateLimiter("test", rate, burst)
+		start := timeutil.Now()
+		read, err := ioutil.ReadAll(cloudimpl.RateLimitReader(ctx, bytes.NewReader(data), limiter))
+		require.NoError(t, err)
+		require.Equal(t, data, read)
+		requireDuration(t, timeutil.Since(start), n, rate, burst)
+	})
+
+	t.Run("writer", func(t *testing.T) {
+		limiter := quotapool.NewRateLimiter("test", rate, burst)
+		var buf bytes.Buffer
+		start := timeutil.Now()
+		_, err := io.Copy(cloudimpl.RateLimitWriter(ctx, &buf, limiter), bytes.NewReader(data))
+		require.NoError(t, err)
+		require.Equal(t, data, buf.Bytes())
+		requireDuration(t, timeutil.Since(start), n, rate, burst)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		limiter := quotapool.NewRateLimiter("test", 1, 1)
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := ioutil.ReadAll(cloudimpl.RateLimitReader(ctx, bytes.NewReader(data), limiter))
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error: %v", err)
+	})
+}
+
+func TestStorageRateLimit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+	testSettings.ExternalIODir = p
+
+	// The burst of the limiters is one second's worth of bytes.
+	const rate, n = 256 << 10, 384 << 10
+	u := testSettings.MakeUpdater()
+	for _, setting := range []string{
+		cloudimpl.CloudstorageReadBytesPerSecSetting, cloudimpl.CloudstorageWriteBytesPerSecSetting,
+	} {
+		require.NoError(t, u.Set(setting, strconv.Itoa(rate), "z"))
+		defer func(setting string) {
+			require.NoError(t, u.Set(setting, "0", "z"))
+		}(setting)
+	}
+
+	s, err := cloudimpl.ExternalStorageFromURI(ctx, "nodelocal://0/limited", base.ExternalIODirConfig{},
+		testSettings, blobs.TestBlobServiceClient(testSettings.ExternalIODir), security.RootUserName(),
+		nil, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	data := bytes.Repeat([]byte("x"), n)
+	start := timeutil.Now()
+	require.NoError(t, s.WriteFile(ctx, "f", bytes.NewReader(data)))
+	requireDuration(t, timeutil.Since(start), n, rate, rate)
+
+	// Concurrent reads share the limit of the storage, so reading the file twice
+	// at once is limited to the rate in aggregate.
+	start = timeutil.Now()
+	g := ctxgroup.WithContext(ctx)
+	for i := 0; i < 2; i++ {
+		g.GoCtx(func(ctx context.Context) error {
+			r, err := s.ReadFile(ctx, "f")
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			_, err = io.Copy(ioutil.Discard, r)
+			return err
+		})
+	}
+	require.NoError(t, g.Wait())
+	requireDuration(t, timeutil.Since(start), 2*n, rate, rate)
+}
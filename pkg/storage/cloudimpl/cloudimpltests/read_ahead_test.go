@@ -0,0 +1,125 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/stretchr/testify/require"
+)
+
+// slowReader is a reader over data that waits for latency on every read, like
+// a reader of a response body over a high-latency link, and counts its reads.
+type slowReader struct {
+	data    []byte
+	latency time.Duration
+	reads   int
+	closes  int
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	r.reads++
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if r.latency > 0 {
+		time.Sleep(r.latency)
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *slowReader) Close() error {
+	r.closes++
+	return nil
+}
+
+// readInChunks reads all of r in reads of size bytes.
+func readInChunks(r io.Reader, size int) ([]byte, error) {
+	var out bytes.Buffer
+	buf := make([]byte, size)
+	for {
+		n, err := r.Read(buf)
+		out.Write(buf[:n])
+		if err == io.EOF {
+			return out.Bytes(), nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func TestReadAheadReader(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewPseudoRand()
+	data := randutil.RandBytes(rng, 1<<20+123)
+
+	t.Run("small reads", func(t *testing.T) {
+		slow := &slowReader{data: data}
+		r := cloudimpl.NewReadAheadReader(slow, 64<<10)
+		read, err := readInChunks(r, 100)
+		require.NoError(t, err)
+		require.Equal(t, data, read)
+		// Each read of slow fills the buffer, plus one read for EOF.
+		require.Equal(t, len(data)/(64<<10)+2, slow.reads)
+		require.NoError(t, r.Close())
+		require.Equal(t, 1, slow.closes)
+	})
+
+	t.Run("large reads", func(t *testing.T) {
+		slow := &slowReader{data: data}
+		r := cloudimpl.NewReadAheadReader(slow, 4<<10)
+		read, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, read)
+		require.NoError(t, r.Close())
+		require.Equal(t, 1, slow.closes)
+	})
+}
+
+// BenchmarkReadAheadReader compares reading a slow reader in small reads with
+// and without read-ahead.
+func BenchmarkReadAheadReader(b *testing.B) {
+	rng, _ := randutil.NewPseudoRand()
+	data := randutil.RandBytes(rng, 4<<20)
+
+	for _, size := range []int{0, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			reads := 0
+			for i := 0; i < b.N; i++ {
+				slow := &slowReader{data: data, latency: 100 * time.Microsecond}
+				var r io.ReadCloser = slow
+				if size > 0 {
+					r = cloudimpl.NewReadAheadReader(slow, size)
+				}
+				if _, err := readInChunks(r, 4<<10); err != nil {
+					b.Fatal(err)
+				}
+				if err := r.Close(); err != nil {
+					b.Fatal(err)
+				}
+				reads += slow.reads
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// breakingStorage is an ExternalStorage of a single file whose streams fail
+// with err after breakAfter bytes, the first breaks times they are opened, and
+// whose opens fail with err the first openFailures times after the first.
+type breakingStorage struct {
+	cloud.ExternalStorage
+	content      []byte
+	err          error
+	breakAfter   int
+	breaks       int
+	openFailures int
+	// opens are the offsets the file was opened at, including failed opens.
+	opens []int64
+}
+
+func (s *breakingStorage) ReadFileAt(
+	_ context.Context, _ string, offset int64,
+) (io.ReadCloser, int64, error) {
+	s.opens = append(s.opens, offset)
+	if len(s.opens) > 1 && s.openFailures > 0 {
+		s.openFailures--
+		return nil, 0, s.err
+	}
+	r := &breakingReader{data: s.content[offset:], remaining: -1}
+	if s.breaks > 0 {
+		s.breaks--
+		r.remaining, r.err = s.breakAfter, s.err
+	}
+	return ioutil.NopCloser(r), int64(len(s.content)), nil
+}
+
+// breakingReader reads data, failing with err after remaining bytes unless
+// remaining is negative.
+type breakingReader struct {
+	data      []byte
+	remaining int
+	err       error
+}
+
+func (r *breakingReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, r.err
+	}
+	if r.remaining > 0 && len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	if r.remaining > 0 {
+		r.remaining -= n
+		if r.remaining == 0 {
+			// Deliver the last bytes of the stream along with its error.
+			return n, r.err
+		}
+	}
+	return n, nil
+}
+
+func TestResilientReader(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	content := make([]byte, 100)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	opts := cloudimpl.RetryOptions{
+		MaxRetries:     20,
+		InitialBackoff: time.Microsecond,
+		MaxBackoff:     time.Millisecond,
+	}
+	read := func(
+		es *breakingStorage, offset int64, opts cloudimpl.RetryOptions,
+	) ([]byte, error) {
+		r, size, err := cloudimpl.NewResilientReader(ctx, es, `f`, offset, opts)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(content)), size)
+		defer func() { require.NoError(t, r.Close()) }()
+		return ioutil.ReadAll(r)
+	}
+
+	for name, transient := range map[string]error{
+		`connection reset`: econnreset,
+		`unexpected EOF`:   io.ErrUnexpectedEOF,
+	} {
+		t.Run(name, func(t *testing.T) {
+			es := &breakingStorage{content: content, err: transient, breakAfter: 30, breaks: 3}
+			data, err := read(es, 0, opts)
+			require.NoError(t, err)
+			require.Equal(t, content, data)
+			// Each stream is reopened where the previous one broke.
+			require.Equal(t, []int64{0, 30, 60, 90}, es.opens)
+		})
+	}
+
+	t.Run("offset", func(t *testing.T) {
+		es := &breakingStorage{content: content, err: econnreset, breakAfter: 7, breaks: 100}
+		data, err := read(es, 42, opts)
+		require.NoError(t, err)
+		require.Equal(t, content[42:], data)
+		require.Equal(t, int64(42), es.opens[0])
+		require.Len(t, es.opens, 9)
+	})
+
+	t.Run("transient open failures", func(t *testing.T) {
+		es := &breakingStorage{
+			content: content, err: econnreset, breakAfter: 50, breaks: 1, openFailures: 2,
+		}
+		data, err := read(es, 0, opts)
+		require.NoError(t, err)
+		require.Equal(t, content, data)
+		require.Equal(t, []int64{0, 50, 50, 50}, es.opens)
+	})
+
+	t.Run("too many retries", func(t *testing.T) {
+		es := &breakingStorage{content: content, err: econnreset, breakAfter: 10, breaks: 100}
+		limited := opts
+		limited.MaxRetries = 3
+		data, err := read(es, 0, limited)
+		require.True(t, errors.Is(err, econnreset), "%v", err)
+		require.Contains(t, err.Error(), `reading f failed after 3 retries`)
+		// The bytes read before the stream broke for the last time are kept.
+		require.Equal(t, content[:40], data)
+		require.Len(t, es.opens, 4)
+
+		// Without retries, the error of the stream is returned as is.
+		es = &breakingStorage{content: content, err: econnreset, breakAfter: 10, breaks: 100}
+		limited.MaxRetries = 0
+		data, err = read(es, 0, limited)
+		require.Equal(t, econnreset, err)
+		require.Equal(t, content[:10], data)
+		require.Len(t, es.opens, 1)
+	})
+
+	t.Run("permanent error", func(t *testing.T) {
+		boom := errors.New(`boom`)
+		es := &breakingStorage{content: content, err: boom, breakAfter: 10, breaks: 1}
+		data, err := read(es, 0, opts)
+		require.Equal(t, boom, err)
+		require.Equal(t, content[:10], data)
+		require.Len(t, es.opens, 1)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		es := &breakingStorage{content: content, err: econnreset, breakAfter: 10, breaks: 100}
+		slow := opts
+		slow.InitialBackoff, slow.MaxBackoff = time.Hour, time.Hour
+		r, _, err := cloudimpl.NewResilientReader(ctx, es, `f`, 0, slow)
+		require.NoError(t, err)
+		defer r.Close()
+		_, err = r.Read(make([]byte, 5))
+		require.NoError(t, err)
+		// The stream breaks after its next 5 bytes, and since the read is
+		// canceled, it fails rather than waiting to reopen the file.
+		cancel()
+		n, err := r.Read(make([]byte, 10))
+		require.Equal(t, 5, n)
+		require.True(t, errors.Is(err, context.Canceled), "%v", err)
+	})
+}
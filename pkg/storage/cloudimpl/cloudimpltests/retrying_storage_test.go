@@ -0,0 +1,247 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/blobs"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+)
+
+// flakyStorage is an ExternalStorage whose operations fail with err the first
+// failures times they are called.
+type flakyStorage struct {
+	cloud.ExternalStorage
+	err      error
+	failures int
+	calls    int
+	written  []string
+}
+
+func (f *flakyStorage) attempt() error {
+	f.calls++
+	if f.calls <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+func (f *flakyStorage) ReadFile(_ context.Context, _ string) (io.ReadCloser, error) {
+	if err := f.attempt(); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(strings.NewReader(`data`)), nil
+}
+
+func (f *flakyStorage) WriteFile(_ context.Context, _ string, content io.ReadSeeker) error {
+	b, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	f.written = append(f.written, string(b))
+	return f.attempt()
+}
+
+// WriteFileIfNotExists stores the content even when the attempt fails, as a
+// request that times out after reaching the server does.
+func (f *flakyStorage) WriteFileIfNotExists(
+	_ context.Context, _ string, content io.ReadSeeker,
+) error {
+	if len(f.written) > 0 {
+		f.calls++
+		return errors.Wrap(cloudimpl.ErrFileAlreadyExists, `exists`)
+	}
+	b, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	f.written = append(f.written, string(b))
+	return f.attempt()
+}
+
+func (f *flakyStorage) ListFiles(_ context.Context, _ string) ([]string, error) {
+	if err := f.attempt(); err != nil {
+		return nil, err
+	}
+	return []string{`a`, `b`}, nil
+}
+
+func (f *flakyStorage) Size(_ context.Context, _ string) (int64, error) {
+	if err := f.attempt(); err != nil {
+		return 0, err
+	}
+	return 4, nil
+}
+
+func TestRetryingStorage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	opts := cloudimpl.RetryOptions{
+		MaxRetries:     3,
+		InitialBackoff: time.Microsecond,
+		MaxBackoff:     time.Millisecond,
+	}
+
+	t.Run("transient", func(t *testing.T) {
+		inner := &flakyStorage{err: econnreset, failures: 2}
+		s := cloudimpl.WithRetry(inner, opts)
+		r, err := s.ReadFile(ctx, `f`)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, `data`, string(data))
+		require.Equal(t, 3, inner.calls)
+
+		inner.calls = 0
+		files, err := s.ListFiles(ctx, ``)
+		require.NoError(t, err)
+		require.Equal(t, []string{`a`, `b`}, files)
+		require.Equal(t, 3, inner.calls)
+
+		inner.calls = 0
+		size, err := s.Size(ctx, `f`)
+		require.NoError(t, err)
+		require.Equal(t, int64(4), size)
+		require.Equal(t, 3, inner.calls)
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		inner := &flakyStorage{err: &googleapi.Error{Code: http.StatusTooManyRequests}, failures: 2}
+		_, err := cloudimpl.WithRetry(inner, opts).ReadFile(ctx, `f`)
+		require.NoError(t, err)
+		require.Equal(t, 3, inner.calls)
+
+		var requests int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&requests, 1) <= 2 {
+				http.Error(w, `slow down`, http.StatusTooManyRequests)
+				return
+			}
+			_, _ = w.Write([]byte(`data`))
+		}))
+		defer srv.Close()
+		store, err := cloudimpl.MakeHTTPStorage(ctx, cloudimpl.ExternalStorageContext{Settings: testSettings},
+			roachpb.ExternalStorage{HttpPath: roachpb.ExternalStorage_Http{BaseUri: srv.URL}})
+		require.NoError(t, err)
+		defer store.Close()
+		r, err := cloudimpl.WithRetry(store, opts).ReadFile(ctx, `f`)
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, `data`, string(data))
+		require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("too many failures", func(t *testing.T) {
+		inner := &flakyStorage{err: econnreset, failures: 10}
+		_, err := cloudimpl.WithRetry(inner, opts).ReadFile(ctx, `f`)
+		require.True(t, errors.Is(err, econnreset))
+		require.Equal(t, opts.MaxRetries+1, inner.calls)
+	})
+
+	t.Run("permanent", func(t *testing.T) {
+		for _, permanent := range []error{
+			errors.New(`unknown table nope for generator bank`),
+			errors.Wrap(cloudimpl.ErrFileDoesNotExist, `missing`),
+		} {
+			inner := &flakyStorage{err: permanent, failures: 10}
+			_, err := cloudimpl.WithRetry(inner, opts).ReadFile(ctx, `f`)
+			require.Equal(t, permanent, err)
+			require.Equal(t, 1, inner.calls)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		inner := &flakyStorage{err: econnreset, failures: 1}
+		_, err := cloudimpl.WithRetry(inner, cloudimpl.RetryOptions{}).ReadFile(ctx, `f`)
+		require.True(t, errors.Is(err, econnreset))
+		require.Equal(t, 1, inner.calls)
+	})
+
+	t.Run("write rewinds content", func(t *testing.T) {
+		inner := &flakyStorage{err: econnreset, failures: 2}
+		err := cloudimpl.WithRetry(inner, opts).WriteFile(ctx, `f`, bytes.NewReader([]byte(`hello`)))
+		require.NoError(t, err)
+		require.Equal(t, []string{`hello`, `hello`, `hello`}, inner.written)
+
+		// Content that cannot seek is written once, and the error of that
+		// attempt is returned rather than a retry of a truncated write.
+		inner = &flakyStorage{err: econnreset, failures: 1}
+		err = cloudimpl.WithRetry(inner, opts).WriteFile(ctx, `f`, unseekableReader{strings.NewReader(`hello`)})
+		require.True(t, testutils.IsError(err, `connection reset by peer: cannot retry a write of content `+
+			`that cannot seek`), "%v", err)
+		require.Equal(t, []string{`hello`}, inner.written)
+
+		inner = &flakyStorage{err: econnreset}
+		err = cloudimpl.WithRetry(inner, opts).WriteFile(ctx, `f`, unseekableReader{strings.NewReader(`hello`)})
+		require.NoError(t, err)
+		require.Equal(t, []string{`hello`}, inner.written)
+	})
+
+	t.Run("conditional write", func(t *testing.T) {
+		inner := &flakyStorage{err: econnreset}
+		s := cloudimpl.WithRetry(inner, opts)
+		require.NoError(t, s.WriteFileIfNotExists(ctx, `f`, bytes.NewReader([]byte(`hello`))))
+		err := s.WriteFileIfNotExists(ctx, `f`, bytes.NewReader([]byte(`hello`)))
+		require.True(t, errors.Is(err, cloudimpl.ErrFileAlreadyExists), "%v", err)
+		require.Equal(t, 2, inner.calls)
+
+		// The file existing after an attempt that failed may only mean that the
+		// attempt wrote it, so the error of the attempt is returned.
+		inner = &flakyStorage{err: econnreset, failures: 1}
+		err = cloudimpl.WithRetry(inner, opts).WriteFileIfNotExists(
+			ctx, `f`, bytes.NewReader([]byte(`hello`)))
+		require.True(t, errors.Is(err, econnreset), "%v", err)
+		require.False(t, errors.Is(err, cloudimpl.ErrFileAlreadyExists), "%v", err)
+		require.True(t, testutils.IsError(err, `may have succeeded`), "%v", err)
+		require.Equal(t, 2, inner.calls)
+		require.Equal(t, []string{`hello`}, inner.written)
+	})
+
+	t.Run("context canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		inner := &flakyStorage{err: econnreset, failures: 10}
+		slow := cloudimpl.RetryOptions{MaxRetries: 10, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+		_, err := cloudimpl.WithRetry(inner, slow).ReadFile(ctx, `f`)
+		require.True(t, errors.Is(err, context.Canceled))
+		require.Equal(t, 1, inner.calls)
+	})
+
+	t.Run("workload opts out", func(t *testing.T) {
+		s, err := cloudimpl.ExternalStorageFromURI(ctx, `workload:///csv/bank/bank?version=1.0.0`,
+			base.ExternalIODirConfig{}, testSettings, blobs.TestEmptyBlobClientFactory,
+			security.RootUserName(), nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, s, cloudimpl.WithRetry(s, opts))
+	})
+}
@@ -11,12 +11,23 @@
 package cloudimpltests
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/xml"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -29,6 +40,8 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/errors"
 	"github.com/stretchr/testify/require"
 )
@@ -311,3 +324,1333 @@ func TestAntagonisticS3Read(t *testing.T) {
 
 	testAntagonisticRead(t, conf)
 }
+
+// fakeS3 is an in-memory stand-in for the S3 API, serving path-style requests
+// to a custom endpoint. It records the requests it receives so that tests can
+// assert the fields set by the S3 client.
+type fakeS3 struct {
+	*httptest.Server
+	mu struct {
+		syncutil.Mutex
+		requests []*http.Request
+		objects  map[string][]byte
+		// parts holds the parts of in-progress multipart uploads, keyed by
+		// upload ID and part number.
+		parts map[string]map[int][]byte
+		// failParts, if set, fails the upload of every part.
+		failParts bool
+		// failPuts is the number of the next PUTs of objects or parts that fail
+		// with a retryable error once their body is received. The bodies of the
+		// failed PUTs are kept in failedBodies.
+		failPuts     int
+		failedBodies [][]byte
+		// lockedObjects are the paths of the objects that DeleteObjects fails to
+		// delete.
+		lockedObjects map[string]bool
+		// deniedObjects are the paths of the objects whose requests are
+		// rejected with AccessDenied.
+		deniedObjects map[string]bool
+		// movedBuckets are the buckets whose requests are rejected with a
+		// PermanentRedirect, as those of a bucket in another region are.
+		movedBuckets map[string]bool
+		// etags overrides the ETags of objects, which are otherwise the MD5
+		// digests of their content.
+		etags map[string]string
+	}
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	f := &fakeS3{}
+	f.mu.objects = make(map[string][]byte)
+	f.mu.parts = make(map[string]map[int][]byte)
+	f.mu.etags = make(map[string]string)
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading request body: %v", err)
+		}
+		// The response is buffered so that it is not written while holding the
+		// lock, which would block other requests on a slow client.
+		rec := httptest.NewRecorder()
+		f.serve(t, rec, r, body)
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		if w.Header().Get(`Content-Length`) == `` {
+			w.Header().Set(`Content-Length`, strconv.Itoa(rec.Body.Len()))
+		}
+		w.WriteHeader(rec.Code)
+		_, _ = w.Write(rec.Body.Bytes())
+	}))
+	return f
+}
+
+func (f *fakeS3) serve(t *testing.T, w http.ResponseWriter, r *http.Request, body []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mu.requests = append(f.mu.requests, r)
+	q := r.URL.Query()
+	uploadID := q.Get(`uploadId`)
+	switch {
+	case f.mu.deniedObjects[r.URL.Path]:
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`<Error><Code>AccessDenied</Code></Error>`))
+	case f.mu.movedBuckets[strings.SplitN(r.URL.Path, `/`, 3)[1]]:
+		w.WriteHeader(http.StatusMovedPermanently)
+		_, _ = w.Write([]byte(`<Error><Code>PermanentRedirect</Code></Error>`))
+	case r.Method == http.MethodPost && q[`uploads`] != nil:
+		uploadID = fmt.Sprintf(`upload-%d`, len(f.mu.requests))
+		f.mu.parts[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><UploadId>%s</UploadId>`+
+			`</InitiateMultipartUploadResult>`, uploadID)
+	case r.Method == http.MethodPut && f.mu.failPuts > 0:
+		f.mu.failPuts--
+		f.mu.failedBodies = append(f.mu.failedBodies, body)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`<Error><Code>InternalError</Code></Error>`))
+	case r.Method == http.MethodPut && uploadID != ``:
+		if f.mu.failParts {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`<Error><Code>InvalidRequest</Code></Error>`))
+			return
+		}
+		partNumber, err := strconv.Atoi(q.Get(`partNumber`))
+		if err != nil {
+			t.Errorf("invalid part number: %v", err)
+		}
+		f.mu.parts[uploadID][partNumber] = body
+		w.Header().Set(`ETag`, fmt.Sprintf(`"part-%d"`, partNumber))
+	case r.Method == http.MethodPost && uploadID != ``:
+		var data []byte
+		for i := 1; i <= len(f.mu.parts[uploadID]); i++ {
+			data = append(data, f.mu.parts[uploadID][i]...)
+		}
+		f.mu.objects[r.URL.Path] = data
+		f.mu.etags[r.URL.Path] = fmt.Sprintf(`"%x-%d"`, md5.Sum(data), len(f.mu.parts[uploadID]))
+		delete(f.mu.parts, uploadID)
+		_, _ = w.Write([]byte(`<CompleteMultipartUploadResult><ETag>"object"</ETag>` +
+			`</CompleteMultipartUploadResult>`))
+	case r.Method == http.MethodPost && q[`delete`] != nil:
+		var req struct {
+			Objects []struct {
+				Key string
+			} `xml:"Object"`
+		}
+		if err := xml.Unmarshal(body, &req); err != nil {
+			t.Errorf("invalid delete request: %v", err)
+		}
+		fmt.Fprint(w, `<DeleteResult>`)
+		for _, object := range req.Objects {
+			if f.mu.lockedObjects[`/bucket/`+object.Key] {
+				fmt.Fprintf(w, `<Error><Key>%s</Key><Code>AccessDenied</Code>`+
+					`<Message>locked</Message></Error>`, object.Key)
+				continue
+			}
+			delete(f.mu.objects, `/bucket/`+object.Key)
+		}
+		fmt.Fprint(w, `</DeleteResult>`)
+	case r.Method == http.MethodDelete && uploadID != ``:
+		delete(f.mu.parts, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get(`X-Amz-Copy-Source`) != ``:
+		source, err := url.PathUnescape(r.Header.Get(`X-Amz-Copy-Source`))
+		if err != nil {
+			t.Errorf("invalid copy source: %v", err)
+		}
+		data, ok := f.mu.objects[`/`+source]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+			return
+		}
+		f.mu.objects[r.URL.Path] = data
+		delete(f.mu.etags, r.URL.Path)
+		_, _ = w.Write([]byte(`<CopyObjectResult><ETag>"object"</ETag></CopyObjectResult>`))
+	case r.Method == http.MethodPut:
+		f.mu.objects[r.URL.Path] = body
+		delete(f.mu.etags, r.URL.Path)
+	case r.Method == http.MethodGet && q[`prefix`] != nil:
+		var names []string
+		for name := range f.mu.objects {
+			if key := strings.TrimPrefix(name, `/bucket/`); strings.HasPrefix(key, q.Get(`prefix`)) {
+				names = append(names, key)
+			}
+		}
+		sort.Strings(names)
+		// Version 2 listings are paged by max-keys, with the last key of a page
+		// as the continuation token of the next.
+		var next string
+		if q.Get(`list-type`) == `2` {
+			if token := q.Get(`continuation-token`); token != `` {
+				names = names[sort.SearchStrings(names, token+"\x00"):]
+			}
+			if max, err := strconv.Atoi(q.Get(`max-keys`)); err == nil && max < len(names) {
+				names = names[:max]
+				next = names[max-1]
+			}
+		}
+		fmt.Fprint(w, `<ListBucketResult>`)
+		for _, name := range names {
+			fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size></Contents>`,
+				name, len(f.mu.objects[`/bucket/`+name]))
+		}
+		if next != `` {
+			fmt.Fprintf(w, `<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>`, next)
+		} else {
+			fmt.Fprint(w, `<IsTruncated>false</IsTruncated>`)
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	case r.Method == http.MethodHead && r.URL.Path == `/bucket`:
+		// The bucket exists.
+	case r.Method == http.MethodHead:
+		data, ok := f.mu.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(`Content-Length`, strconv.Itoa(len(data)))
+		etag, ok := f.mu.etags[r.URL.Path]
+		if !ok {
+			etag = fmt.Sprintf(`"%x"`, md5.Sum(data))
+		}
+		w.Header().Set(`ETag`, etag)
+	case r.Method == http.MethodGet:
+		data, ok := f.mu.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+			return
+		}
+		if rng := r.Header.Get(`Range`); rng != `` {
+			var start int
+			if _, err := fmt.Sscanf(rng, `bytes=%d-`, &start); err != nil || start >= len(data) {
+				t.Errorf("unexpected range %q of object of %d bytes", rng, len(data))
+			}
+			w.Header().Set(`Content-Range`, fmt.Sprintf(`bytes %d-%d/%d`, start, len(data)-1, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			data = data[start:]
+		}
+		_, _ = w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(f.mu.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// uri returns the URI of a path in the bucket of the fake server, with the
+// given additional query parameters.
+func (f *fakeS3) uri(path string, params url.Values) string {
+	q := url.Values{
+		cloudimpl.AWSAccessKeyParam: []string{`key`},
+		cloudimpl.AWSSecretParam:    []string{`secret`},
+		cloudimpl.AWSEndpointParam:  []string{f.URL},
+	}
+	for k, v := range params {
+		q[k] = v
+	}
+	return (&url.URL{Scheme: `s3`, Host: `bucket`, Path: path, RawQuery: q.Encode()}).String()
+}
+
+// requests returns the requests received by the server with any of the given
+// methods, in the order they were received.
+func (f *fakeS3) requests(methods ...string) []*http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var reqs []*http.Request
+	for _, r := range f.mu.requests {
+		for _, method := range methods {
+			if r.Method == method {
+				reqs = append(reqs, r)
+			}
+		}
+	}
+	return reqs
+}
+
+func TestS3ServerSideEncryptionHeaders(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	srv := newFakeS3(t)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		mode, kmsID       string
+		expectedMode      string
+		expectedKMSHeader string
+	}{
+		{mode: ``, kmsID: ``},
+		{mode: `AES256`, expectedMode: `AES256`},
+		{mode: `aws:kms`, kmsID: `key-a`, expectedMode: `aws:kms`, expectedKMSHeader: `key-a`},
+		// A KMS ID alone implies the aws:kms mode.
+		{kmsID: `key-b`, expectedMode: `aws:kms`, expectedKMSHeader: `key-b`},
+	} {
+		t.Run(tc.mode+`/`+tc.kmsID, func(t *testing.T) {
+			params := url.Values{}
+			if tc.mode != `` {
+				params.Set(cloudimpl.AWSServerSideEncryptionMode, tc.mode)
+			}
+			if tc.kmsID != `` {
+				params.Set(cloudimpl.AWSServerSideEncryptionKMSID, tc.kmsID)
+			}
+			s, err := makeS3Storage(ctx, srv.uri(`/sse`, params), user)
+			require.NoError(t, err)
+			defer s.Close()
+
+			before := len(srv.requests(http.MethodPut))
+			require.NoError(t, s.WriteFile(ctx, `f`, bytes.NewReader([]byte(`data`))))
+			puts := srv.requests(http.MethodPut)
+			require.Len(t, puts, before+1)
+			put := puts[len(puts)-1]
+			require.Equal(t, `/bucket/sse/f`, put.URL.Path)
+			require.Equal(t, tc.expectedMode, put.Header.Get(`X-Amz-Server-Side-Encryption`))
+			require.Equal(t, tc.expectedKMSHeader,
+				put.Header.Get(`X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id`))
+		})
+	}
+
+	// A KMS ID conflicts with the AES256 mode.
+	_, err := makeS3Storage(ctx, srv.uri(`/sse`, url.Values{
+		cloudimpl.AWSServerSideEncryptionMode:  []string{`AES256`},
+		cloudimpl.AWSServerSideEncryptionKMSID: []string{`key-a`},
+	}), user)
+	require.EqualError(t, err, `AWS_SERVER_KMS_ID param cannot be set when using AES256`+
+		` server side encryption mode; it requires aws:kms mode.`)
+}
+
+func TestS3StorageClass(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	srv := newFakeS3(t)
+	defer srv.Close()
+
+	_, err := makeS3Storage(ctx, srv.uri(`/class`, url.Values{
+		cloudimpl.AWSStorageClassParam: []string{`CHEAP`},
+	}), user)
+	require.True(t, testutils.IsError(err, `unsupported value CHEAP for AWS_STORAGE_CLASS`), "%v", err)
+
+	for _, storageClass := range []string{``, `STANDARD_IA`, `GLACIER_IR`} {
+		t.Run(storageClass, func(t *testing.T) {
+			params := url.Values{}
+			if storageClass != `` {
+				params.Set(cloudimpl.AWSStorageClassParam, storageClass)
+			}
+			s, err := makeS3Storage(ctx, srv.uri(`/class`, params), user)
+			require.NoError(t, err)
+			defer s.Close()
+			require.Equal(t, storageClass, s.Conf().S3Config.StorageClass)
+
+			// A small file is written with a single PUT, while a file larger than
+			// the 5MiB default part size is written in a multipart upload whose
+			// storage class is set when it is initiated.
+			before := len(srv.requests(http.MethodPut, http.MethodPost))
+			require.NoError(t, s.WriteFile(ctx, `small`, bytes.NewReader([]byte(`data`))))
+			require.NoError(t, s.WriteFile(ctx, `large`, bytes.NewReader(make([]byte, 5<<20+1))))
+			var checked int
+			for _, req := range srv.requests(http.MethodPut, http.MethodPost)[before:] {
+				q := req.URL.Query()
+				if req.Method == http.MethodPut && q.Get(`uploadId`) != `` {
+					// Parts inherit the storage class of their upload.
+					continue
+				}
+				if req.Method == http.MethodPost && q[`uploads`] == nil {
+					// Completing an upload does not set the storage class.
+					continue
+				}
+				require.Equal(t, storageClass, req.Header.Get(`X-Amz-Storage-Class`),
+					"%s %s", req.Method, req.URL)
+				checked++
+			}
+			require.Equal(t, 2, checked)
+		})
+	}
+}
+
+func TestS3ObjectACL(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	srv := newFakeS3(t)
+	defer srv.Close()
+
+	_, err := makeS3Storage(ctx, srv.uri(`/acl`, url.Values{
+		cloudimpl.AWSObjectACLParam: []string{`everyone`},
+	}), user)
+	require.True(t, testutils.IsError(err, `unsupported value everyone for AWS_OBJECT_ACL`), "%v", err)
+
+	for _, acl := range []string{``, `bucket-owner-full-control`, `public-read`} {
+		t.Run(acl, func(t *testing.T) {
+			params := url.Values{}
+			if acl != `` {
+				params.Set(cloudimpl.AWSObjectACLParam, acl)
+			}
+			s, err := makeS3Storage(ctx, srv.uri(`/acl`, params), user)
+			require.NoError(t, err)
+			defer s.Close()
+			require.Equal(t, acl, s.Conf().S3Config.ObjectACL)
+
+			// The ACL is set by a single PUT, by the initiation of a multipart
+			// upload and by a copy, which does not keep the ACL of its source.
+			before := len(srv.requests(http.MethodPut, http.MethodPost))
+			require.NoError(t, s.WriteFile(ctx, `small`, bytes.NewReader([]byte(`data`))))
+			require.NoError(t, s.WriteFile(ctx, `large`, bytes.NewReader(make([]byte, 5<<20+1))))
+			require.NoError(t, cloudimpl.CopyFrom(ctx, s, s, `small`, `copy`))
+			var checked int
+			for _, req := range srv.requests(http.MethodPut, http.MethodPost)[before:] {
+				q := req.URL.Query()
+				if req.Method == http.MethodPut && q.Get(`uploadId`) != `` {
+					// Parts inherit the ACL of their upload.
+					continue
+				}
+				if req.Method == http.MethodPost && q[`uploads`] == nil {
+					// Completing an upload does not set the ACL.
+					continue
+				}
+				require.Equal(t, acl, req.Header.Get(`X-Amz-Acl`), "%s %s", req.Method, req.URL)
+				checked++
+			}
+			require.Equal(t, 3, checked)
+		})
+	}
+}
+
+func TestS3ContentType(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	srv := newFakeS3(t)
+	defer srv.Close()
+
+	_, err := makeS3Storage(ctx, srv.uri(`/type`, url.Values{
+		cloudimpl.ContentTypeParam: []string{`text/`},
+	}), user)
+	require.True(t, testutils.IsError(err, `invalid value for CONTENT_TYPE`), "%v", err)
+
+	for _, tc := range []struct {
+		contentType, expected string
+	}{
+		{``, `application/octet-stream`},
+		{`text/csv`, `text/csv`},
+		{`application/json; charset=utf-8`, `application/json; charset=utf-8`},
+	} {
+		t.Run(tc.expected, func(t *testing.T) {
+			params := url.Values{}
+			if tc.contentType != `` {
+				params.Set(cloudimpl.ContentTypeParam, tc.contentType)
+			}
+			s, err := makeS3Storage(ctx, srv.uri(`/type`, params), user)
+			require.NoError(t, err)
+			defer s.Close()
+			require.Equal(t, tc.contentType, s.Conf().S3Config.ContentType)
+
+			// The content type is set by a single PUT and by the initiation of a
+			// multipart upload.
+			before := len(srv.requests(http.MethodPut, http.MethodPost))
+			require.NoError(t, s.WriteFile(ctx, `small`, bytes.NewReader([]byte(`data`))))
+			require.NoError(t, s.WriteFile(ctx, `large`, bytes.NewReader(make([]byte, 5<<20+1))))
+			var checked int
+			for _, req := range srv.requests(http.MethodPut, http.MethodPost)[before:] {
+				q := req.URL.Query()
+				if req.Method == http.MethodPut && q.Get(`uploadId`) != `` {
+					// Parts have the content type of their upload.
+					continue
+				}
+				if req.Method == http.MethodPost && q[`uploads`] == nil {
+					// Completing an upload does not set the content type.
+					continue
+				}
+				require.Equal(t, tc.expected, req.Header.Get(`Content-Type`), "%s %s", req.Method, req.URL)
+				checked++
+			}
+			require.Equal(t, 2, checked)
+		})
+	}
+}
+
+// setEnv sets the environment variables in vars, unsetting those whose value
+// is empty, and returns a function that restores their previous values.
+func setEnv(t *testing.T, vars map[string]string) func() {
+	prev := make(map[string]*string, len(vars))
+	for k, v := range vars {
+		if old, ok := os.LookupEnv(k); ok {
+			prev[k] = &old
+		} else {
+			prev[k] = nil
+		}
+		if v == `` {
+			require.NoError(t, os.Unsetenv(k))
+		} else {
+			require.NoError(t, os.Setenv(k, v))
+		}
+	}
+	return func() {
+		for k, v := range prev {
+			if v == nil {
+				_ = os.Unsetenv(k)
+			} else {
+				_ = os.Setenv(k, *v)
+			}
+		}
+	}
+}
+
+func TestS3ImplicitAuthFallback(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	srv := newFakeS3(t)
+	defer srv.Close()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	// The credentials of each source of the default chain of the SDK have their
+	// own access key, which the requests to S3 are signed with.
+	credsFile := filepath.Join(dir, `credentials`)
+	require.NoError(t, ioutil.WriteFile(credsFile,
+		[]byte("[default]\naws_access_key_id = shared-key\naws_secret_access_key = secret\n"), 0600))
+	// The instance role is served like the credentials of an ECS task or EKS
+	// pod.
+	roleSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"AccessKeyId":"role-key","SecretAccessKey":"secret","Token":"token",`+
+			`"Expiration":"2100-01-01T00:00:00Z"}`)
+	}))
+	defer roleSrv.Close()
+	baseEnv := map[string]string{
+		`AWS_ACCESS_KEY_ID`:                  ``,
+		`AWS_SECRET_ACCESS_KEY`:              ``,
+		`AWS_SESSION_TOKEN`:                  ``,
+		`AWS_PROFILE`:                        ``,
+		`AWS_CONFIG_FILE`:                    filepath.Join(dir, `missing`),
+		`AWS_SHARED_CREDENTIALS_FILE`:        filepath.Join(dir, `missing`),
+		`AWS_CONTAINER_CREDENTIALS_FULL_URI`: ``,
+		`AWS_EC2_METADATA_DISABLED`:          `true`,
+	}
+	noKeys := url.Values{
+		cloudimpl.AWSAccessKeyParam: []string{``},
+		cloudimpl.AWSSecretParam:    []string{``},
+	}
+
+	signingKey := func(t *testing.T, s cloud.ExternalStorage) string {
+		before := len(srv.requests(http.MethodPut))
+		require.NoError(t, s.WriteFile(ctx, `f`, bytes.NewReader([]byte(`data`))))
+		reqs := srv.requests(http.MethodPut)[before:]
+		require.Len(t, reqs, 1)
+		auth := reqs[0].Header.Get(`Authorization`)
+		start := strings.Index(auth, `Credential=`) + len(`Credential=`)
+		return auth[start : start+strings.Index(auth[start:], `/`)]
+	}
+
+	for _, tc := range []struct {
+		name     string
+		env      map[string]string
+		params   url.Values
+		expected string
+	}{
+		{
+			name:     `uri`,
+			env:      map[string]string{`AWS_ACCESS_KEY_ID`: `env-key`, `AWS_SECRET_ACCESS_KEY`: `secret`},
+			expected: `key`,
+		},
+		{
+			name:     `env`,
+			env:      map[string]string{`AWS_ACCESS_KEY_ID`: `env-key`, `AWS_SECRET_ACCESS_KEY`: `secret`},
+			params:   noKeys,
+			expected: `env-key`,
+		},
+		{
+			name:     `shared config`,
+			env:      map[string]string{`AWS_SHARED_CREDENTIALS_FILE`: credsFile},
+			params:   noKeys,
+			expected: `shared-key`,
+		},
+		{
+			name:     `instance role`,
+			env:      map[string]string{`AWS_CONTAINER_CREDENTIALS_FULL_URI`: roleSrv.URL},
+			params:   noKeys,
+			expected: `role-key`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer setEnv(t, baseEnv)()
+			defer setEnv(t, tc.env)()
+			params := url.Values{cloudimpl.AWSUseImplicitAuthParam: []string{`true`}}
+			for k, v := range tc.params {
+				params[k] = v
+			}
+			uri := srv.uri(`/auth`, params)
+			explicit, _, err := cloudimpl.AccessIsWithExplicitAuth(uri)
+			require.NoError(t, err)
+			// The URI has a custom endpoint, so it is never explicit.
+			require.False(t, explicit)
+			s, err := makeS3Storage(ctx, uri, user)
+			require.NoError(t, err)
+			defer s.Close()
+			require.Equal(t, tc.expected, signingKey(t, s))
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		defer setEnv(t, baseEnv)()
+		defer setEnv(t, map[string]string{
+			`AWS_ACCESS_KEY_ID`: `env-key`, `AWS_SECRET_ACCESS_KEY`: `secret`,
+		})()
+
+		// Without AWS_USE_IMPLICIT_AUTH, credentials are required in the URI.
+		_, err := makeS3Storage(ctx, srv.uri(`/auth`, noKeys), user)
+		require.True(t, testutils.IsError(err,
+			`AUTH is set to 'specified', but AWS_ACCESS_KEY_ID is not set`), "%v", err)
+
+		params := url.Values{cloudimpl.AWSUseImplicitAuthParam: []string{`true`}}
+		for k, v := range noKeys {
+			params[k] = v
+		}
+		conf, err := cloudimpl.ExternalStorageConfFromURI(srv.uri(`/auth`, params), user)
+		require.NoError(t, err)
+		_, err = cloudimpl.MakeExternalStorage(ctx, conf,
+			base.ExternalIODirConfig{DisableImplicitCredentials: true}, testSettings, nil, nil, nil)
+		require.True(t, testutils.IsError(err, `implicit credentials disallowed`), "%v", err)
+	})
+
+	t.Run("explicit auth", func(t *testing.T) {
+		for uri, expected := range map[string]bool{
+			`s3://bucket/path?AWS_USE_IMPLICIT_AUTH=true`:                                               false,
+			`s3://bucket/path?AWS_USE_IMPLICIT_AUTH=true&AWS_ACCESS_KEY_ID=key&AWS_SECRET_ACCESS_KEY=s`: true,
+			`s3://bucket/path?AWS_USE_IMPLICIT_AUTH=false`:                                              true,
+		} {
+			explicit, _, err := cloudimpl.AccessIsWithExplicitAuth(uri)
+			require.NoError(t, err)
+			require.Equal(t, expected, explicit, uri)
+		}
+	})
+}
+
+func TestS3RequesterPays(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	srv := newFakeS3(t)
+	defer srv.Close()
+
+	_, err := makeS3Storage(ctx, srv.uri(`/payer`, url.Values{
+		cloudimpl.AWSRequesterPaysParam: []string{`maybe`},
+	}), user)
+	require.True(t, testutils.IsError(err, `invalid value for AWS_REQUESTER_PAYS`), "%v", err)
+
+	for _, requesterPays := range []bool{false, true} {
+		t.Run(fmt.Sprint(requesterPays), func(t *testing.T) {
+			params := url.Values{}
+			if requesterPays {
+				params.Set(cloudimpl.AWSRequesterPaysParam, `true`)
+			}
+			s, err := makeS3Storage(ctx, srv.uri(`/payer`, params), user)
+			require.NoError(t, err)
+			defer s.Close()
+			require.Equal(t, requesterPays, s.Conf().S3Config.RequesterPays)
+
+			require.NoError(t, s.WriteFile(ctx, `f`, bytes.NewReader([]byte(`data`))))
+			before := len(srv.requests(http.MethodGet, http.MethodHead))
+
+			r, err := s.ReadFile(ctx, `f`)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			r, _, err = s.ReadFileAt(ctx, `f`, 0)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			files, err := s.ListFiles(ctx, `*`)
+			require.NoError(t, err)
+			require.Equal(t, []string{`f`}, files)
+			size, err := s.Size(ctx, `f`)
+			require.NoError(t, err)
+			require.Equal(t, int64(4), size)
+
+			reads := srv.requests(http.MethodGet, http.MethodHead)
+			require.Len(t, reads, before+4)
+			expected := ``
+			if requesterPays {
+				expected = `requester`
+			}
+			for _, req := range reads[before:] {
+				require.Equal(t, expected, req.Header.Get(`X-Amz-Request-Payer`),
+					"%s %s", req.Method, req.URL)
+			}
+		})
+	}
+}
+
+func TestS3WriteFileIfNotExists(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := newFakeS3(t)
+	defer srv.Close()
+
+	s, err := makeS3Storage(ctx, srv.uri(`/exclusive`, nil), security.RootUserName())
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.WriteFileIfNotExists(ctx, `f`, bytes.NewReader([]byte(`first`))))
+	err = s.WriteFileIfNotExists(ctx, `f`, bytes.NewReader([]byte(`second`)))
+	require.True(t, errors.Is(err, cloudimpl.ErrFileAlreadyExists), "%v", err)
+
+	// The existing object was neither overwritten nor re-uploaded.
+	require.Len(t, srv.requests(http.MethodPut), 1)
+	r, err := s.ReadFile(ctx, `f`)
+	require.NoError(t, err)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, `first`, string(data))
+}
+
+func TestS3DeleteAll(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := newFakeS3(t)
+	defer srv.Close()
+
+	s, err := makeS3Storage(ctx, srv.uri(`/backup`, nil), security.RootUserName())
+	require.NoError(t, err)
+	defer s.Close()
+	for _, file := range []string{`2021/a`, `2021/sub/b`, `2021.txt`, `2022/c`, `2022/d`} {
+		require.NoError(t, s.WriteFile(ctx, file, bytes.NewReader([]byte(file))))
+	}
+
+	// All the objects under the prefix are deleted in a single request.
+	before := len(srv.requests(http.MethodPost, http.MethodDelete))
+	require.NoError(t, s.DeleteAll(ctx, `2021/`))
+	require.Len(t, srv.requests(http.MethodPost, http.MethodDelete), before+1)
+	srv.mu.Lock()
+	var remaining []string
+	for name := range srv.mu.objects {
+		remaining = append(remaining, name)
+	}
+	srv.mu.Unlock()
+	sort.Strings(remaining)
+	require.Equal(t, []string{`/bucket/backup/2021.txt`, `/bucket/backup/2022/c`, `/bucket/backup/2022/d`},
+		remaining)
+
+	// The objects that fail to be deleted are reported, while the others are
+	// deleted.
+	srv.mu.Lock()
+	srv.mu.lockedObjects = map[string]bool{`/bucket/backup/2022/c`: true}
+	srv.mu.Unlock()
+	err = s.DeleteAll(ctx, `2022/`)
+	require.True(t, testutils.IsError(err, `failed to delete 1 s3 objects: deleting backup/2022/c: AccessDenied`),
+		"%v", err)
+	srv.mu.Lock()
+	_, cExists := srv.mu.objects[`/bucket/backup/2022/c`]
+	_, dExists := srv.mu.objects[`/bucket/backup/2022/d`]
+	srv.mu.Unlock()
+	require.True(t, cExists)
+	require.False(t, dExists)
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	srv := newFakeS3(t)
+	defer srv.Close()
+	s, err := makeS3Storage(ctx, srv.uri(`/multipart`, nil), user)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// The default part size is the minimum of 5MiB.
+	const partSize = 5 << 20
+	for _, size := range []int{0, 1 << 10, partSize - 1, partSize + 1, 3*partSize + 10} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			data := make([]byte, size)
+			for i := range data {
+				data[i] = byte(i % 251)
+			}
+			initiated := len(srv.requests(http.MethodPost))
+			require.NoError(t, s.WriteFile(ctx, `f`, bytes.NewReader(data)))
+			// Only content larger than a part uses a multipart upload, which is
+			// initiated and completed by POSTs.
+			if size > partSize {
+				require.Len(t, srv.requests(http.MethodPost), initiated+2)
+			} else {
+				require.Len(t, srv.requests(http.MethodPost), initiated)
+			}
+			r, err := s.ReadFile(ctx, `f`)
+			require.NoError(t, err)
+			read, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.True(t, bytes.Equal(data, read))
+		})
+	}
+
+	t.Run("failed parts abort the upload", func(t *testing.T) {
+		srv.mu.Lock()
+		srv.mu.failParts = true
+		srv.mu.Unlock()
+		defer func() {
+			srv.mu.Lock()
+			srv.mu.failParts = false
+			srv.mu.Unlock()
+		}()
+		aborted := len(srv.requests(http.MethodDelete))
+		err := s.WriteFile(ctx, `g`, bytes.NewReader(make([]byte, 2*partSize)))
+		require.Error(t, err)
+		require.Len(t, srv.requests(http.MethodDelete), aborted+1)
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		require.Empty(t, srv.mu.parts)
+	})
+}
+
+func TestS3StorageTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	srv, cleanup := blockingServer()
+	defer cleanup()
+	defer setStorageTimeout(t, "50ms")()
+
+	ctx := context.Background()
+	uri := (&url.URL{Scheme: `s3`, Host: `bucket`, Path: `/timeout`, RawQuery: url.Values{
+		cloudimpl.AWSAccessKeyParam: []string{`key`},
+		cloudimpl.AWSSecretParam:    []string{`secret`},
+		cloudimpl.AWSEndpointParam:  []string{srv.URL},
+	}.Encode()}).String()
+	s, err := makeS3Storage(ctx, uri, security.RootUserName())
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.ListFiles(ctx, `*`)
+	require.True(t, isTimeout(err), "unexpected error: %+v", err)
+
+	_, err = s.ReadFile(ctx, `f`)
+	require.True(t, isTimeout(err), "unexpected error: %+v", err)
+}
+
+func TestS3PresignedURL(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	srv := newFakeS3(t)
+	defer srv.Close()
+
+	s, err := makeS3Storage(ctx, srv.uri(`/presign`, url.Values{
+		cloudimpl.S3RegionParam: []string{`us-east-1`},
+	}), user)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.WriteFile(ctx, `f`, bytes.NewReader([]byte(`data`))))
+
+	_, err = cloudimpl.PresignedURL(ctx, s, `f`, 8*24*time.Hour)
+	require.True(t, testutils.IsError(err, `cannot expire after more than 168h0m0s`), "%v", err)
+
+	signed, err := cloudimpl.PresignedURL(ctx, s, `f`, time.Hour)
+	require.NoError(t, err)
+	u, err := url.Parse(signed)
+	require.NoError(t, err)
+	require.Equal(t, `/bucket/presign/f`, u.Path)
+	q := u.Query()
+	require.Equal(t, `3600`, q.Get(`X-Amz-Expires`))
+	require.True(t, strings.HasPrefix(q.Get(`X-Amz-Credential`), `key/`), q.Get(`X-Amz-Credential`))
+	require.NotEmpty(t, q.Get(`X-Amz-Signature`))
+
+	// The URL can be fetched without any credentials.
+	resp, err := http.Get(signed)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, `data`, string(body))
+}
+
+func TestS3CopyFrom(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	srv := newFakeS3(t)
+	defer srv.Close()
+
+	dst, err := makeS3Storage(ctx, srv.uri(`/dst`, nil), user)
+	require.NoError(t, err)
+	defer dst.Close()
+
+	// copied returns the requests to copy objects and to read them that were
+	// received since the given number of requests.
+	copied := func(since int) (copies, reads int) {
+		for _, req := range srv.requests(http.MethodPut, http.MethodGet)[since:] {
+			if req.Header.Get(`X-Amz-Copy-Source`) != `` {
+				copies++
+			} else if req.Method == http.MethodGet {
+				reads++
+			}
+		}
+		return copies, reads
+	}
+	requireObject := func(t *testing.T, key, expected string) {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		require.Equal(t, expected, string(srv.mu.objects[`/bucket/`+key]))
+	}
+
+	t.Run("server-side", func(t *testing.T) {
+		src, err := makeS3Storage(ctx, srv.uri(`/src dir`, nil), user)
+		require.NoError(t, err)
+		defer src.Close()
+		require.NoError(t, src.WriteFile(ctx, `f`, bytes.NewReader([]byte(`same account`))))
+
+		before := len(srv.requests(http.MethodPut, http.MethodGet))
+		require.NoError(t, cloudimpl.CopyFrom(ctx, dst, src, `f`, `copy`))
+		copies, reads := copied(before)
+		require.Equal(t, 1, copies)
+		require.Equal(t, 0, reads)
+		requireObject(t, `dst/copy`, `same account`)
+
+		err = cloudimpl.CopyFrom(ctx, dst, src, `missing`, `copy`)
+		require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+	})
+
+	t.Run("other credentials", func(t *testing.T) {
+		src, err := makeS3Storage(ctx, srv.uri(`/other`, url.Values{
+			cloudimpl.AWSAccessKeyParam: []string{`other-key`},
+		}), user)
+		require.NoError(t, err)
+		defer src.Close()
+		require.NoError(t, src.WriteFile(ctx, `f`, bytes.NewReader([]byte(`other account`))))
+
+		before := len(srv.requests(http.MethodPut, http.MethodGet))
+		require.NoError(t, cloudimpl.CopyFrom(ctx, dst, src, `f`, `copy`))
+		copies, reads := copied(before)
+		require.Equal(t, 0, copies)
+		require.Equal(t, 1, reads)
+		requireObject(t, `dst/copy`, `other account`)
+	})
+
+	t.Run("other provider", func(t *testing.T) {
+		src := cloudimpl.NewMemoryStorage()
+		defer src.Close()
+		require.NoError(t, src.WriteFile(ctx, `f`, bytes.NewReader([]byte(`in memory`))))
+
+		before := len(srv.requests(http.MethodPut, http.MethodGet))
+		require.NoError(t, cloudimpl.CopyFrom(ctx, dst, src, `f`, `copy`))
+		copies, _ := copied(before)
+		require.Equal(t, 0, copies)
+		requireObject(t, `dst/copy`, `in memory`)
+	})
+}
+
+func TestS3PathStyle(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+
+	_, err := cloudimpl.ExternalStorageConfFromURI(`s3://bucket/prefix?AWS_USE_PATH_STYLE=maybe`, user)
+	require.True(t, testutils.IsError(err, `invalid value for AWS_USE_PATH_STYLE`), "%v", err)
+
+	// The address of an object is that of the presigned URL of it, which the
+	// client builds without sending a request.
+	for _, tc := range []struct {
+		name         string
+		params       url.Values
+		expectedHost string
+		expectedPath string
+	}{
+		{
+			name:         `virtual-hosted`,
+			params:       url.Values{cloudimpl.S3RegionParam: []string{`us-west-2`}},
+			expectedHost: `bucket.s3.us-west-2.amazonaws.com`,
+			expectedPath: `/prefix/f`,
+		},
+		{
+			name: `path-style`,
+			params: url.Values{
+				cloudimpl.S3RegionParam:        []string{`us-west-2`},
+				cloudimpl.AWSUsePathStyleParam: []string{`true`},
+			},
+			expectedHost: `s3.us-west-2.amazonaws.com`,
+			expectedPath: `/bucket/prefix/f`,
+		},
+		{
+			name: `endpoint`,
+			params: url.Values{
+				cloudimpl.S3RegionParam:    []string{`us-east-1`},
+				cloudimpl.AWSEndpointParam: []string{`https://minio.example.com:9000`},
+			},
+			expectedHost: `minio.example.com:9000`,
+			expectedPath: `/bucket/prefix/f`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := url.Values{
+				cloudimpl.AWSAccessKeyParam: []string{`key`},
+				cloudimpl.AWSSecretParam:    []string{`secret`},
+			}
+			for k, v := range tc.params {
+				q[k] = v
+			}
+			uri := (&url.URL{Scheme: `s3`, Host: `bucket`, Path: `/prefix`, RawQuery: q.Encode()}).String()
+			s, err := makeS3Storage(ctx, uri, user)
+			require.NoError(t, err)
+			defer s.Close()
+			conf := s.Conf().S3Config
+			require.Equal(t, tc.params.Get(cloudimpl.AWSUsePathStyleParam) == `true`, conf.UsePathStyle)
+			require.Equal(t, tc.params.Get(cloudimpl.AWSEndpointParam), conf.Endpoint)
+			roundTripped, err := cloudimpl.ExternalStorageConfFromURI(
+				cloudimpl.S3URI(conf.Bucket, conf.Prefix, conf), user)
+			require.NoError(t, err)
+			require.Equal(t, conf.UsePathStyle, roundTripped.S3Config.UsePathStyle)
+
+			signed, err := cloudimpl.PresignedURL(ctx, s, `f`, time.Minute)
+			require.NoError(t, err)
+			u, err := url.Parse(signed)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedHost, u.Host)
+			require.Equal(t, tc.expectedPath, u.Path)
+		})
+	}
+}
+
+func TestS3DualStack(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+
+	_, err := cloudimpl.ExternalStorageConfFromURI(`s3://bucket/prefix?AWS_USE_DUALSTACK=maybe`, user)
+	require.True(t, testutils.IsError(err, `invalid value for AWS_USE_DUALSTACK`), "%v", err)
+
+	// As in TestS3PathStyle, the address of requests is that of presigned URLs.
+	for _, tc := range []struct {
+		dualStack    string
+		expectedHost string
+	}{
+		{dualStack: `false`, expectedHost: `bucket.s3.us-west-2.amazonaws.com`},
+		{dualStack: `true`, expectedHost: `bucket.s3.dualstack.us-west-2.amazonaws.com`},
+	} {
+		t.Run(tc.dualStack, func(t *testing.T) {
+			q := url.Values{
+				cloudimpl.AWSAccessKeyParam:    []string{`key`},
+				cloudimpl.AWSSecretParam:       []string{`secret`},
+				cloudimpl.S3RegionParam:        []string{`us-west-2`},
+				cloudimpl.AWSUseDualStackParam: []string{tc.dualStack},
+			}
+			uri := (&url.URL{Scheme: `s3`, Host: `bucket`, Path: `/prefix`, RawQuery: q.Encode()}).String()
+			s, err := makeS3Storage(ctx, uri, user)
+			require.NoError(t, err)
+			defer s.Close()
+			conf := s.Conf().S3Config
+			require.Equal(t, tc.dualStack == `true`, conf.UseDualStack)
+			roundTripped, err := cloudimpl.ExternalStorageConfFromURI(
+				cloudimpl.S3URI(conf.Bucket, conf.Prefix, conf), user)
+			require.NoError(t, err)
+			require.Equal(t, conf.UseDualStack, roundTripped.S3Config.UseDualStack)
+
+			signed, err := cloudimpl.PresignedURL(ctx, s, `f`, time.Minute)
+			require.NoError(t, err)
+			u, err := url.Parse(signed)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedHost, u.Host)
+		})
+	}
+}
+
+func TestS3WriteRetries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := newFakeS3(t)
+	defer srv.Close()
+	s, err := makeS3Storage(ctx, srv.uri(`/retries`, nil), security.RootUserName())
+	require.NoError(t, err)
+	defer s.Close()
+
+	small := []byte(`small content`)
+	large := make([]byte, 5<<20+1)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	rng, _ := randutil.NewPseudoRand()
+	incompressible := randutil.RandBytes(rng, 6<<20)
+	for _, tc := range []struct {
+		name    string
+		content []byte
+		// consumed is how much of the content was read before the write.
+		consumed int
+		// unseekable hides the io.Seeker and io.ReaderAt of the content.
+		unseekable bool
+		// compressed writes the content with WriteFileCompressed, which can only
+		// seek to its start.
+		compressed bool
+	}{
+		{name: `single`, content: small},
+		{name: `single consumed`, content: small, consumed: 5},
+		{name: `multipart`, content: large},
+		{name: `multipart consumed`, content: large, consumed: 1 << 20},
+		{name: `multipart unseekable`, content: large, unseekable: true},
+		{name: `multipart compressed`, content: incompressible, compressed: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv.mu.Lock()
+			srv.mu.failPuts = 1
+			srv.mu.failedBodies = nil
+			srv.mu.Unlock()
+
+			var content io.ReadSeeker = bytes.NewReader(tc.content)
+			if tc.unseekable {
+				content = unseekableReader{content}
+			}
+			_, err := io.CopyN(ioutil.Discard, content, int64(tc.consumed))
+			require.NoError(t, err)
+			if tc.compressed {
+				require.NoError(t, cloudimpl.WriteFileCompressed(ctx, s, tc.name, content,
+					cloudimpl.CompressionOptions{Compression: cloudimpl.CompressionZstd}))
+			} else {
+				require.NoError(t, s.WriteFile(ctx, tc.name, content))
+			}
+
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			require.Equal(t, 0, srv.mu.failPuts)
+			require.Len(t, srv.mu.failedBodies, 1)
+			data := srv.mu.objects[`/bucket/retries/`+tc.name]
+			if tc.compressed {
+				d, err := cloudimpl.NewDecompressingReader(ioutil.NopCloser(bytes.NewReader(data)), tc.name)
+				require.NoError(t, err)
+				data, err = ioutil.ReadAll(d)
+				require.NoError(t, err)
+				require.NoError(t, d.Close())
+			}
+			// Comparing lengths first keeps the failure of a large mismatch
+			// readable.
+			require.Equal(t, len(tc.content), len(data))
+			require.True(t, bytes.Equal(tc.content, data), "written content differs")
+		})
+	}
+}
+
+func TestS3Sync(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := newFakeS3(t)
+	defer srv.Close()
+	s, err := makeS3Storage(ctx, srv.uri(`/sync`, nil), security.RootUserName())
+	require.NoError(t, err)
+	defer s.Close()
+
+	// S3 stores an object before acknowledging its upload, so there is nothing
+	// left to flush.
+	require.NoError(t, s.WriteFile(ctx, `file`, bytes.NewReader([]byte(`content`))))
+	require.NoError(t, cloudimpl.Sync(ctx, s))
+	require.NoError(t, cloudimpl.Sync(ctx, cloudimpl.WithSizeCache(s, cloudimpl.SizeCacheOptions{})))
+	require.NoError(t, cloudimpl.Sync(ctx, cloudimpl.WithDryRun(s)))
+}
+
+func TestS3ErrorMapping(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	srv := newFakeS3(t)
+	defer srv.Close()
+	s, err := makeS3Storage(ctx, srv.uri(`/errors`, nil), security.RootUserName())
+	require.NoError(t, err)
+	defer s.Close()
+
+	srv.mu.Lock()
+	srv.mu.deniedObjects = map[string]bool{`/bucket/errors/denied`: true}
+	srv.mu.Unlock()
+
+	_, err = s.ReadFile(ctx, `missing`)
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+	_, err = s.Size(ctx, `missing`)
+	require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+
+	_, err = s.ReadFile(ctx, `denied`)
+	require.True(t, errors.Is(err, cloudimpl.ErrAccessDenied), "%v", err)
+	_, err = s.Size(ctx, `denied`)
+	require.True(t, errors.Is(err, cloudimpl.ErrAccessDenied), "%v", err)
+	_, err = s.Stat(ctx, `denied`)
+	require.True(t, errors.Is(err, cloudimpl.ErrAccessDenied), "%v", err)
+	err = s.WriteFile(ctx, `denied`, bytes.NewReader([]byte(`content`)))
+	require.True(t, errors.Is(err, cloudimpl.ErrAccessDenied), "%v", err)
+	err = s.Delete(ctx, `denied`)
+	require.True(t, errors.Is(err, cloudimpl.ErrAccessDenied), "%v", err)
+}
+
+func TestS3Validate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	srv := newFakeS3(t)
+	defer srv.Close()
+
+	s, err := makeS3Storage(ctx, srv.uri(`/validate`, nil), user)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, cloudimpl.Validate(ctx, s))
+	require.NoError(t, cloudimpl.Validate(ctx, cloudimpl.WithRetry(s, cloudimpl.RetryOptions{})))
+	require.NoError(t, cloudimpl.Validate(ctx, cloudimpl.WithDryRun(s)))
+	// Validating transfers no data.
+	require.Len(t, srv.requests(http.MethodGet, http.MethodPut, http.MethodPost), 0)
+
+	t.Run("missing bucket", func(t *testing.T) {
+		uri := strings.Replace(srv.uri(`/validate`, nil), `s3://bucket/`, `s3://missing/`, 1)
+		s, err := makeS3Storage(ctx, uri, user)
+		require.NoError(t, err)
+		defer s.Close()
+		err = cloudimpl.Validate(ctx, s)
+		require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		srv.mu.Lock()
+		srv.mu.deniedObjects = map[string]bool{`/bucket`: true}
+		srv.mu.Unlock()
+		defer func() {
+			srv.mu.Lock()
+			srv.mu.deniedObjects = nil
+			srv.mu.Unlock()
+		}()
+		err := cloudimpl.Validate(ctx, s)
+		require.True(t, errors.Is(err, cloudimpl.ErrAccessDenied), "%v", err)
+	})
+}
+
+func TestS3FallbackRegions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	srv := newFakeS3(t)
+	defer srv.Close()
+
+	_, err := makeS3Storage(ctx, srv.uri(`/fallback`, url.Values{
+		cloudimpl.S3FallbackRegionsParam: []string{`us-west-2,:replica`},
+	}), user)
+	require.True(t, testutils.IsError(err, `regions must not be empty`), "%v", err)
+
+	uri := srv.uri(`/fallback`, url.Values{
+		cloudimpl.S3FallbackRegionsParam: []string{`us-west-2:replica,eu-west-1`},
+	})
+	s, err := makeS3Storage(ctx, uri, user)
+	require.NoError(t, err)
+	defer s.Close()
+	conf := s.Conf().S3Config
+	require.Equal(t, []roachpb.ExternalStorage_S3_Fallback{
+		{Region: `us-west-2`, Bucket: `replica`}, {Region: `eu-west-1`},
+	}, conf.Fallbacks)
+	reparsed, err := cloudimpl.ExternalStorageConfFromURI(
+		cloudimpl.S3URI(conf.Bucket, conf.Prefix, conf), user)
+	require.NoError(t, err)
+	require.Equal(t, conf.Fallbacks, reparsed.S3Config.Fallbacks)
+
+	// lastRead returns the path and the region of the last read request.
+	lastRead := func() (string, string) {
+		reads := srv.requests(http.MethodGet, http.MethodHead)
+		req := reads[len(reads)-1]
+		// The region is in the scope of the credential of the signature.
+		scope := strings.Split(req.Header.Get(`Authorization`), `/`)
+		return req.URL.Path, scope[2]
+	}
+	read := func(basename string) string {
+		r, err := s.ReadFile(ctx, basename)
+		require.NoError(t, err)
+		defer r.Close()
+		content, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	srv.mu.Lock()
+	srv.mu.objects[`/replica/fallback/replicated`] = []byte(`replica`)
+	srv.mu.Unlock()
+
+	t.Run("not found in the bucket", func(t *testing.T) {
+		require.Equal(t, `replica`, read(`replicated`))
+		p, region := lastRead()
+		require.Equal(t, `/replica/fallback/replicated`, p)
+		require.Equal(t, `us-west-2`, region)
+
+		r, size, err := s.ReadFileAt(ctx, `replicated`, 3)
+		require.NoError(t, err)
+		require.Equal(t, int64(7), size)
+		content, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, `lica`, string(content))
+
+		size, err = s.Size(ctx, `replicated`)
+		require.NoError(t, err)
+		require.Equal(t, int64(7), size)
+		info, err := s.Stat(ctx, `replicated`)
+		require.NoError(t, err)
+		require.True(t, info.Exists)
+	})
+
+	t.Run("found in the bucket", func(t *testing.T) {
+		require.NoError(t, s.WriteFile(ctx, `written`, bytes.NewReader([]byte(`primary`))))
+		// Writes are only sent to the bucket of the storage.
+		srv.mu.Lock()
+		_, replicated := srv.mu.objects[`/replica/fallback/written`]
+		srv.mu.Unlock()
+		require.False(t, replicated)
+
+		require.Equal(t, `primary`, read(`written`))
+		p, region := lastRead()
+		require.Equal(t, `/bucket/fallback/written`, p)
+		require.Equal(t, `default-region`, region)
+	})
+
+	t.Run("bucket in another region", func(t *testing.T) {
+		srv.mu.Lock()
+		srv.mu.movedBuckets = map[string]bool{`bucket`: true}
+		srv.mu.Unlock()
+		defer func() {
+			srv.mu.Lock()
+			srv.mu.movedBuckets = nil
+			srv.mu.Unlock()
+		}()
+		require.Equal(t, `replica`, read(`replicated`))
+		p, _ := lastRead()
+		require.Equal(t, `/replica/fallback/replicated`, p)
+	})
+
+	t.Run("not found anywhere", func(t *testing.T) {
+		_, err := s.ReadFile(ctx, `missing`)
+		require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+		// The last fallback has the bucket of the storage.
+		p, region := lastRead()
+		require.Equal(t, `/bucket/fallback/missing`, p)
+		require.Equal(t, `eu-west-1`, region)
+
+		_, err = s.Size(ctx, `missing`)
+		require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+		info, err := s.Stat(ctx, `missing`)
+		require.NoError(t, err)
+		require.False(t, info.Exists)
+	})
+
+	t.Run("access denied", func(t *testing.T) {
+		// Other errors do not fail over.
+		srv.mu.Lock()
+		srv.mu.deniedObjects = map[string]bool{`/bucket/fallback/replicated`: true}
+		srv.mu.Unlock()
+		defer func() {
+			srv.mu.Lock()
+			srv.mu.deniedObjects = nil
+			srv.mu.Unlock()
+		}()
+		_, err := s.ReadFile(ctx, `replicated`)
+		require.True(t, errors.Is(err, cloudimpl.ErrAccessDenied), "%v", err)
+	})
+}
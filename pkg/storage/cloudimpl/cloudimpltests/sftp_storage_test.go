@@ -0,0 +1,314 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/blobs"
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSFTP is an in-process SSH server whose sftp subsystem serves the local
+// filesystem to the user "user", who authenticates with the password
+// "password" or the private key of the server.
+type fakeSFTP struct {
+	t  *testing.T
+	ln net.Listener
+	// hostKey is the key of the server in authorized_keys format, and
+	// privateKey is the base64-encoded PEM key that the user authenticates with.
+	hostKey, privateKey string
+	config              *ssh.ServerConfig
+	wg                  sync.WaitGroup
+
+	mu struct {
+		sync.Mutex
+		conns []net.Conn
+	}
+}
+
+// newSSHKey returns a new private key, as a signer and PEM-encoded.
+func newSSHKey(t *testing.T) (ssh.Signer, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func newFakeSFTP(t *testing.T) *fakeSFTP {
+	hostSigner, _ := newSSHKey(t)
+	userSigner, userPEM := newSSHKey(t)
+	f := &fakeSFTP{
+		t:          t,
+		hostKey:    string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey())),
+		privateKey: base64.StdEncoding.EncodeToString(userPEM),
+	}
+	f.config = &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "user" && string(password) == "password" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "user" && bytes.Equal(key.Marshal(), userSigner.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	f.config.AddHostKey(hostSigner)
+	var err error
+	f.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for {
+			conn, err := f.ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.mu.conns = append(f.mu.conns, conn)
+			f.mu.Unlock()
+			f.wg.Add(1)
+			go func() {
+				defer f.wg.Done()
+				f.serve(conn)
+			}()
+		}
+	}()
+	return f
+}
+
+// serve runs the sftp subsystem of the sessions of conn until it is closed.
+func (f *fakeSFTP) serve(conn net.Conn) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, f.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			_ = newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, chanReqs, err := newChan.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range chanReqs {
+				// The payload of a subsystem request is the length-prefixed name.
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+			}
+		}()
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			f.t.Errorf("starting sftp server: %v", err)
+			return
+		}
+		_ = server.Serve()
+		_ = server.Close()
+	}
+}
+
+// uri returns the sftp URI of dir on the server, with the given query.
+func (f *fakeSFTP) uri(dir string, q url.Values) string {
+	q.Set(cloudimpl.SFTPHostKeyParam, f.hostKey)
+	u := url.URL{
+		Scheme:   "sftp",
+		User:     url.User("user"),
+		Host:     f.ln.Addr().String(),
+		Path:     dir,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+func (f *fakeSFTP) Close() {
+	_ = f.ln.Close()
+	f.mu.Lock()
+	for _, conn := range f.mu.conns {
+		_ = conn.Close()
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+}
+
+func TestPutSFTP(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	srv := newFakeSFTP(t)
+	defer srv.Close()
+	dir, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+	withPassword := url.Values{cloudimpl.SFTPPasswordParam: {"password"}}
+	withKey := url.Values{cloudimpl.SFTPPrivateKeyParam: {srv.privateKey}}
+
+	t.Run("password", func(t *testing.T) {
+		testExportStore(t, srv.uri(filepath.Join(dir, "password"), withPassword), false, user, nil, nil)
+	})
+	t.Run("private key", func(t *testing.T) {
+		testExportStore(t, srv.uri(filepath.Join(dir, "key"), withKey), false, user, nil, nil)
+		testListFiles(t, srv.uri(filepath.Join(dir, "listing-test/basepath"), withKey), user, nil, nil)
+	})
+
+	fromURI := func(uri string) cloud.ExternalStorage {
+		s, err := cloudimpl.ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{},
+			testSettings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
+		require.NoError(t, err)
+		return s
+	}
+
+	t.Run("operations", func(t *testing.T) {
+		s := fromURI(srv.uri(filepath.Join(dir, "ops"), withPassword))
+		defer s.Close()
+		require.NoError(t, s.WriteFile(ctx, "a/b/file", bytes.NewReader([]byte("0123456789"))))
+		content, err := ioutil.ReadFile(filepath.Join(dir, "ops/a/b/file"))
+		require.NoError(t, err)
+		require.Equal(t, "0123456789", string(content))
+
+		r, size, err := s.ReadFileAt(ctx, "a/b/file", 4)
+		require.NoError(t, err)
+		require.Equal(t, int64(10), size)
+		content, err = ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, "456789", string(content))
+
+		size, err = s.Size(ctx, "a/b/file")
+		require.NoError(t, err)
+		require.Equal(t, int64(10), size)
+
+		err = s.WriteFileIfNotExists(ctx, "a/b/file", bytes.NewReader(nil))
+		require.True(t, errors.Is(err, cloudimpl.ErrFileAlreadyExists), "%v", err)
+		require.NoError(t, s.WriteFileIfNotExists(ctx, "a/new", bytes.NewReader([]byte("new"))))
+
+		require.NoError(t, s.Delete(ctx, "a/b/file"))
+		_, err = s.ReadFile(ctx, "a/b/file")
+		require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+		_, err = s.Size(ctx, "a/b/file")
+		require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+		info, err := s.Stat(ctx, "a/b/file")
+		require.NoError(t, err)
+		require.False(t, info.Exists)
+		files, err := s.ListFiles(ctx, "a/*")
+		require.NoError(t, err)
+		require.Equal(t, []string{"a/new"}, files)
+
+		require.NoError(t, s.DeleteAll(ctx, "a/"))
+		files, err = s.ListFiles(ctx, "a/*")
+		require.NoError(t, err)
+		require.Empty(t, files)
+	})
+
+	t.Run("listing a missing directory", func(t *testing.T) {
+		s := fromURI(srv.uri(filepath.Join(dir, "missing"), withPassword))
+		defer s.Close()
+		files, err := s.ListFiles(ctx, "*")
+		require.NoError(t, err)
+		require.Empty(t, files)
+	})
+
+	t.Run("reconnects", func(t *testing.T) {
+		s := fromURI(srv.uri(filepath.Join(dir, "reconnect"), withKey))
+		defer s.Close()
+		require.NoError(t, s.WriteFile(ctx, "file", bytes.NewReader([]byte("content"))))
+		srv.mu.Lock()
+		for _, conn := range srv.mu.conns {
+			_ = conn.Close()
+		}
+		srv.mu.Unlock()
+		// The operation that finds the connection lost fails, and the next one
+		// reconnects.
+		testutils.SucceedsSoon(t, func() error {
+			_, err := s.Size(ctx, "file")
+			return err
+		})
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		s := fromURI(srv.uri(dir, url.Values{cloudimpl.SFTPPasswordParam: {"wrong"}}))
+		defer s.Close()
+		_, err := s.ReadFile(ctx, "file")
+		require.True(t, errors.Is(err, cloudimpl.ErrAccessDenied), "%v", err)
+
+		// A server whose key is not the expected one is not trusted.
+		other := newFakeSFTP(t)
+		defer other.Close()
+		q := url.Values{cloudimpl.SFTPPasswordParam: {"password"}}
+		uri := strings.Replace(srv.uri(dir, q), srv.ln.Addr().String(), other.ln.Addr().String(), 1)
+		s = fromURI(uri)
+		defer s.Close()
+		_, err = s.ReadFile(ctx, "file")
+		require.True(t, testutils.IsError(err, "host key mismatch"), "%v", err)
+	})
+
+	t.Run("parsing", func(t *testing.T) {
+		for _, tc := range []struct {
+			uri, err string
+		}{
+			{uri: "sftp:///path", err: "must specify a host"},
+			{uri: "sftp://host/path?SFTP_PASSWORD=p&SFTP_HOST_KEY=k", err: "must specify a user"},
+			{uri: "sftp://user:p@host/path", err: "must not contain a password"},
+			{uri: "sftp://user@host/path?SFTP_HOST_KEY=k", err: "must set SFTP_PASSWORD or SFTP_PRIVATE_KEY"},
+			{uri: "sftp://user@host/path?SFTP_PASSWORD=p", err: "must set SFTP_HOST_KEY"},
+			{uri: "sftp://user@host//a//b?SFTP_PASSWORD=p&SFTP_HOST_KEY=k", err: "empty segments"},
+		} {
+			_, err := cloudimpl.ExternalStorageConfFromURI(tc.uri, user)
+			require.True(t, testutils.IsError(err, tc.err), "%s: %v", tc.uri, err)
+		}
+
+		conf, err := cloudimpl.ExternalStorageConfFromURI(
+			"sftp://user@host/a/b?SFTP_PASSWORD=p&SFTP_HOST_KEY=k", user)
+		require.NoError(t, err)
+		require.Equal(t, "host:22", conf.SFTPConfig.Host)
+		require.Equal(t, "/a/b", conf.SFTPConfig.Prefix)
+
+		sanitized, err := cloudimpl.SanitizeExternalStorageURI(
+			"sftp://user@host/a?SFTP_PASSWORD=p&SFTP_PRIVATE_KEY=k&SFTP_HOST_KEY=h", nil)
+		require.NoError(t, err)
+		require.Equal(t,
+			"sftp://user@host/a?SFTP_HOST_KEY=h&SFTP_PASSWORD=redacted&SFTP_PRIVATE_KEY=redacted", sanitized)
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/stretchr/testify/require"
+)
+
+// sizeCountingStorage is an ExternalStorage that counts the calls to Size.
+type sizeCountingStorage struct {
+	cloud.ExternalStorage
+	sizes int
+}
+
+func (s *sizeCountingStorage) Size(ctx context.Context, basename string) (int64, error) {
+	s.sizes++
+	return s.ExternalStorage.Size(ctx, basename)
+}
+
+func TestSizeCacheStorage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	clock := timeutil.NewManualTime(timeutil.Unix(0, 0))
+	inner := &sizeCountingStorage{ExternalStorage: cloudimpl.NewMemoryStorage()}
+	s := cloudimpl.WithSizeCache(inner, cloudimpl.SizeCacheOptions{TTL: time.Minute, TimeSource: clock})
+
+	write := func(name, content string) {
+		require.NoError(t, s.WriteFile(ctx, name, bytes.NewReader([]byte(content))))
+	}
+	requireSize := func(name string, expected int64, lookups int) {
+		t.Helper()
+		size, err := s.Size(ctx, name)
+		require.NoError(t, err)
+		require.Equal(t, expected, size)
+		require.Equal(t, lookups, inner.sizes)
+	}
+
+	write(`a`, `hello`)
+	write(`dir/b`, `hi`)
+
+	t.Run("hit", func(t *testing.T) {
+		requireSize(`a`, 5, 1)
+		requireSize(`a`, 5, 1)
+		requireSize(`dir/b`, 2, 2)
+		requireSize(`dir/b`, 2, 2)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		clock.Advance(time.Minute)
+		requireSize(`a`, 5, 3)
+		requireSize(`a`, 5, 3)
+	})
+
+	t.Run("write", func(t *testing.T) {
+		write(`a`, `hello world`)
+		requireSize(`a`, 11, 4)
+		requireSize(`a`, 11, 4)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, s.Delete(ctx, `a`))
+		_, err := s.Size(ctx, `a`)
+		require.Error(t, err)
+		require.Equal(t, 5, inner.sizes)
+	})
+
+	t.Run("delete all", func(t *testing.T) {
+		write(`dir/c`, `hey`)
+		requireSize(`dir/c`, 3, 6)
+		require.NoError(t, s.DeleteAll(ctx, `dir/`))
+		for _, name := range []string{`dir/b`, `dir/c`} {
+			_, err := s.Size(ctx, name)
+			require.Error(t, err)
+		}
+		require.Equal(t, 8, inner.sizes)
+	})
+
+	t.Run("errors are not cached", func(t *testing.T) {
+		_, err := s.Size(ctx, `missing`)
+		require.Error(t, err)
+		write(`missing`, `found`)
+		requireSize(`missing`, 5, 10)
+	})
+}
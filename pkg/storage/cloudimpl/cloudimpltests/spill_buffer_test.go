@@ -0,0 +1,194 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// patternByte is the byte at offset i of the files of a generatedStorage.
+func patternByte(i int64) byte {
+	return byte(i*7 + i/251)
+}
+
+// patternReader reads size bytes of the pattern of patternByte, calling
+// afterRead, if set, with its position after each read.
+type patternReader struct {
+	pos, size int64
+	afterRead func(pos int64)
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if remaining := r.size - r.pos; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	for i := range p {
+		p[i] = patternByte(r.pos + int64(i))
+	}
+	r.pos += int64(len(p))
+	if r.afterRead != nil {
+		r.afterRead(r.pos)
+	}
+	return len(p), nil
+}
+
+// generatedStorage is an ExternalStorage whose files are size bytes that are
+// generated as they are read rather than held in memory.
+type generatedStorage struct {
+	cloud.ExternalStorage
+	settings  *cluster.Settings
+	size      int64
+	afterRead func(pos int64)
+}
+
+func (s *generatedStorage) Settings() *cluster.Settings {
+	return s.settings
+}
+
+func (s *generatedStorage) ReadFile(_ context.Context, _ string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(&patternReader{size: s.size, afterRead: s.afterRead}), nil
+}
+
+func TestReadFileBuffered(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	// Temporary files are created in the directory of TMPDIR.
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	defer func(tmp string) { _ = os.Setenv("TMPDIR", tmp) }(os.Getenv("TMPDIR"))
+	require.NoError(t, os.Setenv("TMPDIR", dir))
+	spilled := func() int {
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		return len(files)
+	}
+
+	const maxInMemory = 1 << 20
+	settings := cluster.MakeTestingClusterSettings()
+	updater := settings.MakeUpdater()
+	require.NoError(t, updater.Set(cloudimpl.CloudstorageMaxInMemoryBufferSizeSetting,
+		"1048576", "z"))
+
+	check := func(t *testing.T, f *cloudimpl.BufferedFile, size int64) {
+		require.Equal(t, size, f.Size())
+		// Read the whole file sequentially in reads that do not line up with
+		// its end in memory.
+		buf := make([]byte, 100<<10+3)
+		var pos int64
+		for {
+			n, err := f.Read(buf)
+			for i := 0; i < n; i++ {
+				if buf[i] != patternByte(pos+int64(i)) {
+					t.Fatalf("unexpected byte at offset %d", pos+int64(i))
+				}
+			}
+			pos += int64(n)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+		}
+		require.Equal(t, size, pos)
+
+		// Read again around the end of memory and the end of the file.
+		for _, off := range []int64{0, maxInMemory - 10, size - 10} {
+			if off < 0 || off >= size {
+				continue
+			}
+			_, err := f.Seek(off, io.SeekStart)
+			require.NoError(t, err)
+			p := make([]byte, 20)
+			n, err := io.ReadFull(f, p)
+			if off+20 > size {
+				require.Equal(t, io.ErrUnexpectedEOF, err)
+			} else {
+				require.NoError(t, err)
+			}
+			for i := 0; i < n; i++ {
+				require.Equal(t, patternByte(off+int64(i)), p[i], "offset %d", off+int64(i))
+			}
+		}
+		n, err := f.ReadAt(make([]byte, 1), size)
+		require.Equal(t, 0, n)
+		require.Equal(t, io.EOF, err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		size    int64
+		spilled bool
+	}{
+		{"empty", 0, false},
+		{"small", 1000, false},
+		{"exactly in memory", maxInMemory, false},
+		{"one byte over", maxInMemory + 1, true},
+		{"large", 64 << 20, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			es := &generatedStorage{settings: settings, size: tc.size}
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			f, err := cloudimpl.ReadFileBuffered(ctx, es, `file`)
+			require.NoError(t, err)
+			runtime.ReadMemStats(&after)
+			// Buffering the file allocates about as much as is held in memory,
+			// however large the file is.
+			require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(3*maxInMemory))
+
+			if tc.spilled {
+				require.Equal(t, 1, spilled())
+			} else {
+				require.Equal(t, 0, spilled())
+			}
+			check(t, f, tc.size)
+			// The temporary file is removed when the buffer is closed.
+			require.NoError(t, f.Close())
+			require.Equal(t, 0, spilled())
+		})
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := cloudimpl.ReadFileBuffered(ctx, &generatedStorage{settings: settings, size: 10}, `file`)
+		require.Equal(t, context.Canceled, err)
+
+		// A read canceled once it spilled removes its temporary file.
+		ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+		es := &generatedStorage{settings: settings, size: 64 << 20, afterRead: func(pos int64) {
+			if pos > 2*maxInMemory {
+				require.Equal(t, 1, spilled())
+				cancel()
+			}
+		}}
+		_, err = cloudimpl.ReadFileBuffered(ctx, es, `file`)
+		require.True(t, errors.Is(err, context.Canceled), "%v", err)
+		require.Equal(t, 0, spilled())
+	})
+}
@@ -0,0 +1,360 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpltests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/blobs"
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloudimpl"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeWebHDFS is an in-memory namenode with the WebHDFS API, which redirects
+// the data of OPEN, CREATE and APPEND to its /datanode endpoint like a real
+// namenode redirects them to a datanode. It accepts the requests of the user
+// "user" or with the delegation token "token".
+type fakeWebHDFS struct {
+	*httptest.Server
+
+	mu struct {
+		sync.Mutex
+		files map[string][]byte
+		// ops are the operations received by the namenode, in order.
+		ops []string
+	}
+}
+
+func newFakeWebHDFS(t *testing.T) *fakeWebHDFS {
+	f := &fakeWebHDFS{}
+	f.mu.files = make(map[string][]byte)
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading request body: %v", err)
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.serve(t, w, r, body)
+	}))
+	return f
+}
+
+func (f *fakeWebHDFS) uri(path string, q url.Values) string {
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		panic(err)
+	}
+	u.Scheme = "webhdfs"
+	u.Path = path
+	if q.Get(cloudimpl.WebHDFSDelegationTokenParam) == "" {
+		u.User = url.User("user")
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (f *fakeWebHDFS) ops() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.mu.ops...)
+}
+
+func writeRemoteException(w http.ResponseWriter, status int, exception, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"RemoteException": map[string]string{"exception": exception, "message": msg},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeWebHDFS) serve(t *testing.T, w http.ResponseWriter, r *http.Request, body []byte) {
+	q := r.URL.Query()
+	if q.Get("user.name") != "user" && q.Get("delegation") != "token" {
+		writeRemoteException(w, http.StatusForbidden, "AccessControlException", "not authorized")
+		return
+	}
+	op := q.Get("op")
+	if p := strings.TrimPrefix(r.URL.Path, "/datanode"); p != r.URL.Path {
+		f.serveData(w, op, p, q, body)
+		return
+	}
+	filePath := strings.TrimPrefix(r.URL.Path, "/webhdfs/v1")
+	if filePath == r.URL.Path {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.mu.ops = append(f.mu.ops, op)
+
+	switch op {
+	case "OPEN", "CREATE", "APPEND":
+		// The data is sent to the datanode, with the parameters of the request.
+		w.Header().Set("Location", fmt.Sprintf("%s/datanode%s?%s", f.URL, filePath, q.Encode()))
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	case "GETFILESTATUS":
+		if data, ok := f.mu.files[filePath]; ok {
+			writeJSON(w, map[string]interface{}{"FileStatus": fileStatus("", data)})
+		} else if f.isDir(filePath) {
+			writeJSON(w, map[string]interface{}{"FileStatus": dirStatus("")})
+		} else {
+			writeRemoteException(w, http.StatusNotFound, "FileNotFoundException", filePath)
+		}
+	case "LISTSTATUS":
+		var statuses []map[string]interface{}
+		if data, ok := f.mu.files[filePath]; ok {
+			statuses = append(statuses, fileStatus("", data))
+		} else if f.isDir(filePath) {
+			children := map[string]map[string]interface{}{}
+			for name, data := range f.mu.files {
+				rel := strings.TrimPrefix(name, strings.TrimSuffix(filePath, "/")+"/")
+				if rel == name {
+					continue
+				}
+				if i := strings.Index(rel, "/"); i >= 0 {
+					children[rel[:i]] = dirStatus(rel[:i])
+				} else {
+					children[rel] = fileStatus(rel, data)
+				}
+			}
+			var names []string
+			for name := range children {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				statuses = append(statuses, children[name])
+			}
+		} else {
+			writeRemoteException(w, http.StatusNotFound, "FileNotFoundException", filePath)
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"FileStatuses": map[string]interface{}{"FileStatus": statuses},
+		})
+	case "DELETE":
+		_, ok := f.mu.files[filePath]
+		delete(f.mu.files, filePath)
+		writeJSON(w, map[string]bool{"boolean": ok})
+	default:
+		writeRemoteException(w, http.StatusBadRequest, "IllegalArgumentException", "unknown op "+op)
+	}
+}
+
+// serveData serves the requests that the namenode redirects to the datanode.
+func (f *fakeWebHDFS) serveData(
+	w http.ResponseWriter, op, filePath string, q url.Values, body []byte,
+) {
+	data, ok := f.mu.files[filePath]
+	switch op {
+	case "OPEN":
+		if !ok {
+			writeRemoteException(w, http.StatusNotFound, "FileNotFoundException", filePath)
+			return
+		}
+		offset, _ := strconv.Atoi(q.Get("offset"))
+		if offset > len(data) {
+			offset = len(data)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)-offset))
+		_, _ = w.Write(data[offset:])
+	case "CREATE":
+		if ok && q.Get("overwrite") != "true" {
+			writeRemoteException(w, http.StatusForbidden, "FileAlreadyExistsException", filePath)
+			return
+		}
+		f.mu.files[filePath] = body
+		w.WriteHeader(http.StatusCreated)
+	case "APPEND":
+		if !ok {
+			writeRemoteException(w, http.StatusNotFound, "FileNotFoundException", filePath)
+			return
+		}
+		f.mu.files[filePath] = append(data, body...)
+	}
+}
+
+func (f *fakeWebHDFS) isDir(dir string) bool {
+	dir = strings.TrimSuffix(dir, "/") + "/"
+	for name := range f.mu.files {
+		if strings.HasPrefix(name, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func fileStatus(suffix string, data []byte) map[string]interface{} {
+	return map[string]interface{}{
+		"pathSuffix": suffix, "type": "FILE", "length": len(data), "modificationTime": 1e12,
+	}
+}
+
+func dirStatus(suffix string) map[string]interface{} {
+	return map[string]interface{}{"pathSuffix": suffix, "type": "DIRECTORY"}
+}
+
+func TestPutWebHDFS(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	user := security.RootUserName()
+	srv := newFakeWebHDFS(t)
+	defer srv.Close()
+	withToken := url.Values{cloudimpl.WebHDFSDelegationTokenParam: {"token"}}
+
+	t.Run("user", func(t *testing.T) {
+		testExportStore(t, srv.uri("/user", nil), false, user, nil, nil)
+		testListFiles(t, srv.uri("/listing-test/basepath", nil), user, nil, nil)
+	})
+	t.Run("delegation token", func(t *testing.T) {
+		// Files larger than a chunk are appended to after they are created.
+		updater := testSettings.MakeUpdater()
+		require.NoError(t, updater.Set(cloudimpl.CloudstorageWebHDFSAppendChunkSizeSetting,
+			"1048576", "z"))
+		defer func() {
+			require.NoError(t, updater.Set(cloudimpl.CloudstorageWebHDFSAppendChunkSizeSetting,
+				"134217728", "z"))
+		}()
+		testExportStore(t, srv.uri("/token", withToken), false, user, nil, nil)
+		require.Contains(t, srv.ops(), "APPEND")
+	})
+
+	fromURI := func(uri string) cloud.ExternalStorage {
+		s, err := cloudimpl.ExternalStorageFromURI(ctx, uri, base.ExternalIODirConfig{},
+			testSettings, blobs.TestEmptyBlobClientFactory, user, nil, nil)
+		require.NoError(t, err)
+		return s
+	}
+
+	t.Run("operations", func(t *testing.T) {
+		s := fromURI(srv.uri("/ops", nil))
+		defer s.Close()
+		require.NoError(t, s.WriteFile(ctx, "a/b/file", bytes.NewReader([]byte("0123456789"))))
+		srv.mu.Lock()
+		content := srv.mu.files["/ops/a/b/file"]
+		srv.mu.Unlock()
+		require.Equal(t, "0123456789", string(content))
+
+		r, size, err := s.ReadFileAt(ctx, "a/b/file", 4)
+		require.NoError(t, err)
+		require.Equal(t, int64(10), size)
+		content, err = ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, "456789", string(content))
+
+		size, err = s.Size(ctx, "a/b/file")
+		require.NoError(t, err)
+		require.Equal(t, int64(10), size)
+		info, err := s.Stat(ctx, "a/b/file")
+		require.NoError(t, err)
+		require.True(t, info.Exists)
+		require.Equal(t, int64(10), info.Size)
+		require.Equal(t, int64(1e12), info.ModTime.UnixNano()/1e6)
+
+		err = s.WriteFileIfNotExists(ctx, "a/b/file", bytes.NewReader(nil))
+		require.True(t, errors.Is(err, cloudimpl.ErrFileAlreadyExists), "%v", err)
+		require.NoError(t, s.WriteFileIfNotExists(ctx, "a/new", bytes.NewReader([]byte("new"))))
+
+		require.NoError(t, s.Delete(ctx, "a/b/file"))
+		_, err = s.ReadFile(ctx, "a/b/file")
+		require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+		_, err = s.Size(ctx, "a/b/file")
+		require.True(t, errors.Is(err, cloudimpl.ErrFileDoesNotExist), "%v", err)
+		info, err = s.Stat(ctx, "a/b/file")
+		require.NoError(t, err)
+		require.False(t, info.Exists)
+		files, err := s.ListFiles(ctx, "a/*")
+		require.NoError(t, err)
+		require.Equal(t, []string{"a/new"}, files)
+
+		require.NoError(t, s.DeleteAll(ctx, "a/"))
+		files, err = s.ListFiles(ctx, "a/*")
+		require.NoError(t, err)
+		require.Empty(t, files)
+	})
+
+	t.Run("listing a missing directory", func(t *testing.T) {
+		s := fromURI(srv.uri("/missing", nil))
+		defer s.Close()
+		files, err := s.ListFiles(ctx, "*")
+		require.NoError(t, err)
+		require.Empty(t, files)
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		s := fromURI(srv.uri("/ops", url.Values{cloudimpl.WebHDFSDelegationTokenParam: {"wrong"}}))
+		defer s.Close()
+		_, err := s.ReadFile(ctx, "file")
+		require.True(t, errors.Is(err, cloudimpl.ErrAccessDenied), "%v", err)
+		err = s.WriteFile(ctx, "file", bytes.NewReader(nil))
+		require.True(t, errors.Is(err, cloudimpl.ErrAccessDenied), "%v", err)
+	})
+
+	t.Run("parsing", func(t *testing.T) {
+		for _, tc := range []struct {
+			uri, err string
+		}{
+			{uri: "webhdfs:///path", err: "must specify the host of the namenode"},
+			{uri: "webhdfs://user:p@host/path", err: "must not contain a password"},
+			{uri: "webhdfs://user@host/path?HDFS_DELEGATION_TOKEN=t", err: "both a user and"},
+			{uri: "webhdfs://user@host//a//b", err: "empty segments"},
+		} {
+			_, err := cloudimpl.ExternalStorageConfFromURI(tc.uri, user)
+			require.True(t, testutils.IsError(err, tc.err), "%s: %v", tc.uri, err)
+		}
+
+		for _, tc := range []struct {
+			uri, host string
+			tls       bool
+		}{
+			{uri: "webhdfs://user@host/a/b", host: "host:9870"},
+			{uri: "swebhdfs://user@host/a/b", host: "host:9871", tls: true},
+			{uri: "webhdfs://user@host:50070/a/b", host: "host:50070"},
+		} {
+			conf, err := cloudimpl.ExternalStorageConfFromURI(tc.uri, user)
+			require.NoError(t, err)
+			require.Equal(t, tc.host, conf.WebHDFSConfig.Host)
+			require.Equal(t, tc.tls, conf.WebHDFSConfig.UseTLS)
+			require.Equal(t, "/a/b", conf.WebHDFSConfig.Prefix)
+			require.Equal(t, "user", conf.WebHDFSConfig.User)
+		}
+
+		sanitized, err := cloudimpl.SanitizeExternalStorageURI(
+			"swebhdfs://host/a?HDFS_DELEGATION_TOKEN=t", nil)
+		require.NoError(t, err)
+		require.Equal(t, "swebhdfs://host/a?HDFS_DELEGATION_TOKEN=redacted", sanitized)
+	})
+}
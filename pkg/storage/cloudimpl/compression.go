@@ -0,0 +1,344 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression identifies the algorithm a file in ExternalStorage is compressed
+// with.
+type Compression int
+
+const (
+	// CompressionNone is used for files that are not compressed.
+	CompressionNone Compression = iota
+	// CompressionGzip is used for gzip-compressed files.
+	CompressionGzip
+	// CompressionZstd is used for files compressed with Zstandard.
+	CompressionZstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return "unknown"
+}
+
+var writeCompression = settings.RegisterEnumSetting(
+	"cloudstorage.write_compression",
+	"the algorithm that files written with WriteFileCompressed are compressed with",
+	"gzip",
+	map[int64]string{
+		int64(CompressionGzip): "gzip",
+		int64(CompressionZstd): "zstd",
+	},
+)
+
+var writeCompressionLevel = settings.RegisterIntSetting(
+	"cloudstorage.write_compression.level",
+	"the level that files written with WriteFileCompressed are compressed at, from 1 to 9 for "+
+		"gzip and 1 to 22 for zstd; 0 uses the default level of the algorithm",
+	0,
+	settings.NonNegativeInt,
+)
+
+// CompressionOptions configures how WriteFileCompressed compresses files.
+type CompressionOptions struct {
+	Compression Compression
+	// Level is the compression level, whose range depends on the algorithm:
+	// from 1 to 9 for gzip, and 1 to 22 for zstd, which is mapped onto the
+	// fewer levels that the encoder implements. Zero uses the default level of
+	// the algorithm.
+	Level int
+}
+
+// CompressionOptionsFromSettings returns the CompressionOptions configured by
+// the cloudstorage.write_compression settings.
+func CompressionOptionsFromSettings(sv *settings.Values) CompressionOptions {
+	return CompressionOptions{
+		Compression: Compression(writeCompression.Get(sv)),
+		Level:       int(writeCompressionLevel.Get(sv)),
+	}
+}
+
+// compressor is implemented by the writers of compressed streams.
+type compressor interface {
+	io.WriteCloser
+	// Reset discards the state of the compressor, which then writes a new
+	// stream to w.
+	Reset(w io.Writer)
+}
+
+func (o CompressionOptions) newCompressor(w io.Writer) (compressor, error) {
+	switch o.Compression {
+	case CompressionGzip:
+		level := o.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		// Only a stream is encoded, which needs a single encoder.
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if o.Level != 0 {
+			if o.Level < 1 || o.Level > 22 {
+				return nil, errors.Errorf("invalid zstd compression level %d", o.Level)
+			}
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(o.Level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	}
+	return nil, errors.Errorf("cannot compress with %s", o.Compression)
+}
+
+// compressingReader is an io.ReadSeeker yielding the compressed content of
+// src, which is compressed as it is read. It can only seek to its start, which
+// restarts the compression from the start of src, so that writes of it can be
+// retried.
+type compressingReader struct {
+	src   io.ReadSeeker
+	w     compressor
+	buf   lockedBuffer
+	chunk []byte
+	// done is set once src is fully read and the compressor is closed.
+	done bool
+	pos  int64
+}
+
+var _ io.ReadSeeker = &compressingReader{}
+
+// lockedBuffer is a bytes.Buffer that is safe for concurrent use, as the zstd
+// encoder writes the blocks it compressed from another goroutine.
+type lockedBuffer struct {
+	syncutil.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Read(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Read(p)
+}
+
+func (b *lockedBuffer) Len() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Len()
+}
+
+func (b *lockedBuffer) Reset() {
+	b.Lock()
+	defer b.Unlock()
+	b.buf.Reset()
+}
+
+// compressingReaderChunkSize is the size of the chunks of src compressed at
+// once.
+const compressingReaderChunkSize = 64 << 10
+
+func newCompressingReader(src io.ReadSeeker, opts CompressionOptions) (*compressingReader, error) {
+	c := &compressingReader{src: src, chunk: make([]byte, compressingReaderChunkSize)}
+	var err error
+	if c.w, err = opts.newCompressor(&c.buf); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Read implements io.Reader.
+func (c *compressingReader) Read(p []byte) (int, error) {
+	for c.buf.Len() == 0 && !c.done {
+		n, err := c.src.Read(c.chunk)
+		if n > 0 {
+			if _, err := c.w.Write(c.chunk[:n]); err != nil {
+				return 0, err
+			}
+		}
+		if err == io.EOF {
+			if err := c.w.Close(); err != nil {
+				return 0, err
+			}
+			c.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if c.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	n, _ := c.buf.Read(p)
+	c.pos += int64(n)
+	return n, nil
+}
+
+// Seek implements io.Seeker. Only the start and the current position can be
+// sought.
+func (c *compressingReader) Seek(offset int64, whence int) (int64, error) {
+	switch {
+	case offset == 0 && whence == io.SeekCurrent:
+		return c.pos, nil
+	case offset == 0 && whence == io.SeekStart:
+		if _, err := c.src.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		// The compressor is reset first, as it waits for the blocks in flight.
+		c.w.Reset(&c.buf)
+		c.buf.Reset()
+		c.done = false
+		c.pos = 0
+		return 0, nil
+	}
+	return 0, errors.New("compressed content can only seek to its start")
+}
+
+// WriteFileCompressed writes the content, compressed as configured by opts, to
+// basename in es. The compressed content cannot report its length, so storage
+// that needs it to upload in parts buffers each part instead.
+func WriteFileCompressed(
+	ctx context.Context,
+	es cloud.ExternalStorage,
+	basename string,
+	content io.ReadSeeker,
+	opts CompressionOptions,
+) error {
+	r, err := newCompressingReader(content, opts)
+	if err != nil {
+		return err
+	}
+	return es.WriteFile(ctx, basename, r)
+}
+
+// gzipMagic and zstdMagic are the headers that every gzip and zstd stream
+// starts with.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// DecompressingReader is an io.ReadCloser that decompresses the file it reads
+// if the file is gzip or zstd-compressed, and otherwise reads it unchanged.
+//
+// The file is identified as compressed by its header rather than by a suffix
+// such as .gz, as some storage, such as GCS serving an object with a gzip
+// Content-Encoding, already decompresses the files it serves.
+type DecompressingReader struct {
+	r    io.ReadCloser
+	body io.Reader
+	// decompressor is set if the file is compressed.
+	decompressor io.ReadCloser
+	compression  Compression
+	name         string
+}
+
+var _ io.ReadCloser = &DecompressingReader{}
+
+// NewDecompressingReader returns a DecompressingReader reading the file name
+// from r, which is used in errors. r is not closed if an error is returned.
+func NewDecompressingReader(r io.ReadCloser, name string) (*DecompressingReader, error) {
+	buffered := bufio.NewReader(r)
+	d := &DecompressingReader{r: r, body: buffered, name: name}
+	// A zstd frame has a header past its magic, so a stream that ends at its
+	// magic is truncated, but the decoder reads it as empty.
+	header, err := buffered.Peek(len(zstdMagic) + 1)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "reading %s", name)
+	}
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		d.compression = CompressionGzip
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(buffered); err == nil {
+			d.decompressor = gz
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	case bytes.HasPrefix(header, zstdMagic):
+		d.compression = CompressionZstd
+		var zr *zstd.Decoder
+		if len(header) == len(zstdMagic) {
+			err = io.ErrUnexpectedEOF
+		} else if zr, err = zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1)); err == nil {
+			d.decompressor = zr.IOReadCloser()
+		}
+	default:
+		return d, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s header of %s", d.compression, name)
+	}
+	d.body = d.decompressor
+	return d, nil
+}
+
+// ReadFileDecompressed opens basename in es for reading, decompressing it if
+// it is compressed.
+func ReadFileDecompressed(
+	ctx context.Context, es cloud.ExternalStorage, basename string,
+) (*DecompressingReader, error) {
+	r, err := es.ReadFile(ctx, basename)
+	if err != nil {
+		return nil, err
+	}
+	d, err := NewDecompressingReader(r, basename)
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Compression returns the algorithm the file is compressed with.
+func (d *DecompressingReader) Compression() Compression {
+	return d.compression
+}
+
+// Read implements io.Reader. A compressed file that ends before its
+// compressed stream does fails with an error wrapping io.ErrUnexpectedEOF.
+func (d *DecompressingReader) Read(p []byte) (int, error) {
+	n, err := d.body.Read(p)
+	if d.decompressor != nil && err == io.ErrUnexpectedEOF {
+		return n, errors.Wrapf(err, "%s stream of %s is truncated", d.compression, d.name)
+	}
+	return n, err
+}
+
+// Close implements io.Closer, closing the underlying reader. Closing a gzip
+// reader only reports the errors already returned by Read, so its error is
+// ignored, but a zstd reader must be closed to release its resources.
+func (d *DecompressingReader) Close() error {
+	if d.decompressor != nil {
+		_ = d.decompressor.Close()
+	}
+	return d.r.Close()
+}
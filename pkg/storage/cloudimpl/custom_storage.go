@@ -0,0 +1,84 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/errors"
+)
+
+// URIParserFn parses a URI of a custom provider into the configuration of a
+// storage, which is opaque to everything but the provider's FactoryFn.
+type URIParserFn func(ExternalStorageURIContext, *url.URL) (config string, _ error)
+
+// FactoryFn creates a storage of a custom provider from a configuration
+// returned by its URIParserFn.
+type FactoryFn func(
+	ctx context.Context, args ExternalStorageContext, config string,
+) (cloud.ExternalStorage, error)
+
+// customProviders are the factories of the providers registered with
+// RegisterProvider, by URI scheme.
+var customProviders = map[string]FactoryFn{}
+
+// RegisterProvider registers a custom external storage provider for URIs with
+// the given scheme, so that ExternalStorageFromURI and MakeExternalStorage
+// create its storages. The configuration returned by parser is stored in an
+// ExternalStorage with the Custom provider, which the Conf of the provider's
+// storages must return, as built by CustomProviderConf, for the storage to be
+// recreated elsewhere, e.g. on another node.
+//
+// The registries of providers are not synchronized: RegisterProvider must be
+// called from an init function, before any storage is created. It panics if
+// a provider is already registered for the scheme.
+func RegisterProvider(scheme string, parser URIParserFn, factory FactoryFn) {
+	if _, ok := confParsers[scheme]; ok {
+		panic(fmt.Sprintf("external storage provider already registered for %s", scheme))
+	}
+	confParsers[scheme] = func(
+		uriCtx ExternalStorageURIContext, uri *url.URL,
+	) (roachpb.ExternalStorage, error) {
+		config, err := parser(uriCtx, uri)
+		if err != nil {
+			return roachpb.ExternalStorage{}, err
+		}
+		return CustomProviderConf(scheme, config), nil
+	}
+	customProviders[scheme] = factory
+}
+
+// CustomProviderConf returns the ExternalStorage configuration of a storage
+// of the custom provider registered for scheme.
+func CustomProviderConf(scheme, config string) roachpb.ExternalStorage {
+	return roachpb.ExternalStorage{
+		Provider:     roachpb.ExternalStorageProvider_Custom,
+		CustomConfig: &roachpb.ExternalStorage_Custom{Scheme: scheme, Config: config},
+	}
+}
+
+func makeCustomStorage(
+	ctx context.Context, args ExternalStorageContext, dest roachpb.ExternalStorage,
+) (cloud.ExternalStorage, error) {
+	conf := dest.CustomConfig
+	if conf == nil {
+		return nil, errors.Errorf("custom storage requested but info missing")
+	}
+	factory, ok := customProviders[conf.Scheme]
+	if !ok {
+		return nil, errors.Errorf("no external storage provider registered for %s", conf.Scheme)
+	}
+	return factory(ctx, args, conf.Config)
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/errors"
+)
+
+// dryRunStorage wraps an ExternalStorage, turning the operations that would
+// modify it into read-only probes.
+type dryRunStorage struct {
+	cloud.ExternalStorage
+}
+
+var _ cloud.ExternalStorage = &dryRunStorage{}
+var _ cloud.Presigner = &dryRunStorage{}
+var _ cloud.Copier = &dryRunStorage{}
+var _ cloud.Syncer = &dryRunStorage{}
+var _ cloud.Validator = &dryRunStorage{}
+var _ cloud.PageLister = &dryRunStorage{}
+var _ cloud.DelimitedLister = &dryRunStorage{}
+
+// WithDryRun returns an ExternalStorage whose WriteFile and Delete do not
+// modify inner. Instead, they stat the file they would have modified, which
+// checks that the path is valid and that the storage is reachable with the
+// configured credentials, and return the error of that probe if any. Reads and
+// listings are passed through to inner unchanged.
+//
+// This is meant for pre-flight checks of a destination; note that a successful
+// probe only proves read access, as checking write access would require
+// writing.
+func WithDryRun(inner cloud.ExternalStorage) cloud.ExternalStorage {
+	return &dryRunStorage{ExternalStorage: inner}
+}
+
+func (d *dryRunStorage) probe(ctx context.Context, op, basename string) error {
+	if _, err := d.ExternalStorage.Stat(ctx, basename); err != nil {
+		return errors.Wrapf(err, "dry run %s of %s", op, basename)
+	}
+	log.VEventf(ctx, 2, "dry run: skipping %s of %s", op, basename)
+	return nil
+}
+
+func (d *dryRunStorage) WriteFile(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	return d.probe(ctx, "write", basename)
+}
+
+// WriteFileIfNotExists fails like the real write would if the file exists.
+func (d *dryRunStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	info, err := d.ExternalStorage.Stat(ctx, basename)
+	if err != nil {
+		return errors.Wrapf(err, "dry run write of %s", basename)
+	}
+	if info.Exists {
+		return errors.Wrapf(ErrFileAlreadyExists, "dry run write of %s", basename)
+	}
+	log.VEventf(ctx, 2, "dry run: skipping write of %s", basename)
+	return nil
+}
+
+// CopyFrom checks that the source file exists and probes the destination.
+func (d *dryRunStorage) CopyFrom(
+	ctx context.Context, src cloud.ExternalStorage, srcName, dstName string,
+) error {
+	info, err := src.Stat(ctx, srcName)
+	if err != nil {
+		return errors.Wrapf(err, "dry run copy of %s", srcName)
+	}
+	if !info.Exists {
+		return errors.Wrapf(ErrFileDoesNotExist, "dry run copy of %s", srcName)
+	}
+	return d.probe(ctx, "copy", dstName)
+}
+
+func (d *dryRunStorage) Delete(ctx context.Context, basename string) error {
+	return d.probe(ctx, "delete", basename)
+}
+
+func (d *dryRunStorage) DeleteAll(ctx context.Context, prefix string) error {
+	return d.probe(ctx, "delete of all files starting with", prefix)
+}
+
+// Sync is a no-op, as nothing is written.
+func (d *dryRunStorage) Sync(ctx context.Context) error {
+	return nil
+}
+
+// Validate is passed through to inner, as validating does not modify it.
+func (d *dryRunStorage) Validate(ctx context.Context) error {
+	return Validate(ctx, d.ExternalStorage)
+}
+
+// ListFilesPage is passed through to inner, like the other listings.
+func (d *dryRunStorage) ListFilesPage(
+	ctx context.Context, prefix, token string, limit int,
+) ([]string, string, error) {
+	return ListFilesPage(ctx, d.ExternalStorage, prefix, token, limit)
+}
+
+// ListFilesWithDelimiter is passed through to inner, like the other listings.
+func (d *dryRunStorage) ListFilesWithDelimiter(
+	ctx context.Context, prefix, delimiter string,
+) ([]string, []string, error) {
+	return ListFilesWithDelimiter(ctx, d.ExternalStorage, prefix, delimiter)
+}
+
+// PresignedURL is passed through to inner, as presigning does not modify it.
+func (d *dryRunStorage) PresignedURL(
+	ctx context.Context, basename string, expiry time.Duration,
+) (string, error) {
+	return PresignedURL(ctx, d.ExternalStorage, basename, expiry)
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
+	"github.com/cockroachdb/errors"
+)
+
+// The classes that the errors of external storage are counted by. There are
+// few of them so that the counters remain few.
+const (
+	storageErrorAuth      = "auth"
+	storageErrorNotFound  = "not-found"
+	storageErrorTimeout   = "timeout"
+	storageErrorRateLimit = "rate-limit"
+	storageErrorOther     = "other"
+)
+
+// errRateLimited marks the errors of the responses of HTTP storage that
+// rejected a request as too frequent, which the other providers identify by
+// their error types.
+var errRateLimited = errors.New("rate limited")
+
+// countStorageError increments the "external-io.<provider>.error.<class>"
+// feature counter for the class of err, where provider is the telemetry name
+// the provider was registered with, and returns err. Nil errors and errors of
+// canceled operations are not counted, as they do not mean the storage failed.
+func countStorageError(provider roachpb.ExternalStorageProvider, err error) error {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return err
+	}
+	if impl, ok := implementations[provider]; ok {
+		telemetry.Count(impl.telemetryName + ".error." + storageErrorClass(err))
+	}
+	return err
+}
+
+// storageErrorClass returns the class of err that it is counted by.
+func storageErrorClass(err error) string {
+	switch {
+	// Some rate limits are reported with a 403, which also marks the error
+	// with ErrAccessDenied.
+	case isRateLimitedError(err):
+		return storageErrorRateLimit
+	case errors.Is(err, ErrAccessDenied):
+		return storageErrorAuth
+	case errors.Is(err, ErrFileDoesNotExist):
+		return storageErrorNotFound
+	}
+	if netErr := (net.Error)(nil); errors.As(err, &netErr) && netErr.Timeout() {
+		return storageErrorTimeout
+	}
+	return storageErrorOther
+}
+
+// isRateLimitedError returns true if err is marked with errRateLimited or is a
+// failed request that a provider rejected as too frequent.
+func isRateLimitedError(err error) bool {
+	if errors.Is(err, errRateLimited) || isGCSRateLimitError(err) {
+		return true
+	}
+	if reqErr := (awserr.RequestFailure)(nil); errors.As(err, &reqErr) {
+		return reqErr.StatusCode() == http.StatusTooManyRequests ||
+			reqErr.Code() == "SlowDown" || reqErr.Code() == "Throttling"
+	}
+	if azerr := (azblob.StorageError)(nil); errors.As(err, &azerr) {
+		return azerr.ServiceCode() == azblob.ServiceCodeServerBusy
+	}
+	return false
+}
@@ -14,8 +14,12 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"mime"
+	"net/http"
 	"net/url"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,10 +29,12 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/kv"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
 	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql"
 	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/util/contextutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/retry"
 	"github.com/cockroachdb/cockroach/pkg/util/sysutil"
@@ -54,9 +60,42 @@ const (
 	// KMS ID to be used for server side encryption.
 	AWSServerSideEncryptionKMSID = "AWS_SERVER_KMS_ID"
 
+	// AWSRequesterPaysParam is the query parameter in an AWS URI which, when
+	// true, acknowledges that the requester pays for reading from the bucket.
+	AWSRequesterPaysParam = "AWS_REQUESTER_PAYS"
+
+	// AWSStorageClassParam is the query parameter in an AWS URI for the storage
+	// class of the objects written to S3, such as STANDARD_IA or GLACIER_IR.
+	AWSStorageClassParam = "AWS_STORAGE_CLASS"
+
+	// AWSObjectACLParam is the query parameter in an AWS URI for the canned ACL
+	// of the objects written to S3, such as bucket-owner-full-control.
+	AWSObjectACLParam = "AWS_OBJECT_ACL"
+
+	// AWSUseImplicitAuthParam is the query parameter in an AWS URI which, when
+	// true, falls back to the credentials of the environment, shared config or
+	// instance role if the URI does not have any.
+	AWSUseImplicitAuthParam = "AWS_USE_IMPLICIT_AUTH"
+
+	// AWSUsePathStyleParam is the query parameter in an AWS URI which, when
+	// true, addresses the bucket in the path of requests rather than in the
+	// host name.
+	AWSUsePathStyleParam = "AWS_USE_PATH_STYLE"
+
+	// AWSUseDualStackParam is the query parameter in an AWS URI which, when
+	// true, sends requests to the dual-stack endpoints of S3, which can be
+	// reached over IPv6.
+	AWSUseDualStackParam = "AWS_USE_DUALSTACK"
+
 	// S3RegionParam is the query parameter for the 'endpoint' in an S3 URI.
 	S3RegionParam = "AWS_REGION"
 
+	// S3FallbackRegionsParam is the query parameter in an S3 URI for the
+	// comma-separated regions that objects are read from when they cannot be
+	// read from the bucket, each as <region> or <region>:<bucket>, where the
+	// bucket defaults to the bucket of the URI.
+	S3FallbackRegionsParam = "AWS_FALLBACK_REGIONS"
+
 	// KMSRegionParam is the query parameter for the 'region' in every KMS URI.
 	KMSRegionParam = "REGION"
 
@@ -64,11 +103,58 @@ const (
 	AzureAccountNameParam = "AZURE_ACCOUNT_NAME"
 	// AzureAccountKeyParam is the query parameter for account_key in an azure URI.
 	AzureAccountKeyParam = "AZURE_ACCOUNT_KEY"
+	// AzureSASTokenParam is the query parameter for the shared access signature
+	// used in place of the account key in an azure URI.
+	AzureSASTokenParam = "AZURE_SAS_TOKEN"
+	// AzureUseManagedIdentityParam is the query parameter in an azure URI which,
+	// when true, authenticates with the managed identity of the node.
+	AzureUseManagedIdentityParam = "AZURE_USE_MANAGED_IDENTITY"
+
+	// HTTPBasicAuthUserParam is the query parameter for the user to authenticate
+	// as with basic auth in an HTTP URI.
+	HTTPBasicAuthUserParam = "AUTH_BASIC_USER"
+	// HTTPBasicAuthPasswordParam is the query parameter for the password to
+	// authenticate with basic auth in an HTTP URI.
+	HTTPBasicAuthPasswordParam = "AUTH_BASIC_PASSWORD"
+	// HTTPBearerTokenParam is the query parameter for the bearer token to
+	// authenticate with in an HTTP URI.
+	HTTPBearerTokenParam = "AUTH_BEARER_TOKEN"
+
+	// SFTPPasswordParam is the query parameter for the password to authenticate
+	// with in an sftp URI.
+	SFTPPasswordParam = "SFTP_PASSWORD"
+	// SFTPPrivateKeyParam is the query parameter for the base64-encoded PEM
+	// private key to authenticate with in an sftp URI.
+	SFTPPrivateKeyParam = "SFTP_PRIVATE_KEY"
+	// SFTPHostKeyParam is the query parameter for the public key, in
+	// authorized_keys format, that the server of an sftp URI must present.
+	SFTPHostKeyParam = "SFTP_HOST_KEY"
+
+	// WebHDFSDelegationTokenParam is the query parameter for the HDFS delegation
+	// token to authenticate with in a webhdfs URI.
+	WebHDFSDelegationTokenParam = "HDFS_DELEGATION_TOKEN"
 
 	// GoogleBillingProjectParam is the query parameter for the billing project
 	// in a gs URI.
 	GoogleBillingProjectParam = "GOOGLE_BILLING_PROJECT"
 
+	// GoogleStorageClassParam is the query parameter in a gs URI for the storage
+	// class of the objects written to GCS, such as NEARLINE or COLDLINE.
+	GoogleStorageClassParam = "GOOGLE_STORAGE_CLASS"
+
+	// GooglePredefinedACLParam is the query parameter in a gs URI for the
+	// predefined ACL of the objects written to GCS, such as publicRead.
+	GooglePredefinedACLParam = "GOOGLE_PREDEFINED_ACL"
+
+	// GoogleUseImplicitAuthParam is the query parameter in a gs URI which, when
+	// true, falls back to the application default credentials if the URI does
+	// not have any.
+	GoogleUseImplicitAuthParam = "GOOGLE_USE_IMPLICIT_AUTH"
+
+	// GoogleObjectMetadataParam is the query parameter in a gs URI for the custom
+	// metadata of the objects written to GCS, as comma-separated key=value pairs.
+	GoogleObjectMetadataParam = "GOOGLE_OBJECT_METADATA"
+
 	// AuthParam is the query parameter for the cluster settings named
 	// key in a URI.
 	AuthParam = "AUTH"
@@ -82,6 +168,10 @@ const (
 	// mode in a URI.
 	AuthParamSpecified = "specified"
 
+	// ContentTypeParam is the query parameter in an s3, gs or azure URI for the
+	// content type of the files written to it, such as text/csv.
+	ContentTypeParam = "CONTENT_TYPE"
+
 	// CredentialsParam is the query parameter for the base64-encoded contents of
 	// the Google Application Credentials JSON file.
 	CredentialsParam = "CREDENTIALS"
@@ -103,15 +193,65 @@ const (
 	// interacting with HTTPS storage.
 	CloudstorageHTTPCASetting = cloudstorageHTTP + ".custom_ca"
 
+	// CloudstorageHTTPInsecureSkipVerifySetting is the setting which, when true,
+	// disables the verification of certificates when interacting with HTTPS
+	// storage.
+	CloudstorageHTTPInsecureSkipVerifySetting = cloudstorageHTTP + ".insecure_skip_verify"
+
+	// CloudstorageGSChunkSizeSetting is the setting whose value is the size of
+	// the chunks in which files are uploaded to Google Cloud Storage.
+	CloudstorageGSChunkSizeSetting = cloudstorageGS + ".chunk_size"
+
+	// CloudstorageUserfileQuotaSetting is the setting whose value is the
+	// maximum number of bytes each user may store in userfile storage.
+	CloudstorageUserfileQuotaSetting = cloudstoragePrefix + ".userfile.quota"
+
+	// CloudstorageReadBytesPerSecSetting is the setting whose value is the
+	// maximum rate at which each ExternalStorage reads data.
+	CloudstorageReadBytesPerSecSetting = cloudstoragePrefix + ".read_bytes_per_sec"
+
+	// CloudstorageWriteBytesPerSecSetting is the setting whose value is the
+	// maximum rate at which each ExternalStorage writes data.
+	CloudstorageWriteBytesPerSecSetting = cloudstoragePrefix + ".write_bytes_per_sec"
+
+	// CloudstorageReadAheadBufferSizeSetting is the setting whose value is the
+	// size of the buffer that files read from cloud storage are read ahead into.
+	CloudstorageReadAheadBufferSizeSetting = cloudstoragePrefix + ".read_ahead_buffer_size"
+
+	// CloudstorageCircuitBreakerThresholdSetting is the setting whose value is
+	// the number of consecutive failures after which the circuit breaker of a
+	// destination opens.
+	CloudstorageCircuitBreakerThresholdSetting = cloudstoragePrefix + ".circuit_breaker.failure_threshold"
+
+	// CloudstorageCircuitBreakerCooldownSetting is the setting whose value is
+	// how long the circuit breaker of a destination stays open before letting
+	// an operation through.
+	CloudstorageCircuitBreakerCooldownSetting = cloudstoragePrefix + ".circuit_breaker.cooldown"
+
+	// CloudstorageWebHDFSAppendChunkSizeSetting is the setting whose value is
+	// the size of the chunks that files are written to WebHDFS in.
+	CloudstorageWebHDFSAppendChunkSizeSetting = cloudstoragePrefix + ".webhdfs.append_chunk_size"
+
+	// CloudstorageMaxInMemoryBufferSizeSetting is the setting whose value is
+	// the number of bytes of a file read by ReadFileBuffered that are held in
+	// memory rather than in a temporary file.
+	CloudstorageMaxInMemoryBufferSizeSetting = cloudstoragePrefix + ".max_in_memory_buffer_size"
+
 	cloudStorageTimeout = cloudstoragePrefix + ".timeout"
 )
 
 // See SanitizeExternalStorageURI.
 var redactedQueryParams = map[string]struct{}{
-	AWSSecretParam:       {},
-	AWSTempTokenParam:    {},
-	AzureAccountKeyParam: {},
-	CredentialsParam:     {},
+	AWSSecretParam:              {},
+	AWSTempTokenParam:           {},
+	AzureAccountKeyParam:        {},
+	AzureSASTokenParam:          {},
+	CredentialsParam:            {},
+	HTTPBasicAuthPasswordParam:  {},
+	HTTPBearerTokenParam:        {},
+	SFTPPasswordParam:           {},
+	SFTPPrivateKeyParam:         {},
+	WebHDFSDelegationTokenParam: {},
 }
 
 // ErrListingUnsupported is a marker for indicating listing is unsupported.
@@ -122,15 +262,67 @@ var ErrListingUnsupported = errors.New("listing is not supported")
 // This error is raised by the ReadFile method.
 var ErrFileDoesNotExist = errors.New("external_storage: file doesn't exist")
 
+// ErrFileAlreadyExists is a sentinel error for indicating that a file that was
+// to be written only if it did not exist already exists. This error is raised
+// by the WriteFileIfNotExists method.
+var ErrFileAlreadyExists = errors.New("external_storage: file already exists")
+
+// ErrUnsupported is a marker for indicating that an ExternalStorage does not
+// support an optional operation, such as generating presigned URLs.
+var ErrUnsupported = errors.New("external_storage: operation not supported")
+
+// ErrReadOnlyStorage is a marker for indicating that an ExternalStorage cannot
+// be written to or deleted from at all, such as workload storage, so that
+// callers can skip writes and cleanups rather than fail them.
+var ErrReadOnlyStorage = errors.New("external_storage: storage is read-only")
+
+// ErrAccessDenied is a marker for indicating that the credentials of an
+// ExternalStorage were rejected or do not grant access to a file.
+var ErrAccessDenied = errors.New("external_storage: access denied")
+
+// listingUnsupportedError marks err, which reports that a storage cannot list
+// files, with both ErrListingUnsupported and ErrUnsupported.
+func listingUnsupportedError(err error) error {
+	return errors.Mark(errors.Mark(err, ErrListingUnsupported), ErrUnsupported)
+}
+
+// readOnlyError marks err, which reports that a storage cannot be modified,
+// with both ErrReadOnlyStorage and ErrUnsupported.
+func readOnlyError(err error) error {
+	return errors.Mark(errors.Mark(err, ErrReadOnlyStorage), ErrUnsupported)
+}
+
+// markStatusError marks err, which was returned for a response with statusCode,
+// with ErrFileDoesNotExist or ErrAccessDenied if the status code means so.
+func markStatusError(err error, statusCode int) error {
+	switch statusCode {
+	case http.StatusNotFound:
+		return errors.Mark(err, ErrFileDoesNotExist)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errors.Mark(err, ErrAccessDenied)
+	}
+	return err
+}
+
 var confParsers = map[string]ExternalStorageURIParser{}
-var implementations = map[roachpb.ExternalStorageProvider]ExternalStorageConstructor{}
+var implementations = map[roachpb.ExternalStorageProvider]implementation{}
+
+// implementation is a registered external storage provider.
+type implementation struct {
+	constructFn ExternalStorageConstructor
+	// telemetryName is the name of the feature counter incremented whenever
+	// an instance of the provider is created.
+	telemetryName string
+}
 
 // RegisterExternalStorageProvider registers an external storage provider for a
-// given URI scheme and provider type.
+// given URI scheme and provider type. Creating an instance of the provider
+// increments the "external-io.<telemetryName>" feature counter.
 func RegisterExternalStorageProvider(
 	providerType roachpb.ExternalStorageProvider,
 	parseFn ExternalStorageURIParser,
 	constructFn ExternalStorageConstructor,
+	telemetryName string,
 	schemes ...string,
 ) {
 	for _, scheme := range schemes {
@@ -142,19 +334,27 @@ func RegisterExternalStorageProvider(
 	if _, ok := implementations[providerType]; ok {
 		panic(fmt.Sprintf("external storage provider already registered for %s", providerType.String()))
 	}
-	implementations[providerType] = constructFn
+	implementations[providerType] = implementation{
+		constructFn:   constructFn,
+		telemetryName: "external-io." + telemetryName,
+	}
 }
 
 func init() {
 	cloud.AccessIsWithExplicitAuth = AccessIsWithExplicitAuth
-	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_Azure, parseAzureURL, makeAzureStorage, "azure")
-	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_GoogleCloud, parseGSURL, makeGCSStorage, "gs")
-	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_Http, parseHTTPURL, MakeHTTPStorage, "http", "https")
-	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_LocalFile, parseNodelocalURL, makeLocalStorage, "nodelocal")
-	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_NullSink, parseNullURL, makeNullSinkStorage, "null")
-	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_S3, parseS3URL, MakeS3Storage, "s3")
-	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_FileTable, parseUserfileURL, makeFileTableStorage, "userfile")
-	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_Workload, ParseWorkloadConfig, makeWorkloadStorage, "workload")
+	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_Azure, parseAzureURL, makeAzureStorage, "azure", "azure")
+	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_GoogleCloud, parseGSURL, makeGCSStorage, "google_cloud", "gs")
+	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_Http, parseHTTPURL, MakeHTTPStorage, "http", "http", "https")
+	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_LocalFile, parseNodelocalURL, makeLocalStorage, "nodelocal", "nodelocal")
+	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_NullSink, parseNullURL, makeNullSinkStorage, "nullsink", "null")
+	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_S3, parseS3URL, MakeS3Storage, "s3", "s3")
+	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_SFTP, parseSFTPURL, makeSFTPStorage, "sftp", "sftp")
+	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_WebHDFS, parseWebHDFSURL, makeWebHDFSStorage, "webhdfs", "webhdfs", "swebhdfs")
+	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_FileTable, parseUserfileURL, makeFileTableStorage, "filetable", "userfile")
+	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_Workload, ParseWorkloadConfig, makeWorkloadStorage, "workload", "workload")
+	// The URIs of custom providers are parsed by the parsers registered for them
+	// with RegisterProvider.
+	RegisterExternalStorageProvider(roachpb.ExternalStorageProvider_Custom, nil, makeCustomStorage, "custom")
 }
 
 // ExternalStorageURIContext contains arguments needed to parse external storage
@@ -261,20 +461,61 @@ func MakeExternalStorage(
 	ie *sql.InternalExecutor,
 	kvDB *kv.DB,
 ) (cloud.ExternalStorage, error) {
-	args := ExternalStorageContext{
+	return MakeExternalStorageFromContext(ctx, dest, ExternalStorageContext{
 		IOConf:            conf,
 		Settings:          settings,
 		BlobClientFactory: blobClientFactory,
 		InternalExecutor:  ie,
 		DB:                kvDB,
+	})
+}
+
+// MakeExternalStorageFromContext creates an ExternalStorage from the given
+// config, using the implementation registered for dest.Provider.
+func MakeExternalStorageFromContext(
+	ctx context.Context, dest roachpb.ExternalStorage, args ExternalStorageContext,
+) (cloud.ExternalStorage, error) {
+	if err := checkExternalIOAllowed(args.IOConf, dest); err != nil {
+		return nil, err
+	}
+	if impl, ok := implementations[dest.Provider]; ok {
+		telemetry.Count(impl.telemetryName)
+		return impl.constructFn(ctx, args, dest)
 	}
+	return nil, errors.Errorf("unsupported external destination type: %s", dest.Provider.String())
+}
+
+// ErrExternalIODisabled is returned when the ExternalIODirConfig of the server
+// does not permit the use of the requested external storage.
+var ErrExternalIODisabled = errors.New("external IO disabled by configuration")
+
+// checkExternalIOAllowed returns an error wrapping ErrExternalIODisabled if
+// conf does not permit the use of dest. This is the single place where the
+// restrictions of ExternalIODirConfig are enforced for each provider, so that
+// a new provider only needs to declare here what kind of IO it does.
+func checkExternalIOAllowed(conf base.ExternalIODirConfig, dest roachpb.ExternalStorage) error {
+	// Userfile storage is stored in the cluster itself, so it is the only
+	// provider allowed when external IO is disabled.
 	if conf.DisableOutbound && dest.Provider != roachpb.ExternalStorageProvider_FileTable {
-		return nil, errors.New("external network access is disabled")
+		return errExternalIODisabled(dest.Provider.String()+" storage", "external-io-disabled")
 	}
-	if fn, ok := implementations[dest.Provider]; ok {
-		return fn(ctx, args, dest)
+	if conf.DisableHTTP {
+		switch dest.Provider {
+		case roachpb.ExternalStorageProvider_Http:
+			return errExternalIODisabled("http storage", "external-io-disable-http")
+		case roachpb.ExternalStorageProvider_WebHDFS:
+			return errExternalIODisabled("webhdfs storage", "external-io-disable-http")
+		case roachpb.ExternalStorageProvider_S3:
+			if dest.S3Config != nil && dest.S3Config.Endpoint != "" {
+				return errExternalIODisabled("custom s3 endpoints", "external-io-disable-http")
+			}
+		}
 	}
-	return nil, errors.Errorf("unsupported external destination type: %s", dest.Provider.String())
+	return nil
+}
+
+func errExternalIODisabled(what, flag string) error {
+	return errors.Wrapf(ErrExternalIODisabled, "%s not allowed due to --%s flag", what, flag)
 }
 
 // URINeedsGlobExpansion checks if URI can be expanded by checking if it contains wildcard characters.
@@ -320,18 +561,36 @@ func AccessIsWithExplicitAuth(path string) (bool, string, error) {
 		auth := uri.Query().Get(AuthParam)
 		hasExplicitAuth = auth == AuthParamSpecified || auth == ""
 
+		// Without credentials, AWS_USE_IMPLICIT_AUTH falls back to those of the
+		// node.
+		if implicit, _ := strconv.ParseBool(uri.Query().Get(AWSUseImplicitAuthParam)); implicit &&
+			auth == "" && uri.Query().Get(AWSAccessKeyParam) == "" {
+			hasExplicitAuth = false
+		}
+
 		// If a custom endpoint has been specified in the S3 URI then this is no
 		// longer an explicit AUTH.
 		hasExplicitAuth = hasExplicitAuth && uri.Query().Get(AWSEndpointParam) == ""
 	case "gs":
 		auth := uri.Query().Get(AuthParam)
 		hasExplicitAuth = auth == AuthParamSpecified
+
+		// With GOOGLE_USE_IMPLICIT_AUTH, the credentials of the URI are used if it
+		// has any.
+		if implicit, _ := strconv.ParseBool(uri.Query().Get(GoogleUseImplicitAuthParam)); implicit &&
+			auth == "" && uri.Query().Get(CredentialsParam) != "" {
+			hasExplicitAuth = true
+		}
 	case "azure":
-		// Azure does not support implicit authentication i.e. all credentials have
-		// to be specified as part of the URI.
-		hasExplicitAuth = true
-	case "http", "https", "nodelocal":
+		// All credentials have to be specified as part of the URI, unless the
+		// managed identity of the node is used.
+		managedIdentity, _ := strconv.ParseBool(uri.Query().Get(AzureUseManagedIdentityParam))
+		hasExplicitAuth = !managedIdentity
+	case "http", "https", "nodelocal", "webhdfs", "swebhdfs":
 		hasExplicitAuth = false
+	case "sftp":
+		// The credentials of the user have to be specified as part of the URI.
+		hasExplicitAuth = true
 	case "experimental-workload", "workload", "userfile", "null":
 		hasExplicitAuth = true
 	default:
@@ -340,10 +599,349 @@ func AccessIsWithExplicitAuth(path string) (bool, string, error) {
 	return hasExplicitAuth, uri.Scheme, nil
 }
 
+// defaultContentType is the content type of the files written to cloud storage
+// whose URI does not set ContentTypeParam.
+const defaultContentType = "application/octet-stream"
+
+// validateContentType returns an error if contentType, the value of the
+// ContentTypeParam of a URI, is neither empty nor a valid media type.
+func validateContentType(contentType string) error {
+	if contentType == "" {
+		return nil
+	}
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		return errors.Wrapf(err, "invalid value for %s", ContentTypeParam)
+	}
+	return nil
+}
+
+// contentTypeOrDefault returns contentType, or the default content type if it
+// is empty.
+func contentTypeOrDefault(contentType string) string {
+	if contentType == "" {
+		return defaultContentType
+	}
+	return contentType
+}
+
+// normalizeURIPath returns p, the path of a storage URI, without its leading
+// slashes, so that a prefix within a bucket is the same however many slashes
+// follow the bucket. A trailing slash is kept, as it distinguishes a prefix of
+// a directory from a prefix of names. Any other empty segment, such as that of
+// a//b, is an error rather than being collapsed, as the backends would
+// otherwise disagree on whether it names a different file.
+func normalizeURIPath(p string) (string, error) {
+	normalized := strings.TrimLeft(p, "/")
+	if strings.Contains(normalized, "//") {
+		return "", errors.Errorf("path %s must not contain empty segments", p)
+	}
+	return normalized, nil
+}
+
+// splitURIPath returns the segments of p, the path of a storage URI, after
+// normalizing it like normalizeURIPath and dropping its trailing slash. The
+// path of a URI without one has no segments.
+func splitURIPath(p string) ([]string, error) {
+	normalized, err := normalizeURIPath(p)
+	if err != nil {
+		return nil, err
+	}
+	normalized = strings.TrimSuffix(normalized, "/")
+	if normalized == "" {
+		return nil, nil
+	}
+	return strings.Split(normalized, "/"), nil
+}
+
 func containsGlob(str string) bool {
 	return strings.ContainsAny(str, "*?[")
 }
 
+// PresignedURL returns a URL from which the named file of es can be read until
+// expiry has passed, if es implements cloud.Presigner. Otherwise, or if es
+// cannot sign URLs with its credentials, the error is marked with
+// ErrUnsupported.
+func PresignedURL(
+	ctx context.Context, es cloud.ExternalStorage, basename string, expiry time.Duration,
+) (string, error) {
+	if expiry <= 0 {
+		return "", errors.Newf("presigned URL expiry must be positive, got %s", expiry)
+	}
+	p, ok := es.(cloud.Presigner)
+	if !ok {
+		return "", errors.Mark(
+			errors.Newf("%s storage does not support presigned URLs", es.Conf().Provider), ErrUnsupported)
+	}
+	return p.PresignedURL(ctx, basename, expiry)
+}
+
+// Sync makes the files written to es durable if es implements cloud.Syncer.
+// Otherwise the files are already durable and Sync returns nil, so code that
+// checkpoints its progress can call it with any storage.
+func Sync(ctx context.Context, es cloud.ExternalStorage) error {
+	if s, ok := es.(cloud.Syncer); ok {
+		return s.Sync(ctx)
+	}
+	return nil
+}
+
+// Validate checks the configuration of es if es implements cloud.Validator, so
+// that a job can fail before it starts transferring data. Storage that does not
+// implement it, such as storage whose configuration is checked when it is
+// created, is assumed to be valid and Validate returns nil.
+func Validate(ctx context.Context, es cloud.ExternalStorage) error {
+	if v, ok := es.(cloud.Validator); ok {
+		return v.Validate(ctx)
+	}
+	return nil
+}
+
+// ListFilesPage returns up to limit of the files of es whose names, relative to
+// its base path, start with prefix, sorted by path, and the token that the next
+// page is listed with, which is empty after the last page, if es implements
+// cloud.PageLister. Otherwise the error is marked with ErrListingUnsupported
+// and ErrUnsupported.
+func ListFilesPage(
+	ctx context.Context, es cloud.ExternalStorage, prefix, token string, limit int,
+) ([]string, string, error) {
+	if limit <= 0 {
+		return nil, "", errors.Newf("page limit must be positive, got %d", limit)
+	}
+	l, ok := es.(cloud.PageLister)
+	if !ok {
+		return nil, "", listingUnsupportedError(
+			errors.Newf("%s storage does not support listing files in pages", es.Conf().Provider))
+	}
+	return l.ListFilesPage(ctx, prefix, token, limit)
+}
+
+// pageOfFiles returns the page of at most limit of paths, which are sorted,
+// that follows token, and the token of the next page, for implementing
+// ListFilesPage on storage whose backend has no continuation tokens. The token
+// of a page is its last path, so that pages are not shifted by the files
+// written or deleted between them.
+func pageOfFiles(paths []string, token string, limit int) ([]string, string) {
+	start := sort.Search(len(paths), func(i int) bool { return paths[i] > token })
+	if end := start + limit; end < len(paths) {
+		return paths[start:end], paths[end-1]
+	}
+	return paths[start:], ""
+}
+
+// ListFilesWithDelimiter returns the files of es whose names, relative to its
+// base path, start with prefix and have no delimiter after it, and the distinct
+// prefixes, ending with the first delimiter after prefix, of those that do, if
+// es implements cloud.DelimitedLister. Otherwise the error is marked with
+// ErrListingUnsupported and ErrUnsupported.
+func ListFilesWithDelimiter(
+	ctx context.Context, es cloud.ExternalStorage, prefix, delimiter string,
+) ([]string, []string, error) {
+	if delimiter == "" {
+		return nil, nil, errors.New("delimiter must not be empty")
+	}
+	l, ok := es.(cloud.DelimitedLister)
+	if !ok {
+		return nil, nil, listingUnsupportedError(
+			errors.Newf("%s storage does not support listing files with a delimiter", es.Conf().Provider))
+	}
+	return l.ListFilesWithDelimiter(ctx, prefix, delimiter)
+}
+
+// groupByDelimiter splits paths, which are sorted and start with prefix, into
+// those with no delimiter after prefix and the distinct prefixes, ending with
+// the first delimiter after prefix, of the others, for implementing
+// ListFilesWithDelimiter on storage whose backend only lists recursively. As
+// the paths sharing a prefix are adjacent, both results are sorted.
+func groupByDelimiter(paths []string, prefix, delimiter string) ([]string, []string) {
+	var files, prefixes []string
+	for _, p := range paths {
+		i := strings.Index(p[len(prefix):], delimiter)
+		if i < 0 {
+			files = append(files, p)
+			continue
+		}
+		common := p[:len(prefix)+i+len(delimiter)]
+		if n := len(prefixes); n == 0 || prefixes[n-1] != common {
+			prefixes = append(prefixes, common)
+		}
+	}
+	return files, prefixes
+}
+
+// errWriteNotRetryable is the cause of the error returned in place of a retry
+// of a write whose content cannot seek.
+var errWriteNotRetryable = errors.New("cannot retry a write of content that cannot seek")
+
+// rewindContent seeks the content of a write back to its start before an
+// attempt to write it, where prevErr is the error of the previous attempt, if
+// any. The first attempt writes content that cannot seek, such as a stream,
+// from where it is, but retries of it are impossible as earlier attempts
+// consumed some of it; the error returned in their place, which explains
+// prevErr, is not retryable.
+func rewindContent(content io.ReadSeeker, prevErr error) error {
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		if prevErr == nil {
+			return nil
+		}
+		return errors.WithSecondaryError(errors.Wrap(errWriteNotRetryable, prevErr.Error()), err)
+	}
+	return nil
+}
+
+// CopyFrom copies the file srcName of src to dstName in dst. If dst implements
+// cloud.Copier, it copies the file within the provider when it can; otherwise
+// the file is streamed through this node.
+func CopyFrom(
+	ctx context.Context, dst, src cloud.ExternalStorage, srcName, dstName string,
+) error {
+	if c, ok := dst.(cloud.Copier); ok {
+		return c.CopyFrom(ctx, src, srcName, dstName)
+	}
+	return copyThrough(ctx, dst, src, srcName, dstName)
+}
+
+// copyThrough copies the file srcName of src to dstName in dst by reading it
+// from src and writing it to dst.
+func copyThrough(
+	ctx context.Context, dst, src cloud.ExternalStorage, srcName, dstName string,
+) error {
+	r, err := newStorageFileReader(ctx, src, srcName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return dst.WriteFile(ctx, dstName, r)
+}
+
+// storageFileReader is an io.ReadSeeker over a file in an ExternalStorage, so
+// that the file can be written to another storage without buffering it. A read
+// after a seek to another position reopens the file there, so that seeks that
+// only measure the file, as writers often do, are free.
+type storageFileReader struct {
+	ctx  context.Context
+	es   cloud.ExternalStorage
+	name string
+	size int64
+	pos  int64
+	// reader, if not nil, reads the file from readerPos.
+	reader    io.ReadCloser
+	readerPos int64
+}
+
+var _ io.ReadSeeker = &storageFileReader{}
+
+func newStorageFileReader(
+	ctx context.Context, es cloud.ExternalStorage, name string,
+) (*storageFileReader, error) {
+	reader, size, err := es.ReadFileAt(ctx, name, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &storageFileReader{ctx: ctx, es: es, name: name, size: size, reader: reader}, nil
+}
+
+func (r *storageFileReader) Read(p []byte) (int, error) {
+	if r.reader != nil && r.readerPos != r.pos {
+		err := r.reader.Close()
+		r.reader = nil
+		if err != nil {
+			return 0, err
+		}
+	}
+	if r.reader == nil {
+		if r.pos >= r.size {
+			return 0, io.EOF
+		}
+		reader, _, err := r.es.ReadFileAt(r.ctx, r.name, r.pos)
+		if err != nil {
+			return 0, err
+		}
+		r.reader, r.readerPos = reader, r.pos
+	}
+	n, err := r.reader.Read(p)
+	r.pos += int64(n)
+	r.readerPos = r.pos
+	return n, err
+}
+
+func (r *storageFileReader) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += r.pos
+	case io.SeekEnd:
+		pos += r.size
+	default:
+		return 0, errors.Newf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, errors.Newf("cannot seek to negative position %d", pos)
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *storageFileReader) Close() error {
+	if r.reader == nil {
+		return nil
+	}
+	return r.reader.Close()
+}
+
+// joinKeyPrefix returns the prefix of the keys of the files whose names start
+// with prefix in a bucket storage with the given base path. Unlike path.Join, a
+// trailing slash of prefix is kept, and the base path is always a directory.
+func joinKeyPrefix(base, prefix string) string {
+	if base != "" && !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + strings.TrimPrefix(prefix, "/")
+}
+
+// deleteEach deletes each of the named files with del, for implementing
+// DeleteAll on storage without a bulk delete. Every file is attempted even if
+// some fail, and the returned error combines their errors.
+func deleteEach(ctx context.Context, names []string, del func(context.Context, string) error) error {
+	var err error
+	var failed int
+	for _, name := range names {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return errors.CombineErrors(ctxErr, err)
+		}
+		if delErr := del(ctx, name); delErr != nil {
+			failed++
+			err = errors.CombineErrors(err, errors.Wrapf(delErr, "deleting %s", name))
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete %d of %d files", failed, len(names))
+	}
+	return nil
+}
+
+// sortFileEntries sorts entries lexicographically by path, the order that every
+// ExternalStorage lists files in, and returns them. Each ListFilesExt sorts its
+// entries through it, whatever order the backend listed them in, so that
+// callers such as restore planning are deterministic.
+func sortFileEntries(entries []cloud.FileEntry) []cloud.FileEntry {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+// fileEntryPaths returns the paths of entries, for implementing ListFiles in
+// terms of ListFilesExt.
+func fileEntryPaths(entries []cloud.FileEntry) []string {
+	if entries == nil {
+		return nil
+	}
+	paths := make([]string, len(entries))
+	for i := range entries {
+		paths[i] = entries[i].Path
+	}
+	return paths
+}
+
 var (
 	// GcsDefault is the setting which defines the JSON key to use during GCS
 	// operations.
@@ -359,6 +957,12 @@ var (
 		"custom root CA (appended to system's default CAs) for verifying certificates when interacting with HTTPS storage",
 		"",
 	).WithPublic()
+	httpInsecureSkipVerify = settings.RegisterBoolSetting(
+		CloudstorageHTTPInsecureSkipVerifySetting,
+		"if set, the certificates of HTTPS storage are not verified, which is insecure and only "+
+			"meant for testing",
+		false,
+	)
 	timeoutSetting = settings.RegisterDurationSetting(
 		cloudStorageTimeout,
 		"the timeout for import/export storage operations",
@@ -366,6 +970,67 @@ var (
 	).WithPublic()
 )
 
+// runWithStorageTimeout runs fn with a context that times out after the
+// cloudstorage.timeout, like contextutil.RunWithTimeout. If settings is nil,
+// fn is run with ctx as-is.
+func runWithStorageTimeout(
+	ctx context.Context, settings *cluster.Settings, op string, fn func(ctx context.Context) error,
+) error {
+	if settings == nil {
+		return fn(ctx)
+	}
+	return contextutil.RunWithTimeout(ctx, op, timeoutSetting.Get(&settings.SV), fn)
+}
+
+// openWithStorageTimeout calls open with a context that is canceled if open
+// has not returned within the cloudstorage.timeout. Unlike with
+// runWithStorageTimeout, the context remains valid after open returns, since
+// the returned reader usually keeps using it, and is only canceled when the
+// reader is closed. If settings is nil, open is called with ctx as-is.
+func openWithStorageTimeout(
+	ctx context.Context,
+	settings *cluster.Settings,
+	op string,
+	open func(ctx context.Context) (io.ReadCloser, int64, error),
+) (io.ReadCloser, int64, error) {
+	if settings == nil {
+		return open(ctx)
+	}
+	timeout := timeoutSetting.Get(&settings.SV)
+	openCtx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(timeout, cancel)
+	reader, size, err := open(openCtx)
+	if !timer.Stop() {
+		// The timeout fired, so even if open succeeded the reader is unusable.
+		if err == nil {
+			err = reader.Close()
+		}
+		cancel()
+		timeoutErr := errors.Wrapf(context.DeadlineExceeded, "%s timed out after %s", op, timeout)
+		if err != nil {
+			timeoutErr = errors.WithSecondaryError(timeoutErr, err)
+		}
+		return nil, 0, timeoutErr
+	}
+	if err != nil {
+		cancel()
+		return nil, 0, err
+	}
+	return &cancelOnCloseReader{ReadCloser: reader, cancel: cancel}, size, nil
+}
+
+// cancelOnCloseReader wraps a reader, canceling the context it reads with when
+// it is closed.
+type cancelOnCloseReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelOnCloseReader) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
 // delayedRetry runs fn and re-runs it a limited number of times if it
 // fails. It knows about specific kinds of errors that need longer retry
 // delays than normal.
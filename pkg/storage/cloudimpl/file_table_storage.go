@@ -22,7 +22,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/kv"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/security"
-	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
+	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql"
 	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
@@ -64,10 +64,24 @@ func parseUserfileURL(
 	conf.Provider = roachpb.ExternalStorageProvider_FileTable
 	conf.FileTableConfig.User = normUser
 	conf.FileTableConfig.QualifiedTableName = qualifiedTableName
-	conf.FileTableConfig.Path = uri.Path
+	var err error
+	if conf.FileTableConfig.Path, err = normalizeURIPath(uri.Path); err != nil {
+		return conf, err
+	}
+	if uri.Path != "" {
+		conf.FileTableConfig.Path = "/" + conf.FileTableConfig.Path
+	}
 	return conf, nil
 }
 
+var userfileQuota = settings.RegisterByteSizeSetting(
+	CloudstorageUserfileQuotaSetting,
+	"the maximum number of bytes each user may store in each of their userfile tables, "+
+		"or 0 for no limit",
+	0,
+	settings.NonNegativeInt,
+)
+
 type fileTableStorage struct {
 	fs       *filetable.FileToTableSystem
 	cfg      roachpb.ExternalStorage_FileTable
@@ -83,7 +97,6 @@ var _ cloud.ExternalStorage = &fileTableStorage{}
 func makeFileTableStorage(
 	ctx context.Context, args ExternalStorageContext, dest roachpb.ExternalStorage,
 ) (cloud.ExternalStorage, error) {
-	telemetry.Count("external-io.filetable")
 
 	cfg := dest.FileTableConfig
 	if cfg.User == "" || cfg.QualifiedTableName == "" {
@@ -244,6 +257,21 @@ func (f *fileTableStorage) ReadFileAt(
 func (f *fileTableStorage) WriteFile(
 	ctx context.Context, basename string, content io.ReadSeeker,
 ) error {
+	return f.writeFile(ctx, basename, content, false /* ifNotExists */)
+}
+
+// WriteFileIfNotExists implements the ExternalStorage interface. The file is
+// only written if no file of the same name exists in the user scoped
+// FileToTableSystem.
+func (f *fileTableStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	return f.writeFile(ctx, basename, content, true /* ifNotExists */)
+}
+
+func (f *fileTableStorage) writeFile(
+	ctx context.Context, basename string, content io.ReadSeeker, ifNotExists bool,
+) (err error) {
 	filepath, err := checkBaseAndJoinFilePath(f.prefix, basename)
 	if err != nil {
 		return err
@@ -255,6 +283,38 @@ func (f *fileTableStorage) WriteFile(
 		return errors.New("cannot WriteFile without a configured internal executor")
 	}
 
+	var reader io.Reader = content
+	if quota := f.quota(); quota > 0 {
+		// The file being overwritten, if any, is deleted before the new one is
+		// written, so its size does not count towards the quota.
+		used, err := f.fs.UserFilesSize(ctx, filepath)
+		if err != nil {
+			return err
+		}
+		q := &quotaReader{r: content, remaining: quota - used, quota: quota, user: f.cfg.User}
+		// If the size of the content is known upfront we can reject the write
+		// before touching the tables. Otherwise, e.g. when the content is streamed
+		// by userfile upload, the quotaReader errors out once it has read too much.
+		if size, err := content.Seek(0, io.SeekEnd); err == nil {
+			if _, err := content.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if size > q.remaining {
+				return q.exceededErr()
+			}
+		}
+		reader = q
+	}
+	defer func() {
+		// Don't leave a partially written file behind if the quota was exceeded
+		// halfway through the write.
+		if errors.Is(err, errUserfileQuotaExceeded) {
+			if delErr := f.fs.DeleteFile(ctx, filepath); delErr != nil {
+				err = errors.WithSecondaryError(err, delErr)
+			}
+		}
+	}()
+
 	defer func() {
 		_, _ = f.ie.Exec(ctx, "userfile-write-file-commit", nil /* txn */, `COMMIT`)
 	}()
@@ -272,12 +332,21 @@ func (f *fileTableStorage) WriteFile(
 		return err
 	}
 
-	writer, err := f.fs.NewFileWriter(ctx, filepath, filetable.ChunkDefaultSize)
+	var writer io.WriteCloser
+	if ifNotExists {
+		writer, err = f.fs.NewFileWriterIfNotExists(ctx, filepath, filetable.ChunkDefaultSize)
+		if oserror.IsExist(err) {
+			return errors.Wrapf(ErrFileAlreadyExists,
+				"file %s already exists in the UserFileTableSystem", filepath)
+		}
+	} else {
+		writer, err = f.fs.NewFileWriter(ctx, filepath, filetable.ChunkDefaultSize)
+	}
 	if err != nil {
 		return err
 	}
 
-	if _, err = io.Copy(writer, content); err != nil {
+	if _, err = io.Copy(writer, reader); err != nil {
 		return errors.Wrap(err, "failed to write using the FileTable writer")
 	}
 
@@ -288,6 +357,41 @@ func (f *fileTableStorage) WriteFile(
 	return err
 }
 
+func (f *fileTableStorage) quota() int64 {
+	if f.settings == nil {
+		return 0
+	}
+	return userfileQuota.Get(&f.settings.SV)
+}
+
+// errUserfileQuotaExceeded is returned by WriteFile when the written file
+// would bring the user's userfile storage above their quota.
+var errUserfileQuotaExceeded = errors.New("userfile quota exceeded")
+
+// quotaReader wraps a reader and errors once more than remaining bytes have
+// been read from it.
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+	quota     int64
+	user      string
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return n, q.exceededErr()
+	}
+	return n, err
+}
+
+func (q *quotaReader) exceededErr() error {
+	return errors.Wrapf(errUserfileQuotaExceeded,
+		"writing this file would exceed the %s limit of %d bytes for user %s",
+		CloudstorageUserfileQuotaSetting, q.quota, q.user)
+}
+
 // getPrefixAndPattern takes a prefix and optionally suffix of a path pattern
 // and derives the constant prefix which would be shared by all matching files
 // and potentially a glob-pattern to match against any remaining suffix of names
@@ -347,12 +451,27 @@ func matchesPrefixAndPattern(name, prefix, pattern string) (bool, error) {
 // ListFiles implements the ExternalStorage interface and lists the files stored
 // in the user scoped FileToTableSystem.
 func (f *fileTableStorage) ListFiles(ctx context.Context, patternSuffix string) ([]string, error) {
+	files, err := f.listFiles(ctx, patternSuffix, false /* sized */)
+	return fileEntryPaths(files), err
+}
+
+// ListFilesExt implements the ExternalStorage interface. Only the sizes of the
+// files are set, each being looked up as by Size.
+func (f *fileTableStorage) ListFilesExt(
+	ctx context.Context, patternSuffix string,
+) ([]cloud.FileEntry, error) {
+	return f.listFiles(ctx, patternSuffix, true /* sized */)
+}
+
+func (f *fileTableStorage) listFiles(
+	ctx context.Context, patternSuffix string, sized bool,
+) ([]cloud.FileEntry, error) {
 	prefix, pattern, err := getPrefixAndPattern(f.prefix, patternSuffix)
 	if err != nil {
 		return nil, err
 	}
 
-	var fileList []string
+	var fileList []cloud.FileEntry
 	matches, err := f.fs.ListFiles(ctx, prefix)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to match pattern provided")
@@ -361,21 +480,29 @@ func (f *fileTableStorage) ListFiles(ctx context.Context, patternSuffix string)
 	for _, match := range matches {
 		if matches, err := matchesPrefixAndPattern(match, prefix, pattern); err != nil {
 			return nil, err
-		} else if matches {
-			if strings.HasPrefix(match, f.prefix) {
-				fileList = append(fileList, strings.TrimPrefix(strings.TrimPrefix(match, f.prefix), "/"))
-			} else {
-				match = strings.TrimPrefix(match, "/")
-				unescapedURI, err := url.PathUnescape(makeUserFileURIWithQualifiedName(f.cfg.QualifiedTableName, match))
-				if err != nil {
-					return nil, err
-				}
-				fileList = append(fileList, unescapedURI)
+		} else if !matches {
+			continue
+		}
+		var entry cloud.FileEntry
+		if sized {
+			if entry.Size, err = f.fs.FileSize(ctx, match); err != nil {
+				return nil, err
+			}
+		}
+		if strings.HasPrefix(match, f.prefix) {
+			entry.Path = strings.TrimPrefix(strings.TrimPrefix(match, f.prefix), "/")
+		} else {
+			match = strings.TrimPrefix(match, "/")
+			unescapedURI, err := url.PathUnescape(makeUserFileURIWithQualifiedName(f.cfg.QualifiedTableName, match))
+			if err != nil {
+				return nil, err
 			}
+			entry.Path = unescapedURI
 		}
+		fileList = append(fileList, entry)
 	}
 
-	return fileList, nil
+	return sortFileEntries(fileList), nil
 }
 
 // Delete implements the ExternalStorage interface and deletes the file from the
@@ -388,6 +515,17 @@ func (f *fileTableStorage) Delete(ctx context.Context, basename string) error {
 	return f.fs.DeleteFile(ctx, filepath)
 }
 
+// DeleteAll implements the ExternalStorage interface and deletes the files in
+// the user scoped FileToTableSystem whose names start with prefix, one at a
+// time.
+func (f *fileTableStorage) DeleteAll(ctx context.Context, prefix string) error {
+	names, err := f.fs.ListFiles(ctx, joinKeyPrefix(f.prefix, prefix))
+	if err != nil {
+		return errors.Wrap(err, "unable to list files")
+	}
+	return deleteEach(ctx, names, f.fs.DeleteFile)
+}
+
 // Size implements the ExternalStorage interface and returns the size of the
 // file stored in the user scoped FileToTableSystem.
 func (f *fileTableStorage) Size(ctx context.Context, basename string) (int64, error) {
@@ -397,3 +535,20 @@ func (f *fileTableStorage) Size(ctx context.Context, basename string) (int64, er
 	}
 	return f.fs.FileSize(ctx, filepath)
 }
+
+// Stat implements the ExternalStorage interface. The UserFileTableSystem does
+// not track modification times.
+func (f *fileTableStorage) Stat(ctx context.Context, basename string) (cloud.FileInfo, error) {
+	filepath, err := checkBaseAndJoinFilePath(f.prefix, basename)
+	if err != nil {
+		return cloud.FileInfo{}, err
+	}
+	size, err := f.fs.FileSize(ctx, filepath)
+	if err != nil {
+		if oserror.IsNotExist(err) {
+			return cloud.FileInfo{}, nil
+		}
+		return cloud.FileInfo{}, err
+	}
+	return cloud.FileInfo{Exists: true, Size: size}, nil
+}
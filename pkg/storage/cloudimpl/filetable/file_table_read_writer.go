@@ -24,6 +24,8 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/security"
 	"github.com/cockroachdb/cockroach/pkg/sql"
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlutil"
@@ -36,6 +38,10 @@ import (
 // before being written to the Payload table.
 const ChunkDefaultSize = 1024 * 1024 * 4 // 4 Mib
 
+// ListFilesDefaultPageSize is the default number of filenames ListFiles reads
+// from the File table in a single query.
+const ListFilesDefaultPageSize = 1000
+
 var fileTableNameSuffix = "_upload_files"
 var payloadTableNameSuffix = "_upload_payload"
 
@@ -311,7 +317,29 @@ func (f *FileToTableSystem) FileSize(ctx context.Context, filename string) (int6
 	}
 
 	if len(rows) == 0 {
-		return 0, errors.Newf("file %s does not exist in the UserFileStorage", filename)
+		return 0, errors.Mark(
+			errors.Newf("file %s does not exist in the UserFileStorage", filename), os.ErrNotExist)
+	}
+
+	return int64(tree.MustBeDInt(rows[0])), nil
+}
+
+// UserFilesSize returns the total size in bytes of the files owned by the
+// user which are currently stored in the user scoped tables, ignoring the file
+// named exclude if there is one.
+func (f *FileToTableSystem) UserFilesSize(ctx context.Context, exclude string) (int64, error) {
+	e, err := resolveInternalFileToTableExecutor(f.executor)
+	if err != nil {
+		return 0, err
+	}
+
+	getUserFilesSizeQuery := fmt.Sprintf(`SELECT COALESCE(sum(file_size), 0)::INT FROM %s WHERE
+username=$1 AND filename!=$2`, f.GetFQFileTableName())
+	rows, err := e.ie.QueryRowEx(ctx, "file-table-storage-user-size", nil,
+		sessiondata.InternalExecutorOverride{User: f.username},
+		getUserFilesSizeQuery, f.username.Normalized(), exclude)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get size of user files from the file table")
 	}
 
 	return int64(tree.MustBeDInt(rows[0])), nil
@@ -321,47 +349,97 @@ func (f *FileToTableSystem) FileSize(ctx context.Context, filename string) (int6
 // user scoped tables.
 func (f *FileToTableSystem) ListFiles(ctx context.Context, pattern string) ([]string, error) {
 	var files []string
-	listFilesQuery := fmt.Sprintf(`SELECT filename FROM %s WHERE filename LIKE $1 ORDER BY
-filename`, f.GetFQFileTableName())
+	if err := f.ListFilesPaginated(ctx, pattern, ListFilesDefaultPageSize, func(filename string) error {
+		files = append(files, filename)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
 
-	rows, err := f.executor.Query(ctx, "file-table-storage-list", listFilesQuery, f.username,
-		pattern+"%")
-	if err != nil {
-		return files, errors.Wrap(err, "failed to list files from file table")
+// ListFilesPaginated calls fn, in order, with the name of every file currently
+// stored in the user scoped tables whose name starts with pattern. The names
+// are read from the File table pageSize at a time, using the last name of the
+// previous page as the (exclusive) start of the next one, so the listing never
+// needs to hold more than a page in memory.
+func (f *FileToTableSystem) ListFilesPaginated(
+	ctx context.Context, pattern string, pageSize int, fn func(string) error,
+) error {
+	if pageSize <= 0 {
+		return errors.Newf("page size must be positive, got %d", pageSize)
 	}
+	firstPageQuery := fmt.Sprintf(`SELECT filename FROM %s WHERE filename LIKE $1 ORDER BY
+filename LIMIT $2`, f.GetFQFileTableName())
+	nextPageQuery := fmt.Sprintf(`SELECT filename FROM %s WHERE filename LIKE $1 AND
+filename > $3 ORDER BY filename LIMIT $2`, f.GetFQFileTableName())
+
+	var last string
+	for first := true; ; first = false {
+		query, qargs := firstPageQuery, []interface{}{pattern + "%", pageSize}
+		if !first {
+			query, qargs = nextPageQuery, append(qargs, last)
+		}
+		rows, err := f.executor.Query(ctx, "file-table-storage-list", query, f.username, qargs...)
+		if err != nil {
+			return errors.Wrap(err, "failed to list files from file table")
+		}
+		var n int
+		if err := f.iterateFilenames(ctx, rows, func(filename string) error {
+			n++
+			last = filename
+			return fn(filename)
+		}); err != nil {
+			return err
+		}
+		if n < pageSize {
+			return nil
+		}
+	}
+}
 
+// iterateFilenames calls fn with the filename stored in the first column of
+// every row output by the executor, and closes the rows.
+func (f *FileToTableSystem) iterateFilenames(
+	ctx context.Context, rows *FileToTableExecutorRows, fn func(string) error,
+) (err error) {
 	// Based on the executor type we must process the outputted rows differently.
 	switch f.executor.(type) {
 	case *InternalFileToTableExecutor:
 		// Verify that all the filenames are strings and aggregate them.
 		it := rows.internalExecResultsIterator
+		defer func() {
+			if closeErr := it.Close(); err == nil {
+				err = closeErr
+			}
+		}()
 		var ok bool
 		for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
-			files = append(files, string(tree.MustBeDString(it.Cur()[0])))
-		}
-		if err != nil {
-			return nil, err
+			if err := fn(string(tree.MustBeDString(it.Cur()[0]))); err != nil {
+				return err
+			}
 		}
+		return err
 	case *SQLConnFileToTableExecutor:
+		defer func() {
+			if closeErr := rows.sqlConnExecResults.Close(); err == nil {
+				err = closeErr
+			}
+		}()
 		vals := make([]driver.Value, 1)
 		for {
 			if err := rows.sqlConnExecResults.Next(vals); err == io.EOF {
-				break
+				return nil
 			} else if err != nil {
-				return files, errors.Wrap(err, "failed to list files from file table")
+				return errors.Wrap(err, "failed to list files from file table")
+			}
+			if err := fn(vals[0].(string)); err != nil {
+				return err
 			}
-			filename := vals[0].(string)
-			files = append(files, filename)
-		}
-
-		if err = rows.sqlConnExecResults.Close(); err != nil {
-			return nil, err
 		}
 	default:
-		return []string{}, errors.New("unsupported executor type in FileSize")
+		return errors.New("unsupported executor type in ListFiles")
 	}
-
-	return files, nil
 }
 
 // DestroyUserFileSystem drops the user scoped tables effectively deleting the
@@ -651,13 +729,18 @@ func newFileTableReader(
 	ie FileToTableSystemExecutor,
 	offset int64,
 ) (io.ReadCloser, int64, error) {
-	// Get file_id from metadata entry in File table.
+	// Get file_id from metadata entry in File table, along with the size of the
+	// file, derived from its last chunk, and the size of its first chunk. Every
+	// chunk but the last one has the size of the first one, so it lets us compute
+	// which chunk holds a given offset of the file.
 	var fileID []byte
-	var sz int64
+	var sz, chunkSize int64
 	metadataQuery := fmt.Sprintf(
-		`SELECT f.file_id, sum_int(length(p.payload))
-		FROM %s f LEFT OUTER JOIN %s p ON p.file_id = f.file_id
-		WHERE f.filename = $1 GROUP BY f.file_id`,
+		`SELECT f.file_id,
+		(SELECT byte_offset + length(payload) FROM %[2]s
+			WHERE file_id = f.file_id ORDER BY byte_offset DESC LIMIT 1),
+		(SELECT length(payload) FROM %[2]s WHERE file_id = f.file_id AND byte_offset = 0)
+		FROM %[1]s f WHERE f.filename = $1`,
 		fileTableName, payloadTableName)
 	metaRows, err := ie.Query(ctx, "userfile-reader-info", metadataQuery, username, filename)
 	if err != nil {
@@ -683,13 +766,16 @@ func newFileTableReader(
 		if it.Cur()[1] != tree.DNull {
 			sz = int64(tree.MustBeDInt(it.Cur()[1]))
 		}
+		if it.Cur()[2] != tree.DNull {
+			chunkSize = int64(tree.MustBeDInt(it.Cur()[2]))
+		}
 	case *SQLConnFileToTableExecutor:
 		defer func() {
 			if err := metaRows.sqlConnExecResults.Close(); err != nil {
 				log.Warningf(ctx, "failed to close %+v", err)
 			}
 		}()
-		vals := make([]driver.Value, 2)
+		vals := make([]driver.Value, 3)
 		err := metaRows.sqlConnExecResults.Next(vals)
 		if err == io.EOF {
 			return nil, 0, os.ErrNotExist
@@ -700,11 +786,14 @@ func newFileTableReader(
 		if vals[1] != nil {
 			sz = vals[1].(int64)
 		}
+		if vals[2] != nil {
+			chunkSize = vals[2].(int64)
+		}
 	default:
 		panic("unknown executor")
 	}
 
-	if sz == 0 {
+	if sz == 0 || chunkSize == 0 {
 		return ioutil.NopCloser(bytes.NewReader(nil)), 0, nil
 	}
 
@@ -714,13 +803,14 @@ func newFileTableReader(
 		if pos >= sz {
 			return 0, io.EOF
 		}
+		// Look up the chunk containing pos directly by its primary key, rather
+		// than scanning the file's chunks.
+		chunkOffset := (pos / chunkSize) * chunkSize
 		query := fmt.Sprintf(
 			`SELECT substr(payload, $2+1-byte_offset, $3)
-			FROM %s WHERE file_id=$1 AND byte_offset <= $2
-			ORDER BY byte_offset DESC
-			LIMIT 1`, payloadTableName)
+			FROM %s WHERE file_id=$1 AND byte_offset=$4`, payloadTableName)
 		rows, err := ie.Query(
-			ctx, "userfile-reader-payload", query, username, fileID, pos, int64(bufSize),
+			ctx, "userfile-reader-payload", query, username, fileID, pos, int64(bufSize), chunkOffset,
 		)
 		if err != nil {
 			return 0, errors.Wrap(err, "reading file content")
@@ -768,10 +858,9 @@ func newFileTableReader(
 	return ioutil.NopCloser(bufio.NewReaderSize(&reader{fn: fn, pos: offset}, bufSize)), sz, nil
 }
 
-// ReadFile returns the blob for filename using a FileTableReader.
-// TODO(adityamaru): Reading currently involves aggregating all chunks of a
-// file from the Payload table. In the future we might want to implement a pull
-// x rows system, or a scan based interface.
+// ReadFile returns the blob for filename using a FileTableReader, starting at
+// offset. Only the chunks of the file from the one containing offset onwards
+// are read from the Payload table.
 func (f *FileToTableSystem) ReadFile(
 	ctx context.Context, filename string, offset int64,
 ) (io.ReadCloser, int64, error) {
@@ -939,3 +1028,23 @@ func (f *FileToTableSystem) NewFileWriter(
 	return newChunkWriter(ctx, chunkSize, filename, f.username, f.GetFQFileTableName(),
 		f.GetFQPayloadTableName(), e.ie, e.db)
 }
+
+// NewFileWriterIfNotExists is like NewFileWriter, but rather than overwriting
+// an existing file it fails with an error marked with os.ErrExist. The check
+// relies on the filename PK of the File table, so it is atomic.
+func (f *FileToTableSystem) NewFileWriterIfNotExists(
+	ctx context.Context, filename string, chunkSize int,
+) (io.WriteCloser, error) {
+	e, err := resolveInternalFileToTableExecutor(f.executor)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := newChunkWriter(ctx, chunkSize, filename, f.username, f.GetFQFileTableName(),
+		f.GetFQPayloadTableName(), e.ie, e.db)
+	if pgerror.GetPGCode(err) == pgcode.UniqueViolation {
+		return nil, errors.Mark(
+			errors.Newf("file %s already exists in the UserFileStorage", filename), os.ErrExist)
+	}
+	return w, err
+}
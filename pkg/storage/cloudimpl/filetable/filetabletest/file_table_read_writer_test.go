@@ -28,6 +28,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/errors/oserror"
 	"github.com/stretchr/testify/require"
 )
@@ -149,6 +150,69 @@ func TestListAndDeleteFiles(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestListFilesPaginated(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	params, _ := tests.CreateTestServerParams()
+	s, _, kvDB := serverutils.StartServer(t, params)
+	defer s.Stopper().Stop(ctx)
+
+	ie := s.InternalExecutor().(*sql.InternalExecutor)
+	executor := filetable.MakeInternalFileToTableExecutor(ie, kvDB)
+	fileTableReadWriter, err := filetable.NewFileToTableSystem(ctx, qualifiedTableName,
+		executor, security.RootUserName())
+	require.NoError(t, err)
+
+	// Populate the File table directly, as uploading this many files through
+	// the FileWriter would be needlessly slow.
+	const numFiles = 2500
+	_, err = ie.Exec(ctx, "populate-file-table", nil /* txn */, fmt.Sprintf(`INSERT INTO %s (filename, file_size, username)
+SELECT 'dir/file' || i::STRING, 0, 'root' FROM generate_series(1, $1) AS g(i)`,
+		fileTableReadWriter.GetFQFileTableName()), numFiles)
+	require.NoError(t, err)
+	_, err = uploadFile(ctx, "other", 16, 8, fileTableReadWriter, kvDB)
+	require.NoError(t, err)
+
+	var expected []string
+	for i := 1; i <= numFiles; i++ {
+		expected = append(expected, fmt.Sprintf("dir/file%d", i))
+	}
+	sort.Strings(expected)
+
+	for _, pageSize := range []int{1, 7, 100, numFiles, numFiles + 1} {
+		t.Run(fmt.Sprintf("page-size=%d", pageSize), func(t *testing.T) {
+			var files []string
+			require.NoError(t, fileTableReadWriter.ListFilesPaginated(ctx, "dir/", pageSize,
+				func(filename string) error {
+					files = append(files, filename)
+					return nil
+				}))
+			require.Equal(t, expected, files)
+		})
+	}
+
+	files, err := fileTableReadWriter.ListFiles(ctx, "dir/")
+	require.NoError(t, err)
+	require.Equal(t, expected, files)
+
+	// An error returned by the callback stops the listing.
+	var seen int
+	err = fileTableReadWriter.ListFilesPaginated(ctx, "", 100, func(string) error {
+		seen++
+		if seen == 150 {
+			return errors.New("stop")
+		}
+		return nil
+	})
+	require.True(t, testutils.IsError(err, "stop"), "%v", err)
+	require.Equal(t, 150, seen)
+
+	require.Error(t, fileTableReadWriter.ListFilesPaginated(ctx, "", 0, func(string) error {
+		return nil
+	}))
+}
+
 func TestReadWriteFile(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
@@ -321,6 +385,54 @@ func TestReadWriteFile(t *testing.T) {
 // the FileToTableSystem methods after creating the FileToTableSystem, which is
 // responsible for granting SELECT, INSERT, DELETE and DROP privileges on the
 // file and payload tables.
+func TestReadFileAtOffset(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	params, _ := tests.CreateTestServerParams()
+	s, _, kvDB := serverutils.StartServer(t, params)
+	defer s.Stopper().Stop(ctx)
+
+	executor := filetable.MakeInternalFileToTableExecutor(s.InternalExecutor().(*sql.
+		InternalExecutor), kvDB)
+	fileTableReadWriter, err := filetable.NewFileToTableSystem(ctx, qualifiedTableName,
+		executor, security.RootUserName())
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		fileSize, chunkSize int
+	}{
+		{1, 1},
+		{100, 1},
+		{1000, 7},
+		{1000, 1000},
+		{1000, 4096},
+		{1 << 20, 100 << 10},
+	} {
+		t.Run(fmt.Sprintf("size=%d/chunk=%d", tc.fileSize, tc.chunkSize), func(t *testing.T) {
+			filename := fmt.Sprintf("file-%d-%d", tc.fileSize, tc.chunkSize)
+			expected, err := uploadFile(ctx, filename, tc.fileSize, tc.chunkSize, fileTableReadWriter,
+				kvDB)
+			require.NoError(t, err)
+
+			offsets := []int{0, 1, tc.chunkSize - 1, tc.chunkSize, tc.chunkSize + 1,
+				tc.fileSize / 2, tc.fileSize - 1, tc.fileSize}
+			for _, offset := range offsets {
+				if offset < 0 || offset > tc.fileSize {
+					continue
+				}
+				reader, size, err := fileTableReadWriter.ReadFile(ctx, filename, int64(offset))
+				require.NoError(t, err)
+				require.Equal(t, int64(tc.fileSize), size)
+				got, err := ioutil.ReadAll(reader)
+				require.NoError(t, err)
+				require.NoError(t, reader.Close())
+				require.Equal(t, expected[offset:], got, "offset %d", offset)
+			}
+		})
+	}
+}
+
 func TestUserGrants(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
@@ -14,22 +14,31 @@ import (
 	"context"
 	"encoding/base64"
 	"io"
+	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	gcs "cloud.google.com/go/storage"
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
-	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
+	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
 	"github.com/cockroachdb/cockroach/pkg/util/contextutil"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/errors"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 )
 
 func parseGSURL(_ ExternalStorageURIContext, uri *url.URL) (roachpb.ExternalStorage, error) {
@@ -41,9 +50,36 @@ func parseGSURL(_ ExternalStorageURIContext, uri *url.URL) (roachpb.ExternalStor
 		Auth:           uri.Query().Get(AuthParam),
 		BillingProject: uri.Query().Get(GoogleBillingProjectParam),
 		Credentials:    uri.Query().Get(CredentialsParam),
+		StorageClass:   uri.Query().Get(GoogleStorageClassParam),
+		PredefinedACL:  uri.Query().Get(GooglePredefinedACLParam),
+		ContentType:    uri.Query().Get(ContentTypeParam),
 		/* NB: additions here should also update gcsQueryParams() serializer */
 	}
-	conf.GoogleCloudConfig.Prefix = strings.TrimLeft(conf.GoogleCloudConfig.Prefix, "/")
+	if err := validateContentType(conf.GoogleCloudConfig.ContentType); err != nil {
+		return conf, err
+	}
+	if useImplicitAuth := uri.Query().Get(GoogleUseImplicitAuthParam); useImplicitAuth != "" {
+		var err error
+		conf.GoogleCloudConfig.UseImplicitAuth, err = strconv.ParseBool(useImplicitAuth)
+		if err != nil {
+			return conf, errors.Wrapf(err, "invalid value for %s", GoogleUseImplicitAuthParam)
+		}
+	}
+	if metadata := uri.Query().Get(GoogleObjectMetadataParam); metadata != "" {
+		conf.GoogleCloudConfig.Metadata = make(map[string]string)
+		for _, pair := range strings.Split(metadata, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return conf, errors.Errorf(
+					"invalid value for %s: %q is not a key=value pair", GoogleObjectMetadataParam, pair)
+			}
+			conf.GoogleCloudConfig.Metadata[kv[0]] = kv[1]
+		}
+	}
+	var err error
+	if conf.GoogleCloudConfig.Prefix, err = normalizeURIPath(conf.GoogleCloudConfig.Prefix); err != nil {
+		return conf, err
+	}
 	return conf, nil
 }
 
@@ -58,9 +94,120 @@ func gcsQueryParams(conf *roachpb.ExternalStorage_GCS) string {
 	if conf.BillingProject != "" {
 		q.Set(GoogleBillingProjectParam, conf.BillingProject)
 	}
+	if conf.StorageClass != "" {
+		q.Set(GoogleStorageClassParam, conf.StorageClass)
+	}
+	if conf.PredefinedACL != "" {
+		q.Set(GooglePredefinedACLParam, conf.PredefinedACL)
+	}
+	if conf.UseImplicitAuth {
+		q.Set(GoogleUseImplicitAuthParam, "true")
+	}
+	if conf.ContentType != "" {
+		q.Set(ContentTypeParam, conf.ContentType)
+	}
+	if len(conf.Metadata) > 0 {
+		pairs := make([]string, 0, len(conf.Metadata))
+		for k, v := range conf.Metadata {
+			pairs = append(pairs, k+"="+v)
+		}
+		sort.Strings(pairs)
+		q.Set(GoogleObjectMetadataParam, strings.Join(pairs, ","))
+	}
 	return q.Encode()
 }
 
+// gcsStorageClasses are the storage classes that objects can be written with.
+// See https://cloud.google.com/storage/docs/storage-classes.
+var gcsStorageClasses = []string{
+	"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE",
+	// Legacy storage classes.
+	"MULTI_REGIONAL", "REGIONAL", "DURABLE_REDUCED_AVAILABILITY",
+}
+
+func isGCSStorageClass(storageClass string) bool {
+	for _, c := range gcsStorageClasses {
+		if c == storageClass {
+			return true
+		}
+	}
+	return false
+}
+
+// gcsPredefinedACLs are the predefined ACLs that objects can be written with.
+// See https://cloud.google.com/storage/docs/json_api/v1/objects/insert.
+var gcsPredefinedACLs = []string{
+	"authenticatedRead", "bucketOwnerFullControl", "bucketOwnerRead", "private",
+	"projectPrivate", "publicRead",
+}
+
+func isGCSPredefinedACL(acl string) bool {
+	for _, a := range gcsPredefinedACLs {
+		if a == acl {
+			return true
+		}
+	}
+	return false
+}
+
+var gcsChunkSize = settings.RegisterByteSizeSetting(
+	CloudstorageGSChunkSizeSetting,
+	"the size of the chunks of resumable uploads to google cloud storage; smaller files are "+
+		"uploaded in a single request",
+	googleapi.DefaultUploadChunkSize,
+	func(v int64) error {
+		if v < googleapi.MinUploadChunkSize {
+			return errors.Errorf("must be at least %d bytes", googleapi.MinUploadChunkSize)
+		}
+		return nil
+	},
+)
+
+var gcsRateLimitMaxRetries = settings.RegisterIntSetting(
+	"cloudstorage.gs.rate_limit_max_retries",
+	"the maximum number of times a google cloud storage request that was rate limited or "+
+		"found the service unavailable is retried",
+	8,
+	settings.NonNegativeInt,
+)
+
+// GCSRateLimitRetryOptions defines the backoff between retries of google cloud
+// storage requests that were rate limited. MaxRetries is ignored in favor of
+// the cloudstorage.gs.rate_limit_max_retries setting.
+var GCSRateLimitRetryOptions = retry.Options{
+	InitialBackoff:      500 * time.Millisecond,
+	MaxBackoff:          30 * time.Second,
+	Multiplier:          2,
+	RandomizationFactor: 0.5,
+}
+
+// gcsRateLimitReasons are the reasons of the errors GCS returns when requests
+// should be retried at a lower rate, some of which are reported with a 403.
+// See https://cloud.google.com/storage/docs/json_api/v1/status-codes.
+var gcsRateLimitReasons = map[string]struct{}{
+	"rateLimitExceeded":     {},
+	"userRateLimitExceeded": {},
+	"backendError":          {},
+}
+
+// isGCSRateLimitError returns true if err is a GCS error returned because the
+// request was rate limited or the service was unavailable.
+func isGCSRateLimitError(err error) bool {
+	var gcsErr *googleapi.Error
+	if !errors.As(err, &gcsErr) {
+		return false
+	}
+	if gcsErr.Code == http.StatusTooManyRequests || gcsErr.Code == http.StatusServiceUnavailable {
+		return true
+	}
+	for _, item := range gcsErr.Errors {
+		if _, ok := gcsRateLimitReasons[item.Reason]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 type gcsStorage struct {
 	bucket   *gcs.BucketHandle
 	client   *gcs.Client
@@ -68,9 +215,19 @@ type gcsStorage struct {
 	ioConf   base.ExternalIODirConfig
 	prefix   string
 	settings *cluster.Settings
+	limiters *rateLimiters
+	// signingEmail and signingKey are the service account email and private key
+	// of the credentials of the storage, which presigned URLs are signed with.
+	// They are unset if the storage uses implicit credentials.
+	signingEmail string
+	signingKey   []byte
 }
 
 var _ cloud.ExternalStorage = &gcsStorage{}
+var _ cloud.Presigner = &gcsStorage{}
+var _ cloud.Copier = &gcsStorage{}
+var _ cloud.Validator = &gcsStorage{}
+var _ cloud.PageLister = &gcsStorage{}
 
 func (g *gcsStorage) Conf() roachpb.ExternalStorage {
 	return roachpb.ExternalStorage{
@@ -87,27 +244,60 @@ func (g *gcsStorage) Settings() *cluster.Settings {
 	return g.settings
 }
 
+// retryRateLimited runs fn, retrying it with jittered exponential backoff while
+// it fails because the request was rate limited. Retries stop once ctx is done.
+func (g *gcsStorage) retryRateLimited(ctx context.Context, op string, fn func() error) error {
+	opts := GCSRateLimitRetryOptions
+	opts.MaxRetries = int(gcsRateLimitMaxRetries.Get(&g.settings.SV))
+	if opts.MaxRetries == 0 {
+		return fn()
+	}
+	var err error
+	for attempt, retrier := 0, retry.StartWithCtx(ctx, opts); retrier.Next(); attempt++ {
+		err = fn()
+		if err == nil || !isGCSRateLimitError(err) {
+			return err
+		}
+		log.Warningf(ctx, "gcs %s was rate limited (attempt %d): %v", op, attempt, err)
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return errors.CombineErrors(ctxErr, err)
+	}
+	return err
+}
+
 func makeGCSStorage(
 	ctx context.Context, args ExternalStorageContext, dest roachpb.ExternalStorage,
 ) (cloud.ExternalStorage, error) {
-	telemetry.Count("external-io.google_cloud")
 	conf := dest.GoogleCloudConfig
 	if conf == nil {
 		return nil, errors.Errorf("google cloud storage upload requested but info missing")
 	}
 	const scope = gcs.ScopeReadWrite
 	opts := []option.ClientOption{option.WithScopes(scope)}
+	var signingEmail string
+	var signingKey []byte
 
 	// "default": only use the key in the settings; error if not present.
 	// "specified": the JSON object for authentication is given by the CREDENTIALS param.
 	// "implicit": only use the environment data.
 	// "": if default key is in the settings use it; otherwise use environment data.
-	if args.IOConf.DisableImplicitCredentials && conf.Auth != AuthParamSpecified {
+	//     With GOOGLE_USE_IMPLICIT_AUTH, `specified` if the CREDENTIALS param is
+	//     set and `implicit` otherwise, so that credentials in the URI always take
+	//     precedence over those of the environment.
+	auth := conf.Auth
+	if auth == "" && conf.UseImplicitAuth {
+		auth = AuthParamImplicit
+		if conf.Credentials != "" {
+			auth = AuthParamSpecified
+		}
+	}
+	if args.IOConf.DisableImplicitCredentials && auth != AuthParamSpecified {
 		return nil, errors.New(
 			"implicit credentials disallowed for gs due to --external-io-disable-implicit-credentials flag")
 	}
 
-	switch conf.Auth {
+	switch auth {
 	case "", AuthParamDefault:
 		var key string
 		if args.Settings != nil {
@@ -123,6 +313,7 @@ func makeGCSStorage(
 				return nil, errors.Wrap(err, "creating GCS oauth token source")
 			}
 			opts = append(opts, option.WithTokenSource(source.TokenSource(ctx)))
+			signingEmail, signingKey = source.Email, source.PrivateKey
 		}
 	case AuthParamSpecified:
 		if conf.Credentials == "" {
@@ -142,13 +333,32 @@ func makeGCSStorage(
 			return nil, errors.Wrap(err, "creating GCS oauth token source from specified credentials")
 		}
 		opts = append(opts, option.WithTokenSource(source.TokenSource(ctx)))
+		signingEmail, signingKey = source.Email, source.PrivateKey
 	case AuthParamImplicit:
 		// Do nothing; use implicit params:
 		// https://godoc.org/golang.org/x/oauth2/google#FindDefaultCredentials
 	default:
 		return nil, errors.Errorf("unsupported value %s for %s", conf.Auth, AuthParam)
 	}
-	g, err := gcs.NewClient(ctx, opts...)
+	if conf.StorageClass != "" && !isGCSStorageClass(conf.StorageClass) {
+		return nil, errors.Errorf("unsupported value %s for %s. Supported values are %s.",
+			conf.StorageClass, GoogleStorageClassParam, strings.Join(gcsStorageClasses, ", "))
+	}
+	if conf.PredefinedACL != "" && !isGCSPredefinedACL(conf.PredefinedACL) {
+		return nil, errors.Errorf("unsupported value %s for %s. Supported values are %s.",
+			conf.PredefinedACL, GooglePredefinedACLParam, strings.Join(gcsPredefinedACLs, ", "))
+	}
+	// The client sends its requests with the shared transport, wrapped in the
+	// authentication that the options configure. gcs.NewClient only disables
+	// authentication for the emulator when it creates the HTTP client itself.
+	if os.Getenv("STORAGE_EMULATOR_HOST") != "" {
+		opts = append(opts, option.WithoutAuthentication())
+	}
+	transport, err := htransport.NewTransport(ctx, makeProviderHTTPClient(args.Settings).Transport, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create google cloud client")
+	}
+	g, err := gcs.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create google cloud client")
 	}
@@ -157,33 +367,128 @@ func makeGCSStorage(
 		bucket = bucket.UserProject(conf.BillingProject)
 	}
 	return &gcsStorage{
-		bucket:   bucket,
-		client:   g,
-		conf:     conf,
-		ioConf:   args.IOConf,
-		prefix:   conf.Prefix,
-		settings: args.Settings,
+		bucket:       bucket,
+		client:       g,
+		conf:         conf,
+		ioConf:       args.IOConf,
+		prefix:       conf.Prefix,
+		settings:     args.Settings,
+		limiters:     newRateLimiters(args.Settings),
+		signingEmail: signingEmail,
+		signingKey:   signingKey,
 	}, nil
 }
 
 func (g *gcsStorage) WriteFile(ctx context.Context, basename string, content io.ReadSeeker) error {
+	return g.writeFile(ctx, basename, content, false /* ifNotExists */)
+}
+
+// WriteFileIfNotExists implements the ExternalStorage interface. The object is
+// written with a precondition that it does not exist, so that GCS rejects the
+// write atomically.
+func (g *gcsStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	return g.writeFile(ctx, basename, content, true /* ifNotExists */)
+}
+
+func (g *gcsStorage) writeFile(
+	ctx context.Context, basename string, content io.ReadSeeker, ifNotExists bool,
+) error {
 	const maxAttempts = 3
+	var exists bool
+	var prevErr error
 	err := retry.WithMaxAttempts(ctx, base.DefaultRetryOptions(), maxAttempts, func() error {
-		if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return g.retryRateLimited(ctx, "write", func() error {
+			if err := rewindContent(content, prevErr); err != nil {
+				return err
+			}
+			// Set the timeout within the retry loop.
+			err := contextutil.RunWithTimeout(ctx, "put gcs file", timeoutSetting.Get(&g.settings.SV),
+				func(ctx context.Context) error {
+					obj := g.bucket.Object(path.Join(g.prefix, basename))
+					if ifNotExists {
+						obj = obj.If(gcs.Conditions{DoesNotExist: true})
+					}
+					w := obj.NewWriter(ctx)
+					// Content larger than a chunk is written in a resumable upload
+					// session, which retries a chunk that fails rather than restarting
+					// the upload from the beginning.
+					w.ChunkSize = int(gcsChunkSize.Get(&g.settings.SV))
+					w.StorageClass = g.conf.StorageClass
+					w.Metadata = g.conf.Metadata
+					w.PredefinedACL = g.conf.PredefinedACL
+					w.ContentType = contentTypeOrDefault(g.conf.ContentType)
+					if _, err := io.Copy(g.limiters.limitWriter(ctx, w), content); err != nil {
+						_ = w.Close()
+						return err
+					}
+					return w.Close()
+				})
+			// A failed precondition is not retried: the object exists, possibly
+			// because an earlier attempt that appeared to fail wrote it.
+			var gcsErr *googleapi.Error
+			if ifNotExists && errors.As(err, &gcsErr) && gcsErr.Code == http.StatusPreconditionFailed {
+				exists = true
+				return nil
+			}
+			prevErr = err
 			return err
-		}
-		// Set the timeout within the retry loop.
-		return contextutil.RunWithTimeout(ctx, "put gcs file", timeoutSetting.Get(&g.settings.SV),
-			func(ctx context.Context) error {
-				w := g.bucket.Object(path.Join(g.prefix, basename)).NewWriter(ctx)
-				if _, err := io.Copy(w, content); err != nil {
-					_ = w.Close()
-					return err
-				}
-				return w.Close()
-			})
+		})
 	})
-	return errors.Wrap(err, "write to google cloud")
+	if err == nil && exists {
+		return errors.Wrapf(ErrFileAlreadyExists, "google cloud object %s already exists",
+			path.Join(g.prefix, basename))
+	}
+	return errors.Wrap(markGCSError(err), "write to google cloud")
+}
+
+// markGCSError marks err with ErrFileDoesNotExist or ErrAccessDenied if it is a
+// GCS error that means so, and counts it in telemetry.
+func markGCSError(err error) error {
+	var gcsErr *googleapi.Error
+	if errors.IsAny(err, gcs.ErrObjectNotExist, gcs.ErrBucketNotExist) {
+		err = errors.Mark(err, ErrFileDoesNotExist)
+	} else if errors.As(err, &gcsErr) {
+		err = markStatusError(err, gcsErr.Code)
+	}
+	return countStorageError(roachpb.ExternalStorageProvider_GoogleCloud, err)
+}
+
+// CopyFrom implements the cloud.Copier interface. An object of GCS storage
+// with the same credentials is copied by rewriting it, which can take several
+// requests for large objects but never passes the bytes through this node;
+// the files of other storage are streamed through.
+func (g *gcsStorage) CopyFrom(
+	ctx context.Context, src cloud.ExternalStorage, srcName, dstName string,
+) error {
+	srcConf := src.Conf()
+	c := srcConf.GoogleCloudConfig
+	if srcConf.Provider != roachpb.ExternalStorageProvider_GoogleCloud || c == nil ||
+		c.Auth != g.conf.Auth || c.Credentials != g.conf.Credentials {
+		return copyThrough(ctx, g, src, srcName, dstName)
+	}
+	srcBucket := g.client.Bucket(c.Bucket)
+	if c.BillingProject != `` {
+		srcBucket = srcBucket.UserProject(c.BillingProject)
+	}
+	srcKey := path.Join(c.Prefix, srcName)
+	copier := g.bucket.Object(path.Join(g.prefix, dstName)).CopierFrom(srcBucket.Object(srcKey))
+	copier.StorageClass = g.conf.StorageClass
+	copier.Metadata = g.conf.Metadata
+	copier.PredefinedACL = g.conf.PredefinedACL
+	err := contextutil.RunWithTimeout(ctx, "copy gcs file", timeoutSetting.Get(&g.settings.SV),
+		func(ctx context.Context) error {
+			return g.retryRateLimited(ctx, "copy", func() error {
+				_, err := copier.Run(ctx)
+				return err
+			})
+		})
+	var gcsErr *googleapi.Error
+	if errors.As(err, &gcsErr) && gcsErr.Code == http.StatusNotFound {
+		return errors.Wrapf(ErrFileDoesNotExist, "gcs object does not exist: %s", srcKey)
+	}
+	return errors.Wrap(markGCSError(err), "copy google cloud object")
 }
 
 // ReadFile is shorthand for ReadFileAt with offset 0.
@@ -194,12 +499,34 @@ func (g *gcsStorage) ReadFile(ctx context.Context, basename string) (io.ReadClos
 
 func (g *gcsStorage) ReadFileAt(
 	ctx context.Context, basename string, offset int64,
+) (io.ReadCloser, int64, error) {
+	reader, size, err := openWithStorageTimeout(ctx, g.settings, "read gcs file",
+		func(ctx context.Context) (io.ReadCloser, int64, error) {
+			return g.readFileAt(ctx, basename, offset)
+		})
+	if err != nil {
+		return nil, 0, err
+	}
+	return g.limiters.limitReader(ctx, readAhead(g.settings, reader)), size, nil
+}
+
+func (g *gcsStorage) readFileAt(
+	ctx context.Context, basename string, offset int64,
 ) (io.ReadCloser, int64, error) {
 	object := path.Join(g.prefix, basename)
 	r := &resumingReader{
 		ctx: ctx,
 		opener: func(ctx context.Context, pos int64) (io.ReadCloser, error) {
-			return g.bucket.Object(object).NewRangeReader(ctx, pos, -1)
+			var reader *gcs.Reader
+			err := g.retryRateLimited(ctx, "read", func() error {
+				var err error
+				reader, err = g.bucket.Object(object).NewRangeReader(ctx, pos, -1)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			return reader, nil
 		},
 		pos: offset,
 	}
@@ -212,17 +539,19 @@ func (g *gcsStorage) ReadFileAt(
 			// return our internal ErrFileDoesNotExist.
 			err = errors.Wrapf(ErrFileDoesNotExist, "gcs object does not exist: %s", err.Error())
 		}
-		return nil, 0, err
+		return nil, 0, markGCSError(err)
 	}
 	return r.reader, r.reader.(*gcs.Reader).Attrs.Size, nil
 }
 
 func (g *gcsStorage) ListFiles(ctx context.Context, patternSuffix string) ([]string, error) {
-	var fileList []string
-	it := g.bucket.Objects(ctx, &gcs.Query{
-		Prefix: getPrefixBeforeWildcard(g.prefix),
-	})
+	files, err := g.ListFilesExt(ctx, patternSuffix)
+	return fileEntryPaths(files), err
+}
 
+func (g *gcsStorage) ListFilesExt(
+	ctx context.Context, patternSuffix string,
+) ([]cloud.FileEntry, error) {
 	pattern := g.prefix
 	if patternSuffix != "" {
 		if containsGlob(g.prefix) {
@@ -231,13 +560,34 @@ func (g *gcsStorage) ListFiles(ctx context.Context, patternSuffix string) ([]str
 		pattern = path.Join(pattern, patternSuffix)
 	}
 
+	var fileList []cloud.FileEntry
+	err := runWithStorageTimeout(ctx, g.settings, "list gcs files", func(ctx context.Context) error {
+		return g.retryRateLimited(ctx, "list", func() error {
+			var err error
+			fileList, err = g.listFiles(ctx, pattern, patternSuffix)
+			return err
+		})
+	})
+	return sortFileEntries(fileList), err
+}
+
+// listFiles lists the files in the bucket matching pattern, starting over from
+// the first page.
+func (g *gcsStorage) listFiles(
+	ctx context.Context, pattern, patternSuffix string,
+) ([]cloud.FileEntry, error) {
+	var fileList []cloud.FileEntry
+	it := g.bucket.Objects(ctx, &gcs.Query{
+		Prefix: getPrefixBeforeWildcard(g.prefix),
+	})
+
 	for {
 		attrs, err := it.Next()
 		if errors.Is(err, iterator.Done) {
 			break
 		}
 		if err != nil {
-			return nil, errors.Wrap(err, "unable to list files in gcs bucket")
+			return nil, errors.Wrap(markGCSError(err), "unable to list files in gcs bucket")
 		}
 
 		matches, errMatch := path.Match(pattern, attrs.Name)
@@ -245,12 +595,13 @@ func (g *gcsStorage) ListFiles(ctx context.Context, patternSuffix string) ([]str
 			continue
 		}
 		if matches {
+			entry := cloud.FileEntry{Size: attrs.Size, ModTime: attrs.Updated}
 			if patternSuffix != "" {
 				if !strings.HasPrefix(attrs.Name, g.prefix) {
 					// TODO(dt): return a nice rel-path instead of erroring out.
 					return nil, errors.New("pattern matched file outside of path")
 				}
-				fileList = append(fileList, strings.TrimPrefix(strings.TrimPrefix(attrs.Name, g.prefix), "/"))
+				entry.Path = strings.TrimPrefix(strings.TrimPrefix(attrs.Name, g.prefix), "/")
 			} else {
 				gsURL := url.URL{
 					Scheme:   "gs",
@@ -258,8 +609,9 @@ func (g *gcsStorage) ListFiles(ctx context.Context, patternSuffix string) ([]str
 					Path:     attrs.Name,
 					RawQuery: gcsQueryParams(g.conf),
 				}
-				fileList = append(fileList, gsURL.String())
+				entry.Path = gsURL.String()
 			}
+			fileList = append(fileList, entry)
 		}
 	}
 
@@ -267,11 +619,97 @@ func (g *gcsStorage) ListFiles(ctx context.Context, patternSuffix string) ([]str
 }
 
 func (g *gcsStorage) Delete(ctx context.Context, basename string) error {
-	return contextutil.RunWithTimeout(ctx, "delete gcs file",
+	return markGCSError(contextutil.RunWithTimeout(ctx, "delete gcs file",
 		timeoutSetting.Get(&g.settings.SV),
 		func(ctx context.Context) error {
-			return g.bucket.Object(path.Join(g.prefix, basename)).Delete(ctx)
+			return g.retryRateLimited(ctx, "delete", func() error {
+				return g.bucket.Object(path.Join(g.prefix, basename)).Delete(ctx)
+			})
+		}))
+}
+
+// PresignedURL implements the cloud.Presigner interface, returning a V4 signed
+// URL. Signing requires the private key of a service account, so it is not
+// supported with implicit credentials.
+func (g *gcsStorage) PresignedURL(
+	_ context.Context, basename string, expiry time.Duration,
+) (string, error) {
+	if g.signingKey == nil {
+		return "", errors.Mark(
+			errors.New("google cloud storage can only presign URLs with service account credentials"),
+			ErrUnsupported)
+	}
+	u, err := gcs.SignedURL(g.conf.Bucket, path.Join(g.prefix, basename), &gcs.SignedURLOptions{
+		GoogleAccessID: g.signingEmail,
+		PrivateKey:     g.signingKey,
+		Method:         http.MethodGet,
+		Expires:        timeutil.Now().Add(expiry),
+		Scheme:         gcs.SigningSchemeV4,
+	})
+	return u, errors.Wrap(err, "failed to sign google cloud storage URL")
+}
+
+// DeleteAll implements the ExternalStorage interface. GCS has no bulk delete in
+// this client, so the listed objects are deleted one at a time.
+// ListFilesPage implements the cloud.PageLister interface with the page tokens
+// of the GCS API, which lists objects in lexicographic order.
+func (g *gcsStorage) ListFilesPage(
+	ctx context.Context, prefix, token string, limit int,
+) ([]string, string, error) {
+	var objects []*gcs.ObjectAttrs
+	var nextToken string
+	err := runWithStorageTimeout(ctx, g.settings, "list gcs files", func(ctx context.Context) error {
+		return g.retryRateLimited(ctx, "list", func() error {
+			objects = objects[:0]
+			it := g.bucket.Objects(ctx, &gcs.Query{Prefix: joinKeyPrefix(g.prefix, prefix)})
+			var err error
+			nextToken, err = iterator.NewPager(it, limit, token).NextPage(&objects)
+			if err != nil {
+				return errors.Wrap(markGCSError(err), "unable to list files in gcs bucket")
+			}
+			return nil
 		})
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	paths := make([]string, len(objects))
+	for i, attrs := range objects {
+		paths[i] = strings.TrimPrefix(strings.TrimPrefix(attrs.Name, g.prefix), "/")
+	}
+	return paths, nextToken, nil
+}
+
+func (g *gcsStorage) DeleteAll(ctx context.Context, prefix string) error {
+	var names []string
+	err := runWithStorageTimeout(ctx, g.settings, "list gcs files", func(ctx context.Context) error {
+		return g.retryRateLimited(ctx, "list", func() error {
+			names = names[:0]
+			it := g.bucket.Objects(ctx, &gcs.Query{Prefix: joinKeyPrefix(g.prefix, prefix)})
+			for {
+				attrs, err := it.Next()
+				if errors.Is(err, iterator.Done) {
+					return nil
+				}
+				if err != nil {
+					return errors.Wrap(markGCSError(err), "unable to list files in gcs bucket")
+				}
+				names = append(names, attrs.Name)
+			}
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return deleteEach(ctx, names, func(ctx context.Context, name string) error {
+		return markGCSError(contextutil.RunWithTimeout(ctx, "delete gcs file",
+			timeoutSetting.Get(&g.settings.SV),
+			func(ctx context.Context) error {
+				return g.retryRateLimited(ctx, "delete", func() error {
+					return g.bucket.Object(name).Delete(ctx)
+				})
+			}))
+	})
 }
 
 func (g *gcsStorage) Size(ctx context.Context, basename string) (int64, error) {
@@ -279,17 +717,63 @@ func (g *gcsStorage) Size(ctx context.Context, basename string) (int64, error) {
 	if err := contextutil.RunWithTimeout(ctx, "size gcs file",
 		timeoutSetting.Get(&g.settings.SV),
 		func(ctx context.Context) error {
-			var err error
-			r, err = g.bucket.Object(path.Join(g.prefix, basename)).NewReader(ctx)
-			return err
+			return g.retryRateLimited(ctx, "size", func() error {
+				var err error
+				r, err = g.bucket.Object(path.Join(g.prefix, basename)).NewReader(ctx)
+				return err
+			})
 		}); err != nil {
-		return 0, err
+		return 0, markGCSError(err)
 	}
 	sz := r.Attrs.Size
 	_ = r.Close()
 	return sz, nil
 }
 
+func (g *gcsStorage) Stat(ctx context.Context, basename string) (cloud.FileInfo, error) {
+	var attrs *gcs.ObjectAttrs
+	if err := contextutil.RunWithTimeout(ctx, "stat gcs file",
+		timeoutSetting.Get(&g.settings.SV),
+		func(ctx context.Context) error {
+			return g.retryRateLimited(ctx, "stat", func() error {
+				var err error
+				attrs, err = g.bucket.Object(path.Join(g.prefix, basename)).Attrs(ctx)
+				return err
+			})
+		}); err != nil {
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			return cloud.FileInfo{}, nil
+		}
+		return cloud.FileInfo{}, markGCSError(err)
+	}
+	info := cloud.FileInfo{Exists: true, Size: attrs.Size, ModTime: attrs.Updated}
+	// Composite objects have no MD5 digest, which the client decodes as empty.
+	if len(attrs.MD5) > 0 {
+		info.ContentMD5 = attrs.MD5
+	}
+	return info, nil
+}
+
+// Validate implements the cloud.Validator interface, fetching the attributes of
+// the bucket to check that it exists and that the credentials can access it.
+func (g *gcsStorage) Validate(ctx context.Context) error {
+	if err := contextutil.RunWithTimeout(ctx, "get gcs bucket attributes",
+		timeoutSetting.Get(&g.settings.SV),
+		func(ctx context.Context) error {
+			return g.retryRateLimited(ctx, "validate", func() error {
+				_, err := g.bucket.Attrs(ctx)
+				return err
+			})
+		}); err != nil {
+		return errors.Wrapf(markGCSError(err), "failed to access gcs bucket %s", g.conf.Bucket)
+	}
+	return nil
+}
+
+// Close does not close the client: its transport wraps the shared one and has
+// no connections of its own, and closing the client would only drop its
+// references to it, making any use of it still in progress, or made after the
+// storage is closed, panic.
 func (g *gcsStorage) Close() error {
-	return g.client.Close()
+	return nil
 }
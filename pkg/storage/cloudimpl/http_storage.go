@@ -12,8 +12,6 @@ package cloudimpl
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	"hash/fnv"
 	"io"
@@ -27,28 +25,68 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
-	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
 	"github.com/cockroachdb/cockroach/pkg/util/contextutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/errors"
 )
 
 func parseHTTPURL(_ ExternalStorageURIContext, uri *url.URL) (roachpb.ExternalStorage, error) {
 	conf := roachpb.ExternalStorage{}
 	conf.Provider = roachpb.ExternalStorageProvider_Http
+	// The credentials are removed from the base URI so that they are not sent
+	// to the server, or logged, as part of the URL of every request.
+	q := uri.Query()
+	conf.HttpPath.BasicAuthUser = q.Get(HTTPBasicAuthUserParam)
+	conf.HttpPath.BasicAuthPassword = q.Get(HTTPBasicAuthPasswordParam)
+	conf.HttpPath.BearerToken = q.Get(HTTPBearerTokenParam)
+	if n := len(q); n > 0 {
+		q.Del(HTTPBasicAuthUserParam)
+		q.Del(HTTPBasicAuthPasswordParam)
+		q.Del(HTTPBearerTokenParam)
+		if len(q) != n {
+			uri.RawQuery = q.Encode()
+		}
+	}
+	if err := validateHTTPAuth(conf.HttpPath); err != nil {
+		return conf, err
+	}
 	conf.HttpPath.BaseUri = uri.String()
 	return conf, nil
 }
 
+// validateHTTPAuth checks that at most one way to authenticate is configured.
+func validateHTTPAuth(conf roachpb.ExternalStorage_Http) error {
+	if conf.BasicAuthPassword != "" && conf.BasicAuthUser == "" {
+		return errors.Errorf("%s is set, but %s is not set",
+			HTTPBasicAuthPasswordParam, HTTPBasicAuthUserParam)
+	}
+	if conf.BasicAuthUser != "" && conf.BearerToken != "" {
+		return errors.Errorf("%s and %s cannot both be set", HTTPBasicAuthUserParam, HTTPBearerTokenParam)
+	}
+	return nil
+}
+
 type httpStorage struct {
 	base     *url.URL
+	conf     roachpb.ExternalStorage_Http
 	client   *http.Client
 	hosts    []string
 	settings *cluster.Settings
 	ioConf   base.ExternalIODirConfig
+	limiters *rateLimiters
+
+	mu struct {
+		syncutil.Mutex
+		// sizes holds the sizes of the files that were read, from the headers of
+		// their responses, so that Size does not need to issue a HEAD request
+		// for them. The size of a file is forgotten when it is written or deleted
+		// through this storage.
+		sizes map[string]int64
+	}
 }
 
 var _ cloud.ExternalStorage = &httpStorage{}
@@ -70,50 +108,39 @@ var HTTPRetryOptions = retry.Options{
 	Multiplier:     4,
 }
 
-func makeHTTPClient(settings *cluster.Settings) (*http.Client, error) {
-	var tlsConf *tls.Config
-	if pem := httpCustomCA.Get(&settings.SV); pem != "" {
-		roots, err := x509.SystemCertPool()
-		if err != nil {
-			return nil, errors.Wrap(err, "could not load system root CA pool")
-		}
-		if !roots.AppendCertsFromPEM([]byte(pem)) {
-			return nil, errors.Errorf("failed to parse root CA certificate from %q", pem)
-		}
-		tlsConf = &tls.Config{RootCAs: roots}
-	}
-	// Copy the defaults from http.DefaultTransport. We cannot just copy the
-	// entire struct because it has a sync Mutex. This has the unfortunate problem
-	// that if Go adds fields to DefaultTransport they won't be copied here,
-	// but this is ok for now.
-	t := http.DefaultTransport.(*http.Transport)
-	return &http.Client{Transport: &http.Transport{
-		Proxy:                 t.Proxy,
-		DialContext:           t.DialContext,
-		MaxIdleConns:          t.MaxIdleConns,
-		IdleConnTimeout:       t.IdleConnTimeout,
-		TLSHandshakeTimeout:   t.TLSHandshakeTimeout,
-		ExpectContinueTimeout: t.ExpectContinueTimeout,
-
-		// Add our custom CA.
-		TLSClientConfig: tlsConf,
-	}}, nil
+// makeHTTPClient returns a client of the shared transport with the custom CA
+// and certificate verification of the cloudstorage.http settings, for storage
+// at user-provided HTTPS endpoints.
+func makeHTTPClient(ctx context.Context, settings *cluster.Settings) (*http.Client, error) {
+	tlsKey := httpTransportTLS{
+		customCA:           httpCustomCA.Get(&settings.SV),
+		insecureSkipVerify: httpInsecureSkipVerify.Get(&settings.SV),
+	}
+	if tlsKey.insecureSkipVerify {
+		log.Warningf(ctx, "%s is set; certificates of HTTPS storage will not be verified",
+			CloudstorageHTTPInsecureSkipVerifySetting)
+	}
+	return makeSharedHTTPClient(settings, tlsKey)
 }
 
 // MakeHTTPStorage returns an instance of HTTPStorage ExternalStorage.
 func MakeHTTPStorage(
 	ctx context.Context, args ExternalStorageContext, dest roachpb.ExternalStorage,
 ) (cloud.ExternalStorage, error) {
-	telemetry.Count("external-io.http")
+	// MakeHTTPStorage can be called directly, bypassing the checks of
+	// MakeExternalStorage.
 	if args.IOConf.DisableHTTP {
-		return nil, errors.New("external http access disabled")
+		return nil, errExternalIODisabled("http storage", "external-io-disable-http")
 	}
 	base := dest.HttpPath.BaseUri
 	if base == "" {
 		return nil, errors.Errorf("HTTP storage requested but prefix path not provided")
 	}
+	if err := validateHTTPAuth(dest.HttpPath); err != nil {
+		return nil, err
+	}
 
-	client, err := makeHTTPClient(args.Settings)
+	client, err := makeHTTPClient(ctx, args.Settings)
 	if err != nil {
 		return nil, err
 	}
@@ -121,21 +148,25 @@ func MakeHTTPStorage(
 	if err != nil {
 		return nil, err
 	}
-	return &httpStorage{
+	h := &httpStorage{
 		base:     uri,
+		conf:     dest.HttpPath,
 		client:   client,
 		hosts:    strings.Split(uri.Host, ","),
 		settings: args.Settings,
 		ioConf:   args.IOConf,
-	}, nil
+		limiters: newRateLimiters(args.Settings),
+	}
+	h.mu.sizes = make(map[string]int64)
+	return h, nil
 }
 
 func (h *httpStorage) Conf() roachpb.ExternalStorage {
+	conf := h.conf
+	conf.BaseUri = h.base.String()
 	return roachpb.ExternalStorage{
 		Provider: roachpb.ExternalStorageProvider_Http,
-		HttpPath: roachpb.ExternalStorage_Http{
-			BaseUri: h.base.String(),
-		},
+		HttpPath: conf,
 	}
 }
 
@@ -218,22 +249,63 @@ func (h *httpStorage) openStreamAt(
 	return nil, ctx.Err()
 }
 
+// openAt opens the file at pos, returning the response along with the size of
+// the whole file, which is -1 if the response does not include it, e.g. because
+// it uses chunked transfer encoding. Servers that support range requests respond with the part of
+// the file starting at pos, while servers that ignore the Range header respond
+// with the whole file, in which case the bytes before pos are discarded.
+func (h *httpStorage) openAt(
+	ctx context.Context, basename string, pos int64,
+) (*http.Response, int64, error) {
+	stream, err := h.openStreamAt(ctx, basename, pos)
+	if err != nil {
+		return nil, 0, err
+	}
+	if pos == 0 {
+		return stream, stream.ContentLength, nil
+	}
+	if stream.StatusCode == http.StatusPartialContent || stream.Header.Get("Content-Range") != "" {
+		size, err := checkHTTPContentRangeHeader(stream.Header.Get("Content-Range"), pos)
+		if err != nil {
+			_ = stream.Body.Close()
+			return nil, 0, err
+		}
+		return stream, size, nil
+	}
+	if _, err := io.CopyN(ioutil.Discard, stream.Body, pos); err != nil {
+		_ = stream.Body.Close()
+		return nil, 0, errors.Wrapf(err, "skipping to offset %d of %s", pos, basename)
+	}
+	return stream, stream.ContentLength, nil
+}
+
+// ReadFileAt implements the ExternalStorage interface. The size it returns is
+// that of the Content-Length or Content-Range header of the response, or -1 if
+// the server did not send it.
 func (h *httpStorage) ReadFileAt(
 	ctx context.Context, basename string, offset int64,
 ) (io.ReadCloser, int64, error) {
-	stream, err := h.openStreamAt(ctx, basename, offset)
+	reader, size, err := openWithStorageTimeout(ctx, h.settings, fmt.Sprintf("GET %s", basename),
+		func(ctx context.Context) (io.ReadCloser, int64, error) {
+			return h.readFileAt(ctx, basename, offset)
+		})
 	if err != nil {
 		return nil, 0, err
 	}
+	return h.limiters.limitReader(ctx, readAhead(h.settings, reader)), size, nil
+}
 
-	var size int64
-	if offset == 0 {
-		size = stream.ContentLength
-	} else {
-		size, err = checkHTTPContentRangeHeader(stream.Header.Get("Content-Range"), offset)
-		if err != nil {
-			return nil, 0, err
-		}
+func (h *httpStorage) readFileAt(
+	ctx context.Context, basename string, offset int64,
+) (io.ReadCloser, int64, error) {
+	stream, size, err := h.openAt(ctx, basename, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if size >= 0 {
+		h.mu.Lock()
+		h.mu.sizes[basename] = size
+		h.mu.Unlock()
 	}
 
 	canResume := stream.Header.Get("Accept-Ranges") == "bytes"
@@ -241,7 +313,7 @@ func (h *httpStorage) ReadFileAt(
 		return &resumingReader{
 			ctx: ctx,
 			opener: func(ctx context.Context, pos int64) (io.ReadCloser, error) {
-				s, err := h.openStreamAt(ctx, basename, pos)
+				s, _, err := h.openAt(ctx, basename, pos)
 				if err != nil {
 					return nil, err
 				}
@@ -254,19 +326,51 @@ func (h *httpStorage) ReadFileAt(
 	return stream.Body, size, nil
 }
 
+// forgetSize forgets the size of basename that was remembered when it was read.
+func (h *httpStorage) forgetSize(basename string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.mu.sizes, basename)
+}
+
 func (h *httpStorage) WriteFile(ctx context.Context, basename string, content io.ReadSeeker) error {
+	defer h.forgetSize(basename)
+	return contextutil.RunWithTimeout(ctx, fmt.Sprintf("PUT %s", basename),
+		timeoutSetting.Get(&h.settings.SV), func(ctx context.Context) error {
+			_, err := h.reqNoBody(ctx, "PUT", basename, h.limiters.limitContent(ctx, content))
+			return err
+		})
+}
+
+// WriteFileIfNotExists implements the ExternalStorage interface. The file is
+// PUT with an If-None-Match: * header, which a server that supports
+// conditional requests rejects if the file exists. Servers that ignore the
+// header overwrite the file.
+func (h *httpStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	defer h.forgetSize(basename)
 	return contextutil.RunWithTimeout(ctx, fmt.Sprintf("PUT %s", basename),
 		timeoutSetting.Get(&h.settings.SV), func(ctx context.Context) error {
-			_, err := h.reqNoBody(ctx, "PUT", basename, content)
+			resp, err := h.req(ctx, "PUT", basename, h.limiters.limitContent(ctx, content),
+				map[string]string{"If-None-Match": "*"})
+			if resp != nil {
+				resp.Body.Close()
+			}
 			return err
 		})
 }
 
 func (h *httpStorage) ListFiles(_ context.Context, _ string) ([]string, error) {
-	return nil, errors.Mark(errors.New("http storage does not support listing"), ErrListingUnsupported)
+	return nil, listingUnsupportedError(errors.New("http storage does not support listing"))
+}
+
+func (h *httpStorage) ListFilesExt(_ context.Context, _ string) ([]cloud.FileEntry, error) {
+	return nil, listingUnsupportedError(errors.New("http storage does not support listing"))
 }
 
 func (h *httpStorage) Delete(ctx context.Context, basename string) error {
+	defer h.forgetSize(basename)
 	return contextutil.RunWithTimeout(ctx, fmt.Sprintf("DELETE %s", basename),
 		timeoutSetting.Get(&h.settings.SV), func(ctx context.Context) error {
 			_, err := h.reqNoBody(ctx, "DELETE", basename, nil)
@@ -274,7 +378,22 @@ func (h *httpStorage) Delete(ctx context.Context, basename string) error {
 		})
 }
 
+// DeleteAll is not supported, as deleting by prefix requires listing.
+func (h *httpStorage) DeleteAll(_ context.Context, _ string) error {
+	return listingUnsupportedError(errors.New("http storage does not support listing"))
+}
+
+// Size implements the ExternalStorage interface. The size of a file that was
+// read through this storage is that of its response, while the size of other
+// files is requested with a HEAD request.
 func (h *httpStorage) Size(ctx context.Context, basename string) (int64, error) {
+	h.mu.Lock()
+	size, ok := h.mu.sizes[basename]
+	h.mu.Unlock()
+	if ok {
+		return size, nil
+	}
+
 	var resp *http.Response
 	if err := contextutil.RunWithTimeout(ctx, fmt.Sprintf("HEAD %s", basename),
 		timeoutSetting.Get(&h.settings.SV), func(ctx context.Context) error {
@@ -290,6 +409,30 @@ func (h *httpStorage) Size(ctx context.Context, basename string) (int64, error)
 	return resp.ContentLength, nil
 }
 
+func (h *httpStorage) Stat(ctx context.Context, basename string) (cloud.FileInfo, error) {
+	var resp *http.Response
+	if err := contextutil.RunWithTimeout(ctx, fmt.Sprintf("HEAD %s", basename),
+		timeoutSetting.Get(&h.settings.SV), func(ctx context.Context) error {
+			var err error
+			resp, err = h.reqNoBody(ctx, "HEAD", basename, nil)
+			return err
+		}); err != nil {
+		if errors.Is(err, ErrFileDoesNotExist) {
+			return cloud.FileInfo{}, nil
+		}
+		return cloud.FileInfo{}, err
+	}
+	if resp.ContentLength < 0 {
+		return cloud.FileInfo{}, errors.Errorf("bad ContentLength: %d", resp.ContentLength)
+	}
+	info := cloud.FileInfo{Exists: true, Size: resp.ContentLength}
+	// Servers are not required to send Last-Modified, so it is best-effort.
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return info, nil
+}
+
 func (h *httpStorage) Close() error {
 	return nil
 }
@@ -331,6 +474,12 @@ func (h *httpStorage) req(
 	for key, val := range headers {
 		req.Header.Add(key, val)
 	}
+	switch {
+	case h.conf.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+h.conf.BearerToken)
+	case h.conf.BasicAuthUser != "":
+		req.SetBasicAuth(h.conf.BasicAuthUser, h.conf.BasicAuthPassword)
+	}
 
 	resp, err := h.client.Do(req)
 	if err != nil {
@@ -338,7 +487,7 @@ func (h *httpStorage) req(
 		// a response object/server response code). Those errors (e.g. due to
 		// network blip, or DNS resolution blip, etc) are usually transient. The
 		// client may choose to retry the request few times before giving up.
-		return nil, &retryableHTTPError{err}
+		return nil, &retryableHTTPError{countStorageError(roachpb.ExternalStorageProvider_Http, err)}
 	}
 
 	switch resp.StatusCode {
@@ -351,7 +500,16 @@ func (h *httpStorage) req(
 		if err != nil && resp.StatusCode == 404 {
 			err = errors.Wrapf(ErrFileDoesNotExist, "http storage file does not exist: %s", err.Error())
 		}
-		return nil, err
+		if resp.StatusCode == 401 || resp.StatusCode == 403 {
+			err = errors.Mark(err, ErrAccessDenied)
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			err = errors.Mark(err, errRateLimited)
+		}
+		if err != nil && resp.StatusCode == 412 && headers["If-None-Match"] == "*" {
+			err = errors.Wrapf(ErrFileAlreadyExists, "http storage file already exists: %s", err.Error())
+		}
+		return nil, countStorageError(roachpb.ExternalStorageProvider_Http, err)
 	}
 	return resp, nil
 }
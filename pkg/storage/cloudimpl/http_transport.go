@@ -0,0 +1,270 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
+)
+
+var (
+	httpMaxIdleConns = settings.RegisterIntSetting(
+		"cloudstorage.max_idle_conns",
+		"the maximum number of idle connections to cloud storage that are kept open by each "+
+			"connection pool, or 0 for no limit",
+		100,
+		settings.NonNegativeInt,
+	)
+	httpMaxIdleConnsPerHost = settings.RegisterIntSetting(
+		"cloudstorage.max_idle_conns_per_host",
+		"the maximum number of idle connections to each cloud storage host that are kept open "+
+			"by each connection pool",
+		100,
+		settings.PositiveInt,
+	)
+	httpIdleConnTimeout = settings.RegisterDurationSetting(
+		"cloudstorage.idle_conn_timeout",
+		"the duration after which idle connections to cloud storage are closed, or 0 to keep "+
+			"them open",
+		90*time.Second,
+		settings.NonNegativeDuration,
+	)
+)
+
+// httpTransportTLS is the TLS customization of a shared transport. The zero
+// value verifies certificates against the system's root CAs only.
+type httpTransportTLS struct {
+	customCA           string
+	insecureSkipVerify bool
+}
+
+// httpTransportLimits are the limits of the connection pool of a shared
+// transport.
+type httpTransportLimits struct {
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+}
+
+func makeHTTPTransportLimits(settings *cluster.Settings) httpTransportLimits {
+	if settings == nil {
+		return httpTransportLimits{
+			maxIdleConns:        int(httpMaxIdleConns.Default()),
+			maxIdleConnsPerHost: int(httpMaxIdleConnsPerHost.Default()),
+			idleConnTimeout:     httpIdleConnTimeout.Default(),
+		}
+	}
+	return httpTransportLimits{
+		maxIdleConns:        int(httpMaxIdleConns.Get(&settings.SV)),
+		maxIdleConnsPerHost: int(httpMaxIdleConnsPerHost.Get(&settings.SV)),
+		idleConnTimeout:     httpIdleConnTimeout.Get(&settings.SV),
+	}
+}
+
+// httpTransportKey identifies a shared transport.
+type httpTransportKey struct {
+	tls    httpTransportTLS
+	limits httpTransportLimits
+}
+
+// sharedHTTPTransports holds the transports that the clients of all the cloud
+// storage backends send their requests with, one per TLS customization and
+// connection pool limits, so that connections to the same host are pooled.
+// Transports are keyed by their limits too, so that clients with different
+// settings, such as those of the tenants of a process, each keep using the
+// transport of their limits rather than replacing that of the others. Once a
+// change of the settings leaves a transport unused, its idle connections are
+// closed after the idle connection timeout it was created with.
+var sharedHTTPTransports struct {
+	syncutil.Mutex
+	m map[httpTransportKey]*http.Transport
+	// generation is incremented when the transports are reset for testing, so
+	// that the clients stop using the transports they looked up before.
+	generation int64
+}
+
+// getSharedHTTPTransport returns the shared transport of key, creating it if
+// it does not exist yet.
+func getSharedHTTPTransport(key httpTransportKey) (*http.Transport, int64, error) {
+	sharedHTTPTransports.Lock()
+	defer sharedHTTPTransports.Unlock()
+	generation := atomic.LoadInt64(&sharedHTTPTransports.generation)
+	if t, ok := sharedHTTPTransports.m[key]; ok {
+		return t, generation, nil
+	}
+	t, err := newHTTPTransport(key.tls, key.limits)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sharedHTTPTransports.m == nil {
+		sharedHTTPTransports.m = make(map[httpTransportKey]*http.Transport)
+	}
+	sharedHTTPTransports.m[key] = t
+	return t, generation, nil
+}
+
+func newHTTPTransport(tlsKey httpTransportTLS, limits httpTransportLimits) (*http.Transport, error) {
+	var tlsConf *tls.Config
+	if tlsKey.customCA != "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load system root CA pool")
+		}
+		if !roots.AppendCertsFromPEM([]byte(tlsKey.customCA)) {
+			return nil, errors.Errorf("failed to parse root CA certificate from %q", tlsKey.customCA)
+		}
+		tlsConf = &tls.Config{RootCAs: roots}
+	}
+	if tlsKey.insecureSkipVerify {
+		if tlsConf == nil {
+			tlsConf = &tls.Config{}
+		}
+		tlsConf.InsecureSkipVerify = true
+	}
+	// Copy the defaults from http.DefaultTransport. We cannot just copy the
+	// entire struct because it has a sync Mutex. This has the unfortunate problem
+	// that if Go adds fields to DefaultTransport they won't be copied here,
+	// but this is ok for now.
+	t := http.DefaultTransport.(*http.Transport)
+	return &http.Transport{
+		Proxy:                 t.Proxy,
+		DialContext:           t.DialContext,
+		TLSHandshakeTimeout:   t.TLSHandshakeTimeout,
+		ExpectContinueTimeout: t.ExpectContinueTimeout,
+
+		MaxIdleConns:        limits.maxIdleConns,
+		MaxIdleConnsPerHost: limits.maxIdleConnsPerHost,
+		IdleConnTimeout:     limits.idleConnTimeout,
+
+		// Add our custom CA.
+		TLSClientConfig: tlsConf,
+	}, nil
+}
+
+// sharedHTTPRoundTripper sends each request with the shared transport of its
+// TLS customization and the current connection pool limits of its settings, so
+// that changes of the settings apply to the clients that were already created.
+type sharedHTTPRoundTripper struct {
+	settings *cluster.Settings
+	tlsKey   httpTransportTLS
+	// current holds the *cachedHTTPTransport that requests are sent with,
+	// which is only looked up again when the limits change, so that requests
+	// do not contend on the lock of sharedHTTPTransports.
+	current atomic.Value
+}
+
+// cachedHTTPTransport is a shared transport looked up by a
+// sharedHTTPRoundTripper.
+type cachedHTTPTransport struct {
+	limits     httpTransportLimits
+	generation int64
+	transport  *http.Transport
+}
+
+// transport returns the shared transport to send requests with.
+func (r *sharedHTTPRoundTripper) transport() (*http.Transport, error) {
+	limits := makeHTTPTransportLimits(r.settings)
+	if c, ok := r.current.Load().(*cachedHTTPTransport); ok && c.limits == limits &&
+		c.generation == atomic.LoadInt64(&sharedHTTPTransports.generation) {
+		return c.transport, nil
+	}
+	t, generation, err := getSharedHTTPTransport(httpTransportKey{tls: r.tlsKey, limits: limits})
+	if err != nil {
+		return nil, err
+	}
+	r.current.Store(&cachedHTTPTransport{limits: limits, generation: generation, transport: t})
+	return t, nil
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (r *sharedHTTPRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	t, err := r.transport()
+	if err != nil {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.RoundTrip(req)
+}
+
+// makeSharedHTTPClient returns a client that sends its requests with the
+// shared transport of tlsKey. An invalid TLS customization is reported here,
+// rather than on the first request.
+func makeSharedHTTPClient(settings *cluster.Settings, tlsKey httpTransportTLS) (*http.Client, error) {
+	rt := &sharedHTTPRoundTripper{settings: settings, tlsKey: tlsKey}
+	if _, err := rt.transport(); err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: rt}, nil
+}
+
+// makeProviderHTTPClient returns a client of the shared transport without any
+// TLS customization, for the endpoints of cloud providers, whose certificates
+// are signed by public CAs.
+func makeProviderHTTPClient(settings *cluster.Settings) *http.Client {
+	// The zero httpTransportTLS cannot fail to create a transport.
+	client, _ := makeSharedHTTPClient(settings, httpTransportTLS{})
+	return client
+}
+
+// makeUnsharedHTTPClient returns a client with a transport of its own, which
+// is configured like the shared transport of client, for libraries that need
+// to modify the transport of their client. Clients that do not use a shared
+// transport are returned as-is.
+func makeUnsharedHTTPClient(client *http.Client) (*http.Client, error) {
+	rt, ok := client.Transport.(*sharedHTTPRoundTripper)
+	if !ok {
+		return client, nil
+	}
+	t, err := newHTTPTransport(rt.tlsKey, makeHTTPTransportLimits(rt.settings))
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+// closeUnsharedHTTPClient closes the idle connections of client if it has a
+// transport of its own, such as one made by makeUnsharedHTTPClient, for the
+// storage that uses it to release them when it is closed. The connections of
+// the shared transports are kept for the other clients.
+func closeUnsharedHTTPClient(client *http.Client) {
+	if client == nil {
+		return
+	}
+	if _, ok := client.Transport.(*sharedHTTPRoundTripper); ok {
+		return
+	}
+	if t, ok := client.Transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// ResetSharedHTTPTransportsForTesting closes the idle connections of the
+// shared transports and drops them, so that the clients create new ones from
+// the current http.DefaultTransport.
+func ResetSharedHTTPTransportsForTesting() {
+	sharedHTTPTransports.Lock()
+	defer sharedHTTPTransports.Unlock()
+	for _, t := range sharedHTTPTransports.m {
+		t.CloseIdleConnections()
+	}
+	sharedHTTPTransports.m = nil
+	atomic.AddInt64(&sharedHTTPTransports.generation, 1)
+}
@@ -0,0 +1,206 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// memoryStorage is an ExternalStorage that keeps its files in memory. It has
+// no serializable configuration and so cannot be reconstructed from Conf; it
+// is meant for tests that need an ExternalStorage without disk or network.
+type memoryStorage struct {
+	mu struct {
+		syncutil.Mutex
+		files map[string]memoryFile
+	}
+}
+
+var _ cloud.ExternalStorage = &memoryStorage{}
+var _ cloud.PageLister = &memoryStorage{}
+var _ cloud.DelimitedLister = &memoryStorage{}
+
+// NewMemoryStorage returns an empty ExternalStorage backed by memory. It is
+// safe for concurrent use.
+func NewMemoryStorage() cloud.ExternalStorage {
+	s := &memoryStorage{}
+	s.mu.files = make(map[string]memoryFile)
+	return s
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
+
+func (s *memoryStorage) Conf() roachpb.ExternalStorage {
+	return roachpb.ExternalStorage{}
+}
+
+func (s *memoryStorage) ExternalIOConf() base.ExternalIODirConfig {
+	return base.ExternalIODirConfig{}
+}
+
+func (s *memoryStorage) Settings() *cluster.Settings {
+	return nil
+}
+
+func (s *memoryStorage) lookup(basename string) (memoryFile, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.mu.files[basename]
+	return f, ok
+}
+
+func (s *memoryStorage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	reader, _, err := s.ReadFileAt(ctx, basename, 0)
+	return reader, err
+}
+
+func (s *memoryStorage) ReadFileAt(
+	_ context.Context, basename string, offset int64,
+) (io.ReadCloser, int64, error) {
+	f, ok := s.lookup(basename)
+	if !ok {
+		return nil, 0, errors.Wrapf(ErrFileDoesNotExist, "memory storage file does not exist: %s", basename)
+	}
+	size := int64(len(f.data))
+	if offset < 0 || offset > size {
+		return nil, 0, errors.Errorf("offset %d is out of range for file %s of size %d",
+			offset, basename, size)
+	}
+	// Written data is never modified in place, so it can be read without
+	// holding the lock.
+	return ioutil.NopCloser(bytes.NewReader(f.data[offset:])), size, nil
+}
+
+func (s *memoryStorage) WriteFile(_ context.Context, basename string, content io.ReadSeeker) error {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.files[basename] = memoryFile{data: data, modTime: timeutil.Now()}
+	return nil
+}
+
+func (s *memoryStorage) WriteFileIfNotExists(
+	_ context.Context, basename string, content io.ReadSeeker,
+) error {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.mu.files[basename]; ok {
+		return errors.Wrapf(ErrFileAlreadyExists, "memory storage file %s already exists", basename)
+	}
+	s.mu.files[basename] = memoryFile{data: data, modTime: timeutil.Now()}
+	return nil
+}
+
+// ListFiles returns the sorted names of the files that start with prefix.
+func (s *memoryStorage) ListFiles(ctx context.Context, prefix string) ([]string, error) {
+	files, err := s.ListFilesExt(ctx, prefix)
+	return fileEntryPaths(files), err
+}
+
+// ListFilesExt returns the files that start with prefix, sorted by name.
+func (s *memoryStorage) ListFilesExt(_ context.Context, prefix string) ([]cloud.FileEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []cloud.FileEntry
+	for name, f := range s.mu.files {
+		if strings.HasPrefix(name, prefix) {
+			files = append(files, cloud.FileEntry{
+				Path: name, Size: int64(len(f.data)), ModTime: f.modTime,
+			})
+		}
+	}
+	return sortFileEntries(files), nil
+}
+
+// ListFilesPage implements the cloud.PageLister interface.
+func (s *memoryStorage) ListFilesPage(
+	ctx context.Context, prefix, token string, limit int,
+) ([]string, string, error) {
+	files, err := s.ListFiles(ctx, prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	paths, nextToken := pageOfFiles(files, token, limit)
+	return paths, nextToken, nil
+}
+
+// ListFilesWithDelimiter implements the cloud.DelimitedLister interface.
+func (s *memoryStorage) ListFilesWithDelimiter(
+	ctx context.Context, prefix, delimiter string,
+) ([]string, []string, error) {
+	files, err := s.ListFiles(ctx, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, prefixes := groupByDelimiter(files, prefix, delimiter)
+	return files, prefixes, nil
+}
+
+func (s *memoryStorage) Delete(_ context.Context, basename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.mu.files, basename)
+	return nil
+}
+
+func (s *memoryStorage) DeleteAll(_ context.Context, prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.mu.files {
+		if strings.HasPrefix(name, prefix) {
+			delete(s.mu.files, name)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStorage) Size(_ context.Context, basename string) (int64, error) {
+	f, ok := s.lookup(basename)
+	if !ok {
+		return 0, errors.Wrapf(ErrFileDoesNotExist, "memory storage file does not exist: %s", basename)
+	}
+	return int64(len(f.data)), nil
+}
+
+func (s *memoryStorage) Stat(_ context.Context, basename string) (cloud.FileInfo, error) {
+	f, ok := s.lookup(basename)
+	if !ok {
+		return cloud.FileInfo{}, nil
+	}
+	return cloud.FileInfo{Exists: true, Size: int64(len(f.data)), ModTime: f.modTime}, nil
+}
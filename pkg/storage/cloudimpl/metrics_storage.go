@@ -0,0 +1,261 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// The operations of external storage that StorageMetrics records, which name
+// and label their metrics.
+const (
+	storageOpRead   = "read"
+	storageOpWrite  = "write"
+	storageOpList   = "list"
+	storageOpDelete = "delete"
+	storageOpSize   = "size"
+)
+
+// StorageMetrics are the metrics of the operations of the storages wrapped by
+// WithMetrics, by provider and operation. The metrics of a provider and
+// operation are named cloudstorage.<provider>.<operation>.{requests,errors,
+// latency}, where provider is the name the provider's usage is counted as in
+// telemetry, and are labeled with the provider and the operation. They are
+// added to the registry the first time a storage of the provider is wrapped,
+// so that the providers that are not used do not add metrics.
+type StorageMetrics struct {
+	registry        *metric.Registry
+	histogramWindow time.Duration
+
+	mu struct {
+		syncutil.Mutex
+		ops map[storageOpKey]*storageOpMetrics
+	}
+}
+
+type storageOpKey struct {
+	provider, op string
+}
+
+// storageOpMetrics are the metrics of an operation of a provider.
+type storageOpMetrics struct {
+	requests *metric.Counter
+	errors   *metric.Counter
+	latency  *metric.Histogram
+}
+
+// NewStorageMetrics returns StorageMetrics that add the metrics of the storages
+// wrapped with them to registry, with latency histograms that retain values for
+// about histogramWindow.
+func NewStorageMetrics(registry *metric.Registry, histogramWindow time.Duration) *StorageMetrics {
+	m := &StorageMetrics{registry: registry, histogramWindow: histogramWindow}
+	m.mu.ops = make(map[storageOpKey]*storageOpMetrics)
+	return m
+}
+
+// forOp returns the metrics of op of provider, creating them if needed.
+func (m *StorageMetrics) forOp(provider, op string) *storageOpMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := storageOpKey{provider: provider, op: op}
+	if o, ok := m.mu.ops[key]; ok {
+		return o
+	}
+	meta := func(name, help, measurement string, unit metric.Unit) metric.Metadata {
+		md := metric.Metadata{
+			Name:        fmt.Sprintf("cloudstorage.%s.%s.%s", provider, op, name),
+			Help:        fmt.Sprintf(help, op, provider),
+			Measurement: measurement,
+			Unit:        unit,
+		}
+		md.AddLabel("provider", provider)
+		md.AddLabel("op", op)
+		return md
+	}
+	o := &storageOpMetrics{
+		requests: metric.NewCounter(
+			meta("requests", "Number of %s operations on %s storage", "Requests", metric.Unit_COUNT)),
+		errors: metric.NewCounter(
+			meta("errors", "Number of failed %s operations on %s storage", "Errors", metric.Unit_COUNT)),
+		latency: metric.NewLatency(
+			meta("latency", "Latency of %s operations on %s storage", "Latency", metric.Unit_NANOSECONDS),
+			m.histogramWindow),
+	}
+	m.registry.AddMetric(o.requests)
+	m.registry.AddMetric(o.errors)
+	m.registry.AddMetric(o.latency)
+	m.mu.ops[key] = o
+	return o
+}
+
+// record records an operation that started at start and returned err, which it
+// returns. Operations that were canceled are not counted as errors.
+func (o *storageOpMetrics) record(start time.Time, err error) error {
+	o.requests.Inc(1)
+	o.latency.RecordValue(timeutil.Since(start).Nanoseconds())
+	if err != nil && !errors.Is(err, context.Canceled) {
+		o.errors.Inc(1)
+	}
+	return err
+}
+
+// storageMetricsProvider returns the name of provider in the names of its
+// metrics.
+func storageMetricsProvider(provider roachpb.ExternalStorageProvider) string {
+	if impl, ok := implementations[provider]; ok {
+		return strings.TrimPrefix(impl.telemetryName, "external-io.")
+	}
+	return strings.ToLower(provider.String())
+}
+
+// metricsStorage wraps an ExternalStorage, recording the metrics of its
+// operations.
+type metricsStorage struct {
+	cloud.ExternalStorage
+	read, write, list, delete, size *storageOpMetrics
+}
+
+var _ cloud.ExternalStorage = &metricsStorage{}
+var _ cloud.Presigner = &metricsStorage{}
+var _ cloud.Copier = &metricsStorage{}
+var _ cloud.Syncer = &metricsStorage{}
+var _ cloud.Validator = &metricsStorage{}
+var _ cloud.PageLister = &metricsStorage{}
+var _ cloud.DelimitedLister = &metricsStorage{}
+
+// WithMetrics returns an ExternalStorage that records the number, errors and
+// latency of the operations on inner in m, under the provider of inner's Conf:
+// reads, writes (including copies to inner), listings, deletes and lookups of
+// sizes. The latency of a read is that of opening the file; the time spent
+// reading it is up to the caller.
+func WithMetrics(inner cloud.ExternalStorage, m *StorageMetrics) cloud.ExternalStorage {
+	provider := storageMetricsProvider(inner.Conf().Provider)
+	return &metricsStorage{
+		ExternalStorage: inner,
+		read:            m.forOp(provider, storageOpRead),
+		write:           m.forOp(provider, storageOpWrite),
+		list:            m.forOp(provider, storageOpList),
+		delete:          m.forOp(provider, storageOpDelete),
+		size:            m.forOp(provider, storageOpSize),
+	}
+}
+
+func (s *metricsStorage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	start := timeutil.Now()
+	r, err := s.ExternalStorage.ReadFile(ctx, basename)
+	return r, s.read.record(start, err)
+}
+
+func (s *metricsStorage) ReadFileAt(
+	ctx context.Context, basename string, offset int64,
+) (io.ReadCloser, int64, error) {
+	start := timeutil.Now()
+	r, size, err := s.ExternalStorage.ReadFileAt(ctx, basename, offset)
+	return r, size, s.read.record(start, err)
+}
+
+func (s *metricsStorage) WriteFile(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	start := timeutil.Now()
+	return s.write.record(start, s.ExternalStorage.WriteFile(ctx, basename, content))
+}
+
+func (s *metricsStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	start := timeutil.Now()
+	return s.write.record(start, s.ExternalStorage.WriteFileIfNotExists(ctx, basename, content))
+}
+
+func (s *metricsStorage) CopyFrom(
+	ctx context.Context, src cloud.ExternalStorage, srcName, dstName string,
+) error {
+	start := timeutil.Now()
+	return s.write.record(start, CopyFrom(ctx, s.ExternalStorage, src, srcName, dstName))
+}
+
+func (s *metricsStorage) ListFiles(ctx context.Context, patternSuffix string) ([]string, error) {
+	start := timeutil.Now()
+	files, err := s.ExternalStorage.ListFiles(ctx, patternSuffix)
+	return files, s.list.record(start, err)
+}
+
+func (s *metricsStorage) ListFilesExt(
+	ctx context.Context, patternSuffix string,
+) ([]cloud.FileEntry, error) {
+	start := timeutil.Now()
+	files, err := s.ExternalStorage.ListFilesExt(ctx, patternSuffix)
+	return files, s.list.record(start, err)
+}
+
+func (s *metricsStorage) ListFilesPage(
+	ctx context.Context, prefix, token string, limit int,
+) ([]string, string, error) {
+	start := timeutil.Now()
+	files, next, err := ListFilesPage(ctx, s.ExternalStorage, prefix, token, limit)
+	return files, next, s.list.record(start, err)
+}
+
+func (s *metricsStorage) ListFilesWithDelimiter(
+	ctx context.Context, prefix, delimiter string,
+) ([]string, []string, error) {
+	start := timeutil.Now()
+	files, prefixes, err := ListFilesWithDelimiter(ctx, s.ExternalStorage, prefix, delimiter)
+	return files, prefixes, s.list.record(start, err)
+}
+
+func (s *metricsStorage) Delete(ctx context.Context, basename string) error {
+	start := timeutil.Now()
+	return s.delete.record(start, s.ExternalStorage.Delete(ctx, basename))
+}
+
+func (s *metricsStorage) DeleteAll(ctx context.Context, prefix string) error {
+	start := timeutil.Now()
+	return s.delete.record(start, s.ExternalStorage.DeleteAll(ctx, prefix))
+}
+
+func (s *metricsStorage) Size(ctx context.Context, basename string) (int64, error) {
+	start := timeutil.Now()
+	size, err := s.ExternalStorage.Size(ctx, basename)
+	return size, s.size.record(start, err)
+}
+
+func (s *metricsStorage) Stat(ctx context.Context, basename string) (cloud.FileInfo, error) {
+	start := timeutil.Now()
+	info, err := s.ExternalStorage.Stat(ctx, basename)
+	return info, s.size.record(start, err)
+}
+
+func (s *metricsStorage) PresignedURL(
+	ctx context.Context, basename string, expiry time.Duration,
+) (string, error) {
+	return PresignedURL(ctx, s.ExternalStorage, basename, expiry)
+}
+
+func (s *metricsStorage) Sync(ctx context.Context) error {
+	return Sync(ctx, s.ExternalStorage)
+}
+
+func (s *metricsStorage) Validate(ctx context.Context) error {
+	return Validate(ctx, s.ExternalStorage)
+}
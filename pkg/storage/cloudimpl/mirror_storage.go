@@ -0,0 +1,230 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/errors"
+)
+
+// mirrorStorage wraps a primary ExternalStorage, which it embeds, and a
+// secondary one, writing every file to both.
+type mirrorStorage struct {
+	cloud.ExternalStorage
+	secondary cloud.ExternalStorage
+}
+
+var _ cloud.ExternalStorage = &mirrorStorage{}
+var _ cloud.Syncer = &mirrorStorage{}
+var _ cloud.Validator = &mirrorStorage{}
+var _ cloud.PageLister = &mirrorStorage{}
+var _ cloud.DelimitedLister = &mirrorStorage{}
+
+// MirrorStorage returns an ExternalStorage that writes each file to both
+// primary and secondary, streaming the content to them concurrently, and whose
+// reads fall back to secondary for the files that primary does not have. Files
+// are deleted from both. Listings, sizes and stats, as well as Conf, are those
+// of primary.
+//
+// The content of a write is only read once, so the writes to the destinations
+// cannot be retried after they have started to read it. If a destination fails,
+// the write to the other is aborted and the error names the destination that
+// failed; a destination that had already received all of the content may still
+// have written the file.
+func MirrorStorage(primary, secondary cloud.ExternalStorage) cloud.ExternalStorage {
+	return &mirrorStorage{ExternalStorage: primary, secondary: secondary}
+}
+
+// mirrorDestination is a storage that a mirrorStorage writes to, along with
+// the name it is referred to by in errors.
+type mirrorDestination struct {
+	name string
+	es   cloud.ExternalStorage
+}
+
+func (m *mirrorStorage) destinations() []mirrorDestination {
+	return []mirrorDestination{{"primary", m.ExternalStorage}, {"secondary", m.secondary}}
+}
+
+// errMirrorWriteAborted is the error that the writes of a mirrorStorage fail
+// with when another destination stopped reading the content, e.g. because it
+// failed.
+var errMirrorWriteAborted = errors.New("the write to another mirror destination was aborted")
+
+// mirrorContent is the content of a mirrored write as read by one of its
+// destinations. It can only seek to the position it is at, so that the
+// destination writes it once rather than retrying.
+type mirrorContent struct {
+	r   *io.PipeReader
+	pos int64
+}
+
+func (c *mirrorContent) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.pos += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker. Only the current position can be sought.
+func (c *mirrorContent) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && (whence == io.SeekCurrent || (whence == io.SeekStart && c.pos == 0)) {
+		return c.pos, nil
+	}
+	return 0, errors.New("mirrored content can only seek to its current position")
+}
+
+// write streams content to every destination with the given write function.
+func (m *mirrorStorage) write(
+	ctx context.Context,
+	basename string,
+	content io.ReadSeeker,
+	write func(ctx context.Context, es cloud.ExternalStorage, content io.ReadSeeker) error,
+) error {
+	dests := m.destinations()
+	errs := make([]error, len(dests))
+	pipes := make([]*io.PipeWriter, len(dests))
+	writers := make([]io.Writer, len(dests))
+	var wg sync.WaitGroup
+	for i := range dests {
+		pr, pw := io.Pipe()
+		pipes[i], writers[i] = pw, pw
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = write(ctx, dests[i].es, &mirrorContent{r: pr})
+			// A destination that returns without reading all of the content
+			// would otherwise block the copy to the others.
+			pr.CloseWithError(errMirrorWriteAborted)
+		}(i)
+	}
+	_, copyErr := io.Copy(io.MultiWriter(writers...), content)
+	for _, pw := range pipes {
+		// A nil error closes the pipes with io.EOF.
+		pw.CloseWithError(copyErr)
+	}
+	wg.Wait()
+
+	var err error
+	for i, d := range dests {
+		if errs[i] != nil && !errors.Is(errs[i], errMirrorWriteAborted) {
+			err = errors.CombineErrors(err,
+				errors.Wrapf(errs[i], "writing %s to %s storage", basename, d.name))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if copyErr != nil {
+		return errors.Wrapf(copyErr, "writing %s", basename)
+	}
+	return nil
+}
+
+func (m *mirrorStorage) WriteFile(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	return m.write(ctx, basename, content,
+		func(ctx context.Context, es cloud.ExternalStorage, content io.ReadSeeker) error {
+			return es.WriteFile(ctx, basename, content)
+		})
+}
+
+// WriteFileIfNotExists fails if the file exists in either destination, though
+// the destination where it does not exist may have written it.
+func (m *mirrorStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	return m.write(ctx, basename, content,
+		func(ctx context.Context, es cloud.ExternalStorage, content io.ReadSeeker) error {
+			return es.WriteFileIfNotExists(ctx, basename, content)
+		})
+}
+
+func (m *mirrorStorage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	r, _, err := m.ReadFileAt(ctx, basename, 0)
+	return r, err
+}
+
+// ReadFileAt reads the file from primary, or from secondary if primary does
+// not have it.
+func (m *mirrorStorage) ReadFileAt(
+	ctx context.Context, basename string, offset int64,
+) (io.ReadCloser, int64, error) {
+	r, size, err := m.ExternalStorage.ReadFileAt(ctx, basename, offset)
+	if errors.Is(err, ErrFileDoesNotExist) {
+		return m.secondary.ReadFileAt(ctx, basename, offset)
+	}
+	return r, size, err
+}
+
+// ListFilesPage lists the files of primary, like the other listings.
+func (m *mirrorStorage) ListFilesPage(
+	ctx context.Context, prefix, token string, limit int,
+) ([]string, string, error) {
+	return ListFilesPage(ctx, m.ExternalStorage, prefix, token, limit)
+}
+
+// ListFilesWithDelimiter lists the files of primary, like the other listings.
+func (m *mirrorStorage) ListFilesWithDelimiter(
+	ctx context.Context, prefix, delimiter string,
+) ([]string, []string, error) {
+	return ListFilesWithDelimiter(ctx, m.ExternalStorage, prefix, delimiter)
+}
+
+func (m *mirrorStorage) Delete(ctx context.Context, basename string) error {
+	var err error
+	for _, d := range m.destinations() {
+		if delErr := d.es.Delete(ctx, basename); delErr != nil {
+			err = errors.CombineErrors(err,
+				errors.Wrapf(delErr, "deleting %s from %s storage", basename, d.name))
+		}
+	}
+	return err
+}
+
+func (m *mirrorStorage) DeleteAll(ctx context.Context, prefix string) error {
+	var err error
+	for _, d := range m.destinations() {
+		if delErr := d.es.DeleteAll(ctx, prefix); delErr != nil {
+			err = errors.CombineErrors(err,
+				errors.Wrapf(delErr, "deleting %s* from %s storage", prefix, d.name))
+		}
+	}
+	return err
+}
+
+func (m *mirrorStorage) Sync(ctx context.Context) error {
+	var err error
+	for _, d := range m.destinations() {
+		if syncErr := Sync(ctx, d.es); syncErr != nil {
+			err = errors.CombineErrors(err, errors.Wrapf(syncErr, "syncing %s storage", d.name))
+		}
+	}
+	return err
+}
+
+func (m *mirrorStorage) Validate(ctx context.Context) error {
+	var err error
+	for _, d := range m.destinations() {
+		if valErr := Validate(ctx, d.es); valErr != nil {
+			err = errors.CombineErrors(err, errors.Wrapf(valErr, "validating %s storage", d.name))
+		}
+	}
+	return err
+}
+
+func (m *mirrorStorage) Close() error {
+	return errors.CombineErrors(m.ExternalStorage.Close(), m.secondary.Close())
+}
@@ -11,20 +11,25 @@
 package cloudimpl
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"net/url"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/blobs"
+	"github.com/cockroachdb/cockroach/pkg/blobs/blobspb"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
-	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/errors"
 	"github.com/cockroachdb/errors/oserror"
 	"google.golang.org/grpc/codes"
@@ -48,7 +53,12 @@ func parseNodelocalURL(_ ExternalStorageURIContext, uri *url.URL) (roachpb.Exter
 		return conf, errors.Errorf("host component of nodelocal URI must be a node ID: %s", uri.String())
 	}
 	conf.Provider = roachpb.ExternalStorageProvider_LocalFile
-	conf.LocalFile.Path = uri.Path
+	if conf.LocalFile.Path, err = normalizeURIPath(uri.Path); err != nil {
+		return conf, err
+	}
+	if uri.Path != "" {
+		conf.LocalFile.Path = "/" + conf.LocalFile.Path
+	}
 	conf.LocalFile.NodeID = roachpb.NodeID(nodeID)
 	return conf, nil
 }
@@ -59,9 +69,20 @@ type localFileStorage struct {
 	base       string                                // relative filepath prefixed with externalIODir, for I/O ops on this node.
 	blobClient blobs.BlobClient                      // inter-node file sharing service
 	settings   *cluster.Settings                     // cluster settings for the ExternalStorage
+	limiters   *rateLimiters                         // read and write rate limits of the ExternalStorage
+
+	mu struct {
+		syncutil.Mutex
+		// unsynced is the set of the paths written since the last Sync.
+		unsynced map[string]struct{}
+	}
 }
 
 var _ cloud.ExternalStorage = &localFileStorage{}
+var _ cloud.Syncer = &localFileStorage{}
+var _ cloud.Validator = &localFileStorage{}
+var _ cloud.PageLister = &localFileStorage{}
+var _ cloud.DelimitedLister = &localFileStorage{}
 
 // MakeLocalStorageURI converts a local path (should always be relative) to a
 // valid nodelocal URI.
@@ -89,7 +110,6 @@ func TestingMakeLocalStorage(
 func makeLocalStorage(
 	ctx context.Context, args ExternalStorageContext, dest roachpb.ExternalStorage,
 ) (cloud.ExternalStorage, error) {
-	telemetry.Count("external-io.nodelocal")
 	if args.BlobClientFactory == nil {
 		return nil, errors.New("nodelocal storage is not available")
 	}
@@ -101,8 +121,10 @@ func makeLocalStorage(
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create blob client")
 	}
-	return &localFileStorage{base: cfg.Path, cfg: cfg, ioConf: args.IOConf, blobClient: client,
-		settings: args.Settings}, nil
+	s := &localFileStorage{base: cfg.Path, cfg: cfg, ioConf: args.IOConf, blobClient: client,
+		settings: args.Settings, limiters: newRateLimiters(args.Settings)}
+	s.mu.unsynced = make(map[string]struct{})
+	return s, nil
 }
 
 func (l *localFileStorage) Conf() roachpb.ExternalStorage {
@@ -129,7 +151,91 @@ func joinRelativePath(filePath string, file string) string {
 func (l *localFileStorage) WriteFile(
 	ctx context.Context, basename string, content io.ReadSeeker,
 ) error {
-	return l.blobClient.WriteFile(ctx, joinRelativePath(l.base, basename), content)
+	filename := joinRelativePath(l.base, basename)
+	if err := l.blobClient.WriteFile(ctx, filename, l.limiters.limitContent(ctx, content)); err != nil {
+		return markLocalError(err)
+	}
+	l.setUnsynced(filename, true)
+	return nil
+}
+
+func (l *localFileStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	filename := joinRelativePath(l.base, basename)
+	err := l.blobClient.WriteFileIfNotExists(ctx, filename, l.limiters.limitContent(ctx, content))
+	if err == nil {
+		l.setUnsynced(filename, true)
+		return nil
+	}
+	// As in ReadFileAt, the error differs based on whether the store is local or
+	// remote.
+	if oserror.IsExist(err) || status.Code(err) == codes.AlreadyExists {
+		return errors.Wrapf(ErrFileAlreadyExists, "nodelocal storage file already exists: %s", err.Error())
+	}
+	return markLocalError(err)
+}
+
+// setUnsynced adds filename to, or removes it from, the files to flush on Sync.
+func (l *localFileStorage) setUnsynced(filename string, unsynced bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if unsynced {
+		l.mu.unsynced[filename] = struct{}{}
+	} else {
+		delete(l.mu.unsynced, filename)
+	}
+}
+
+// Sync implements the cloud.Syncer interface, flushing the files written since
+// the last Sync to disk on the node that has them. Files are written with fsync
+// unless cloudstorage.nodelocal.fsync.enabled is disabled, in which case Sync
+// is the only way to make them durable.
+func (l *localFileStorage) Sync(ctx context.Context) error {
+	l.mu.Lock()
+	files := make([]string, 0, len(l.mu.unsynced))
+	for f := range l.mu.unsynced {
+		files = append(files, f)
+	}
+	l.mu.Unlock()
+	if len(files) == 0 {
+		return nil
+	}
+	sort.Strings(files)
+	if err := l.blobClient.Sync(ctx, files); err != nil {
+		return errors.Wrap(markLocalError(err), "syncing nodelocal storage")
+	}
+	for _, f := range files {
+		l.setUnsynced(f, false)
+	}
+	return nil
+}
+
+// Validate implements the cloud.Validator interface, checking that files can be
+// written under the base path by writing and deleting an empty file there. The
+// base path is created if it does not exist, as it would be by the first write.
+func (l *localFileStorage) Validate(ctx context.Context) error {
+	filename := joinRelativePath(l.base, fmt.Sprintf(".validate-%d", timeutil.Now().UnixNano()))
+	if err := l.blobClient.WriteFile(ctx, filename, bytes.NewReader(nil)); err != nil {
+		return errors.Wrapf(markLocalError(err), "nodelocal path %s is not writable", l.cfg.Path)
+	}
+	return errors.Wrap(markLocalError(l.blobClient.Delete(ctx, filename)),
+		"deleting nodelocal validation file")
+}
+
+// markLocalError marks err with ErrFileDoesNotExist or ErrAccessDenied if it
+// means so. As in ReadFileAt, the error differs based on whether the store is
+// local or remote.
+func markLocalError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case oserror.IsNotExist(err) || status.Code(err) == codes.NotFound:
+		return errors.Mark(err, ErrFileDoesNotExist)
+	case oserror.IsPermission(err) || status.Code(err) == codes.PermissionDenied:
+		return errors.Mark(err, ErrAccessDenied)
+	}
+	return err
 }
 
 // ReadFile is shorthand for ReadFileAt with offset 0.
@@ -150,13 +256,28 @@ func (l *localFileStorage) ReadFileAt(
 		if oserror.IsNotExist(err) || status.Code(err) == codes.NotFound {
 			return nil, 0, errors.Wrapf(ErrFileDoesNotExist, "nodelocal storage file does not exist: %s", err.Error())
 		}
-		return nil, 0, err
+		return nil, 0, markLocalError(err)
 	}
-	return reader, size, nil
+	return l.limiters.limitReader(ctx, reader), size, nil
 }
 
 func (l *localFileStorage) ListFiles(ctx context.Context, patternSuffix string) ([]string, error) {
+	files, err := l.listFiles(ctx, patternSuffix, false /* stat */)
+	return fileEntryPaths(files), err
+}
 
+// ListFilesExt implements the ExternalStorage interface. The sizes and
+// modification times of the files are listed along with their names, in a
+// single request to the node that has them.
+func (l *localFileStorage) ListFilesExt(
+	ctx context.Context, patternSuffix string,
+) ([]cloud.FileEntry, error) {
+	return l.listFiles(ctx, patternSuffix, true /* stat */)
+}
+
+func (l *localFileStorage) listFiles(
+	ctx context.Context, patternSuffix string, stat bool,
+) ([]cloud.FileEntry, error) {
 	pattern := l.base
 	if patternSuffix != "" {
 		if containsGlob(l.base) {
@@ -165,39 +286,139 @@ func (l *localFileStorage) ListFiles(ctx context.Context, patternSuffix string)
 		pattern = joinRelativePath(pattern, patternSuffix)
 	}
 
-	var fileList []string
-	matches, err := l.blobClient.List(ctx, pattern)
+	var fileList []cloud.FileEntry
+	var matches []string
+	var stats []*blobspb.BlobStat
+	var err error
+	if stat {
+		matches, stats, err = l.blobClient.ListWithStats(ctx, pattern)
+	} else {
+		matches, err = l.blobClient.List(ctx, pattern)
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to match pattern provided")
+		return nil, errors.Wrap(markLocalError(err), "unable to match pattern provided")
 	}
 
-	for _, fileName := range matches {
+	for i, fileName := range matches {
+		var entry cloud.FileEntry
 		if patternSuffix != "" {
 			if !strings.HasPrefix(fileName, l.base) {
 				// TODO(dt): return a nice rel-path instead of erroring out.
 				return nil, errors.Errorf("pattern matched file outside of base path %q", l.base)
 			}
-			fileList = append(fileList, strings.TrimPrefix(strings.TrimPrefix(fileName, l.base), "/"))
+			entry.Path = strings.TrimPrefix(strings.TrimPrefix(fileName, l.base), "/")
 		} else {
-			fileList = append(fileList, makeNodeLocalURIWithNodeID(l.cfg.NodeID, fileName))
+			entry.Path = makeNodeLocalURIWithNodeID(l.cfg.NodeID, fileName)
+		}
+		if stat {
+			entry.Size = stats[i].Filesize
+			entry.ModTime = blobModTime(stats[i])
 		}
+		fileList = append(fileList, entry)
 	}
 
-	return fileList, nil
+	return sortFileEntries(fileList), nil
+}
+
+// ListFilesPage implements the cloud.PageLister interface. The files are listed
+// recursively from the base path each time, as the blob service has no
+// continuation tokens, and the page is cut from the sorted listing.
+func (l *localFileStorage) ListFilesPage(
+	ctx context.Context, prefix, token string, limit int,
+) ([]string, string, error) {
+	paths, err := l.listPrefix(ctx, prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	paths, nextToken := pageOfFiles(paths, token, limit)
+	return paths, nextToken, nil
+}
+
+// ListFilesWithDelimiter implements the cloud.DelimitedLister interface. Like
+// ListFilesPage, the files are listed recursively from the base path, and then
+// grouped by delimiter. Directories without files are not listed.
+func (l *localFileStorage) ListFilesWithDelimiter(
+	ctx context.Context, prefix, delimiter string,
+) ([]string, []string, error) {
+	paths, err := l.listPrefix(ctx, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, prefixes := groupByDelimiter(paths, prefix, delimiter)
+	return files, prefixes, nil
+}
+
+// listPrefix returns the sorted paths, relative to the base path, of all of the
+// files under it whose paths start with prefix.
+func (l *localFileStorage) listPrefix(ctx context.Context, prefix string) ([]string, error) {
+	files, err := l.listFiles(ctx, "**", false /* stat */)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Path, prefix) {
+			paths = append(paths, f.Path)
+		}
+	}
+	return paths, nil
 }
 
 func (l *localFileStorage) Delete(ctx context.Context, basename string) error {
-	return l.blobClient.Delete(ctx, joinRelativePath(l.base, basename))
+	filename := joinRelativePath(l.base, basename)
+	if err := l.blobClient.Delete(ctx, filename); err != nil {
+		return markLocalError(err)
+	}
+	l.setUnsynced(filename, false)
+	return nil
+}
+
+// DeleteAll implements the ExternalStorage interface. The files are listed
+// recursively from the base path and deleted one at a time; the directories
+// that contained them are left in place.
+func (l *localFileStorage) DeleteAll(ctx context.Context, prefix string) error {
+	files, err := l.listFiles(ctx, "**", false /* stat */)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Path, prefix) {
+			names = append(names, f.Path)
+		}
+	}
+	return deleteEach(ctx, names, l.Delete)
 }
 
 func (l *localFileStorage) Size(ctx context.Context, basename string) (int64, error) {
 	stat, err := l.blobClient.Stat(ctx, joinRelativePath(l.base, basename))
 	if err != nil {
-		return 0, err
+		return 0, markLocalError(err)
 	}
 	return stat.Filesize, nil
 }
 
+func (l *localFileStorage) Stat(ctx context.Context, basename string) (cloud.FileInfo, error) {
+	stat, err := l.blobClient.Stat(ctx, joinRelativePath(l.base, basename))
+	if err != nil {
+		// See ReadFileAt for why there are two kinds of not found errors.
+		if oserror.IsNotExist(err) || status.Code(err) == codes.NotFound {
+			return cloud.FileInfo{}, nil
+		}
+		return cloud.FileInfo{}, markLocalError(err)
+	}
+	return cloud.FileInfo{Exists: true, Size: stat.Filesize, ModTime: blobModTime(stat)}, nil
+}
+
+// blobModTime returns the modification time in stat, or the zero time if it is
+// unset, as it is by nodes that predate it.
+func blobModTime(stat *blobspb.BlobStat) time.Time {
+	if stat.ModTime == 0 {
+		return time.Time{}
+	}
+	return timeutil.Unix(0, stat.ModTime)
+}
+
 func (*localFileStorage) Close() error {
 	return nil
 }
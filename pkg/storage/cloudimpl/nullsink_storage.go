@@ -19,7 +19,6 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
-	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
 )
@@ -39,7 +38,6 @@ type nullSinkStorage struct {
 func makeNullSinkStorage(
 	_ context.Context, _ ExternalStorageContext, _ roachpb.ExternalStorage,
 ) (cloud.ExternalStorage, error) {
-	telemetry.Count("external-io.nullsink")
 	return &nullSinkStorage{}, nil
 }
 
@@ -75,16 +73,36 @@ func (n *nullSinkStorage) WriteFile(_ context.Context, _ string, content io.Read
 	return err
 }
 
+// WriteFileIfNotExists discards the content like WriteFile, as no file ever
+// exists in a null sink.
+func (n *nullSinkStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	return n.WriteFile(ctx, basename, content)
+}
+
 func (n *nullSinkStorage) ListFiles(_ context.Context, _ string) ([]string, error) {
 	return nil, nil
 }
 
+func (n *nullSinkStorage) ListFilesExt(_ context.Context, _ string) ([]cloud.FileEntry, error) {
+	return nil, nil
+}
+
 func (n *nullSinkStorage) Delete(_ context.Context, _ string) error {
 	return nil
 }
 
+func (n *nullSinkStorage) DeleteAll(_ context.Context, _ string) error {
+	return nil
+}
+
 func (n *nullSinkStorage) Size(_ context.Context, _ string) (int64, error) {
 	return 0, nil
 }
 
+func (n *nullSinkStorage) Stat(_ context.Context, _ string) (cloud.FileInfo, error) {
+	return cloud.FileInfo{Exists: true}, nil
+}
+
 var _ cloud.ExternalStorage = &nullSinkStorage{}
@@ -0,0 +1,141 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/errors"
+)
+
+// ParallelListOptions configures ListFilesParallel.
+type ParallelListOptions struct {
+	// Delimiter separates the prefixes that are listed concurrently from the
+	// rest of the names of their files. It defaults to "/".
+	Delimiter string
+	// Parallelism is the maximum number of prefixes listed concurrently. It
+	// defaults to 8.
+	Parallelism int
+	// PageSize is the number of files listed by each request. It defaults to
+	// 1000.
+	PageSize int
+}
+
+const (
+	defaultParallelListDelimiter   = "/"
+	defaultParallelListParallelism = 8
+	defaultParallelListPageSize    = 1000
+)
+
+// ListFilesParallel returns the files of es whose names, relative to its base
+// path, start with prefix, sorted and without duplicates, like ListFilesPage
+// does page by page. The prefixes that end with the first opts.Delimiter after
+// prefix are found with ListFilesWithDelimiter, and up to opts.Parallelism of
+// them are then listed concurrently with ListFilesPage, so that listing a
+// storage with many nested directories, such as a large backup, is not
+// limited by the latency of serial requests.
+//
+// The first error cancels the listings in flight and is returned. es must
+// implement both cloud.DelimitedLister and cloud.PageLister; otherwise the
+// error is marked with ErrListingUnsupported and ErrUnsupported.
+func ListFilesParallel(
+	ctx context.Context, es cloud.ExternalStorage, prefix string, opts ParallelListOptions,
+) ([]string, error) {
+	if opts.Delimiter == "" {
+		opts.Delimiter = defaultParallelListDelimiter
+	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = defaultParallelListParallelism
+	}
+	if opts.PageSize <= 0 {
+		opts.PageSize = defaultParallelListPageSize
+	}
+	files, prefixes, err := ListFilesWithDelimiter(ctx, es, prefix, opts.Delimiter)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([][]string, len(prefixes))
+	errs := make([]error, len(prefixes))
+	sem := make(chan struct{}, opts.Parallelism)
+	var wg sync.WaitGroup
+	for i := range prefixes {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i], errs[i] = listAllPages(ctx, es, prefixes[i], opts.PageSize)
+			if errs[i] != nil {
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		// The listings canceled by the first error fail with the context's
+		// error, which is not the one to report.
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return nil, errors.Wrapf(err, "listing files with prefix %s", prefixes[i])
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, r := range results {
+		files = append(files, r...)
+	}
+	return sortedUnique(files), nil
+}
+
+// listAllPages returns all the files of es that start with prefix, listing them
+// in pages of pageSize.
+func listAllPages(
+	ctx context.Context, es cloud.ExternalStorage, prefix string, pageSize int,
+) ([]string, error) {
+	var files []string
+	var token string
+	for {
+		page, next, err := ListFilesPage(ctx, es, prefix, token, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, page...)
+		if next == "" {
+			return files, nil
+		}
+		token = next
+	}
+}
+
+// sortedUnique sorts paths and removes the duplicates from them in place.
+func sortedUnique(paths []string) []string {
+	sort.Strings(paths)
+	out := paths[:0]
+	for _, p := range paths {
+		if len(out) == 0 || p != out[len(out)-1] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/errors"
+)
+
+// ParallelReadOptions configures the reader returned by NewParallelReader.
+type ParallelReadOptions struct {
+	// RangeSize is the size of the ranges the file is split into. It defaults
+	// to 8 MiB.
+	RangeSize int64
+	// Parallelism is the maximum number of ranges downloaded concurrently. It
+	// defaults to 4.
+	Parallelism int
+}
+
+const (
+	defaultParallelReadRangeSize   = 8 << 20
+	defaultParallelReadParallelism = 4
+)
+
+// parallelReader is an io.ReadCloser that downloads the ranges of a file
+// concurrently and returns them in order.
+type parallelReader struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	es     cloud.ExternalStorage
+	name   string
+	size   int64
+	opts   ParallelReadOptions
+
+	// next is the offset of the first range that is not being downloaded yet.
+	next int64
+	// pending holds the ranges being downloaded, in order, as channels that
+	// receive each range once it is downloaded.
+	pending []chan parallelRange
+	// cur is what is left to read of the range being read.
+	cur []byte
+	err error
+	wg  sync.WaitGroup
+}
+
+type parallelRange struct {
+	data []byte
+	err  error
+}
+
+var _ io.ReadCloser = &parallelReader{}
+
+// NewParallelReader returns a reader of basename in es that splits the file
+// into ranges of opts.RangeSize, downloads up to opts.Parallelism of them
+// concurrently with ReadFileAt, and returns them in order, so that reading a
+// large file is not limited by the bandwidth of a single request. The size of
+// the file is looked up when the reader is created, and the file is expected
+// not to change while it is read.
+//
+// Besides the range being read, at most opts.Parallelism ranges are buffered,
+// which bounds the memory the reader uses. Closing the reader cancels the
+// ranges that are still being downloaded.
+func NewParallelReader(
+	ctx context.Context, es cloud.ExternalStorage, basename string, opts ParallelReadOptions,
+) (io.ReadCloser, error) {
+	if opts.RangeSize <= 0 {
+		opts.RangeSize = defaultParallelReadRangeSize
+	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = defaultParallelReadParallelism
+	}
+	size, err := es.Size(ctx, basename)
+	if err != nil {
+		return nil, err
+	}
+	p := &parallelReader{es: es, name: basename, size: size, opts: opts}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	p.fill()
+	return p, nil
+}
+
+// fill starts downloading ranges until opts.Parallelism are being downloaded
+// or the whole file has been requested.
+func (p *parallelReader) fill() {
+	for len(p.pending) < p.opts.Parallelism && p.next < p.size {
+		length := p.opts.RangeSize
+		if remaining := p.size - p.next; length > remaining {
+			length = remaining
+		}
+		res := make(chan parallelRange, 1)
+		p.wg.Add(1)
+		go func(offset, length int64) {
+			defer p.wg.Done()
+			data, err := readRange(p.ctx, p.es, p.name, offset, length)
+			res <- parallelRange{data: data, err: err}
+		}(p.next, length)
+		p.pending = append(p.pending, res)
+		p.next += length
+	}
+}
+
+// readRange reads length bytes of basename in es, from offset.
+func readRange(
+	ctx context.Context, es cloud.ExternalStorage, basename string, offset, length int64,
+) ([]byte, error) {
+	r, _, err := es.ReadFileAt(ctx, basename, offset)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s at offset %d", basename, offset)
+	}
+	defer r.Close()
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, errors.Wrapf(err, "reading %d bytes of %s at offset %d", length, basename, offset)
+	}
+	return data, nil
+}
+
+// Read implements io.Reader.
+func (p *parallelReader) Read(b []byte) (int, error) {
+	for len(p.cur) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		if len(p.pending) == 0 {
+			return 0, io.EOF
+		}
+		var res parallelRange
+		select {
+		case res = <-p.pending[0]:
+		case <-p.ctx.Done():
+			res.err = p.ctx.Err()
+		}
+		p.pending = p.pending[1:]
+		if res.err != nil {
+			// The ranges after the failed one are useless.
+			p.err = res.err
+			p.cancel()
+			continue
+		}
+		p.cur = res.data
+		p.fill()
+	}
+	n := copy(b, p.cur)
+	p.cur = p.cur[n:]
+	return n, nil
+}
+
+// Close implements io.Closer, cancelling the ranges that are being downloaded
+// and waiting for their goroutines to exit.
+func (p *parallelReader) Close() error {
+	p.cancel()
+	p.wg.Wait()
+	if p.err == nil {
+		p.err = errors.New("read of closed parallel reader")
+	}
+	p.pending, p.cur = nil, nil
+	return nil
+}
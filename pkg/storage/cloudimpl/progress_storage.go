@@ -0,0 +1,234 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+)
+
+// ProgressFunc is called with the number of bytes of a file read or written so
+// far, and the size of the file, or -1 if it is unknown.
+type ProgressFunc func(bytesDone, bytesTotal int64)
+
+// progressReportBytes is the number of bytes transferred between the calls of a
+// ProgressFunc, so that small reads and writes do not each call it.
+const progressReportBytes = 256 << 10
+
+// progressStorage wraps an ExternalStorage, reporting the progress of the
+// files read from and written to it.
+type progressStorage struct {
+	cloud.ExternalStorage
+	fn ProgressFunc
+}
+
+var _ cloud.ExternalStorage = &progressStorage{}
+var _ cloud.Presigner = &progressStorage{}
+var _ cloud.Copier = &progressStorage{}
+var _ cloud.Syncer = &progressStorage{}
+var _ cloud.Validator = &progressStorage{}
+var _ cloud.PageLister = &progressStorage{}
+var _ cloud.DelimitedLister = &progressStorage{}
+
+// WithProgress returns an ExternalStorage that calls fn as the bytes of the
+// files read from or written to inner flow through, once every 256 KiB and once
+// the file is fully transferred. The total of a read is the size of the file
+// as returned by ReadFileAt, and that of a write the length of its content if
+// the content can seek to its end.
+//
+// fn is called for each file separately, and concurrently for files that are
+// transferred concurrently. The bytes done only increase, unless the reader or
+// the content of a write seeks, e.g. when a write is retried from its start.
+func WithProgress(inner cloud.ExternalStorage, fn ProgressFunc) cloud.ExternalStorage {
+	return &progressStorage{ExternalStorage: inner, fn: fn}
+}
+
+// ReadFile reads the file with ReadFileAt, which returns its size.
+func (p *progressStorage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	r, _, err := p.ReadFileAt(ctx, basename, 0)
+	return r, err
+}
+
+func (p *progressStorage) ReadFileAt(
+	ctx context.Context, basename string, offset int64,
+) (io.ReadCloser, int64, error) {
+	r, size, err := p.ExternalStorage.ReadFileAt(ctx, basename, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	total := size
+	if total < 0 {
+		total = -1
+	}
+	tracker := &progressTracker{fn: p.fn, done: offset, reported: offset, total: total}
+	reader := &progressReader{r: r, progressTracker: tracker}
+	if seeker, ok := r.(io.Seeker); ok {
+		return &progressReadSeeker{progressReader: reader, seeker: seeker}, size, nil
+	}
+	return reader, size, nil
+}
+
+func (p *progressStorage) WriteFile(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	return p.ExternalStorage.WriteFile(ctx, basename, newProgressContent(content, p.fn))
+}
+
+func (p *progressStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	return p.ExternalStorage.WriteFileIfNotExists(ctx, basename, newProgressContent(content, p.fn))
+}
+
+// CopyFrom reports the progress of a copy that is streamed through this node.
+// A copy within the provider is not reported, as its bytes do not flow through.
+func (p *progressStorage) CopyFrom(
+	ctx context.Context, src cloud.ExternalStorage, srcName, dstName string,
+) error {
+	if c, ok := p.ExternalStorage.(cloud.Copier); ok {
+		return c.CopyFrom(ctx, src, srcName, dstName)
+	}
+	return copyThrough(ctx, p, src, srcName, dstName)
+}
+
+func (p *progressStorage) PresignedURL(
+	ctx context.Context, basename string, expiry time.Duration,
+) (string, error) {
+	return PresignedURL(ctx, p.ExternalStorage, basename, expiry)
+}
+
+func (p *progressStorage) Sync(ctx context.Context) error {
+	return Sync(ctx, p.ExternalStorage)
+}
+
+func (p *progressStorage) Validate(ctx context.Context) error {
+	return Validate(ctx, p.ExternalStorage)
+}
+
+func (p *progressStorage) ListFilesPage(
+	ctx context.Context, prefix, token string, limit int,
+) ([]string, string, error) {
+	return ListFilesPage(ctx, p.ExternalStorage, prefix, token, limit)
+}
+
+func (p *progressStorage) ListFilesWithDelimiter(
+	ctx context.Context, prefix, delimiter string,
+) ([]string, []string, error) {
+	return ListFilesWithDelimiter(ctx, p.ExternalStorage, prefix, delimiter)
+}
+
+// progressTracker counts the bytes of a file transferred, calling fn once
+// progressReportBytes were transferred since it was last called.
+type progressTracker struct {
+	fn          ProgressFunc
+	done, total int64
+	// reported is the value of done when fn was last called.
+	reported int64
+}
+
+func (t *progressTracker) add(n int) {
+	t.done += int64(n)
+	if t.done-t.reported >= progressReportBytes {
+		t.report()
+	}
+}
+
+// report calls fn if bytes were transferred since it was last called.
+func (t *progressTracker) report() {
+	if t.done != t.reported {
+		t.reported = t.done
+		t.fn(t.done, t.total)
+	}
+}
+
+// seek moves the count of the bytes done to pos, without calling fn.
+func (t *progressTracker) seek(pos int64) {
+	t.done, t.reported = pos, pos
+}
+
+// progressReader is an io.ReadCloser that reports the progress of the reads
+// of r.
+type progressReader struct {
+	r io.ReadCloser
+	*progressTracker
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.add(n)
+	if err == io.EOF {
+		r.report()
+	}
+	return n, err
+}
+
+// Close reports the bytes that were read since the last report.
+func (r *progressReader) Close() error {
+	r.report()
+	return r.r.Close()
+}
+
+// progressReadSeeker is a progressReader of a reader that also implements
+// io.Seeker.
+type progressReadSeeker struct {
+	*progressReader
+	seeker io.Seeker
+}
+
+func (r *progressReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.seeker.Seek(offset, whence)
+	if err == nil {
+		r.seek(pos)
+	}
+	return pos, err
+}
+
+// progressContent is the content of a write that reports the progress of its
+// reads.
+type progressContent struct {
+	content io.ReadSeeker
+	*progressTracker
+}
+
+// newProgressContent returns content, reporting its progress to fn. Its total
+// is the length of the content if it can seek to its end.
+func newProgressContent(content io.ReadSeeker, fn ProgressFunc) *progressContent {
+	tracker := &progressTracker{fn: fn, total: -1}
+	if pos, err := content.Seek(0, io.SeekCurrent); err == nil {
+		tracker.seek(pos)
+		if end, err := content.Seek(0, io.SeekEnd); err == nil {
+			if _, err := content.Seek(pos, io.SeekStart); err == nil {
+				tracker.total = end
+			}
+		}
+	}
+	return &progressContent{content: content, progressTracker: tracker}
+}
+
+func (c *progressContent) Read(p []byte) (int, error) {
+	n, err := c.content.Read(p)
+	c.add(n)
+	if err == io.EOF {
+		c.report()
+	}
+	return n, err
+}
+
+func (c *progressContent) Seek(offset int64, whence int) (int64, error) {
+	pos, err := c.content.Seek(offset, whence)
+	if err == nil {
+		c.seek(pos)
+	}
+	return pos, err
+}
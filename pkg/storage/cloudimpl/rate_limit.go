@@ -0,0 +1,216 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"context"
+	"io"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/quotapool"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+var (
+	readRateLimit = settings.RegisterByteSizeSetting(
+		CloudstorageReadBytesPerSecSetting,
+		"the maximum number of bytes per second read by each external storage, or 0 for no limit",
+		0,
+		settings.NonNegativeInt,
+	)
+	writeRateLimit = settings.RegisterByteSizeSetting(
+		CloudstorageWriteBytesPerSecSetting,
+		"the maximum number of bytes per second written by each external storage, or 0 for no limit",
+		0,
+		settings.NonNegativeInt,
+	)
+)
+
+// rateLimiters holds the read and write rate limiters of an ExternalStorage.
+// The limiters are shared by all the operations of the storage, so that their
+// aggregate throughput stays under the configured limits. A nil *rateLimiters
+// does not limit anything.
+type rateLimiters struct {
+	settings    *cluster.Settings
+	read, write settingRateLimiter
+}
+
+// newRateLimiters returns the rateLimiters for a storage using the limits in
+// settings, which may be nil for no limits.
+func newRateLimiters(settings *cluster.Settings) *rateLimiters {
+	if settings == nil {
+		return nil
+	}
+	return &rateLimiters{
+		settings: settings,
+		read:     settingRateLimiter{name: "cloudstorage-read", setting: readRateLimit},
+		write:    settingRateLimiter{name: "cloudstorage-write", setting: writeRateLimit},
+	}
+}
+
+// limitReader returns r, whose reads are limited by the read limit. If r is
+// also an io.Seeker, so is the returned reader.
+func (l *rateLimiters) limitReader(ctx context.Context, r io.ReadCloser) io.ReadCloser {
+	if l == nil {
+		return r
+	}
+	limiter := l.read.get(&l.settings.SV)
+	if limiter == nil {
+		return r
+	}
+	limited := RateLimitReader(ctx, r, limiter)
+	if seeker, ok := r.(io.Seeker); ok {
+		return struct {
+			io.Reader
+			io.Seeker
+			io.Closer
+		}{limited, seeker, r}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{limited, r}
+}
+
+// limitContent returns the content of a write, whose reads are limited by the
+// write limit.
+func (l *rateLimiters) limitContent(ctx context.Context, content io.ReadSeeker) io.ReadSeeker {
+	if l == nil {
+		return content
+	}
+	limiter := l.write.get(&l.settings.SV)
+	if limiter == nil {
+		return content
+	}
+	return struct {
+		io.Reader
+		io.Seeker
+	}{RateLimitReader(ctx, content, limiter), content}
+}
+
+// limitWriter returns w, whose writes are limited by the write limit.
+func (l *rateLimiters) limitWriter(ctx context.Context, w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	limiter := l.write.get(&l.settings.SV)
+	if limiter == nil {
+		return w
+	}
+	return RateLimitWriter(ctx, w, limiter)
+}
+
+// settingRateLimiter is a rate limiter whose rate is the value of a setting.
+// The limiter is created when the setting is first non-zero, and its rate is
+// updated whenever it is used after the setting changes.
+type settingRateLimiter struct {
+	name    string
+	setting *settings.ByteSizeSetting
+
+	mu struct {
+		syncutil.Mutex
+		rate    int64
+		limiter *quotapool.RateLimiter
+	}
+}
+
+// get returns the limiter for the current value of the setting, or nil if the
+// setting does not limit the rate.
+func (l *settingRateLimiter) get(sv *settings.Values) *quotapool.RateLimiter {
+	rate := l.setting.Get(sv)
+	if rate <= 0 {
+		return nil
+	}
+	// The burst is one second's worth of bytes, but no less than a chunk.
+	burst := rate
+	if burst < maxRateLimitedChunk {
+		burst = maxRateLimitedChunk
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.mu.limiter == nil {
+		l.mu.limiter = quotapool.NewRateLimiter(l.name, quotapool.Limit(rate), burst)
+	} else if l.mu.rate != rate {
+		l.mu.limiter.UpdateLimit(quotapool.Limit(rate), burst)
+	}
+	l.mu.rate = rate
+	return l.mu.limiter
+}
+
+// maxRateLimitedChunk bounds the size of the individual reads and writes of
+// rate limited readers and writers, so that a large buffer is transferred in
+// steps rather than in a burst followed by a long wait. A limiter only waits
+// for a request larger than its burst until the bucket is full, so the burst
+// of limiters should be at least this large for the rate to be accurate.
+const maxRateLimitedChunk = 64 << 10
+
+// RateLimitReader returns a reader whose reads from r are limited to the rate
+// of limiter, whose burst should be at least 64 KiB. Reads wait for the quota
+// of the bytes they returned, so that readers sharing a limiter are limited in
+// aggregate. A read fails with the error of ctx if it is done while waiting.
+func RateLimitReader(ctx context.Context, r io.Reader, limiter *quotapool.RateLimiter) io.Reader {
+	return &rateLimitedReader{ctx: ctx, r: r, limiter: limiter}
+}
+
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *quotapool.RateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxRateLimitedChunk {
+		p = p[:maxRateLimitedChunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, int64(n)); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// RateLimitWriter returns a writer whose writes to w are limited to the rate
+// of limiter, whose burst should be at least 64 KiB. Writes wait for the quota
+// of their bytes before writing them, so that writers sharing a limiter are
+// limited in aggregate. A write fails with the error of ctx if it is done while
+// waiting.
+func RateLimitWriter(ctx context.Context, w io.Writer, limiter *quotapool.RateLimiter) io.Writer {
+	return &rateLimitedWriter{ctx: ctx, w: w, limiter: limiter}
+}
+
+type rateLimitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *quotapool.RateLimiter
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxRateLimitedChunk {
+			chunk = chunk[:maxRateLimitedChunk]
+		}
+		if err := w.limiter.WaitN(w.ctx, int64(len(chunk))); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+)
+
+var readAheadBufferSize = settings.RegisterByteSizeSetting(
+	CloudstorageReadAheadBufferSizeSetting,
+	"the size of the buffer that files read from cloud storage are read ahead into, so "+
+		"that small sequential reads do not each wait on the network, or 0 to disable read-ahead",
+	1<<20,
+	settings.NonNegativeInt,
+)
+
+// readAheadReader reads ahead of its caller into a buffer.
+type readAheadReader struct {
+	*bufio.Reader
+	r io.ReadCloser
+}
+
+var _ io.ReadCloser = &readAheadReader{}
+
+// NewReadAheadReader returns a reader that reads r ahead of its caller, into a
+// buffer of the given size, so that r is read in large reads however small the
+// reads of the caller are. Reads that are at least as large as the buffer are
+// passed through to r. Closing the returned reader closes r.
+func NewReadAheadReader(r io.ReadCloser, size int) io.ReadCloser {
+	return &readAheadReader{Reader: bufio.NewReaderSize(r, size), r: r}
+}
+
+// Close implements io.Closer.
+func (r *readAheadReader) Close() error {
+	return r.r.Close()
+}
+
+// readAhead returns r, read ahead into a buffer of the size configured in
+// settings, which may be nil for no read-ahead. Readers that can seek are
+// returned unchanged, as a seek would be offset by the buffered bytes.
+func readAhead(settings *cluster.Settings, r io.ReadCloser) io.ReadCloser {
+	if settings == nil {
+		return r
+	}
+	if _, ok := r.(io.Seeker); ok {
+		return r
+	}
+	size := readAheadBufferSize.Get(&settings.SV)
+	if size <= 0 {
+		return r
+	}
+	return NewReadAheadReader(r, int(size))
+}
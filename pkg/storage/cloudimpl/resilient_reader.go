@@ -0,0 +1,134 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"context"
+	"io"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/errors"
+)
+
+// resilientReader reads a file of an ExternalStorage, reopening it where the
+// previous stream broke when a read fails with a transient error.
+type resilientReader struct {
+	ctx  context.Context
+	es   cloud.ExternalStorage
+	name string
+	// retrier paces the reopens of the file, of which there are at most
+	// maxRetries over the whole read.
+	retrier    retry.Retry
+	retries    int
+	maxRetries int
+	// reader, if not nil, is the open stream of the file from pos.
+	reader io.ReadCloser
+	// pos is the offset of the next byte of the file to be read.
+	pos int64
+}
+
+var _ io.ReadCloser = &resilientReader{}
+
+// NewResilientReader opens basename of es at offset, as es.ReadFileAt does, and
+// returns a reader of it that survives the stream breaking partway, such as
+// when the connection is reset. When a read fails with an error that is likely
+// to be transient, the file is reopened with ReadFileAt at the offset of the
+// bytes read so far and the read continues from there, so the caller sees the
+// whole file. The file is reopened at most opts.MaxRetries times over the whole
+// read, with exponential backoff, after which the error is returned.
+func NewResilientReader(
+	ctx context.Context, es cloud.ExternalStorage, basename string, offset int64, opts RetryOptions,
+) (io.ReadCloser, int64, error) {
+	reader, size, err := es.ReadFileAt(ctx, basename, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	r := &resilientReader{
+		ctx:  ctx,
+		es:   es,
+		name: basename,
+		retrier: retry.StartWithCtx(ctx, retry.Options{
+			InitialBackoff: opts.InitialBackoff,
+			MaxBackoff:     opts.MaxBackoff,
+			Multiplier:     2,
+		}),
+		maxRetries: opts.MaxRetries,
+		reader:     reader,
+		pos:        offset,
+	}
+	// The first call to Next does not wait, and accounts for the first open.
+	r.retrier.Next()
+	return r, size, nil
+}
+
+// Read implements io.Reader.
+func (r *resilientReader) Read(p []byte) (int, error) {
+	for {
+		if r.reader == nil {
+			reader, _, err := r.es.ReadFileAt(r.ctx, r.name, r.pos)
+			if err != nil {
+				if err := r.retry(err); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			r.reader = reader
+		}
+		n, err := r.reader.Read(p)
+		r.pos += int64(n)
+		if err == nil || err == io.EOF || !isRetryableStorageError(err) {
+			return n, err
+		}
+		// Drop the broken stream, so the file is reopened at pos.
+		_ = r.reader.Close()
+		r.reader = nil
+		if retryErr := r.retry(err); retryErr != nil {
+			return n, retryErr
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// retry waits until the file can be reopened after it failed to be read with
+// err, or returns the error to fail the read with if err is not transient or
+// the file was reopened too many times.
+func (r *resilientReader) retry(err error) error {
+	if !isRetryableStorageError(err) {
+		return err
+	}
+	if r.retries >= r.maxRetries {
+		if r.retries == 0 {
+			return err
+		}
+		return errors.Wrapf(err, "reading %s failed after %d retries", r.name, r.retries)
+	}
+	r.retries++
+	log.Warningf(r.ctx, "reading %s failed at offset %d, reopening it (retry %d): %v",
+		r.name, r.pos, r.retries, err)
+	if !r.retrier.Next() {
+		return errors.CombineErrors(r.ctx.Err(), err)
+	}
+	return nil
+}
+
+// Close implements io.Closer.
+func (r *resilientReader) Close() error {
+	if r.reader == nil {
+		return nil
+	}
+	err := r.reader.Close()
+	r.reader = nil
+	return err
+}
@@ -0,0 +1,301 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/errors"
+	"google.golang.org/api/googleapi"
+)
+
+// RetryOptions configures the retry policy of an ExternalStorage returned by
+// WithRetry.
+type RetryOptions struct {
+	// MaxRetries is the maximum number of times an operation is retried after
+	// its first attempt fails. Zero disables retries.
+	MaxRetries int
+	// InitialBackoff is how long to wait before the first retry. The wait
+	// doubles after every subsequent retry.
+	InitialBackoff time.Duration
+	// MaxBackoff is the upper bound on the wait between retries.
+	MaxBackoff time.Duration
+}
+
+// retryingStorage wraps an ExternalStorage, retrying operations that fail with
+// a retryable error.
+type retryingStorage struct {
+	cloud.ExternalStorage
+	opts RetryOptions
+}
+
+var _ cloud.ExternalStorage = &retryingStorage{}
+var _ cloud.Presigner = &retryingStorage{}
+var _ cloud.Syncer = &retryingStorage{}
+var _ cloud.Copier = &retryingStorage{}
+var _ cloud.Validator = &retryingStorage{}
+var _ cloud.PageLister = &retryingStorage{}
+var _ cloud.DelimitedLister = &retryingStorage{}
+
+// WithRetry returns an ExternalStorage that retries the operations of inner
+// with exponential backoff when they fail with an error that is likely to be
+// transient, such as a network error, a 5xx response or a rate limit. Retries stop once the
+// ctx passed to the operation is done.
+//
+// Storage whose errors are deterministic, such as workload storage, is returned
+// unwrapped as retrying it can never succeed.
+func WithRetry(inner cloud.ExternalStorage, opts RetryOptions) cloud.ExternalStorage {
+	if _, ok := inner.(*workloadStorage); ok {
+		return inner
+	}
+	return &retryingStorage{ExternalStorage: inner, opts: opts}
+}
+
+func (r *retryingStorage) retry(ctx context.Context, op string, fn func() error) error {
+	if r.opts.MaxRetries <= 0 {
+		return fn()
+	}
+	opts := retry.Options{
+		InitialBackoff: r.opts.InitialBackoff,
+		MaxBackoff:     r.opts.MaxBackoff,
+		Multiplier:     2,
+		MaxRetries:     r.opts.MaxRetries,
+	}
+	var err error
+	for attempt, retrier := 0, retry.StartWithCtx(ctx, opts); retrier.Next(); attempt++ {
+		err = fn()
+		if err == nil || !isRetryableStorageError(err) {
+			return err
+		}
+		log.Warningf(ctx, "external storage %s failed (attempt %d): %v", op, attempt, err)
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return errors.CombineErrors(ctxErr, err)
+	}
+	return err
+}
+
+func (r *retryingStorage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	err := r.retry(ctx, "read", func() error {
+		var err error
+		reader, err = r.ExternalStorage.ReadFile(ctx, basename)
+		return err
+	})
+	return reader, err
+}
+
+func (r *retryingStorage) ReadFileAt(
+	ctx context.Context, basename string, offset int64,
+) (io.ReadCloser, int64, error) {
+	var reader io.ReadCloser
+	var size int64
+	err := r.retry(ctx, "read", func() error {
+		var err error
+		reader, size, err = r.ExternalStorage.ReadFileAt(ctx, basename, offset)
+		return err
+	})
+	return reader, size, err
+}
+
+func (r *retryingStorage) WriteFile(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	var prevErr error
+	return r.retry(ctx, "write", func() error {
+		// A failed attempt may have consumed some of the content.
+		if err := rewindContent(content, prevErr); err != nil {
+			return err
+		}
+		prevErr = r.ExternalStorage.WriteFile(ctx, basename, content)
+		return prevErr
+	})
+}
+
+// WriteFileIfNotExists retries the conditional write. An attempt that failed
+// may still have written the file, in which case the retry finds it to exist
+// because of this very write; as that cannot be told apart from the file having
+// been written by another, the error of the failed attempt is returned rather
+// than ErrFileAlreadyExists.
+func (r *retryingStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	var prevErr, ambiguousErr error
+	err := r.retry(ctx, "write", func() error {
+		if err := rewindContent(content, prevErr); err != nil {
+			return err
+		}
+		err := r.ExternalStorage.WriteFileIfNotExists(ctx, basename, content)
+		if prevErr != nil && errors.Is(err, ErrFileAlreadyExists) {
+			ambiguousErr = errors.WithSecondaryError(errors.Wrapf(prevErr,
+				"write of %s failed, but may have succeeded as the file now exists", basename), err)
+			return nil
+		}
+		prevErr = err
+		return err
+	})
+	if ambiguousErr != nil {
+		return ambiguousErr
+	}
+	return err
+}
+
+// CopyFrom retries the whole copy with the wrapped storage, which reopens the
+// source if the file is streamed through.
+func (r *retryingStorage) CopyFrom(
+	ctx context.Context, src cloud.ExternalStorage, srcName, dstName string,
+) error {
+	return r.retry(ctx, "copy", func() error {
+		return CopyFrom(ctx, r.ExternalStorage, src, srcName, dstName)
+	})
+}
+
+func (r *retryingStorage) ListFiles(ctx context.Context, patternSuffix string) ([]string, error) {
+	var files []string
+	err := r.retry(ctx, "list", func() error {
+		var err error
+		files, err = r.ExternalStorage.ListFiles(ctx, patternSuffix)
+		return err
+	})
+	return files, err
+}
+
+func (r *retryingStorage) ListFilesExt(
+	ctx context.Context, patternSuffix string,
+) ([]cloud.FileEntry, error) {
+	var files []cloud.FileEntry
+	err := r.retry(ctx, "list", func() error {
+		var err error
+		files, err = r.ExternalStorage.ListFilesExt(ctx, patternSuffix)
+		return err
+	})
+	return files, err
+}
+
+func (r *retryingStorage) ListFilesPage(
+	ctx context.Context, prefix, token string, limit int,
+) ([]string, string, error) {
+	var paths []string
+	var nextToken string
+	err := r.retry(ctx, "list page", func() error {
+		var err error
+		paths, nextToken, err = ListFilesPage(ctx, r.ExternalStorage, prefix, token, limit)
+		return err
+	})
+	return paths, nextToken, err
+}
+
+func (r *retryingStorage) ListFilesWithDelimiter(
+	ctx context.Context, prefix, delimiter string,
+) ([]string, []string, error) {
+	var files, prefixes []string
+	err := r.retry(ctx, "list with delimiter", func() error {
+		var err error
+		files, prefixes, err = ListFilesWithDelimiter(ctx, r.ExternalStorage, prefix, delimiter)
+		return err
+	})
+	return files, prefixes, err
+}
+
+func (r *retryingStorage) Delete(ctx context.Context, basename string) error {
+	return r.retry(ctx, "delete", func() error {
+		return r.ExternalStorage.Delete(ctx, basename)
+	})
+}
+
+// DeleteAll retries the whole DeleteAll of the wrapped storage, which only
+// finds the files that are left to delete.
+func (r *retryingStorage) DeleteAll(ctx context.Context, prefix string) error {
+	return r.retry(ctx, "delete", func() error {
+		return r.ExternalStorage.DeleteAll(ctx, prefix)
+	})
+}
+
+func (r *retryingStorage) Size(ctx context.Context, basename string) (int64, error) {
+	var size int64
+	err := r.retry(ctx, "size", func() error {
+		var err error
+		size, err = r.ExternalStorage.Size(ctx, basename)
+		return err
+	})
+	return size, err
+}
+
+func (r *retryingStorage) Stat(ctx context.Context, basename string) (cloud.FileInfo, error) {
+	var info cloud.FileInfo
+	err := r.retry(ctx, "stat", func() error {
+		var err error
+		info, err = r.ExternalStorage.Stat(ctx, basename)
+		return err
+	})
+	return info, err
+}
+
+func (r *retryingStorage) Sync(ctx context.Context) error {
+	return r.retry(ctx, "sync", func() error {
+		return Sync(ctx, r.ExternalStorage)
+	})
+}
+
+func (r *retryingStorage) Validate(ctx context.Context) error {
+	return r.retry(ctx, "validate", func() error {
+		return Validate(ctx, r.ExternalStorage)
+	})
+}
+
+// PresignedURL presigns with the wrapped storage. Presigning is done locally
+// by the backends, so it is not retried.
+func (r *retryingStorage) PresignedURL(
+	ctx context.Context, basename string, expiry time.Duration,
+) (string, error) {
+	return PresignedURL(ctx, r.ExternalStorage, basename, expiry)
+}
+
+// isRetryableStorageError returns true if err is likely to be transient, in
+// which case the operation that returned it may succeed if retried.
+func isRetryableStorageError(err error) bool {
+	if errors.IsAny(err, context.Canceled, context.DeadlineExceeded, ErrFileDoesNotExist) {
+		return false
+	}
+	if errors.HasType(err, (*retryableHTTPError)(nil)) || isResumableHTTPError(err) {
+		return true
+	}
+	// A request rejected as too frequent succeeds once retried after backing
+	// off.
+	if isRateLimitedError(err) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var s3err s3.RequestFailure
+	if errors.As(err, &s3err) {
+		return s3err.StatusCode() >= 500
+	}
+	var gcsErr *googleapi.Error
+	if errors.As(err, &gcsErr) {
+		return gcsErr.Code >= 500
+	}
+	var azerr azblob.StorageError
+	if errors.As(err, &azerr) {
+		return azerr.Response() != nil && azerr.Response().StatusCode >= 500
+	}
+	return false
+}
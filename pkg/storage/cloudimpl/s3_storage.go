@@ -12,11 +12,16 @@ package cloudimpl
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -25,7 +30,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
-	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
+	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
 	"github.com/cockroachdb/cockroach/pkg/util/contextutil"
@@ -40,9 +45,17 @@ type s3Storage struct {
 	prefix   string
 	opts     session.Options
 	settings *cluster.Settings
+	limiters *rateLimiters
+	// fallbacks are the storages of the fallback regions of conf, which reads
+	// fail over to.
+	fallbacks []*s3Storage
 }
 
 var _ cloud.ExternalStorage = &s3Storage{}
+var _ cloud.Presigner = &s3Storage{}
+var _ cloud.Copier = &s3Storage{}
+var _ cloud.Validator = &s3Storage{}
+var _ cloud.PageLister = &s3Storage{}
 
 type serverSideEncMode string
 
@@ -67,6 +80,31 @@ func S3URI(bucket, path string, conf *roachpb.ExternalStorage_S3) string {
 	setIf(AuthParam, conf.Auth)
 	setIf(AWSServerSideEncryptionMode, conf.ServerEncMode)
 	setIf(AWSServerSideEncryptionKMSID, conf.ServerKMSID)
+	if conf.RequesterPays {
+		q.Set(AWSRequesterPaysParam, "true")
+	}
+	setIf(AWSStorageClassParam, conf.StorageClass)
+	setIf(AWSObjectACLParam, conf.ObjectACL)
+	setIf(ContentTypeParam, conf.ContentType)
+	if conf.UsePathStyle {
+		q.Set(AWSUsePathStyleParam, "true")
+	}
+	if conf.UseDualStack {
+		q.Set(AWSUseDualStackParam, "true")
+	}
+	if conf.UseImplicitAuth {
+		q.Set(AWSUseImplicitAuthParam, "true")
+	}
+	if len(conf.Fallbacks) > 0 {
+		fallbacks := make([]string, len(conf.Fallbacks))
+		for i, f := range conf.Fallbacks {
+			fallbacks[i] = f.Region
+			if f.Bucket != "" {
+				fallbacks[i] += ":" + f.Bucket
+			}
+		}
+		q.Set(S3FallbackRegionsParam, strings.Join(fallbacks, ","))
+	}
 
 	s3URL := url.URL{
 		Scheme:   "s3",
@@ -78,6 +116,26 @@ func S3URI(bucket, path string, conf *roachpb.ExternalStorage_S3) string {
 	return s3URL.String()
 }
 
+var (
+	s3MultipartPartSize = settings.RegisterByteSizeSetting(
+		"cloudstorage.s3.multipart_part_size",
+		"the size of the parts of S3 multipart uploads; smaller files are uploaded in a single request",
+		s3manager.DefaultUploadPartSize,
+		func(v int64) error {
+			if v < s3manager.MinUploadPartSize {
+				return errors.Errorf("must be at least %d bytes", s3manager.MinUploadPartSize)
+			}
+			return nil
+		},
+	)
+	s3MultipartConcurrency = settings.RegisterIntSetting(
+		"cloudstorage.s3.multipart_concurrency",
+		"the number of parts of an S3 multipart upload that are uploaded concurrently",
+		s3manager.DefaultUploadConcurrency,
+		settings.PositiveInt,
+	)
+)
+
 func parseS3URL(_ ExternalStorageURIContext, uri *url.URL) (roachpb.ExternalStorage, error) {
 	conf := roachpb.ExternalStorage{}
 	conf.Provider = roachpb.ExternalStorageProvider_S3
@@ -92,9 +150,59 @@ func parseS3URL(_ ExternalStorageURIContext, uri *url.URL) (roachpb.ExternalStor
 		Auth:          uri.Query().Get(AuthParam),
 		ServerEncMode: uri.Query().Get(AWSServerSideEncryptionMode),
 		ServerKMSID:   uri.Query().Get(AWSServerSideEncryptionKMSID),
+		StorageClass:  uri.Query().Get(AWSStorageClassParam),
+		ObjectACL:     uri.Query().Get(AWSObjectACLParam),
+		ContentType:   uri.Query().Get(ContentTypeParam),
 		/* NB: additions here should also update s3QueryParams() serializer */
 	}
-	conf.S3Config.Prefix = strings.TrimLeft(conf.S3Config.Prefix, "/")
+	if requesterPays := uri.Query().Get(AWSRequesterPaysParam); requesterPays != "" {
+		var err error
+		conf.S3Config.RequesterPays, err = strconv.ParseBool(requesterPays)
+		if err != nil {
+			return conf, errors.Wrapf(err, "invalid value for %s", AWSRequesterPaysParam)
+		}
+	}
+	if usePathStyle := uri.Query().Get(AWSUsePathStyleParam); usePathStyle != "" {
+		var err error
+		conf.S3Config.UsePathStyle, err = strconv.ParseBool(usePathStyle)
+		if err != nil {
+			return conf, errors.Wrapf(err, "invalid value for %s", AWSUsePathStyleParam)
+		}
+	}
+	if useDualStack := uri.Query().Get(AWSUseDualStackParam); useDualStack != "" {
+		var err error
+		conf.S3Config.UseDualStack, err = strconv.ParseBool(useDualStack)
+		if err != nil {
+			return conf, errors.Wrapf(err, "invalid value for %s", AWSUseDualStackParam)
+		}
+	}
+	if err := validateContentType(conf.S3Config.ContentType); err != nil {
+		return conf, err
+	}
+	if useImplicitAuth := uri.Query().Get(AWSUseImplicitAuthParam); useImplicitAuth != "" {
+		var err error
+		conf.S3Config.UseImplicitAuth, err = strconv.ParseBool(useImplicitAuth)
+		if err != nil {
+			return conf, errors.Wrapf(err, "invalid value for %s", AWSUseImplicitAuthParam)
+		}
+	}
+	if fallbacks := uri.Query().Get(S3FallbackRegionsParam); fallbacks != "" {
+		for _, fallback := range strings.Split(fallbacks, ",") {
+			f := roachpb.ExternalStorage_S3_Fallback{Region: fallback}
+			if i := strings.IndexByte(fallback, ':'); i >= 0 {
+				f.Region, f.Bucket = fallback[:i], fallback[i+1:]
+			}
+			if f.Region == "" {
+				return conf, errors.Errorf("invalid value %q for %s: regions must not be empty",
+					fallbacks, S3FallbackRegionsParam)
+			}
+			conf.S3Config.Fallbacks = append(conf.S3Config.Fallbacks, f)
+		}
+	}
+	var err error
+	if conf.S3Config.Prefix, err = normalizeURIPath(conf.S3Config.Prefix); err != nil {
+		return conf, err
+	}
 	// AWS secrets often contain + characters, which must be escaped when
 	// included in a query string; otherwise, they represent a space character.
 	// More than a few users have been bitten by this.
@@ -110,34 +218,39 @@ func parseS3URL(_ ExternalStorageURIContext, uri *url.URL) (roachpb.ExternalStor
 func MakeS3Storage(
 	ctx context.Context, args ExternalStorageContext, dest roachpb.ExternalStorage,
 ) (cloud.ExternalStorage, error) {
-	telemetry.Count("external-io.s3")
 	conf := dest.S3Config
 	if conf == nil {
 		return nil, errors.Errorf("s3 upload requested but info missing")
 	}
-	config := conf.Keys()
+	httpClient := makeProviderHTTPClient(args.Settings)
 	if conf.Endpoint != "" {
+		// MakeS3Storage can be called directly, bypassing the checks of
+		// MakeExternalStorage.
 		if args.IOConf.DisableHTTP {
-			return nil, errors.New(
-				"custom endpoints disallowed for s3 due to --external-io-disable-http flag")
+			return nil, errExternalIODisabled("custom s3 endpoints", "external-io-disable-http")
 		}
-		config.Endpoint = &conf.Endpoint
 		if conf.Region == "" {
 			conf.Region = "default-region"
 		}
-		client, err := makeHTTPClient(args.Settings)
+		var err error
+		httpClient, err = makeHTTPClient(ctx, args.Settings)
 		if err != nil {
 			return nil, err
 		}
-		config.HTTPClient = client
 	}
 
 	// "specified": use credentials provided in URI params; error if not present.
 	// "implicit": enable SharedConfig, which loads in credentials from environment.
 	//             Detailed in https://docs.aws.amazon.com/sdk-for-go/api/aws/session/
-	// "": default to `specified`.
+	// "": default to `specified`, or to `implicit` if AWS_USE_IMPLICIT_AUTH is
+	//     set and the URI params have no credentials, so that credentials in the
+	//     URI always take precedence over those of the environment.
 	opts := session.Options{}
-	switch conf.Auth {
+	auth := conf.Auth
+	if auth == "" && conf.UseImplicitAuth && conf.AccessKey == "" && conf.Secret == "" {
+		auth = AuthParamImplicit
+	}
+	switch auth {
 	case "", AuthParamSpecified:
 		if conf.AccessKey == "" {
 			return nil, errors.Errorf(
@@ -155,7 +268,7 @@ func MakeS3Storage(
 				AWSSecretParam,
 			)
 		}
-		opts.Config.MergeIn(config)
+		opts.Config.MergeIn(conf.Keys())
 	case AuthParamImplicit:
 		if args.IOConf.DisableImplicitCredentials {
 			return nil, errors.New(
@@ -169,20 +282,35 @@ func MakeS3Storage(
 	// TODO(yevgeniy): Revisit retry logic.  Retrying 10 times seems arbitrary.
 	maxRetries := 10
 	opts.Config.MaxRetries = &maxRetries
+	opts.Config.HTTPClient = httpClient
 
+	// The endpoint is set for either kind of credentials. Stores at custom
+	// endpoints, such as MinIO, often cannot resolve the bucket in the host name
+	// of virtual-hosted-style requests, so they are always addressed
+	// path-style.
 	if conf.Endpoint != "" {
+		opts.Config.Endpoint = aws.String(conf.Endpoint)
+	}
+	if conf.UsePathStyle || conf.Endpoint != "" {
 		opts.Config.S3ForcePathStyle = aws.Bool(true)
 	}
+	if conf.UseDualStack {
+		opts.Config.UseDualStack = aws.Bool(true)
+	}
 	if log.V(2) {
 		opts.Config.LogLevel = aws.LogLevel(aws.LogDebugWithRequestRetries | aws.LogDebugWithRequestErrors)
 		opts.Config.CredentialsChainVerboseErrors = aws.Bool(true)
 	}
 
 	// Ensure that a KMS ID is specified if server side encryption is set to use
-	// KMS.
+	// KMS, and only then.
 	if conf.ServerEncMode != "" {
 		switch conf.ServerEncMode {
 		case string(aes256Enc):
+			if conf.ServerKMSID != "" {
+				return nil, errors.Newf("AWS_SERVER_KMS_ID param cannot be set when using %s"+
+					" server side encryption mode; it requires aws:kms mode.", conf.ServerEncMode)
+			}
 		case string(kmsEnc):
 			if conf.ServerKMSID == "" {
 				return nil, errors.New("AWS_SERVER_KMS_ID param must be set" +
@@ -194,18 +322,94 @@ func MakeS3Storage(
 		}
 	}
 
-	return &s3Storage{
+	if conf.StorageClass != "" && !isS3StorageClass(conf.StorageClass) {
+		return nil, errors.Newf("unsupported value %s for %s. Supported values are %s.",
+			conf.StorageClass, AWSStorageClassParam, strings.Join(s3StorageClasses(), ", "))
+	}
+	if conf.ObjectACL != "" && !isS3ObjectACL(conf.ObjectACL) {
+		return nil, errors.Newf("unsupported value %s for %s. Supported values are %s.",
+			conf.ObjectACL, AWSObjectACLParam, strings.Join(s3.ObjectCannedACL_Values(), ", "))
+	}
+
+	s := &s3Storage{
 		bucket:   aws.String(conf.Bucket),
 		conf:     conf,
 		ioConf:   args.IOConf,
 		prefix:   conf.Prefix,
 		opts:     opts,
 		settings: args.Settings,
-	}, nil
+		limiters: newRateLimiters(args.Settings),
+	}
+	// The storage of a fallback region has a client of its own, for the region,
+	// and the same credentials and prefix.
+	for _, f := range conf.Fallbacks {
+		fallbackConf := *conf
+		fallbackConf.Region = f.Region
+		if f.Bucket != "" {
+			fallbackConf.Bucket = f.Bucket
+		}
+		fallbackConf.Fallbacks = nil
+		fallback := *s
+		fallback.bucket = aws.String(fallbackConf.Bucket)
+		fallback.conf = &fallbackConf
+		s.fallbacks = append(s.fallbacks, &fallback)
+	}
+	return s, nil
+}
+
+// withFallbacks calls read with s and then, while it fails with an error that
+// means the object may be read from another region, with the storage of each
+// fallback region in order. It returns the error of the last call.
+func (s *s3Storage) withFallbacks(
+	ctx context.Context, basename string, read func(s *s3Storage) error,
+) error {
+	err := read(s)
+	from := s
+	for _, fallback := range s.fallbacks {
+		if err == nil || !isS3FailoverError(err) {
+			return err
+		}
+		log.Warningf(ctx, "reading s3 object %s from bucket %s failed, failing over to bucket %s "+
+			"in region %s: %v", path.Join(s.prefix, basename), aws.StringValue(from.bucket),
+			aws.StringValue(fallback.bucket), fallback.conf.Region, err)
+		err = read(fallback)
+		from = fallback
+	}
+	return err
+}
+
+// isS3FailoverError returns true if err means that a read may succeed in
+// another region: the object is missing, the bucket is in another region than
+// the client's, or the region failed to serve the request.
+func isS3FailoverError(err error) bool {
+	if errors.Is(err, ErrFileDoesNotExist) {
+		return true
+	}
+	if reqErr := (awserr.RequestFailure)(nil); errors.As(err, &reqErr) {
+		switch reqErr.Code() {
+		case "PermanentRedirect", "AuthorizationHeaderMalformed", "BucketRegionError":
+			return true
+		}
+		return reqErr.StatusCode() == http.StatusMovedPermanently ||
+			reqErr.StatusCode() >= http.StatusInternalServerError
+	}
+	return false
 }
 
 func (s *s3Storage) newS3Client(ctx context.Context) (*s3.S3, error) {
 	sess, err := session.NewSessionWithOptions(s.opts)
+	if awsErr := (awserr.Error)(nil); errors.As(err, &awsErr) &&
+		awsErr.Code() == session.ErrCodeLoadCustomCABundle {
+		// The SDK loads a custom CA bundle, from AWS_CA_BUNDLE or the shared
+		// config, into the transport of the client, which it can only do for an
+		// *http.Transport, so the storage gets a transport of its own.
+		client, clientErr := makeUnsharedHTTPClient(s.opts.Config.HTTPClient)
+		if clientErr != nil {
+			return nil, clientErr
+		}
+		s.opts.Config.HTTPClient = client
+		sess, err = session.NewSessionWithOptions(s.opts)
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "new aws session")
 	}
@@ -222,6 +426,48 @@ func (s *s3Storage) newS3Client(ctx context.Context) (*s3.S3, error) {
 	return s3.New(sess), nil
 }
 
+// s3StorageClasses returns the storage classes that objects can be written
+// with. GLACIER_IR is newer than the version of the SDK.
+func s3StorageClasses() []string {
+	return append(s3.StorageClass_Values(), "GLACIER_IR")
+}
+
+func isS3StorageClass(storageClass string) bool {
+	for _, c := range s3StorageClasses() {
+		if c == storageClass {
+			return true
+		}
+	}
+	return false
+}
+
+func isS3ObjectACL(acl string) bool {
+	for _, a := range s3.ObjectCannedACL_Values() {
+		if a == acl {
+			return true
+		}
+	}
+	return false
+}
+
+// objectACL returns the value of the ACL field of write requests, which is
+// nil to leave the ACL of objects to the bucket.
+func (s *s3Storage) objectACL() *string {
+	if s.conf.ObjectACL == "" {
+		return nil
+	}
+	return aws.String(s.conf.ObjectACL)
+}
+
+// requestPayer returns the value of the RequestPayer field of read requests,
+// which must be set to read from requester-pays buckets.
+func (s *s3Storage) requestPayer() *string {
+	if s.conf.RequesterPays {
+		return aws.String(s3.RequestPayerRequester)
+	}
+	return nil
+}
+
 func (s *s3Storage) Conf() roachpb.ExternalStorage {
 	return roachpb.ExternalStorage{
 		Provider: roachpb.ExternalStorageProvider_S3,
@@ -245,31 +491,155 @@ func (s *s3Storage) WriteFile(ctx context.Context, basename string, content io.R
 	err = contextutil.RunWithTimeout(ctx, "put s3 object",
 		timeoutSetting.Get(&s.settings.SV),
 		func(ctx context.Context) error {
-			putObjectInput := s3.PutObjectInput{
-				Bucket: s.bucket,
-				Key:    aws.String(path.Join(s.prefix, basename)),
-				Body:   content,
+			// The uploader reads the parts of content that is an io.ReaderAt at
+			// their offsets from its start, so it must be at its start. Other
+			// content is copied into a buffer per part. Either way, the SDK
+			// rewinds the part of a request that it retries.
+			var body io.Reader = s.limiters.limitContent(ctx, content)
+			if _, err := content.Seek(0, io.SeekStart); err != nil {
+				// The uploader fails to measure content that is an io.Seeker but
+				// cannot seek, so it is only passed as a reader.
+				body = struct{ io.Reader }{body}
+			} else if _, err := aws.SeekerLen(content); err != nil {
+				// Likewise for content that can only seek to its start, such as
+				// compressed content.
+				body = struct{ io.Reader }{body}
 			}
-
-			// If a server side encryption mode is provided in the URI, we must set
-			// the header values to enable SSE before writing the file to the s3
-			// bucket.
-			if s.conf.ServerEncMode != "" {
-				switch s.conf.ServerEncMode {
-				case string(aes256Enc):
-					putObjectInput.SetServerSideEncryption(s.conf.ServerEncMode)
-				case string(kmsEnc):
-					putObjectInput.SetServerSideEncryption(s.conf.ServerEncMode)
-					putObjectInput.SetSSEKMSKeyId(s.conf.ServerKMSID)
-				default:
-					return errors.Newf("unsupported server encryption mode %s. "+
-						"Supported values are `aws:kms` and `AES256`.", s.conf.ServerEncMode)
-				}
+			input := s3manager.UploadInput{
+				Bucket:      s.bucket,
+				Key:         aws.String(path.Join(s.prefix, basename)),
+				Body:        body,
+				ACL:         s.objectACL(),
+				ContentType: aws.String(contentTypeOrDefault(s.conf.ContentType)),
+			}
+			if s.conf.StorageClass != "" {
+				input.StorageClass = aws.String(s.conf.StorageClass)
+			}
+			var err error
+			input.ServerSideEncryption, input.SSEKMSKeyId, err = s.serverSideEncryption()
+			if err != nil {
+				return err
 			}
-			_, err := client.PutObjectWithContext(ctx, &putObjectInput)
+			// Content smaller than a part is written with a single PutObject, while
+			// larger content is uploaded in parts, concurrently.
+			uploader := s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+				u.PartSize = s3MultipartPartSize.Get(&s.settings.SV)
+				u.Concurrency = int(s3MultipartConcurrency.Get(&s.settings.SV))
+				// Abort the multipart upload if any part fails, so that the parts
+				// already uploaded are not left behind to be charged for.
+				u.LeavePartsOnError = false
+			})
+			_, err = uploader.UploadWithContext(ctx, &input)
+			return err
+		})
+	return errors.Wrap(markS3Error(err), "failed to put s3 object")
+}
+
+// serverSideEncryption returns the server side encryption mode and KMS key ID
+// headers to write objects with, which must be set to enable SSE if a mode is
+// provided in the URI. A KMS ID without a mode implies the aws:kms mode.
+func (s *s3Storage) serverSideEncryption() (encMode *string, kmsID *string, _ error) {
+	mode := s.conf.ServerEncMode
+	if mode == "" && s.conf.ServerKMSID != "" {
+		mode = string(kmsEnc)
+	}
+	switch mode {
+	case "":
+		return nil, nil, nil
+	case string(aes256Enc):
+		return aws.String(mode), nil, nil
+	case string(kmsEnc):
+		return aws.String(mode), aws.String(s.conf.ServerKMSID), nil
+	default:
+		return nil, nil, errors.Newf("unsupported server encryption mode %s. "+
+			"Supported values are `aws:kms` and `AES256`.", mode)
+	}
+}
+
+// s3MaxCopyObjectSize is the size of the largest object that can be copied
+// with a single CopyObject.
+const s3MaxCopyObjectSize = 5 << 30
+
+// CopyFrom implements the cloud.Copier interface. An object of S3 storage at
+// the same endpoint is copied with CopyObject if it is readable with the same
+// credentials, unless it is too large for a single CopyObject, in which case
+// it is streamed through like the files of other storage.
+func (s *s3Storage) CopyFrom(
+	ctx context.Context, src cloud.ExternalStorage, srcName, dstName string,
+) error {
+	srcConf := src.Conf()
+	if !s.canCopyFrom(srcConf) {
+		return copyThrough(ctx, s, src, srcName, dstName)
+	}
+	srcKey := path.Join(srcConf.S3Config.Prefix, srcName)
+	info, err := src.Stat(ctx, srcName)
+	if err != nil {
+		return err
+	}
+	if !info.Exists {
+		return errors.Wrapf(ErrFileDoesNotExist, "s3 object does not exist: %s", srcKey)
+	}
+	if info.Size > s3MaxCopyObjectSize {
+		return copyThrough(ctx, s, src, srcName, dstName)
+	}
+
+	client, err := s.newS3Client(ctx)
+	if err != nil {
+		return err
+	}
+	input := &s3.CopyObjectInput{
+		Bucket: s.bucket,
+		Key:    aws.String(path.Join(s.prefix, dstName)),
+		// The copy source is the URL-encoded bucket and key.
+		CopySource: aws.String((&url.URL{Path: path.Join(srcConf.S3Config.Bucket, srcKey)}).EscapedPath()),
+		// A copy does not keep the ACL of its source.
+		ACL: s.objectACL(),
+	}
+	if srcConf.S3Config.RequesterPays {
+		input.RequestPayer = aws.String(s3.RequestPayerRequester)
+	}
+	if s.conf.StorageClass != "" {
+		input.StorageClass = aws.String(s.conf.StorageClass)
+	}
+	if input.ServerSideEncryption, input.SSEKMSKeyId, err = s.serverSideEncryption(); err != nil {
+		return err
+	}
+	err = contextutil.RunWithTimeout(ctx, "copy s3 object",
+		timeoutSetting.Get(&s.settings.SV),
+		func(ctx context.Context) error {
+			_, err := client.CopyObjectWithContext(ctx, input)
 			return err
 		})
-	return errors.Wrap(err, "failed to put s3 object")
+	return errors.Wrap(markS3Error(err), "failed to copy s3 object")
+}
+
+// canCopyFrom returns true if the objects of the storage with the given
+// configuration can be copied with CopyObject by this storage, which requires
+// them to be at the same endpoint and readable with the same credentials.
+func (s *s3Storage) canCopyFrom(src roachpb.ExternalStorage) bool {
+	c := src.S3Config
+	return src.Provider == roachpb.ExternalStorageProvider_S3 && c != nil &&
+		c.Endpoint == s.conf.Endpoint && c.Auth == s.conf.Auth &&
+		c.AccessKey == s.conf.AccessKey && c.Secret == s.conf.Secret &&
+		c.TempToken == s.conf.TempToken
+}
+
+// WriteFileIfNotExists implements the ExternalStorage interface. S3 does not
+// support conditional puts, so the existence of the object is checked before it
+// is written; an object created by a concurrent writer in between is
+// overwritten.
+func (s *s3Storage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	info, err := s.Stat(ctx, basename)
+	if err != nil {
+		return err
+	}
+	if info.Exists {
+		return errors.Wrapf(ErrFileAlreadyExists, "s3 object %s already exists",
+			path.Join(s.prefix, basename))
+	}
+	return s.WriteFile(ctx, basename, content)
 }
 
 func (s *s3Storage) openStreamAt(
@@ -279,7 +649,11 @@ func (s *s3Storage) openStreamAt(
 	if err != nil {
 		return nil, err
 	}
-	req := &s3.GetObjectInput{Bucket: s.bucket, Key: aws.String(path.Join(s.prefix, basename))}
+	req := &s3.GetObjectInput{
+		Bucket:       s.bucket,
+		Key:          aws.String(path.Join(s.prefix, basename)),
+		RequestPayer: s.requestPayer(),
+	}
 	if pos != 0 {
 		req.Range = aws.String(fmt.Sprintf("bytes=%d-", pos))
 	}
@@ -293,20 +667,50 @@ func (s *s3Storage) openStreamAt(
 				return nil, errors.Wrapf(ErrFileDoesNotExist, "s3 object does not exist: %s", err.Error())
 			}
 		}
-		return nil, errors.Wrap(err, "failed to get s3 object")
+		return nil, errors.Wrap(markS3Error(err), "failed to get s3 object")
 	}
 	return out, nil
 }
 
+// markS3Error marks err with ErrFileDoesNotExist or ErrAccessDenied if it is a
+// failed request whose status code means so, and counts it in telemetry.
+func markS3Error(err error) error {
+	if reqErr := (awserr.RequestFailure)(nil); errors.As(err, &reqErr) {
+		err = markStatusError(err, reqErr.StatusCode())
+	}
+	return countStorageError(roachpb.ExternalStorageProvider_S3, err)
+}
+
 // ReadFile is shorthand for ReadFileAt with offset 0.
 func (s *s3Storage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
 	reader, _, err := s.ReadFileAt(ctx, basename, 0)
 	return reader, err
 }
 
-// ReadFileAt opens a reader at the requested offset.
+// ReadFileAt opens a reader at the requested offset, in the first of the region
+// of the bucket and the fallback regions that can serve it. A reader that is
+// cut short resumes in the region it was opened in.
 func (s *s3Storage) ReadFileAt(
 	ctx context.Context, basename string, offset int64,
+) (io.ReadCloser, int64, error) {
+	var reader io.ReadCloser
+	var size int64
+	err := s.withFallbacks(ctx, basename, func(s *s3Storage) error {
+		var err error
+		reader, size, err = openWithStorageTimeout(ctx, s.settings, "get s3 object",
+			func(ctx context.Context) (io.ReadCloser, int64, error) {
+				return s.readFileAt(ctx, basename, offset)
+			})
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.limiters.limitReader(ctx, readAhead(s.settings, reader)), size, nil
+}
+
+func (s *s3Storage) readFileAt(
+	ctx context.Context, basename string, offset int64,
 ) (io.ReadCloser, int64, error) {
 	stream, err := s.openStreamAt(ctx, basename, offset)
 	if err != nil {
@@ -343,7 +747,14 @@ func (s *s3Storage) ReadFileAt(
 }
 
 func (s *s3Storage) ListFiles(ctx context.Context, patternSuffix string) ([]string, error) {
-	var fileList []string
+	files, err := s.ListFilesExt(ctx, patternSuffix)
+	return fileEntryPaths(files), err
+}
+
+func (s *s3Storage) ListFilesExt(
+	ctx context.Context, patternSuffix string,
+) ([]cloud.FileEntry, error) {
+	var fileList []cloud.FileEntry
 
 	pattern := s.prefix
 	if patternSuffix != "" {
@@ -358,44 +769,89 @@ func (s *s3Storage) ListFiles(ctx context.Context, patternSuffix string) ([]stri
 	}
 
 	var matchErr error
-	err = client.ListObjectsPagesWithContext(
-		ctx,
-		&s3.ListObjectsInput{
-			Bucket: s.bucket,
-			Prefix: aws.String(getPrefixBeforeWildcard(s.prefix)),
-		},
-		func(page *s3.ListObjectsOutput, lastPage bool) bool {
-			for _, fileObject := range page.Contents {
-				matches, err := path.Match(pattern, *fileObject.Key)
-				if err != nil {
-					matchErr = err
-					return false
-				}
-				if matches {
-					if patternSuffix != "" {
-						if !strings.HasPrefix(*fileObject.Key, s.prefix) {
-							// TODO(dt): return a nice rel-path instead of erroring out.
-							matchErr = errors.New("pattern matched file outside of path")
-							return false
+	err = runWithStorageTimeout(ctx, s.settings, "list s3 objects", func(ctx context.Context) error {
+		return client.ListObjectsPagesWithContext(
+			ctx,
+			&s3.ListObjectsInput{
+				Bucket:       s.bucket,
+				Prefix:       aws.String(getPrefixBeforeWildcard(s.prefix)),
+				RequestPayer: s.requestPayer(),
+			},
+			func(page *s3.ListObjectsOutput, lastPage bool) bool {
+				for _, fileObject := range page.Contents {
+					matches, err := path.Match(pattern, *fileObject.Key)
+					if err != nil {
+						matchErr = err
+						return false
+					}
+					if matches {
+						entry := cloud.FileEntry{
+							Size:    aws.Int64Value(fileObject.Size),
+							ModTime: aws.TimeValue(fileObject.LastModified),
 						}
-						fileList = append(fileList, strings.TrimPrefix(strings.TrimPrefix(*fileObject.Key, s.prefix), "/"))
-					} else {
-
-						fileList = append(fileList, S3URI(*s.bucket, *fileObject.Key, s.conf))
+						if patternSuffix != "" {
+							if !strings.HasPrefix(*fileObject.Key, s.prefix) {
+								// TODO(dt): return a nice rel-path instead of erroring out.
+								matchErr = errors.New("pattern matched file outside of path")
+								return false
+							}
+							entry.Path = strings.TrimPrefix(strings.TrimPrefix(*fileObject.Key, s.prefix), "/")
+						} else {
+							entry.Path = S3URI(*s.bucket, *fileObject.Key, s.conf)
+						}
+						fileList = append(fileList, entry)
 					}
 				}
-			}
-			return !lastPage
-		},
-	)
+				return !lastPage
+			},
+		)
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, `failed to list s3 bucket`)
+		return nil, errors.Wrap(markS3Error(err), `failed to list s3 bucket`)
 	}
 	if matchErr != nil {
 		return nil, errors.Wrap(matchErr, `failed to list s3 bucket`)
 	}
 
-	return fileList, nil
+	return sortFileEntries(fileList), nil
+}
+
+// ListFilesPage implements the cloud.PageLister interface with the
+// continuation tokens of ListObjectsV2, which lists keys in lexicographic
+// order.
+func (s *s3Storage) ListFilesPage(
+	ctx context.Context, prefix, token string, limit int,
+) ([]string, string, error) {
+	client, err := s.newS3Client(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket:       s.bucket,
+		Prefix:       aws.String(joinKeyPrefix(s.prefix, prefix)),
+		MaxKeys:      aws.Int64(int64(limit)),
+		RequestPayer: s.requestPayer(),
+	}
+	if token != "" {
+		input.ContinuationToken = aws.String(token)
+	}
+	var out *s3.ListObjectsV2Output
+	err = runWithStorageTimeout(ctx, s.settings, "list s3 objects", func(ctx context.Context) error {
+		var err error
+		out, err = client.ListObjectsV2WithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, "", errors.Wrap(markS3Error(err), "failed to list s3 bucket")
+	}
+	paths := make([]string, len(out.Contents))
+	for i, object := range out.Contents {
+		paths[i] = strings.TrimPrefix(strings.TrimPrefix(aws.StringValue(object.Key), s.prefix), "/")
+	}
+	if !aws.BoolValue(out.IsTruncated) {
+		return paths, "", nil
+	}
+	return paths, aws.StringValue(out.NextContinuationToken), nil
 }
 
 func (s *s3Storage) Delete(ctx context.Context, basename string) error {
@@ -403,7 +859,7 @@ func (s *s3Storage) Delete(ctx context.Context, basename string) error {
 	if err != nil {
 		return err
 	}
-	return contextutil.RunWithTimeout(ctx, "delete s3 object",
+	return markS3Error(contextutil.RunWithTimeout(ctx, "delete s3 object",
 		timeoutSetting.Get(&s.settings.SV),
 		func(ctx context.Context) error {
 			_, err := client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
@@ -411,10 +867,116 @@ func (s *s3Storage) Delete(ctx context.Context, basename string) error {
 				Key:    aws.String(path.Join(s.prefix, basename)),
 			})
 			return err
-		})
+		}))
+}
+
+// s3MaxPresignExpiry is the longest expiry of a URL signed with SigV4.
+const s3MaxPresignExpiry = 7 * 24 * time.Hour
+
+// PresignedURL implements the cloud.Presigner interface, signing a GET of the
+// object with the credentials of the storage.
+func (s *s3Storage) PresignedURL(
+	ctx context.Context, basename string, expiry time.Duration,
+) (string, error) {
+	if expiry > s3MaxPresignExpiry {
+		return "", errors.Newf("s3 presigned URLs cannot expire after more than %s", s3MaxPresignExpiry)
+	}
+	client, err := s.newS3Client(ctx)
+	if err != nil {
+		return "", err
+	}
+	req, _ := client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket:       s.bucket,
+		Key:          aws.String(path.Join(s.prefix, basename)),
+		RequestPayer: s.requestPayer(),
+	})
+	req.SetContext(ctx)
+	u, err := req.Presign(expiry)
+	return u, errors.Wrap(err, "failed to presign s3 object URL")
+}
+
+// s3MaxDeleteObjects is the maximum number of keys of a DeleteObjects request.
+const s3MaxDeleteObjects = 1000
+
+// DeleteAll implements the ExternalStorage interface. The objects are deleted
+// with DeleteObjects requests, a page of the listing at a time.
+func (s *s3Storage) DeleteAll(ctx context.Context, prefix string) error {
+	client, err := s.newS3Client(ctx)
+	if err != nil {
+		return err
+	}
+	var keys []*string
+	err = runWithStorageTimeout(ctx, s.settings, "list s3 objects", func(ctx context.Context) error {
+		return client.ListObjectsPagesWithContext(ctx,
+			&s3.ListObjectsInput{
+				Bucket:       s.bucket,
+				Prefix:       aws.String(joinKeyPrefix(s.prefix, prefix)),
+				RequestPayer: s.requestPayer(),
+			},
+			func(page *s3.ListObjectsOutput, lastPage bool) bool {
+				for _, object := range page.Contents {
+					keys = append(keys, object.Key)
+				}
+				return !lastPage
+			})
+	})
+	if err != nil {
+		return errors.Wrap(markS3Error(err), "failed to list s3 bucket")
+	}
+
+	var failed int
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > s3MaxDeleteObjects {
+			batch = batch[:s3MaxDeleteObjects]
+		}
+		keys = keys[len(batch):]
+		objects := make([]*s3.ObjectIdentifier, len(batch))
+		for i := range batch {
+			objects[i] = &s3.ObjectIdentifier{Key: batch[i]}
+		}
+		var out *s3.DeleteObjectsOutput
+		if delErr := contextutil.RunWithTimeout(ctx, "delete s3 objects",
+			timeoutSetting.Get(&s.settings.SV),
+			func(ctx context.Context) error {
+				var err error
+				out, err = client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+					Bucket: s.bucket,
+					// Only the keys that failed to be deleted are returned.
+					Delete:       &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+					RequestPayer: s.requestPayer(),
+				})
+				return err
+			}); delErr != nil {
+			failed += len(batch)
+			err = errors.CombineErrors(err, errors.Wrap(delErr, "failed to delete s3 objects"))
+			continue
+		}
+		for _, objErr := range out.Errors {
+			failed++
+			err = errors.CombineErrors(err, errors.Newf("deleting %s: %s: %s",
+				aws.StringValue(objErr.Key), aws.StringValue(objErr.Code), aws.StringValue(objErr.Message)))
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete %d s3 objects", failed)
+	}
+	return nil
 }
 
+// Size implements the ExternalStorage interface, failing over to the fallback
+// regions like ReadFileAt.
 func (s *s3Storage) Size(ctx context.Context, basename string) (int64, error) {
+	var size int64
+	err := s.withFallbacks(ctx, basename, func(s *s3Storage) error {
+		var err error
+		size, err = s.size(ctx, basename)
+		return err
+	})
+	return size, err
+}
+
+func (s *s3Storage) size(ctx context.Context, basename string) (int64, error) {
 	client, err := s.newS3Client(ctx)
 	if err != nil {
 		return 0, err
@@ -425,17 +987,108 @@ func (s *s3Storage) Size(ctx context.Context, basename string) (int64, error) {
 		func(ctx context.Context) error {
 			var err error
 			out, err = client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
-				Bucket: s.bucket,
-				Key:    aws.String(path.Join(s.prefix, basename)),
+				Bucket:       s.bucket,
+				Key:          aws.String(path.Join(s.prefix, basename)),
+				RequestPayer: s.requestPayer(),
 			})
 			return err
 		})
 	if err != nil {
-		return 0, errors.Wrap(err, "failed to get s3 object headers")
+		return 0, errors.Wrap(markS3Error(err), "failed to get s3 object headers")
 	}
 	return *out.ContentLength, nil
 }
 
+// Stat implements the ExternalStorage interface, looking a missing object up in
+// the fallback regions.
+func (s *s3Storage) Stat(ctx context.Context, basename string) (cloud.FileInfo, error) {
+	var info cloud.FileInfo
+	err := s.withFallbacks(ctx, basename, func(s *s3Storage) error {
+		var err error
+		if info, err = s.stat(ctx, basename); err == nil && !info.Exists {
+			return errors.Wrapf(ErrFileDoesNotExist, "s3 object does not exist: %s", basename)
+		}
+		return err
+	})
+	if errors.Is(err, ErrFileDoesNotExist) {
+		return cloud.FileInfo{}, nil
+	}
+	return info, err
+}
+
+func (s *s3Storage) stat(ctx context.Context, basename string) (cloud.FileInfo, error) {
+	client, err := s.newS3Client(ctx)
+	if err != nil {
+		return cloud.FileInfo{}, err
+	}
+	var out *s3.HeadObjectOutput
+	err = contextutil.RunWithTimeout(ctx, "get s3 object header",
+		timeoutSetting.Get(&s.settings.SV),
+		func(ctx context.Context) error {
+			var err error
+			out, err = client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+				Bucket:       s.bucket,
+				Key:          aws.String(path.Join(s.prefix, basename)),
+				RequestPayer: s.requestPayer(),
+			})
+			return err
+		})
+	if err != nil {
+		// HEAD responses have no body, so a missing object is only identified by
+		// its status code.
+		if reqErr := (awserr.RequestFailure)(nil); errors.As(err, &reqErr) &&
+			reqErr.StatusCode() == http.StatusNotFound {
+			return cloud.FileInfo{}, nil
+		}
+		return cloud.FileInfo{}, errors.Wrap(markS3Error(err), "failed to get s3 object headers")
+	}
+	return cloud.FileInfo{
+		Exists:     true,
+		Size:       aws.Int64Value(out.ContentLength),
+		ModTime:    aws.TimeValue(out.LastModified),
+		ContentMD5: s3ETagMD5(out),
+	}, nil
+}
+
+// s3ETagMD5 returns the MD5 digest of the content of an object, which is its
+// ETag, or nil if the ETag is not a digest of the content. That is the case of
+// the objects uploaded in multiple parts, whose ETag ends in "-<parts>", and of
+// the objects encrypted with SSE-KMS or SSE-C.
+func s3ETagMD5(out *s3.HeadObjectOutput) []byte {
+	if aws.StringValue(out.ServerSideEncryption) == string(kmsEnc) || out.SSECustomerAlgorithm != nil {
+		return nil
+	}
+	sum, err := hex.DecodeString(strings.Trim(aws.StringValue(out.ETag), `"`))
+	if err != nil || len(sum) != md5.Size {
+		return nil
+	}
+	return sum
+}
+
+// Validate implements the cloud.Validator interface, checking with a HEAD
+// request of the bucket that it exists and that the credentials can access it.
+func (s *s3Storage) Validate(ctx context.Context) error {
+	client, err := s.newS3Client(ctx)
+	if err != nil {
+		return err
+	}
+	err = runWithStorageTimeout(ctx, s.settings, "head s3 bucket", func(ctx context.Context) error {
+		_, err := client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: s.bucket})
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(markS3Error(err), "failed to access s3 bucket %s", aws.StringValue(s.bucket))
+	}
+	return nil
+}
+
+// Close releases the connections of the transports of the storage and of its
+// fallback regions that have one of their own, which is only the case if they
+// load a custom CA bundle.
 func (s *s3Storage) Close() error {
+	closeUnsharedHTTPClient(s.opts.Config.HTTPClient)
+	for _, fallback := range s.fallbacks {
+		_ = fallback.Close()
+	}
 	return nil
 }
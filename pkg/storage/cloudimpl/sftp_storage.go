@@ -0,0 +1,479 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/errors/oserror"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpDefaultPort is the port of the SSH server of an sftp URI without one.
+const sftpDefaultPort = "22"
+
+func parseSFTPURL(_ ExternalStorageURIContext, uri *url.URL) (roachpb.ExternalStorage, error) {
+	conf := roachpb.ExternalStorage{}
+	if uri.Hostname() == "" {
+		return conf, errors.Errorf("sftp URI must specify a host: %s", uri.Redacted())
+	}
+	if _, ok := uri.User.Password(); ok {
+		return conf, errors.Errorf("sftp URI must not contain a password; use %s", SFTPPasswordParam)
+	}
+	conf.Provider = roachpb.ExternalStorageProvider_SFTP
+	q := uri.Query()
+	conf.SFTPConfig = &roachpb.ExternalStorage_SFTP{
+		Host:       uri.Host,
+		User:       uri.User.Username(),
+		Password:   q.Get(SFTPPasswordParam),
+		PrivateKey: q.Get(SFTPPrivateKeyParam),
+		HostKey:    q.Get(SFTPHostKeyParam),
+	}
+	if uri.Port() == "" {
+		conf.SFTPConfig.Host = net.JoinHostPort(uri.Hostname(), sftpDefaultPort)
+	}
+	prefix, err := normalizeURIPath(uri.Path)
+	if err != nil {
+		return conf, err
+	}
+	conf.SFTPConfig.Prefix = "/" + prefix
+	return conf, validateSFTPConfig(conf.SFTPConfig)
+}
+
+// validateSFTPConfig checks that conf has a user to authenticate as, at least
+// one of their credentials, and the key of the host to verify.
+func validateSFTPConfig(conf *roachpb.ExternalStorage_SFTP) error {
+	if conf.User == "" {
+		return errors.New("sftp URI must specify a user")
+	}
+	if conf.Password == "" && conf.PrivateKey == "" {
+		return errors.Errorf("sftp URI must set %s or %s", SFTPPasswordParam, SFTPPrivateKeyParam)
+	}
+	if conf.HostKey == "" {
+		return errors.Errorf("sftp URI must set %s to verify the host", SFTPHostKeyParam)
+	}
+	return nil
+}
+
+// SFTPURI returns the string URI for the given path of the SFTP server of conf.
+func SFTPURI(conf *roachpb.ExternalStorage_SFTP, filePath string) string {
+	q := make(url.Values)
+	if conf.Password != "" {
+		q.Set(SFTPPasswordParam, conf.Password)
+	}
+	if conf.PrivateKey != "" {
+		q.Set(SFTPPrivateKeyParam, conf.PrivateKey)
+	}
+	q.Set(SFTPHostKeyParam, conf.HostKey)
+	uri := url.URL{
+		Scheme:   "sftp",
+		User:     url.User(conf.User),
+		Host:     conf.Host,
+		Path:     filePath,
+		RawQuery: q.Encode(),
+	}
+	return uri.String()
+}
+
+type sftpStorage struct {
+	conf     *roachpb.ExternalStorage_SFTP
+	ioConf   base.ExternalIODirConfig
+	settings *cluster.Settings
+	limiters *rateLimiters
+	// prefix is the absolute path on the server that the paths of the storage
+	// are relative to.
+	prefix string
+
+	// clientConfig is the configuration that the connection to the server
+	// authenticates and verifies it with.
+	clientConfig *ssh.ClientConfig
+
+	mu struct {
+		syncutil.Mutex
+		closed bool
+		// conn and client are the connection to the server and the SFTP session
+		// over it, opened by the first operation and reopened after they are
+		// lost.
+		conn   *ssh.Client
+		client *sftp.Client
+	}
+}
+
+var _ cloud.ExternalStorage = &sftpStorage{}
+
+func makeSFTPStorage(
+	_ context.Context, args ExternalStorageContext, dest roachpb.ExternalStorage,
+) (cloud.ExternalStorage, error) {
+	conf := dest.SFTPConfig
+	if conf == nil {
+		return nil, errors.Errorf("sftp storage requested but info missing")
+	}
+	if err := validateSFTPConfig(conf); err != nil {
+		return nil, err
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(conf.HostKey))
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing value of %s", SFTPHostKeyParam)
+	}
+	var auth []ssh.AuthMethod
+	if conf.PrivateKey != "" {
+		pemKey, err := base64.StdEncoding.DecodeString(conf.PrivateKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding value of %s", SFTPPrivateKeyParam)
+		}
+		signer, err := ssh.ParsePrivateKey(pemKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing value of %s", SFTPPrivateKeyParam)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if conf.Password != "" {
+		auth = append(auth, ssh.Password(conf.Password))
+	}
+	return &sftpStorage{
+		conf:     conf,
+		ioConf:   args.IOConf,
+		settings: args.Settings,
+		limiters: newRateLimiters(args.Settings),
+		prefix:   conf.Prefix,
+		clientConfig: &ssh.ClientConfig{
+			User:            conf.User,
+			Auth:            auth,
+			HostKeyCallback: ssh.FixedHostKey(hostKey),
+		},
+	}, nil
+}
+
+func (s *sftpStorage) Conf() roachpb.ExternalStorage {
+	return roachpb.ExternalStorage{
+		Provider:   roachpb.ExternalStorageProvider_SFTP,
+		SFTPConfig: s.conf,
+	}
+}
+
+func (s *sftpStorage) ExternalIOConf() base.ExternalIODirConfig {
+	return s.ioConf
+}
+
+func (s *sftpStorage) Settings() *cluster.Settings {
+	return s.settings
+}
+
+// client returns the SFTP session of the storage, connecting to the server if
+// it is the first one or the last one was lost.
+func (s *sftpStorage) client(ctx context.Context) (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mu.closed {
+		return nil, errors.New("sftp storage is closed")
+	}
+	if s.mu.client != nil {
+		return s.mu.client, nil
+	}
+	netConn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.conf.Host)
+	if err != nil {
+		return nil, countStorageError(roachpb.ExternalStorageProvider_SFTP,
+			errors.Wrapf(err, "connecting to sftp server %s", s.conf.Host))
+	}
+	// The SSH handshake does not take a context, so the deadline of ctx, if any,
+	// is set on the connection while it runs.
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = netConn.SetDeadline(deadline)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, s.conf.Host, s.clientConfig)
+	if err != nil {
+		_ = netConn.Close()
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			err = errors.Mark(err, ErrAccessDenied)
+		}
+		return nil, countStorageError(roachpb.ExternalStorageProvider_SFTP,
+			errors.Wrapf(err, "ssh handshake with %s", s.conf.Host))
+	}
+	_ = netConn.SetDeadline(time.Time{})
+	conn := ssh.NewClient(sshConn, chans, reqs)
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, countStorageError(roachpb.ExternalStorageProvider_SFTP,
+			errors.Wrapf(err, "starting sftp session with %s", s.conf.Host))
+	}
+	s.mu.conn, s.mu.client = conn, client
+	return client, nil
+}
+
+// markSFTPError marks err with ErrFileDoesNotExist or ErrAccessDenied if it
+// means so, and counts it in telemetry. If err means that the connection to
+// the server was lost, the next operation reconnects.
+func (s *sftpStorage) markSFTPError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case oserror.IsNotExist(err):
+		err = errors.Mark(err, ErrFileDoesNotExist)
+	case oserror.IsPermission(err):
+		err = errors.Mark(err, ErrAccessDenied)
+	case errors.Is(err, sftp.ErrSSHFxConnectionLost):
+		s.mu.Lock()
+		s.closeLocked()
+		s.mu.Unlock()
+	}
+	return countStorageError(roachpb.ExternalStorageProvider_SFTP, err)
+}
+
+func (s *sftpStorage) filePath(basename string) string {
+	return path.Join(s.prefix, basename)
+}
+
+// ReadFile is shorthand for ReadFileAt with offset 0.
+func (s *sftpStorage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	body, _, err := s.ReadFileAt(ctx, basename, 0)
+	return body, err
+}
+
+// ReadFileAt implements the ExternalStorage interface, seeking the opened file
+// to offset.
+func (s *sftpStorage) ReadFileAt(
+	ctx context.Context, basename string, offset int64,
+) (io.ReadCloser, int64, error) {
+	client, err := s.client(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := client.Open(s.filePath(basename))
+	if err != nil {
+		if oserror.IsNotExist(err) {
+			return nil, 0, errors.Wrapf(ErrFileDoesNotExist, "sftp file does not exist: %s", err.Error())
+		}
+		return nil, 0, errors.Wrap(s.markSFTPError(err), "opening sftp file")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, errors.Wrap(s.markSFTPError(err), "stat of sftp file")
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, 0, errors.Wrap(s.markSFTPError(err), "seeking sftp file")
+	}
+	return s.limiters.limitReader(ctx, f), info.Size(), nil
+}
+
+func (s *sftpStorage) WriteFile(ctx context.Context, basename string, content io.ReadSeeker) error {
+	return s.writeFile(ctx, basename, content, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+}
+
+// WriteFileIfNotExists implements the ExternalStorage interface. The file is
+// created exclusively, which the server checks atomically.
+func (s *sftpStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	return s.writeFile(ctx, basename, content, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+}
+
+// writeFile writes content to the named file, opened with flags, creating the
+// directories that contain it. A file that was created but fails to be written
+// is removed.
+func (s *sftpStorage) writeFile(
+	ctx context.Context, basename string, content io.ReadSeeker, flags int,
+) error {
+	client, err := s.client(ctx)
+	if err != nil {
+		return err
+	}
+	filePath := s.filePath(basename)
+	if err := client.MkdirAll(path.Dir(filePath)); err != nil {
+		return errors.Wrap(s.markSFTPError(err), "creating sftp directory")
+	}
+	f, err := client.OpenFile(filePath, flags)
+	if err != nil {
+		if flags&os.O_EXCL != 0 {
+			// Servers report the creation of a file that exists as a generic
+			// failure, so the file is stat'ed to tell.
+			if _, statErr := client.Stat(filePath); statErr == nil {
+				return errors.Wrapf(ErrFileAlreadyExists, "sftp file %s already exists", filePath)
+			}
+		}
+		return errors.Wrap(s.markSFTPError(err), "creating sftp file")
+	}
+	_, err = io.Copy(s.limiters.limitWriter(ctx, f), s.limiters.limitContent(ctx, content))
+	if err == nil {
+		if _, ok := client.HasExtension("fsync@openssh.com"); ok {
+			err = f.Sync()
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = client.Remove(filePath)
+		return errors.Wrap(s.markSFTPError(err), "writing sftp file")
+	}
+	return nil
+}
+
+func (s *sftpStorage) ListFiles(ctx context.Context, patternSuffix string) ([]string, error) {
+	files, err := s.ListFilesExt(ctx, patternSuffix)
+	return fileEntryPaths(files), err
+}
+
+// ListFilesExt implements the ExternalStorage interface, walking the directory
+// before the first glob of the pattern and matching the files under it.
+func (s *sftpStorage) ListFilesExt(
+	ctx context.Context, patternSuffix string,
+) ([]cloud.FileEntry, error) {
+	pattern := s.prefix
+	if patternSuffix != "" {
+		if containsGlob(s.prefix) {
+			return nil, errors.New("prefix cannot contain globs pattern when passing an explicit pattern")
+		}
+		pattern = path.Join(pattern, patternSuffix)
+	}
+
+	var fileList []cloud.FileEntry
+	err := s.walk(ctx, getPrefixBeforeWildcard(pattern), func(filePath string, info os.FileInfo) error {
+		matches, err := path.Match(pattern, filePath)
+		if err != nil || !matches {
+			return err
+		}
+		entry := cloud.FileEntry{Size: info.Size(), ModTime: info.ModTime()}
+		if patternSuffix != "" {
+			if !strings.HasPrefix(filePath, s.prefix) {
+				// TODO(dt): return a nice rel-path instead of erroring out.
+				return errors.New("pattern matched file outside of path")
+			}
+			entry.Path = strings.TrimPrefix(strings.TrimPrefix(filePath, s.prefix), "/")
+		} else {
+			entry.Path = SFTPURI(s.conf, filePath)
+		}
+		fileList = append(fileList, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortFileEntries(fileList), nil
+}
+
+// walk calls fn with the path and info of every file under the directory root,
+// which is not an error if it does not exist.
+func (s *sftpStorage) walk(
+	ctx context.Context, root string, fn func(filePath string, info os.FileInfo) error,
+) error {
+	client, err := s.client(ctx)
+	if err != nil {
+		return err
+	}
+	walker := client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if walker.Path() == root && oserror.IsNotExist(err) {
+				return nil
+			}
+			return errors.Wrap(s.markSFTPError(err), "listing sftp directory")
+		}
+		if walker.Stat().IsDir() {
+			continue
+		}
+		if err := fn(walker.Path(), walker.Stat()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sftpStorage) Delete(ctx context.Context, basename string) error {
+	client, err := s.client(ctx)
+	if err != nil {
+		return err
+	}
+	return s.markSFTPError(client.Remove(s.filePath(basename)))
+}
+
+// DeleteAll implements the ExternalStorage interface. The files are listed
+// recursively from the base path and deleted one at a time; the directories
+// that contained them are left in place.
+func (s *sftpStorage) DeleteAll(ctx context.Context, prefix string) error {
+	var names []string
+	err := s.walk(ctx, s.prefix, func(filePath string, _ os.FileInfo) error {
+		name := strings.TrimPrefix(strings.TrimPrefix(filePath, s.prefix), "/")
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return deleteEach(ctx, names, s.Delete)
+}
+
+func (s *sftpStorage) Size(ctx context.Context, basename string) (int64, error) {
+	client, err := s.client(ctx)
+	if err != nil {
+		return 0, err
+	}
+	info, err := client.Stat(s.filePath(basename))
+	if err != nil {
+		return 0, s.markSFTPError(err)
+	}
+	return info.Size(), nil
+}
+
+func (s *sftpStorage) Stat(ctx context.Context, basename string) (cloud.FileInfo, error) {
+	client, err := s.client(ctx)
+	if err != nil {
+		return cloud.FileInfo{}, err
+	}
+	info, err := client.Stat(s.filePath(basename))
+	if err != nil {
+		if oserror.IsNotExist(err) {
+			return cloud.FileInfo{}, nil
+		}
+		return cloud.FileInfo{}, s.markSFTPError(err)
+	}
+	return cloud.FileInfo{Exists: true, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Close implements the ExternalStorage interface, closing the connection to
+// the server if there is one. Readers opened by the storage fail once it is
+// closed.
+func (s *sftpStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.closed = true
+	s.closeLocked()
+	return nil
+}
+
+// closeLocked closes the connection to the server, if any, so that the next
+// operation reconnects unless the storage is closed.
+func (s *sftpStorage) closeLocked() {
+	if s.mu.client != nil {
+		_ = s.mu.client.Close()
+		_ = s.mu.conn.Close()
+		s.mu.client, s.mu.conn = nil, nil
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// SizeCacheOptions configures the cache of an ExternalStorage returned by
+// WithSizeCache.
+type SizeCacheOptions struct {
+	// TTL is how long a size is remembered after it is looked up.
+	TTL time.Duration
+	// TimeSource is the clock used to expire sizes. It defaults to the system
+	// clock and is generally set by tests.
+	TimeSource timeutil.TimeSource
+}
+
+// sizeCacheStorage wraps an ExternalStorage, remembering the sizes it returns.
+type sizeCacheStorage struct {
+	cloud.ExternalStorage
+	opts SizeCacheOptions
+
+	mu struct {
+		syncutil.Mutex
+		sizes map[string]cachedSize
+	}
+}
+
+type cachedSize struct {
+	size    int64
+	expires time.Time
+}
+
+var _ cloud.ExternalStorage = &sizeCacheStorage{}
+var _ cloud.Presigner = &sizeCacheStorage{}
+var _ cloud.Copier = &sizeCacheStorage{}
+var _ cloud.Syncer = &sizeCacheStorage{}
+var _ cloud.Validator = &sizeCacheStorage{}
+var _ cloud.PageLister = &sizeCacheStorage{}
+var _ cloud.DelimitedLister = &sizeCacheStorage{}
+
+// WithSizeCache returns an ExternalStorage that remembers the size of each file
+// returned by Size for opts.TTL, so that opening the same file repeatedly, e.g.
+// during a restore, looks its size up in inner once. The size of a file is
+// forgotten when it is written or deleted through the returned storage, but
+// changes made to the file by others are only seen once the TTL has passed.
+func WithSizeCache(inner cloud.ExternalStorage, opts SizeCacheOptions) cloud.ExternalStorage {
+	if opts.TimeSource == nil {
+		opts.TimeSource = timeutil.DefaultTimeSource{}
+	}
+	c := &sizeCacheStorage{ExternalStorage: inner, opts: opts}
+	c.mu.sizes = make(map[string]cachedSize)
+	return c
+}
+
+func (c *sizeCacheStorage) Size(ctx context.Context, basename string) (int64, error) {
+	c.mu.Lock()
+	cached, ok := c.mu.sizes[basename]
+	c.mu.Unlock()
+	if ok && c.opts.TimeSource.Now().Before(cached.expires) {
+		return cached.size, nil
+	}
+
+	size, err := c.ExternalStorage.Size(ctx, basename)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mu.sizes[basename] = cachedSize{size: size, expires: c.opts.TimeSource.Now().Add(c.opts.TTL)}
+	return size, nil
+}
+
+// invalidate forgets the sizes of the files whose name starts with prefix, or
+// that of the named file if exact is set.
+func (c *sizeCacheStorage) invalidate(prefix string, exact bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if exact {
+		delete(c.mu.sizes, prefix)
+		return
+	}
+	for basename := range c.mu.sizes {
+		if strings.HasPrefix(basename, prefix) {
+			delete(c.mu.sizes, basename)
+		}
+	}
+}
+
+// WriteFile forgets the size of the file once the write is done, whether or not
+// it succeeded, as a failed write may still have replaced the file.
+func (c *sizeCacheStorage) WriteFile(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	defer c.invalidate(basename, true /* exact */)
+	return c.ExternalStorage.WriteFile(ctx, basename, content)
+}
+
+func (c *sizeCacheStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	defer c.invalidate(basename, true /* exact */)
+	return c.ExternalStorage.WriteFileIfNotExists(ctx, basename, content)
+}
+
+func (c *sizeCacheStorage) CopyFrom(
+	ctx context.Context, src cloud.ExternalStorage, srcName, dstName string,
+) error {
+	defer c.invalidate(dstName, true /* exact */)
+	return CopyFrom(ctx, c.ExternalStorage, src, srcName, dstName)
+}
+
+func (c *sizeCacheStorage) Delete(ctx context.Context, basename string) error {
+	defer c.invalidate(basename, true /* exact */)
+	return c.ExternalStorage.Delete(ctx, basename)
+}
+
+func (c *sizeCacheStorage) DeleteAll(ctx context.Context, prefix string) error {
+	defer c.invalidate(prefix, false /* exact */)
+	return c.ExternalStorage.DeleteAll(ctx, prefix)
+}
+
+func (c *sizeCacheStorage) PresignedURL(
+	ctx context.Context, basename string, expiry time.Duration,
+) (string, error) {
+	return PresignedURL(ctx, c.ExternalStorage, basename, expiry)
+}
+
+func (c *sizeCacheStorage) Sync(ctx context.Context) error {
+	return Sync(ctx, c.ExternalStorage)
+}
+
+func (c *sizeCacheStorage) Validate(ctx context.Context) error {
+	return Validate(ctx, c.ExternalStorage)
+}
+
+func (c *sizeCacheStorage) ListFilesPage(
+	ctx context.Context, prefix, token string, limit int,
+) ([]string, string, error) {
+	return ListFilesPage(ctx, c.ExternalStorage, prefix, token, limit)
+}
+
+func (c *sizeCacheStorage) ListFilesWithDelimiter(
+	ctx context.Context, prefix, delimiter string,
+) ([]string, []string, error) {
+	return ListFilesWithDelimiter(ctx, c.ExternalStorage, prefix, delimiter)
+}
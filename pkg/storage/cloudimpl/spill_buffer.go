@@ -0,0 +1,199 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/errors"
+)
+
+var maxInMemoryBufferSize = settings.RegisterByteSizeSetting(
+	CloudstorageMaxInMemoryBufferSizeSetting,
+	"the maximum number of bytes of a file read from cloud storage that are buffered in memory, "+
+		"beyond which the rest of the file is spilled to a temporary file",
+	64<<20,
+	settings.NonNegativeInt,
+)
+
+// BufferedFile is a file read from an ExternalStorage into a buffer, so that it
+// can be read, seeked and read again without holding the connection it was
+// read through open. The first bytes of the file are held in memory and the
+// rest, if any, in a temporary file.
+type BufferedFile struct {
+	mem []byte
+	// spill, if not nil, is the temporary file holding the bytes of the file
+	// that follow mem.
+	spill *os.File
+	size  int64
+	pos   int64
+}
+
+var _ io.ReadSeeker = &BufferedFile{}
+var _ io.ReaderAt = &BufferedFile{}
+var _ io.Closer = &BufferedFile{}
+
+// ReadFileBuffered reads the whole file basename of es into a BufferedFile. At
+// most the number of bytes configured by the max_in_memory_buffer_size setting
+// of es are held in memory, and the rest of the file is written to a temporary
+// file in the directory for temporary files of the OS, rather than in the
+// external IO directory, where nodelocal storage would list it. The temporary
+// file is removed when the BufferedFile is closed, which the caller must do.
+func ReadFileBuffered(
+	ctx context.Context, es cloud.ExternalStorage, basename string,
+) (*BufferedFile, error) {
+	maxInMemory := maxInMemoryBufferSize.Default()
+	if s := es.Settings(); s != nil {
+		maxInMemory = maxInMemoryBufferSize.Get(&s.SV)
+	}
+	r, err := es.ReadFile(ctx, basename)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return newBufferedFile(&ctxReader{ctx: ctx, ReadCloser: r}, maxInMemory)
+}
+
+// bufferedFileInitialSize is the initial size of the buffer in memory of a
+// BufferedFile.
+const bufferedFileInitialSize = 32 << 10
+
+// newBufferedFile reads r into a BufferedFile holding at most maxInMemory bytes
+// in memory and the rest in a temporary file.
+func newBufferedFile(r io.Reader, maxInMemory int64) (*BufferedFile, error) {
+	// The buffer in memory grows as it is filled, but never past maxInMemory,
+	// so that buffering small files is cheap and large ones allocate at most
+	// about twice maxInMemory.
+	mem := make([]byte, 0, minInt64(maxInMemory, bufferedFileInitialSize))
+	for int64(len(mem)) < maxInMemory {
+		if len(mem) == cap(mem) {
+			grown := make([]byte, len(mem), minInt64(maxInMemory, 2*int64(cap(mem))))
+			copy(grown, mem)
+			mem = grown
+		}
+		n, err := r.Read(mem[len(mem):cap(mem)])
+		mem = mem[:len(mem)+n]
+		if err == io.EOF {
+			return &BufferedFile{mem: mem, size: int64(len(mem))}, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	b := &BufferedFile{mem: mem, size: int64(len(mem))}
+	// Check that there is more to read before creating a file for it.
+	var next [1]byte
+	n, err := io.ReadFull(r, next[:])
+	if err == io.EOF {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile("", "cloudstorage-buffer-")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating temporary file to buffer into")
+	}
+	b.spill = f
+	spilled, err := io.Copy(f, io.MultiReader(bytes.NewReader(next[:n]), r))
+	if err != nil {
+		_ = b.Close()
+		return nil, errors.Wrap(err, "buffering into temporary file")
+	}
+	b.size += spilled
+	return b, nil
+}
+
+// Size returns the size of the file in bytes.
+func (b *BufferedFile) Size() int64 {
+	return b.size
+}
+
+// Read implements io.Reader.
+func (b *BufferedFile) Read(p []byte) (int, error) {
+	n, err := b.ReadAt(p, b.pos)
+	b.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (b *BufferedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.Newf("cannot read at negative offset %d", off)
+	}
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	var n int
+	if memLen := int64(len(b.mem)); off < memLen {
+		n = copy(p, b.mem[off:])
+		off = memLen
+	}
+	if n < len(p) && b.spill != nil {
+		m, err := b.spill.ReadAt(p[n:], off-int64(len(b.mem)))
+		n += m
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Seek implements io.Seeker.
+func (b *BufferedFile) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += b.pos
+	case io.SeekEnd:
+		pos += b.size
+	default:
+		return 0, errors.Newf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, errors.Newf("cannot seek to negative position %d", pos)
+	}
+	b.pos = pos
+	return pos, nil
+}
+
+// Close releases the buffer, removing its temporary file if it has one.
+func (b *BufferedFile) Close() error {
+	b.mem = nil
+	if b.spill == nil {
+		return nil
+	}
+	f := b.spill
+	b.spill = nil
+	err := f.Close()
+	if rmErr := os.Remove(f.Name()); rmErr != nil {
+		err = errors.CombineErrors(err, rmErr)
+	}
+	return err
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,557 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package cloudimpl
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// The ports of the WebHDFS endpoints of namenodes, over HTTP and HTTPS, that
+// are used for URIs without one.
+const (
+	webhdfsDefaultPort  = "9870"
+	swebhdfsDefaultPort = "9871"
+)
+
+var webhdfsAppendChunkSize = settings.RegisterByteSizeSetting(
+	CloudstorageWebHDFSAppendChunkSizeSetting,
+	"the size of the chunks that files are written to webhdfs in; the first chunk creates the "+
+		"file and the others are appended to it",
+	128<<20,
+	func(v int64) error {
+		if v <= 0 {
+			return errors.Errorf("must be positive")
+		}
+		return nil
+	},
+)
+
+func parseWebHDFSURL(_ ExternalStorageURIContext, uri *url.URL) (roachpb.ExternalStorage, error) {
+	conf := roachpb.ExternalStorage{}
+	if uri.Hostname() == "" {
+		return conf, errors.Errorf("%s URI must specify the host of the namenode: %s",
+			uri.Scheme, uri.Redacted())
+	}
+	if _, ok := uri.User.Password(); ok {
+		return conf, errors.Errorf("%s URI must not contain a password", uri.Scheme)
+	}
+	conf.Provider = roachpb.ExternalStorageProvider_WebHDFS
+	conf.WebHDFSConfig = &roachpb.ExternalStorage_WebHDFS{
+		Host:            uri.Host,
+		UseTLS:          uri.Scheme == "swebhdfs",
+		User:            uri.User.Username(),
+		DelegationToken: uri.Query().Get(WebHDFSDelegationTokenParam),
+	}
+	if uri.Port() == "" {
+		port := webhdfsDefaultPort
+		if conf.WebHDFSConfig.UseTLS {
+			port = swebhdfsDefaultPort
+		}
+		conf.WebHDFSConfig.Host = net.JoinHostPort(uri.Hostname(), port)
+	}
+	prefix, err := normalizeURIPath(uri.Path)
+	if err != nil {
+		return conf, err
+	}
+	conf.WebHDFSConfig.Prefix = "/" + prefix
+	return conf, validateWebHDFSConfig(conf.WebHDFSConfig)
+}
+
+// validateWebHDFSConfig checks that conf authenticates in at most one way.
+func validateWebHDFSConfig(conf *roachpb.ExternalStorage_WebHDFS) error {
+	if conf.User != "" && conf.DelegationToken != "" {
+		return errors.Errorf("webhdfs URI cannot specify both a user and %s",
+			WebHDFSDelegationTokenParam)
+	}
+	return nil
+}
+
+// WebHDFSURI returns the string URI for the given path of the HDFS of conf.
+func WebHDFSURI(conf *roachpb.ExternalStorage_WebHDFS, filePath string) string {
+	uri := url.URL{Scheme: "webhdfs", Host: conf.Host, Path: filePath}
+	if conf.UseTLS {
+		uri.Scheme = "swebhdfs"
+	}
+	if conf.User != "" {
+		uri.User = url.User(conf.User)
+	}
+	if conf.DelegationToken != "" {
+		uri.RawQuery = url.Values{WebHDFSDelegationTokenParam: {conf.DelegationToken}}.Encode()
+	}
+	return uri.String()
+}
+
+type webhdfsStorage struct {
+	conf     *roachpb.ExternalStorage_WebHDFS
+	ioConf   base.ExternalIODirConfig
+	settings *cluster.Settings
+	limiters *rateLimiters
+	// prefix is the absolute path in HDFS that the paths of the storage are
+	// relative to.
+	prefix string
+
+	// client follows the redirects of the namenode to the datanodes that serve
+	// reads, while noRedirects returns the redirects of writes, whose data is
+	// only sent to the datanode.
+	client, noRedirects *http.Client
+}
+
+var _ cloud.ExternalStorage = &webhdfsStorage{}
+
+func makeWebHDFSStorage(
+	ctx context.Context, args ExternalStorageContext, dest roachpb.ExternalStorage,
+) (cloud.ExternalStorage, error) {
+	conf := dest.WebHDFSConfig
+	if conf == nil {
+		return nil, errors.Errorf("webhdfs storage requested but info missing")
+	}
+	if err := validateWebHDFSConfig(conf); err != nil {
+		return nil, err
+	}
+	client, err := makeHTTPClient(ctx, args.Settings)
+	if err != nil {
+		return nil, err
+	}
+	noRedirects := *client
+	noRedirects.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &webhdfsStorage{
+		conf:        conf,
+		ioConf:      args.IOConf,
+		settings:    args.Settings,
+		limiters:    newRateLimiters(args.Settings),
+		prefix:      conf.Prefix,
+		client:      client,
+		noRedirects: &noRedirects,
+	}, nil
+}
+
+func (w *webhdfsStorage) Conf() roachpb.ExternalStorage {
+	return roachpb.ExternalStorage{
+		Provider:      roachpb.ExternalStorageProvider_WebHDFS,
+		WebHDFSConfig: w.conf,
+	}
+}
+
+func (w *webhdfsStorage) ExternalIOConf() base.ExternalIODirConfig {
+	return w.ioConf
+}
+
+func (w *webhdfsStorage) Settings() *cluster.Settings {
+	return w.settings
+}
+
+func (w *webhdfsStorage) filePath(basename string) string {
+	return path.Join(w.prefix, basename)
+}
+
+// opURL returns the URL of the WebHDFS operation op on filePath, with the given
+// parameters and those that authenticate it.
+func (w *webhdfsStorage) opURL(filePath, op string, params url.Values) string {
+	q := url.Values{"op": {op}}
+	for k, v := range params {
+		q[k] = v
+	}
+	switch {
+	case w.conf.DelegationToken != "":
+		q.Set("delegation", w.conf.DelegationToken)
+	case w.conf.User != "":
+		q.Set("user.name", w.conf.User)
+	}
+	uri := url.URL{
+		Scheme: "http", Host: w.conf.Host, Path: "/webhdfs/v1" + filePath, RawQuery: q.Encode(),
+	}
+	if w.conf.UseTLS {
+		uri.Scheme = "https"
+	}
+	return uri.String()
+}
+
+// do sends a request with client. Its response is returned whatever its
+// status, for the caller to check.
+func (w *webhdfsStorage) do(
+	ctx context.Context, client *http.Client, method, reqURL string, body io.Reader,
+) (*http.Response, error) {
+	req, err := http.NewRequest(method, reqURL, body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error constructing request %s", method)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, countStorageError(roachpb.ExternalStorageProvider_WebHDFS, err)
+	}
+	return resp, nil
+}
+
+// webhdfsRemoteException is the JSON body of the failed responses of WebHDFS.
+type webhdfsRemoteException struct {
+	RemoteException struct {
+		Exception string `json:"exception"`
+		Message   string `json:"message"`
+	} `json:"RemoteException"`
+}
+
+// webhdfsResponseError returns the error of the failed response of op, which it
+// closes, marked with ErrFileDoesNotExist, ErrFileAlreadyExists or
+// ErrAccessDenied if its status or the exception it reports means so.
+func webhdfsResponseError(op string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	var remote webhdfsRemoteException
+	if json.Unmarshal(body, &remote) != nil || remote.RemoteException.Exception == "" {
+		err := errors.Errorf("webhdfs %s: %s %q", op, resp.Status, body)
+		return countStorageError(roachpb.ExternalStorageProvider_WebHDFS,
+			markStatusError(err, resp.StatusCode))
+	}
+	exception := remote.RemoteException.Exception
+	err := errors.Errorf("webhdfs %s: %s %s: %s", op, resp.Status, exception,
+		remote.RemoteException.Message)
+	switch exception {
+	case "FileNotFoundException":
+		err = errors.Mark(err, ErrFileDoesNotExist)
+	case "FileAlreadyExistsException":
+		err = errors.Mark(err, ErrFileAlreadyExists)
+	case "AccessControlException", "SecurityException":
+		err = errors.Mark(err, ErrAccessDenied)
+	default:
+		err = markStatusError(err, resp.StatusCode)
+	}
+	return countStorageError(roachpb.ExternalStorageProvider_WebHDFS, err)
+}
+
+// ReadFile is shorthand for ReadFileAt with offset 0.
+func (w *webhdfsStorage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	body, _, err := w.ReadFileAt(ctx, basename, 0)
+	return body, err
+}
+
+// ReadFileAt implements the ExternalStorage interface, opening the file at
+// offset, and resuming from where it was read if the response is cut short.
+func (w *webhdfsStorage) ReadFileAt(
+	ctx context.Context, basename string, offset int64,
+) (io.ReadCloser, int64, error) {
+	resp, err := w.openAt(ctx, basename, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := offset + resp.ContentLength
+	if resp.ContentLength < 0 {
+		if size, err = w.Size(ctx, basename); err != nil {
+			_ = resp.Body.Close()
+			return nil, 0, err
+		}
+	}
+	return w.limiters.limitReader(ctx, &resumingReader{
+		ctx: ctx,
+		opener: func(ctx context.Context, pos int64) (io.ReadCloser, error) {
+			resp, err := w.openAt(ctx, basename, pos)
+			if err != nil {
+				return nil, err
+			}
+			return resp.Body, nil
+		},
+		reader: resp.Body,
+		pos:    offset,
+	}), size, nil
+}
+
+func (w *webhdfsStorage) openAt(
+	ctx context.Context, basename string, offset int64,
+) (*http.Response, error) {
+	params := url.Values{"offset": {strconv.FormatInt(offset, 10)}}
+	resp, err := w.do(ctx, w.client, "GET", w.opURL(w.filePath(basename), "OPEN", params), nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, webhdfsResponseError("OPEN", resp)
+	}
+	return resp, nil
+}
+
+func (w *webhdfsStorage) WriteFile(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	return w.writeFile(ctx, basename, content, true /* overwrite */)
+}
+
+// WriteFileIfNotExists implements the ExternalStorage interface. The file is
+// created without overwriting, which the namenode checks atomically.
+func (w *webhdfsStorage) WriteFileIfNotExists(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	return w.writeFile(ctx, basename, content, false /* overwrite */)
+}
+
+// writeFile writes content to the named file in chunks of
+// cloudstorage.webhdfs.append_chunk_size: the first creates the file, and the
+// others are appended to it. A file that was created but fails to be written
+// is deleted.
+func (w *webhdfsStorage) writeFile(
+	ctx context.Context, basename string, content io.ReadSeeker, overwrite bool,
+) error {
+	filePath := w.filePath(basename)
+	chunkSize := webhdfsAppendChunkSize.Get(&w.settings.SV)
+	r := bufio.NewReader(w.limiters.limitContent(ctx, content))
+	params := url.Values{"overwrite": {strconv.FormatBool(overwrite)}}
+	err := w.writeChunk(ctx, "PUT", "CREATE", filePath, params, io.LimitReader(r, chunkSize))
+	if err != nil {
+		if errors.Is(err, ErrFileAlreadyExists) {
+			return errors.Wrapf(err, "webhdfs file %s already exists", filePath)
+		}
+		return err
+	}
+	for {
+		_, err := r.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			err = w.writeChunk(ctx, "POST", "APPEND", filePath, nil, io.LimitReader(r, chunkSize))
+		}
+		if err != nil {
+			_ = w.Delete(ctx, basename)
+			return errors.Wrapf(err, "writing webhdfs file %s", filePath)
+		}
+	}
+}
+
+// writeChunk sends the two requests of a CREATE or APPEND of data to filePath:
+// the first is sent without data to the namenode, which redirects it to the
+// datanode that the second sends the data to.
+func (w *webhdfsStorage) writeChunk(
+	ctx context.Context, method, op, filePath string, params url.Values, data io.Reader,
+) error {
+	return runWithStorageTimeout(ctx, w.settings, fmt.Sprintf("webhdfs %s %s", op, filePath),
+		func(ctx context.Context) error {
+			resp, err := w.do(ctx, w.noRedirects, method, w.opURL(filePath, op, params), nil)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != http.StatusTemporaryRedirect {
+				return webhdfsResponseError(op, resp)
+			}
+			_ = resp.Body.Close()
+			location := resp.Header.Get("Location")
+			if location == "" {
+				return errors.Errorf("webhdfs %s: redirect without a location", op)
+			}
+			resp, err = w.do(ctx, w.noRedirects, method, location, data)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+				return webhdfsResponseError(op, resp)
+			}
+			return resp.Body.Close()
+		})
+}
+
+// webhdfsFileStatus is the JSON status of a file or directory in the responses
+// of WebHDFS.
+type webhdfsFileStatus struct {
+	// PathSuffix is the name of the file within the listed directory, which is
+	// empty for the status of the file that was requested.
+	PathSuffix string `json:"pathSuffix"`
+	Type       string `json:"type"`
+	Length     int64  `json:"length"`
+	// ModificationTime is in milliseconds since the Unix epoch.
+	ModificationTime int64 `json:"modificationTime"`
+}
+
+func (s webhdfsFileStatus) fileEntry(path string) cloud.FileEntry {
+	return cloud.FileEntry{
+		Path: path, Size: s.Length, ModTime: timeutil.Unix(0, s.ModificationTime*1e6),
+	}
+}
+
+// getJSON sends the GET of op on filePath and decodes its JSON response into
+// v.
+func (w *webhdfsStorage) getJSON(ctx context.Context, filePath, op string, v interface{}) error {
+	return runWithStorageTimeout(ctx, w.settings, fmt.Sprintf("webhdfs %s %s", op, filePath),
+		func(ctx context.Context) error {
+			resp, err := w.do(ctx, w.client, "GET", w.opURL(filePath, op, nil), nil)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != http.StatusOK {
+				return webhdfsResponseError(op, resp)
+			}
+			defer resp.Body.Close()
+			return errors.Wrapf(json.NewDecoder(resp.Body).Decode(v), "decoding webhdfs %s", op)
+		})
+}
+
+func (w *webhdfsStorage) fileStatus(
+	ctx context.Context, basename string,
+) (webhdfsFileStatus, error) {
+	var status struct {
+		FileStatus webhdfsFileStatus `json:"FileStatus"`
+	}
+	err := w.getJSON(ctx, w.filePath(basename), "GETFILESTATUS", &status)
+	return status.FileStatus, err
+}
+
+func (w *webhdfsStorage) ListFiles(ctx context.Context, patternSuffix string) ([]string, error) {
+	files, err := w.ListFilesExt(ctx, patternSuffix)
+	return fileEntryPaths(files), err
+}
+
+// ListFilesExt implements the ExternalStorage interface, listing the directory
+// before the first glob of the pattern recursively and matching the files
+// under it.
+func (w *webhdfsStorage) ListFilesExt(
+	ctx context.Context, patternSuffix string,
+) ([]cloud.FileEntry, error) {
+	pattern := w.prefix
+	if patternSuffix != "" {
+		if containsGlob(w.prefix) {
+			return nil, errors.New("prefix cannot contain globs pattern when passing an explicit pattern")
+		}
+		pattern = path.Join(pattern, patternSuffix)
+	}
+
+	var fileList []cloud.FileEntry
+	root := getPrefixBeforeWildcard(pattern)
+	err := w.walk(ctx, root, func(filePath string, s webhdfsFileStatus) error {
+		matches, err := path.Match(pattern, filePath)
+		if err != nil || !matches {
+			return err
+		}
+		if patternSuffix == "" {
+			fileList = append(fileList, s.fileEntry(WebHDFSURI(w.conf, filePath)))
+			return nil
+		}
+		if !strings.HasPrefix(filePath, w.prefix) {
+			// TODO(dt): return a nice rel-path instead of erroring out.
+			return errors.New("pattern matched file outside of path")
+		}
+		fileList = append(fileList,
+			s.fileEntry(strings.TrimPrefix(strings.TrimPrefix(filePath, w.prefix), "/")))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortFileEntries(fileList), nil
+}
+
+// walk calls fn with the path and status of every file under the directory
+// root, which is not an error if it does not exist, listing each directory
+// with a LISTSTATUS.
+func (w *webhdfsStorage) walk(
+	ctx context.Context, root string, fn func(filePath string, s webhdfsFileStatus) error,
+) error {
+	var list struct {
+		FileStatuses struct {
+			FileStatus []webhdfsFileStatus `json:"FileStatus"`
+		} `json:"FileStatuses"`
+	}
+	if err := w.getJSON(ctx, root, "LISTSTATUS", &list); err != nil {
+		if errors.Is(err, ErrFileDoesNotExist) {
+			return nil
+		}
+		return errors.Wrap(err, "listing webhdfs directory")
+	}
+	for _, s := range list.FileStatuses.FileStatus {
+		filePath := path.Join(root, s.PathSuffix)
+		if s.Type == "DIRECTORY" {
+			if err := w.walk(ctx, filePath, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(filePath, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *webhdfsStorage) Delete(ctx context.Context, basename string) error {
+	filePath := w.filePath(basename)
+	return runWithStorageTimeout(ctx, w.settings, fmt.Sprintf("webhdfs DELETE %s", filePath),
+		func(ctx context.Context) error {
+			resp, err := w.do(ctx, w.client, "DELETE", w.opURL(filePath, "DELETE", nil), nil)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != http.StatusOK {
+				return webhdfsResponseError("DELETE", resp)
+			}
+			// The response reports whether the file existed, which does not matter
+			// to the caller.
+			return resp.Body.Close()
+		})
+}
+
+// DeleteAll implements the ExternalStorage interface. The files are listed
+// recursively from the base path and deleted one at a time; the directories
+// that contained them are left in place.
+func (w *webhdfsStorage) DeleteAll(ctx context.Context, prefix string) error {
+	var names []string
+	err := w.walk(ctx, w.prefix, func(filePath string, _ webhdfsFileStatus) error {
+		name := strings.TrimPrefix(strings.TrimPrefix(filePath, w.prefix), "/")
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return deleteEach(ctx, names, w.Delete)
+}
+
+// Size implements the ExternalStorage interface with a GETFILESTATUS.
+func (w *webhdfsStorage) Size(ctx context.Context, basename string) (int64, error) {
+	s, err := w.fileStatus(ctx, basename)
+	if err != nil {
+		return 0, err
+	}
+	return s.Length, nil
+}
+
+func (w *webhdfsStorage) Stat(ctx context.Context, basename string) (cloud.FileInfo, error) {
+	s, err := w.fileStatus(ctx, basename)
+	if err != nil {
+		if errors.Is(err, ErrFileDoesNotExist) {
+			return cloud.FileInfo{}, nil
+		}
+		return cloud.FileInfo{}, err
+	}
+	entry := s.fileEntry(basename)
+	return cloud.FileInfo{Exists: true, Size: entry.Size, ModTime: entry.ModTime}, nil
+}
+
+func (w *webhdfsStorage) Close() error {
+	return nil
+}
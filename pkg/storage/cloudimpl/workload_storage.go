@@ -11,75 +11,422 @@
 package cloudimpl
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"net/url"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"unicode/utf8"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/col/coldata"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
 	"github.com/cockroachdb/cockroach/pkg/storage/cloud"
+	"github.com/cockroachdb/cockroach/pkg/util/bufalloc"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding/csv"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/version"
 	"github.com/cockroachdb/cockroach/pkg/workload"
 	"github.com/cockroachdb/errors"
+	"github.com/spf13/pflag"
 )
 
+// workloadStorage is a read-only ExternalStorage of the initial data of the
+// tables of a workload generator. The data of a table in a delimited format
+// (csv or tsv) or in the fixed format, whose fields are padded to the widths of
+// their columns, is only its rows, with no header row, unless the header
+// parameter prepends the header row to them or the header-only parameter makes
+// it only the header row.
 type workloadStorage struct {
-	conf     *roachpb.ExternalStorage_Workload
-	ioConf   base.ExternalIODirConfig
-	gen      workload.Generator
+	conf   *roachpb.ExternalStorage_Workload
+	ioConf base.ExternalIODirConfig
+	gen    workload.Generator
+	// table is the table named by the URI, if any. Otherwise, any of tables can
+	// be read by passing its name as the basename.
 	table    workload.Table
+	tables   []workload.Table
+	format   string
+	opts     workload.CSVRowsReaderOptions
 	settings *cluster.Settings
+	limiters *rateLimiters
+
+	mu struct {
+		syncutil.Mutex
+		// sizes caches the length in bytes of the compressed data returned by
+		// ReadFile, keyed by table name.
+		sizes map[string]int64
+		// batchOffsets caches the result of batchOffsets, keyed by table name.
+		batchOffsets map[string][]int64
+	}
 }
 
 var _ cloud.ExternalStorage = &workloadStorage{}
+var _ cloud.Validator = &workloadStorage{}
 
 func makeWorkloadStorage(
 	ctx context.Context, args ExternalStorageContext, dest roachpb.ExternalStorage,
 ) (cloud.ExternalStorage, error) {
-	telemetry.Count("external-io.workload")
 	conf := dest.WorkloadConfig
 	if conf == nil {
 		return nil, errors.Errorf("workload upload requested but info missing")
 	}
-	if strings.ToLower(conf.Format) != `csv` {
+	var opts workload.CSVRowsReaderOptions
+	format := strings.ToLower(conf.Format)
+	switch format {
+	case `csv`:
+		opts.Comma = ','
+	case `tsv`:
+		opts.Comma = '\t'
+	case `ndjson`:
+		if conf.Delimiter != `` {
+			return nil, errors.Errorf(`delimiter is not supported for format %s`, conf.Format)
+		}
+		if conf.Header {
+			return nil, errors.Errorf(`header is not supported for format %s`, conf.Format)
+		}
+		if conf.HeaderOnly {
+			return nil, errors.Errorf(`header-only is not supported for format %s`, conf.Format)
+		}
+		if conf.NullAs != `` {
+			return nil, errors.Errorf(`null-as is not supported for format %s`, conf.Format)
+		}
+		if conf.Quote != `` {
+			return nil, errors.Errorf(`quote is not supported for format %s`, conf.Format)
+		}
+	case `fixed`:
+		// Fields are separated by their widths rather than a delimiter, and
+		// never quoted.
+		if conf.Delimiter != `` {
+			return nil, errors.Errorf(`delimiter is not supported for format %s`, conf.Format)
+		}
+		if conf.Quote != `` {
+			return nil, errors.Errorf(`quote is not supported for format %s`, conf.Format)
+		}
+	default:
 		return nil, errors.Errorf(`unsupported format: %s`, conf.Format)
 	}
+	if format != `fixed` {
+		if len(conf.Widths) > 0 {
+			return nil, errors.Errorf(`widths is not supported for format %s`, conf.Format)
+		}
+		if conf.Truncate {
+			return nil, errors.Errorf(`truncate is not supported for format %s`, conf.Format)
+		}
+	}
+	if conf.Delimiter != `` {
+		if err := validateWorkloadDelimiter(conf.Delimiter); err != nil {
+			return nil, err
+		}
+		opts.Comma = rune(conf.Delimiter[0])
+	}
+	if conf.NullAs != `` {
+		if err := validateWorkloadNullAs(conf.NullAs, opts.Comma); err != nil {
+			return nil, err
+		}
+		opts.Null = conf.NullAs
+	}
+	quote, err := parseWorkloadQuote(conf.Quote)
+	if err != nil {
+		return nil, err
+	}
+	opts.Quote = quote
+	if err := validateWorkloadCompression(conf.Compression); err != nil {
+		return nil, err
+	}
+	gen, err := resolveWorkloadGenerator(conf)
+	if err != nil {
+		return nil, err
+	}
+	s := &workloadStorage{
+		conf:     conf,
+		ioConf:   args.IOConf,
+		gen:      gen,
+		tables:   gen.Tables(),
+		format:   format,
+		opts:     opts,
+		settings: args.Settings,
+		limiters: newRateLimiters(args.Settings),
+	}
+	s.mu.sizes = make(map[string]int64)
+	s.mu.batchOffsets = make(map[string][]int64)
+	if conf.Table == `` {
+		return s, nil
+	}
+	if s.table, err = findWorkloadTable(gen, s.tables, conf.Table); err != nil {
+		return nil, err
+	}
+	if format == `fixed` {
+		// Check the widths when the table is known, rather than when it is read.
+		if _, err := s.fixedWidthOptions(s.table); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// resolveWorkloadGenerator returns the generator named by conf, configured by
+// its flags, after checking that its version matches the requested one.
+func resolveWorkloadGenerator(conf *roachpb.ExternalStorage_Workload) (workload.Generator, error) {
 	meta, err := workload.Get(conf.Generator)
 	if err != nil {
 		return nil, err
 	}
 	// Different versions of the workload could generate different data, so
-	// disallow this.
-	if meta.Version != conf.Version {
-		return nil, errors.Errorf(
-			`expected %s version "%s" but got "%s"`, meta.Name, conf.Version, meta.Version)
+	// disallow this unless the URI explicitly accepts a range of versions.
+	if ok, err := workloadVersionMatches(conf.Version, meta.Version); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.WithHint(errors.Errorf(
+			`expected %s version "%s" but got "%s"`, meta.Name, conf.Version, meta.Version),
+			workloadVersionHint)
 	}
 	gen := meta.New()
 	if f, ok := gen.(workload.Flagser); ok {
 		if err := f.Flags().Parse(conf.Flags); err != nil {
+			if detail := describeWorkloadFlagError(f.Flags().FlagSet, conf.Flags); detail != `` {
+				err = errors.Wrapf(err, `%s`, detail)
+			}
 			return nil, errors.Wrapf(err, `parsing parameters %s`, strings.Join(conf.Flags, ` `))
 		}
 	}
-	s := &workloadStorage{
-		conf:     conf,
-		ioConf:   args.IOConf,
-		gen:      gen,
-		settings: args.Settings,
+	return gen, nil
+}
+
+// findWorkloadTable returns the table of gen with the given name.
+func findWorkloadTable(
+	gen workload.Generator, tables []workload.Table, name string,
+) (workload.Table, error) {
+	for _, t := range tables {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return workload.Table{}, withWorkloadTablesHint(
+		errors.Errorf(`unknown table %s for generator %s`, name, gen.Meta().Name), tables)
+}
+
+// ColumnSpec describes a column of a table generated by a workload.
+type ColumnSpec struct {
+	Name string
+	Type *types.T
+}
+
+// WorkloadTableSchema returns the columns of the given table of the given
+// generator, in the order they appear in its data. The generator is resolved
+// with its default configuration, and its version must match as it would in a
+// workload URI.
+func WorkloadTableSchema(generator, table, version string) ([]ColumnSpec, error) {
+	conf := &roachpb.ExternalStorage_Workload{Generator: generator, Version: version}
+	gen, err := resolveWorkloadGenerator(conf)
+	if err != nil {
+		return nil, err
+	}
+	t, err := findWorkloadTable(gen, gen.Tables(), table)
+	if err != nil {
+		return nil, err
+	}
+	defs, err := workloadColumnDefs(t)
+	if err != nil {
+		return nil, err
+	}
+	cols := make([]ColumnSpec, len(defs))
+	for i, def := range defs {
+		typ, ok := tree.GetStaticallyKnownType(def.Type)
+		if !ok {
+			return nil, errors.Errorf(`column %s of table %s has unsupported type %s`,
+				def.Name, t.Name, def.Type.SQLString())
+		}
+		cols[i] = ColumnSpec{Name: string(def.Name), Type: typ}
+	}
+	return cols, nil
+}
+
+// workloadSizeSampleBatches is the number of batches, spread evenly across the
+// range, that EstimateWorkloadSize generates.
+const workloadSizeSampleBatches = 16
+
+// EstimateWorkloadSize returns an estimate of the size in bytes of the CSV data
+// of the rows [rowStart, rowEnd) of the table of the named generator, at its
+// default configuration, as they are numbered by the row-start and row-end
+// parameters of workload URIs. A rowEnd of zero is the end of the table. Only a
+// sample of the rows is generated, so the estimate is cheaper than the exact
+// Size, but it is only as accurate as the sampled rows are representative of
+// the others.
+func EstimateWorkloadSize(generator, table, version string, rowStart, rowEnd int64) (int64, error) {
+	conf := &roachpb.ExternalStorage_Workload{Generator: generator, Version: version}
+	gen, err := resolveWorkloadGenerator(conf)
+	if err != nil {
+		return 0, err
+	}
+	t, err := findWorkloadTable(gen, gen.Tables(), table)
+	if err != nil {
+		return 0, err
+	}
+	numBatches := int64(t.InitialRows.NumBatches)
+	if rowEnd == 0 {
+		rowEnd = numBatches
+	}
+	if rowStart < 0 || rowStart > rowEnd || rowEnd > numBatches {
+		return 0, errors.Errorf(`rows [%d, %d) are not within table %s, which has %d rows`,
+			rowStart, rowEnd, t.Name, numBatches)
 	}
-	for _, t := range gen.Tables() {
-		if t.Name == conf.Table {
-			s.table = t
-			break
+	count := rowEnd - rowStart
+	if count == 0 {
+		return 0, nil
+	}
+	samples := int64(workloadSizeSampleBatches)
+	if count < samples {
+		samples = count
+	}
+	var sampled int64
+	for i := int64(0); i < samples; i++ {
+		batchIdx := int(rowStart + i*count/samples)
+		n, err := io.Copy(ioutil.Discard, workload.NewCSVRowsReader(t, batchIdx, batchIdx+1))
+		if err != nil {
+			return 0, err
+		}
+		sampled += n
+	}
+	return sampled * count / samples, nil
+}
+
+// WorkloadMeta describes a registered workload generator, as resolved with its
+// default configuration.
+type WorkloadMeta struct {
+	Name        string
+	Description string
+	Version     string
+	Tables      []WorkloadTableMeta
+	// Flags are the parameters that a workload URI can configure the generator
+	// with, sorted by name.
+	Flags []FlagSpec
+}
+
+// WorkloadTableMeta describes a table of a workload generator.
+type WorkloadTableMeta struct {
+	Name string
+	// RowCount is the number of rows of the table according to the statistics
+	// of the generator, or -1 if it has none for the table.
+	RowCount int64
+}
+
+// FlagSpec describes a flag of a workload generator.
+type FlagSpec struct {
+	Name    string
+	Type    string
+	Default string
+	Usage   string
+	// RuntimeOnly is set for flags that do not affect the generated data.
+	RuntimeOnly bool
+}
+
+// ListWorkloadGenerators returns the registered workload generators, sorted by
+// name. Each is resolved as makeWorkloadStorage resolves it for a URI with its
+// version and no parameters; the generators that fail to resolve are omitted.
+func ListWorkloadGenerators() []WorkloadMeta {
+	var metas []WorkloadMeta
+	for _, reg := range workload.Registered() {
+		conf := &roachpb.ExternalStorage_Workload{Generator: reg.Name, Version: reg.Version}
+		gen, err := resolveWorkloadGenerator(conf)
+		if err != nil {
+			continue
 		}
+		meta := WorkloadMeta{Name: reg.Name, Description: reg.Description, Version: reg.Version}
+		for _, t := range gen.Tables() {
+			rowCount := int64(-1)
+			if len(t.Stats) > 0 {
+				rowCount = int64(t.Stats[0].RowCount)
+			}
+			meta.Tables = append(meta.Tables, WorkloadTableMeta{Name: t.Name, RowCount: rowCount})
+		}
+		meta.Flags = workloadFlagSpecs(gen)
+		metas = append(metas, meta)
+	}
+	return metas
+}
+
+// WorkloadGeneratorFlags returns the flags of the given generator, which are
+// the parameters that a workload URI can configure it with, sorted by name.
+// The generator is resolved as makeWorkloadStorage resolves it, so its version
+// must match as it would in a workload URI.
+func WorkloadGeneratorFlags(generator, version string) ([]FlagSpec, error) {
+	conf := &roachpb.ExternalStorage_Workload{Generator: generator, Version: version}
+	gen, err := resolveWorkloadGenerator(conf)
+	if err != nil {
+		return nil, err
 	}
-	if s.table.Name == `` {
-		return nil, errors.Errorf(`unknown table %s for generator %s`, conf.Table, meta.Name)
+	return workloadFlagSpecs(gen), nil
+}
+
+// workloadFlagSpecs returns the flags of gen, sorted by name, or nil if it has
+// none.
+func workloadFlagSpecs(gen workload.Generator) []FlagSpec {
+	f, ok := gen.(workload.Flagser)
+	if !ok {
+		return nil
 	}
-	return s, nil
+	var specs []FlagSpec
+	flags := f.Flags()
+	flags.VisitAll(func(flag *pflag.Flag) {
+		specs = append(specs, FlagSpec{
+			Name:        flag.Name,
+			Type:        flag.Value.Type(),
+			Default:     flag.DefValue,
+			Usage:       flag.Usage,
+			RuntimeOnly: flags.Meta[flag.Name].RuntimeOnly,
+		})
+	})
+	return specs
+}
+
+// resolveTable returns the table whose data is read for basename. If the URI
+// named a table, basename must be empty; otherwise it must name a table of the
+// generator.
+func (s *workloadStorage) resolveTable(basename string) (workload.Table, error) {
+	if s.conf.Table != `` {
+		if basename != `` {
+			return workload.Table{}, errors.Errorf(`basenames are not supported by workload storage`)
+		}
+		return s.table, nil
+	}
+	if basename == `` {
+		return workload.Table{}, errors.Errorf(
+			`a table basename is required when the workload URI does not name a table`)
+	}
+	for _, t := range s.tables {
+		if t.Name == basename {
+			return t, nil
+		}
+	}
+	return workload.Table{}, withWorkloadTablesHint(errors.Wrapf(ErrFileDoesNotExist,
+		`unknown table %s for generator %s`, basename, s.conf.Generator), s.tables)
+}
+
+// withWorkloadTablesHint decorates err with a hint listing the names of tables
+// in sorted order.
+func withWorkloadTablesHint(err error, tables []workload.Table) error {
+	names := make([]string, len(tables))
+	for i, t := range tables {
+		names[i] = t.Name
+	}
+	sort.Strings(names)
+	return errors.WithHintf(err, `valid tables: %s`, strings.Join(names, `, `))
 }
 
 func (s *workloadStorage) Conf() roachpb.ExternalStorage {
@@ -97,34 +444,1063 @@ func (s *workloadStorage) Settings() *cluster.Settings {
 	return s.settings
 }
 
+// ReadFileAt implements the ExternalStorage interface. The size of uncompressed
+// data is found from the offsets of its batches, which reading from offset
+// needs anyway, so the data is only generated once before the read.
 func (s *workloadStorage) ReadFileAt(
-	_ context.Context, basename string, offset int64,
+	ctx context.Context, basename string, offset int64,
 ) (io.ReadCloser, int64, error) {
-	panic("unimplemented")
+	if offset < 0 {
+		return nil, 0, errors.Errorf(`negative offset %d is not supported by workload storage`, offset)
+	}
+	table, err := s.resolveTable(basename)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := s.size(ctx, table)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > size {
+		return nil, 0, errors.Errorf(
+			`offset %d is past the end of workload data of size %d`, offset, size)
+	}
+	r, err := s.newWorkloadReader(ctx, basename, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.limitReader(ctx, r), size, nil
+}
+
+// ReadFile implements the ExternalStorage interface. The returned reader also
+// implements io.Seeker and WorkloadCheckpointer.
+func (s *workloadStorage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	r, err := s.newWorkloadReader(ctx, basename, 0 /* offset */)
+	if err != nil {
+		return nil, err
+	}
+	return s.limitReader(ctx, r), nil
+}
+
+// ReadFileFromCheckpoint returns a reader of the data of the table that token,
+// returned by the Checkpoint of a reader of s, was taken from, starting at the
+// row it was taken at. The token must have been taken with the same
+// configuration as s.
+func (s *workloadStorage) ReadFileFromCheckpoint(
+	ctx context.Context, token string,
+) (io.ReadCloser, error) {
+	c, err := decodeWorkloadCheckpoint(token)
+	if err != nil {
+		return nil, err
+	}
+	if c.Conf != workloadConfFingerprint(s.conf) {
+		return nil, errors.New(`checkpoint token was taken from a different workload configuration`)
+	}
+	basename := c.Table
+	if s.conf.Table != `` {
+		if c.Table != s.table.Name {
+			return nil, errors.Errorf(`checkpoint token is for table %s, not %s`, c.Table, s.table.Name)
+		}
+		basename = ``
+	}
+	table, err := s.resolveTable(basename)
+	if err != nil {
+		return nil, err
+	}
+	boundaries, err := s.checkpointBoundaries(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	begin := s.conf.BatchBegin
+	if c.Batch < begin || c.Batch-begin >= int64(len(boundaries)) {
+		return nil, errors.Errorf(`checkpoint token batch %d is outside of the range of batches [%d, %d]`,
+			c.Batch, begin, begin+int64(len(boundaries))-1)
+	}
+	r, err := s.newWorkloadReader(ctx, basename, boundaries[c.Batch-begin])
+	if err != nil {
+		return nil, err
+	}
+	return s.limitReader(ctx, r), nil
+}
+
+// ReadFileFromCheckpoint returns a reader of the data of the workload storage
+// es from the checkpoint token, which was returned by the Checkpoint of one of
+// its readers. Other storage does not support checkpoints.
+func ReadFileFromCheckpoint(
+	ctx context.Context, es cloud.ExternalStorage, token string,
+) (io.ReadCloser, error) {
+	s, ok := es.(*workloadStorage)
+	if !ok {
+		return nil, errors.Mark(
+			errors.Newf(`%s storage does not support checkpoints`, es.Conf().Provider), ErrUnsupported)
+	}
+	return s.ReadFileFromCheckpoint(ctx, token)
+}
+
+// limitReader returns r, whose reads are limited by the read limit, as an
+// io.ReadCloser that still implements io.Seeker and WorkloadCheckpointer.
+func (s *workloadStorage) limitReader(ctx context.Context, r *workloadReader) io.ReadCloser {
+	limited := s.limiters.limitReader(ctx, r)
+	if limited == io.ReadCloser(r) {
+		return r
+	}
+	return struct {
+		io.ReadCloser
+		io.Seeker
+		WorkloadCheckpointer
+	}{limited, r, r}
+}
+
+func (s *workloadStorage) newWorkloadReader(
+	ctx context.Context, basename string, offset int64,
+) (*workloadReader, error) {
+	table, err := s.resolveTable(basename)
+	if err != nil {
+		return nil, err
+	}
+	r := &workloadReader{ctx: ctx, s: s, basename: basename, table: table, pos: offset}
+	// Open the data eagerly so that any error generating it is returned here.
+	if r.r, err = s.openAt(ctx, table, offset, &r.rows); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// openAt returns a reader of the data of table, starting offset bytes into it.
+// If rows is non-nil, it is atomically incremented by the number of rows
+// generated.
+func (s *workloadStorage) openAt(
+	ctx context.Context, table workload.Table, offset int64, rows *int64,
+) (io.ReadCloser, error) {
+	if s.conf.HeaderOnly {
+		return s.openHeaderAt(ctx, table, offset)
+	}
+	batchBegin, batchEnd := int(s.conf.BatchBegin), int(s.conf.BatchEnd)
+	if batchEnd == 0 {
+		batchEnd = table.InitialRows.NumBatches
+	}
+	var header []byte
+	if s.conf.Header {
+		var err error
+		if header, err = s.header(table); err != nil {
+			return nil, err
+		}
+	}
+	skip := offset
+	// Compressed data has no batch boundaries to start at, so it is always
+	// generated from the beginning. An offset within the header also starts
+	// there, and one past it is an offset into the rows that follow it.
+	if rowsOffset := offset - int64(len(header)); rowsOffset > 0 && s.conf.Compression == `` {
+		offsets, err := s.batchOffsets(ctx, table)
+		if err != nil {
+			return nil, err
+		}
+		i := sort.Search(len(offsets), func(i int) bool { return offsets[i] > rowsOffset }) - 1
+		batchBegin += i
+		skip = rowsOffset - offsets[i]
+		header = nil
+	}
+	r, err := s.generate(ctx, table, batchBegin, batchEnd, rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > 0 {
+		r = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(header), r), r}
+	}
+	if s.conf.MaxBytes != 0 {
+		// The cap is relative to the beginning of the data, which offset-skip
+		// bytes of precede batchBegin.
+		r = &maxBytesReader{
+			r: r, maxBytes: s.conf.MaxBytes - (offset - skip),
+			csv: s.format == `csv` || s.format == `tsv`,
+		}
+	}
+	if s.conf.Compression == `gzip` {
+		r = newGzipReader(r)
+	}
+	r = &ctxReader{ctx: ctx, ReadCloser: r}
+	// An offset past the end of the data leaves r at EOF.
+	if _, err := io.CopyN(ioutil.Discard, r, skip); err != nil && err != io.EOF {
+		_ = r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// openHeaderAt returns a reader of the header row of table, starting offset
+// bytes into it.
+func (s *workloadStorage) openHeaderAt(
+	ctx context.Context, table workload.Table, offset int64,
+) (io.ReadCloser, error) {
+	header, err := s.header(table)
+	if err != nil {
+		return nil, err
+	}
+	r := ioutil.NopCloser(bytes.NewReader(header))
+	if s.conf.Compression == `gzip` {
+		r = newGzipReader(r)
+	}
+	r = &ctxReader{ctx: ctx, ReadCloser: r}
+	if _, err := io.CopyN(ioutil.Discard, r, offset); err != nil && err != io.EOF {
+		_ = r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// header returns the header row of table: the names of its columns, written
+// with the same delimiter and quoting as its rows, or padded to the widths of
+// their columns in the fixed format.
+func (s *workloadStorage) header(table workload.Table) ([]byte, error) {
+	names, err := workloadColumnNames(table)
+	if err != nil {
+		return nil, err
+	}
+	if s.format == `fixed` {
+		opts, err := s.fixedWidthOptions(table)
+		if err != nil {
+			return nil, err
+		}
+		return workload.AppendFixedWidthRow(nil, names, names, opts)
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if s.opts.Comma != 0 {
+		w.Comma = s.opts.Comma
+	}
+	w.Quote = s.opts.Quote
+	if err := w.Write(names); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// generate returns a reader of the uncompressed data of the batches of table
+// in [batchBegin, batchEnd). If rows is non-nil, it is atomically incremented
+// by the number of rows generated.
+func (s *workloadStorage) generate(
+	ctx context.Context, table workload.Table, batchBegin, batchEnd int, rows *int64,
+) (io.ReadCloser, error) {
+	if rows != nil {
+		fillBatch := table.InitialRows.FillBatch
+		table.InitialRows.FillBatch = func(
+			batchIdx int, cb coldata.Batch, a *bufalloc.ByteAllocator,
+		) {
+			fillBatch(batchIdx, cb, a)
+			atomic.AddInt64(rows, int64(cb.Length()))
+		}
+	}
+	var columnNames []string
+	var fixed workload.FixedWidthOptions
+	if s.format == `ndjson` || s.format == `fixed` {
+		var err error
+		if columnNames, err = workloadColumnNames(table); err != nil {
+			return nil, err
+		}
+	}
+	if s.format == `fixed` {
+		var err error
+		if fixed, err = s.fixedWidthOptions(table); err != nil {
+			return nil, err
+		}
+	}
+	newReader := func(batchBegin, batchEnd int) io.Reader {
+		switch s.format {
+		case `ndjson`:
+			return workload.NewJSONRowsReader(table, columnNames, batchBegin, batchEnd)
+		case `fixed`:
+			return workload.NewFixedWidthRowsReader(table, columnNames, batchBegin, batchEnd, fixed)
+		}
+		return workload.NewCSVRowsReaderWithOptions(table, batchBegin, batchEnd, s.opts)
+	}
+	if s.conf.Parallelism > 1 {
+		parallelism := int(s.conf.Parallelism)
+		return newParallelWorkloadReader(ctx, batchBegin, batchEnd, parallelism, newReader), nil
+	}
+	return ioutil.NopCloser(newReader(batchBegin, batchEnd)), nil
+}
+
+// fixedWidthOptions returns the options of the fixed format output of table:
+// the widths of its columns given by the URI, or if it gives none, those
+// derived from the types of the columns.
+func (s *workloadStorage) fixedWidthOptions(
+	table workload.Table,
+) (workload.FixedWidthOptions, error) {
+	opts := workload.FixedWidthOptions{Truncate: s.conf.Truncate, Null: s.conf.NullAs}
+	defs, err := workloadColumnDefs(table)
+	if err != nil {
+		return opts, err
+	}
+	if len(s.conf.Widths) > 0 {
+		if len(s.conf.Widths) != len(defs) {
+			return opts, errors.Errorf(`%d widths were given but table %s has %d columns`,
+				len(s.conf.Widths), table.Name, len(defs))
+		}
+		for _, w := range s.conf.Widths {
+			opts.Widths = append(opts.Widths, int(w))
+		}
+		return opts, nil
+	}
+	for _, def := range defs {
+		typ, ok := tree.GetStaticallyKnownType(def.Type)
+		width := 0
+		if ok {
+			width = workloadFixedWidth(typ)
+		}
+		if width == 0 {
+			return opts, errors.WithHint(errors.Errorf(
+				`cannot derive the width of column %s of table %s from its type %s`,
+				def.Name, table.Name, def.Type.SQLString()),
+				`the widths of the columns can be given with the widths parameter`)
+		}
+		opts.Widths = append(opts.Widths, width)
+	}
+	return opts, nil
+}
+
+// workloadFixedWidth returns the width in characters that fits every value of
+// typ, or zero if the values of typ have no bounded width.
+func workloadFixedWidth(typ *types.T) int {
+	switch typ.Family() {
+	case types.BoolFamily:
+		return len(`false`)
+	case types.IntFamily:
+		switch typ.Width() {
+		case 16:
+			return len(`-32768`)
+		case 32:
+			return len(`-2147483648`)
+		}
+		return len(`-9223372036854775808`)
+	case types.StringFamily, types.CollatedStringFamily:
+		return int(typ.Width())
+	case types.DecimalFamily:
+		if typ.Precision() == 0 {
+			return 0
+		}
+		// The digits, a sign and a decimal point.
+		return int(typ.Precision()) + 2
+	case types.DateFamily:
+		return len(`2006-01-02`)
+	case types.UuidFamily:
+		return len(`00000000-0000-0000-0000-000000000000`)
+	}
+	return 0
+}
+
+// batchOffsets returns the offset in bytes of the start of each batch of the
+// uncompressed data of table, followed by the total size of the data.
+func (s *workloadStorage) batchOffsets(ctx context.Context, table workload.Table) ([]int64, error) {
+	s.mu.Lock()
+	offsets, ok := s.mu.batchOffsets[table.Name]
+	s.mu.Unlock()
+	if ok {
+		return offsets, nil
+	}
+	// The data is generated without holding the lock, so that reads of the
+	// other tables, and of this one from cached offsets, do not wait for it.
+	batchBegin, batchEnd := int(s.conf.BatchBegin), int(s.conf.BatchEnd)
+	if batchEnd == 0 {
+		batchEnd = table.InitialRows.NumBatches
+	}
+	offsets = make([]int64, 0, batchEnd-batchBegin+1)
+	var offset int64
+	for batchIdx := batchBegin; batchIdx < batchEnd; batchIdx++ {
+		offsets = append(offsets, offset)
+		r, err := s.generate(ctx, table, batchIdx, batchIdx+1, nil /* rows */)
+		if err != nil {
+			return nil, err
+		}
+		n, err := io.Copy(ioutil.Discard, &ctxReader{ctx: ctx, ReadCloser: r})
+		if closeErr := r.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset += n
+	}
+	offsets = append(offsets, offset)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.batchOffsets[table.Name] = offsets
+	return offsets, nil
+}
+
+// maxBytesReader is an io.ReadCloser that ends the data read from r at the
+// last row boundary before it exceeds maxBytes.
+type maxBytesReader struct {
+	r        io.ReadCloser
+	maxBytes int64
+	// csv is true if the data is CSV, in which case newlines within quoted
+	// fields are not row boundaries. Other formats never have raw newlines
+	// within a row.
+	csv bool
+
+	// buf holds the data read from r but not yet returned. Its first complete
+	// bytes end on a row boundary within maxBytes, and its first scanned bytes
+	// have been checked for row boundaries.
+	buf      []byte
+	complete int
+	scanned  int
+	// quoted is whether the data at scanned is within a quoted CSV field.
+	quoted bool
+	// returned is the number of bytes returned so far.
+	returned int64
+	// err, if set, is returned once buf has no complete rows left. It is io.EOF
+	// once the cap is reached or r is exhausted.
+	err   error
+	chunk [32 << 10]byte
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	for m.complete == 0 {
+		if m.err != nil {
+			return 0, m.err
+		}
+		m.fill()
+	}
+	n := copy(p, m.buf[:m.complete])
+	m.buf = m.buf[n:]
+	m.complete -= n
+	m.scanned -= n
+	m.returned += int64(n)
+	return n, nil
+}
+
+// fill reads more data from r into buf and advances complete to the last row
+// boundary within maxBytes.
+func (m *maxBytesReader) fill() {
+	n, err := m.r.Read(m.chunk[:])
+	m.buf = append(m.buf, m.chunk[:n]...)
+	for ; m.scanned < len(m.buf); m.scanned++ {
+		switch m.buf[m.scanned] {
+		case '"':
+			if m.csv {
+				m.quoted = !m.quoted
+			}
+		case '\n':
+			if m.quoted {
+				continue
+			}
+			if m.returned+int64(m.scanned)+1 > m.maxBytes {
+				m.err = io.EOF
+				return
+			}
+			m.complete = m.scanned + 1
+		}
+	}
+	if err != nil {
+		m.err = err
+	}
+}
+
+func (m *maxBytesReader) Close() error {
+	return m.r.Close()
+}
+
+// WorkloadCheckpointer is implemented by the readers of workload storage.
+type WorkloadCheckpointer interface {
+	// Checkpoint returns an opaque token of the last row boundary at or before
+	// the current position of the reader, from which ReadFileFromCheckpoint
+	// reads the data again. The rows read since that boundary are read again
+	// when resuming. Checkpoints are not supported for compressed data or
+	// header-only reads.
+	Checkpoint() (string, error)
+}
+
+// workloadCheckpoint is the content of a checkpoint token.
+type workloadCheckpoint struct {
+	// Conf is the fingerprint of the configuration of the storage the token was
+	// taken from.
+	Conf uint64 `json:"c"`
+	// Table is the name of the table that was read.
+	Table string `json:"t"`
+	// Batch is the index of the batch that the data is read from when resuming.
+	Batch int64 `json:"b"`
+}
+
+func (c workloadCheckpoint) encode() (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return ``, err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeWorkloadCheckpoint(token string) (workloadCheckpoint, error) {
+	var c workloadCheckpoint
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return workloadCheckpoint{}, errors.Wrap(err, `invalid checkpoint token`)
+	}
+	return c, nil
+}
+
+// workloadConfFingerprint returns a hash of conf, which determines the data of
+// each table. The flags are hashed in sorted order, as their order in conf
+// depends on the order in which the URI was parsed.
+func workloadConfFingerprint(conf *roachpb.ExternalStorage_Workload) uint64 {
+	c := *conf
+	c.Flags = append([]string(nil), conf.Flags...)
+	sort.Strings(c.Flags)
+	data, err := protoutil.Marshal(&c)
+	if err != nil {
+		// The config is always marshalable.
+		panic(err)
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	return h.Sum64()
+}
+
+// checkpointBoundaries returns the offset in bytes of the data of table that
+// reading from each batch of the configured range starts at, followed by the
+// offset of the end of the range. The first batch of the range is read from
+// the beginning of the data, so that any header is read again along with it.
+func (s *workloadStorage) checkpointBoundaries(
+	ctx context.Context, table workload.Table,
+) ([]int64, error) {
+	if s.conf.Compression != `` || s.conf.HeaderOnly {
+		return nil, errors.Mark(errors.New(
+			`checkpoints are not supported for compressed or header-only workload data`), ErrUnsupported)
+	}
+	offsets, err := s.batchOffsets(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	var headerLen int64
+	if s.conf.Header {
+		header, err := s.header(table)
+		if err != nil {
+			return nil, err
+		}
+		headerLen = int64(len(header))
+	}
+	boundaries := make([]int64, len(offsets))
+	for i := 1; i < len(offsets); i++ {
+		boundaries[i] = headerLen + offsets[i]
+	}
+	return boundaries, nil
+}
+
+// workloadReader is the io.ReadCloser returned by ReadFile. The data is
+// generated deterministically, so it also implements io.Seeker by generating
+// the data again from the new offset. It counts the bytes read through it and
+// reports them, along with the number of rows generated, to telemetry when
+// closed.
+type workloadReader struct {
+	ctx      context.Context
+	s        *workloadStorage
+	basename string
+	table    workload.Table
+	// r reads the data from pos, or is nil after a Seek until the next Read
+	// opens it at the new pos.
+	r      io.ReadCloser
+	pos    int64
+	bytes  int64
+	rows   int64 // accessed atomically
+	closed bool
+}
+
+var _ io.ReadSeeker = &workloadReader{}
+
+func (r *workloadReader) Read(p []byte) (int, error) {
+	if r.r == nil {
+		var err error
+		if r.r, err = r.s.openAt(r.ctx, r.table, r.pos, &r.rows); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.r.Read(p)
+	r.pos += int64(n)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker. Seeking past the end of the data is allowed, and
+// subsequent reads return io.EOF.
+func (r *workloadReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		size, err := r.s.Size(r.ctx, r.basename)
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, errors.Errorf(`invalid whence: %d`, whence)
+	}
+	if offset < 0 {
+		return 0, errors.Errorf(`negative offset %d is not supported by workload storage`, offset)
+	}
+	if offset == r.pos {
+		return offset, nil
+	}
+	if r.r != nil {
+		err := r.r.Close()
+		r.r = nil
+		if err != nil {
+			return 0, err
+		}
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Checkpoint implements the WorkloadCheckpointer interface.
+func (r *workloadReader) Checkpoint() (string, error) {
+	boundaries, err := r.s.checkpointBoundaries(r.ctx, r.table)
+	if err != nil {
+		return ``, err
+	}
+	i := sort.Search(len(boundaries), func(i int) bool { return boundaries[i] > r.pos }) - 1
+	return workloadCheckpoint{
+		Conf:  workloadConfFingerprint(r.s.conf),
+		Table: r.table.Name,
+		Batch: r.s.conf.BatchBegin + int64(i),
+	}.encode()
+}
+
+func (r *workloadReader) Close() error {
+	var err error
+	if r.r != nil {
+		// Closing the inner reader waits for any generation in progress, so the
+		// count of rows is final afterwards.
+		err = r.r.Close()
+		r.r = nil
+	}
+	if !r.closed {
+		r.closed = true
+		telemetry.CountBucketed(`external-io.workload.read-bytes`, r.bytes)
+		telemetry.CountBucketed(`external-io.workload.read-rows`, atomic.LoadInt64(&r.rows))
+	}
+	return err
+}
+
+const workloadVersionHint = `the version must be an exact version such as 1.0.0, ` +
+	`a version ending in x such as 1.x or 1.2.x to accept any version with the same ` +
+	`leading components, or a minimum version such as >=1.0.0`
+
+// isUnversionedWorkload returns whether v is the version of a generator that
+// does not version its data.
+func isUnversionedWorkload(v string) bool {
+	return v == `` || v == workload.Unversioned
+}
+
+// workloadVersionMatches returns whether the version of a generator satisfies
+// the version requested by a workload URI. See workloadVersionHint for the
+// forms the requested version can take.
+func workloadVersionMatches(requested, actual string) (bool, error) {
+	if min := strings.TrimPrefix(requested, `>=`); min != requested {
+		minVersion, err := version.Parse(`v` + min)
+		if err != nil {
+			return false, errors.WithHint(
+				errors.Errorf(`invalid minimum version: %s`, requested), workloadVersionHint)
+		}
+		actualVersion, err := version.Parse(`v` + actual)
+		if err != nil {
+			return false, errors.Wrapf(err, `cannot compare version %s to %s`, actual, requested)
+		}
+		return actualVersion.AtLeast(minVersion), nil
+	}
+	if prefix := strings.TrimSuffix(requested, `.x`); prefix != requested {
+		if len(prefix) == 0 || strings.Contains(prefix, `x`) {
+			return false, errors.WithHint(
+				errors.Errorf(`invalid version range: %s`, requested), workloadVersionHint)
+		}
+		return strings.HasPrefix(actual, prefix+`.`), nil
+	}
+	return requested == actual, nil
+}
+
+// ctxReader is an io.ReadCloser that fails every Read once its context is
+// done, so that generation of workload data stops when the operation reading
+// it is canceled.
+type ctxReader struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p)
+}
+
+// workloadParallelChunkBatches is the maximum number of batches generated as
+// one unit of work by a parallelWorkloadReader.
+const workloadParallelChunkBatches = 16
+
+// parallelWorkloadReader is an io.ReadCloser that generates a range of batches
+// by splitting it into chunks, generating up to parallelism chunks
+// concurrently and streaming them back in order through a pipe.
+type parallelWorkloadReader struct {
+	pr   *io.PipeReader
+	done chan struct{}
+}
+
+type workloadChunk struct {
+	data []byte
+	err  error
+}
+
+func newParallelWorkloadReader(
+	ctx context.Context,
+	batchBegin, batchEnd, parallelism int,
+	newReader func(batchBegin, batchEnd int) io.Reader,
+) *parallelWorkloadReader {
+	pr, pw := io.Pipe()
+	p := &parallelWorkloadReader{pr: pr, done: make(chan struct{})}
+
+	chunkBatches := (batchEnd - batchBegin + parallelism - 1) / parallelism
+	if chunkBatches > workloadParallelChunkBatches {
+		chunkBatches = workloadParallelChunkBatches
+	} else if chunkBatches < 1 {
+		chunkBatches = 1
+	}
+
+	// Each chunk is handed to the writer, in order, as a channel that receives
+	// its data once generated. Bounding the queue bounds the number of chunks
+	// being generated or buffered at once.
+	pending := make(chan chan workloadChunk, parallelism)
+	stop := make(chan struct{})
+	go func() {
+		defer close(pending)
+		for begin := batchBegin; begin < batchEnd; begin += chunkBatches {
+			end := begin + chunkBatches
+			if end > batchEnd {
+				end = batchEnd
+			}
+			res := make(chan workloadChunk, 1)
+			select {
+			case pending <- res:
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+			go func(begin, end int) {
+				r := &ctxReader{ctx: ctx, ReadCloser: ioutil.NopCloser(newReader(begin, end))}
+				data, err := ioutil.ReadAll(r)
+				res <- workloadChunk{data: data, err: err}
+			}(begin, end)
+		}
+	}()
+	go func() {
+		defer close(p.done)
+		var err error
+		for res := range pending {
+			chunk := <-res
+			if err != nil {
+				// Keep draining so that every generating goroutine exits.
+				continue
+			}
+			if err = chunk.err; err == nil {
+				_, err = pw.Write(chunk.data)
+			}
+			if err != nil {
+				close(stop)
+			}
+		}
+		if err == nil {
+			// The producer stops early if the context is done, so don't let the
+			// output appear complete.
+			err = ctx.Err()
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	return p
+}
+
+func (p *parallelWorkloadReader) Read(b []byte) (int, error) {
+	return p.pr.Read(b)
+}
+
+// Close stops the generation of any remaining chunks and waits for all of the
+// goroutines to exit.
+func (p *parallelWorkloadReader) Close() error {
+	err := p.pr.Close()
+	<-p.done
+	return err
+}
+
+// workloadColumnNames returns the names of the columns of t, in the order they
+// are generated, as declared by its schema.
+func workloadColumnNames(t workload.Table) ([]string, error) {
+	defs, err := workloadColumnDefs(t)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(defs))
+	for i, def := range defs {
+		names[i] = string(def.Name)
+	}
+	return names, nil
+}
+
+// workloadColumnDefs returns the definitions of the columns of t, as declared
+// by its schema.
+func workloadColumnDefs(t workload.Table) ([]*tree.ColumnTableDef, error) {
+	stmt, err := parser.ParseOne(fmt.Sprintf(`CREATE TABLE %s %s`, t.Name, t.Schema))
+	if err != nil {
+		return nil, errors.Wrapf(err, `parsing schema of table %s`, t.Name)
+	}
+	create, ok := stmt.AST.(*tree.CreateTable)
+	if !ok {
+		return nil, errors.AssertionFailedf(`expected CREATE TABLE but got %T`, stmt.AST)
+	}
+	var defs []*tree.ColumnTableDef
+	for _, def := range create.Defs {
+		if col, ok := def.(*tree.ColumnTableDef); ok {
+			defs = append(defs, col)
+		}
+	}
+	return defs, nil
+}
+
+// gzipReader is an io.ReadCloser that yields the gzip compressed contents of
+// an underlying reader. The compression happens in a goroutine writing to a
+// pipe, which is torn down by Close.
+type gzipReader struct {
+	r    io.ReadCloser
+	pr   *io.PipeReader
+	done chan struct{}
+}
+
+func newGzipReader(r io.ReadCloser) *gzipReader {
+	pr, pw := io.Pipe()
+	g := &gzipReader{r: r, pr: pr, done: make(chan struct{})}
+	go func() {
+		defer close(g.done)
+		gw := gzip.NewWriter(pw)
+		_, err := io.Copy(gw, r)
+		// Closing the gzip writer flushes any buffered data and writes the gzip
+		// footer, so it must happen before the pipe is closed.
+		if closeErr := gw.Close(); err == nil {
+			err = closeErr
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	return g
+}
+
+func (g *gzipReader) Read(p []byte) (int, error) {
+	return g.pr.Read(p)
 }
 
-func (s *workloadStorage) ReadFile(_ context.Context, basename string) (io.ReadCloser, error) {
-	if basename != `` {
-		return nil, errors.Errorf(`basenames are not supported by workload storage`)
+// Close stops the compression goroutine (if it is still running), waits for it
+// to exit and closes the underlying reader.
+func (g *gzipReader) Close() error {
+	err := g.pr.Close()
+	<-g.done
+	if closeErr := g.r.Close(); err == nil {
+		err = closeErr
 	}
-	r := workload.NewCSVRowsReader(s.table, int(s.conf.BatchBegin), int(s.conf.BatchEnd))
-	return ioutil.NopCloser(r), nil
+	return err
 }
 
+// WriteFile is not supported, as workload storage only generates files. Note
+// that a generated file written to other storage is generated again from its
+// start whenever that storage seeks it back to retry the write.
 func (s *workloadStorage) WriteFile(_ context.Context, _ string, _ io.ReadSeeker) error {
-	return errors.Errorf(`workload storage does not support writes`)
+	return readOnlyError(errors.New(`workload storage does not support writes`))
+}
+
+func (s *workloadStorage) WriteFileIfNotExists(_ context.Context, _ string, _ io.ReadSeeker) error {
+	return readOnlyError(errors.New(`workload storage does not support writes`))
+}
+
+// ListFiles returns one basename per table of the generator. It is only
+// supported if the URI does not name a table.
+func (s *workloadStorage) ListFiles(ctx context.Context, patternSuffix string) ([]string, error) {
+	files, err := s.listFiles(ctx, patternSuffix, false /* sized */)
+	return fileEntryPaths(files), err
 }
 
-func (s *workloadStorage) ListFiles(_ context.Context, _ string) ([]string, error) {
-	return nil, errors.Errorf(`workload storage does not support listing files`)
+// ListFilesExt implements the ExternalStorage interface. The size of each table
+// is computed as by Size, which generates its data the first time.
+func (s *workloadStorage) ListFilesExt(
+	ctx context.Context, patternSuffix string,
+) ([]cloud.FileEntry, error) {
+	return s.listFiles(ctx, patternSuffix, true /* sized */)
+}
+
+func (s *workloadStorage) listFiles(
+	ctx context.Context, patternSuffix string, sized bool,
+) ([]cloud.FileEntry, error) {
+	if s.conf.Table != `` {
+		return nil, listingUnsupportedError(errors.New(`workload storage does not support listing files`))
+	}
+	var fileList []cloud.FileEntry
+	for _, t := range s.tables {
+		entry := cloud.FileEntry{Path: t.Name}
+		if patternSuffix == `` {
+			entry.Path = WorkloadTableURI(s.conf, t.Name)
+		} else if matches, err := path.Match(patternSuffix, t.Name); err != nil {
+			return nil, err
+		} else if !matches {
+			continue
+		}
+		if sized {
+			var err error
+			if entry.Size, err = s.Size(ctx, t.Name); err != nil {
+				return nil, err
+			}
+		}
+		fileList = append(fileList, entry)
+	}
+	return sortFileEntries(fileList), nil
 }
 
 func (s *workloadStorage) Delete(_ context.Context, _ string) error {
-	return errors.Errorf(`workload storage does not support deletes`)
+	return readOnlyError(errors.New(`workload storage does not support deletes`))
+}
+
+func (s *workloadStorage) DeleteAll(_ context.Context, _ string) error {
+	return readOnlyError(errors.New(`workload storage does not support deletes`))
 }
-func (s *workloadStorage) Size(_ context.Context, _ string) (int64, error) {
-	return 0, errors.Errorf(`workload storage does not support sizing`)
+
+func (s *workloadStorage) Size(ctx context.Context, basename string) (int64, error) {
+	table, err := s.resolveTable(basename)
+	if err != nil {
+		return 0, err
+	}
+	return s.size(ctx, table)
 }
+
+// size returns the length in bytes of the data of table.
+func (s *workloadStorage) size(ctx context.Context, table workload.Table) (int64, error) {
+	if s.conf.Compression == `` {
+		return s.uncompressedSize(ctx, table)
+	}
+	s.mu.Lock()
+	size, ok := s.mu.sizes[table.Name]
+	s.mu.Unlock()
+	if ok {
+		return size, nil
+	}
+	// The data is generated deterministically, so the total size can be found
+	// by generating it once and counting the bytes. This is not a read of the
+	// data, so it is not counted in telemetry. It is generated without holding
+	// the lock, so that the other tables can be read in the meantime.
+	r, err := s.openAt(ctx, table, 0 /* offset */, nil /* rows */)
+	if err != nil {
+		return 0, err
+	}
+	size, err = io.Copy(ioutil.Discard, r)
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.sizes[table.Name] = size
+	return size, nil
+}
+
+// uncompressedSize returns the length in bytes of the uncompressed data of
+// table, which is that of its header, if any, followed by its batches, whose
+// offsets are cached. The rows of data capped by max-bytes end within the
+// batch that crosses the cap, which is the only one generated to find where.
+func (s *workloadStorage) uncompressedSize(
+	ctx context.Context, table workload.Table,
+) (int64, error) {
+	var header []byte
+	if s.conf.Header || s.conf.HeaderOnly {
+		var err error
+		if header, err = s.header(table); err != nil {
+			return 0, err
+		}
+	}
+	if s.conf.HeaderOnly {
+		return int64(len(header)), nil
+	}
+	headerLen := int64(len(header))
+	offsets, err := s.batchOffsets(ctx, table)
+	if err != nil {
+		return 0, err
+	}
+	total := headerLen + offsets[len(offsets)-1]
+	if s.conf.MaxBytes == 0 || total <= s.conf.MaxBytes {
+		return total, nil
+	}
+	if headerLen > s.conf.MaxBytes {
+		return 0, nil
+	}
+	i := sort.Search(len(offsets), func(i int) bool { return headerLen+offsets[i] > s.conf.MaxBytes }) - 1
+	batchIdx := int(s.conf.BatchBegin) + i
+	r, err := s.generate(ctx, table, batchIdx, batchIdx+1, nil /* rows */)
+	if err != nil {
+		return 0, err
+	}
+	r = &maxBytesReader{
+		r: &ctxReader{ctx: ctx, ReadCloser: r}, maxBytes: s.conf.MaxBytes - headerLen - offsets[i],
+		csv: s.format == `csv` || s.format == `tsv`,
+	}
+	n, err := io.Copy(ioutil.Discard, r)
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return headerLen + offsets[i] + n, nil
+}
+
+// Stat implements the ExternalStorage interface. Workload data is generated on
+// demand, so it has no modification time.
+func (s *workloadStorage) Stat(ctx context.Context, basename string) (cloud.FileInfo, error) {
+	if _, err := s.resolveTable(basename); err != nil {
+		if errors.Is(err, ErrFileDoesNotExist) {
+			return cloud.FileInfo{}, nil
+		}
+		return cloud.FileInfo{}, err
+	}
+	size, err := s.Size(ctx, basename)
+	if err != nil {
+		return cloud.FileInfo{}, err
+	}
+	return cloud.FileInfo{Exists: true, Size: size}, nil
+}
+
+// Validate implements the cloud.Validator interface. The generator and table
+// are resolved when the storage is made, so this runs the checks of the flags
+// that the generator only does before generating data, and checks that the
+// requested batches exist in the table named by the URI.
+func (s *workloadStorage) Validate(ctx context.Context) error {
+	if h, ok := s.gen.(workload.Hookser); ok {
+		if validate := h.Hooks().Validate; validate != nil {
+			if err := validate(); err != nil {
+				return errors.Wrapf(err, `invalid parameters for generator %s`, s.conf.Generator)
+			}
+		}
+	}
+	if s.conf.Table != `` {
+		if n := int64(s.table.InitialRows.NumBatches); s.conf.BatchEnd > n {
+			return errors.Errorf(`the range ends at batch %d, past the end of table %s, which has %d batches`,
+				s.conf.BatchEnd, s.table.Name, n)
+		}
+	}
+	return nil
+}
+
 func (s *workloadStorage) Close() error {
 	return nil
 }
@@ -136,32 +1512,178 @@ func ParseWorkloadConfig(
 	conf := roachpb.ExternalStorage{}
 	conf.Provider = roachpb.ExternalStorageProvider_Workload
 	c := &roachpb.ExternalStorage_Workload{}
-	pathParts := strings.Split(strings.Trim(uri.Path, `/`), `/`)
-	if len(pathParts) != 3 {
+	if uri.Fragment != `` {
+		return conf, errors.Errorf(`workload URI must not have a fragment: #%s`, uri.Fragment)
+	}
+	// The escaped path is split so that a part may contain an encoded slash,
+	// and each part is then decoded.
+	pathParts, err := splitURIPath(uri.EscapedPath())
+	if err != nil {
+		return conf, err
+	}
+	for i := range pathParts {
+		if pathParts[i], err = url.PathUnescape(pathParts[i]); err != nil {
+			return conf, errors.Wrapf(err, `decoding path %s`, uri.EscapedPath())
+		}
+	}
+	switch len(pathParts) {
+	case 2:
+		c.Format, c.Generator = pathParts[0], pathParts[1]
+	case 3:
+		c.Format, c.Generator, c.Table = pathParts[0], pathParts[1], pathParts[2]
+	default:
 		return conf, errors.Errorf(
-			`path must be of the form /<format>/<generator>/<table>: %s`, uri.Path)
+			`path must be of the form /<format>/<generator>[/<table>]: %s`, uri.Path)
 	}
-	c.Format, c.Generator, c.Table = pathParts[0], pathParts[1], pathParts[2]
 	q := uri.Query()
-	if _, ok := q[`version`]; !ok {
+	if _, ok := q[`version`]; ok {
+		c.Version = q.Get(`version`)
+		q.Del(`version`)
+	} else if meta, err := workload.Get(c.Generator); err == nil && isUnversionedWorkload(meta.Version) {
+		// A generator that does not version its data generates the same data for
+		// any URI, so its version may be omitted.
+		c.Version = meta.Version
+	} else {
 		return conf, errors.New(`parameter version is required`)
 	}
-	c.Version = q.Get(`version`)
-	q.Del(`version`)
-	if s := q.Get(`row-start`); len(s) > 0 {
-		q.Del(`row-start`)
+	// `row=N` is shorthand for `row-start=N&row-end=N+1`.
+	if r := q.Get(`row`); len(r) > 0 {
+		q.Del(`row`)
+		if q.Get(`row-start`) != `` || q.Get(`row-end`) != `` {
+			return conf, errors.New(`row cannot be combined with row-start or row-end`)
+		}
+		row, err := strconv.ParseInt(r, 10, 64)
+		if err != nil {
+			return conf, err
+		}
+		if row < 0 {
+			return conf, errors.Errorf(`row must not be negative: %d`, row)
+		}
+		c.BatchBegin, c.BatchEnd = row, row+1
+	}
+	// batch-start and batch-end set the same range of batches as row-start and
+	// row-end, which are only row numbers for generators that generate one row
+	// per batch. Combining them would make it unclear which one was meant.
+	endParam := `row-end or row`
+	if q.Get(`batch-start`) != `` || q.Get(`batch-end`) != `` {
+		if c.BatchEnd != 0 || q.Get(`row-start`) != `` || q.Get(`row-end`) != `` {
+			return conf, errors.New(`batch-start and batch-end cannot be combined with row, row-start or row-end`)
+		}
+		if err := parseWorkloadBatchRange(q, `batch-start`, `batch-end`, c); err != nil {
+			return conf, err
+		}
+		endParam = `batch-end`
+	} else if err := parseWorkloadBatchRange(q, `row-start`, `row-end`, c); err != nil {
+		return conf, err
+	}
+	if m := q.Get(`max-bytes`); len(m) > 0 {
+		q.Del(`max-bytes`)
+		// Both bound the data, so allowing both would make it unclear which one
+		// ends it.
+		if c.BatchEnd != 0 {
+			return conf, errors.Newf(`max-bytes cannot be combined with %s`, endParam)
+		}
 		var err error
-		if c.BatchBegin, err = strconv.ParseInt(s, 10, 64); err != nil {
+		if c.MaxBytes, err = strconv.ParseInt(m, 10, 64); err != nil {
 			return conf, err
 		}
+		if c.MaxBytes < 1 {
+			return conf, errors.Errorf(`max-bytes must be positive: %d`, c.MaxBytes)
+		}
 	}
-	if e := q.Get(`row-end`); len(e) > 0 {
-		q.Del(`row-end`)
+	if h := q.Get(`header-only`); len(h) > 0 {
+		q.Del(`header-only`)
 		var err error
-		if c.BatchEnd, err = strconv.ParseInt(e, 10, 64); err != nil {
+		if c.HeaderOnly, err = strconv.ParseBool(h); err != nil {
+			return conf, errors.Wrapf(err, `parsing header-only`)
+		}
+		// The header is not made of rows, so it cannot be bounded by them.
+		if c.HeaderOnly && (c.BatchBegin != 0 || c.BatchEnd != 0 || c.MaxBytes != 0) {
+			return conf, errors.New(`header-only cannot be combined with a range of rows or max-bytes`)
+		}
+	}
+	if h := q.Get(`header`); len(h) > 0 {
+		q.Del(`header`)
+		var err error
+		if c.Header, err = strconv.ParseBool(h); err != nil {
+			return conf, errors.Wrapf(err, `parsing header`)
+		}
+		if c.Header && c.HeaderOnly {
+			return conf, errors.New(`header cannot be combined with header-only`)
+		}
+	}
+	if _, ok := q[`compress`]; ok {
+		c.Compression = strings.ToLower(q.Get(`compress`))
+		q.Del(`compress`)
+		if err := validateWorkloadCompression(c.Compression); err != nil {
+			return conf, err
+		}
+	}
+	if p := q.Get(`parallelism`); len(p) > 0 {
+		q.Del(`parallelism`)
+		parallelism, err := strconv.ParseInt(p, 10, 32)
+		if err != nil {
+			return conf, err
+		}
+		if parallelism < 1 {
+			return conf, errors.Errorf(`parallelism must be positive: %d`, parallelism)
+		}
+		c.Parallelism = int32(parallelism)
+	}
+	if _, ok := q[`delimiter`]; ok {
+		c.Delimiter = q.Get(`delimiter`)
+		q.Del(`delimiter`)
+		if err := validateWorkloadDelimiter(c.Delimiter); err != nil {
 			return conf, err
 		}
 	}
+	if _, ok := q[`null-as`]; ok {
+		c.NullAs = q.Get(`null-as`)
+		q.Del(`null-as`)
+		// An empty value could not be told apart from the default.
+		if c.NullAs == `` {
+			return conf, errors.New(`null-as must not be empty`)
+		}
+	}
+	if w := q.Get(`widths`); len(w) > 0 {
+		q.Del(`widths`)
+		for _, part := range strings.Split(w, `,`) {
+			width, err := strconv.ParseInt(part, 10, 32)
+			if err != nil {
+				return conf, errors.Wrapf(err, `parsing widths`)
+			}
+			if width < 1 {
+				return conf, errors.Errorf(`widths must be positive: %d`, width)
+			}
+			c.Widths = append(c.Widths, int32(width))
+		}
+	}
+	if tr := q.Get(`truncate`); len(tr) > 0 {
+		q.Del(`truncate`)
+		var err error
+		if c.Truncate, err = strconv.ParseBool(tr); err != nil {
+			return conf, errors.Wrapf(err, `parsing truncate`)
+		}
+	}
+	if _, ok := q[`quote`]; ok {
+		c.Quote = strings.ToLower(q.Get(`quote`))
+		q.Del(`quote`)
+		if _, err := parseWorkloadQuote(c.Quote); err != nil {
+			return conf, err
+		}
+	}
+	if s := q.Get(`strict`); len(s) > 0 {
+		q.Del(`strict`)
+		strict, err := strconv.ParseBool(s)
+		if err != nil {
+			return conf, errors.Wrapf(err, `parsing strict`)
+		}
+		if strict {
+			if err := checkWorkloadFlagsKnown(c.Generator, q); err != nil {
+				return conf, err
+			}
+		}
+	}
 	for k, vs := range q {
 		for _, v := range vs {
 			c.Flags = append(c.Flags, `--`+k+`=`+v)
@@ -170,3 +1692,209 @@ func ParseWorkloadConfig(
 	conf.WorkloadConfig = c
 	return conf, nil
 }
+
+// checkWorkloadFlagsKnown returns an error naming the parameters in q that are
+// not flags of the named generator.
+func checkWorkloadFlagsKnown(generator string, q url.Values) error {
+	meta, err := workload.Get(generator)
+	if err != nil {
+		return err
+	}
+	var flags *pflag.FlagSet
+	if f, ok := meta.New().(workload.Flagser); ok {
+		flags = f.Flags().FlagSet
+	}
+	var unknown []string
+	for k := range q {
+		if flags == nil || flags.Lookup(k) == nil {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	err = errors.Errorf(`unknown parameters for generator %s: %s`,
+		generator, strings.Join(unknown, `, `))
+	if flags != nil {
+		var names []string
+		flags.VisitAll(func(f *pflag.Flag) {
+			names = append(names, f.Name)
+		})
+		sort.Strings(names)
+		err = errors.WithHintf(err, `valid parameters: %s`, strings.Join(names, `, `))
+	}
+	return err
+}
+
+// describeWorkloadFlagError returns a description of the first of args whose
+// value cannot be applied to flags, naming the flag and the type of value it
+// expects, or the empty string if no such argument is found.
+func describeWorkloadFlagError(flags *pflag.FlagSet, args []string) string {
+	for _, arg := range args {
+		kv := strings.SplitN(strings.TrimPrefix(arg, `--`), `=`, 2)
+		flag := flags.Lookup(kv[0])
+		if flag == nil {
+			// pflag already names unknown flags in its error.
+			return ``
+		}
+		if len(kv) < 2 {
+			continue
+		}
+		if err := flag.Value.Set(kv[1]); err != nil {
+			return fmt.Sprintf(`flag --%s expects a value of type %s but got %q`,
+				flag.Name, flag.Value.Type(), kv[1])
+		}
+	}
+	return ``
+}
+
+// validateWorkloadDelimiter checks that d is usable as the field separator of
+// generated rows: a single byte that does not conflict with quoting or line
+// endings.
+func validateWorkloadDelimiter(d string) error {
+	if len(d) != 1 || d[0] >= utf8.RuneSelf {
+		return errors.Errorf(`delimiter must be a single byte: %q`, d)
+	}
+	switch d[0] {
+	case '"', '\r', '\n':
+		return errors.Errorf(`invalid delimiter: %q`, d)
+	}
+	return nil
+}
+
+// validateWorkloadNullAs checks that n is usable as the field written for NULL
+// values in rows whose fields are separated by comma: it must not contain comma
+// or a line ending, which would make it more than a field.
+func validateWorkloadNullAs(n string, comma rune) error {
+	if strings.ContainsRune(n, comma) || strings.ContainsAny(n, "\r\n") {
+		return errors.Errorf(`null-as must not contain the delimiter or a newline: %q`, n)
+	}
+	return nil
+}
+
+// parseWorkloadBatchRange sets the batches of c to the range given by the
+// startParam and endParam parameters of q, if any, and removes them from q.
+func parseWorkloadBatchRange(
+	q url.Values, startParam, endParam string, c *roachpb.ExternalStorage_Workload,
+) error {
+	if s := q.Get(startParam); len(s) > 0 {
+		q.Del(startParam)
+		var err error
+		if c.BatchBegin, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return err
+		}
+		if c.BatchBegin < 0 {
+			return errors.Errorf(`%s must not be negative: %d`, startParam, c.BatchBegin)
+		}
+	}
+	if e := q.Get(endParam); len(e) > 0 {
+		q.Del(endParam)
+		var err error
+		if c.BatchEnd, err = strconv.ParseInt(e, 10, 64); err != nil {
+			return err
+		}
+		if c.BatchEnd < 0 {
+			return errors.Errorf(`%s must not be negative: %d`, endParam, c.BatchEnd)
+		}
+		// A zero end is the end of the table, which no start is past.
+		if c.BatchEnd != 0 && c.BatchEnd < c.BatchBegin {
+			return errors.Errorf(
+				`%s %d must not be less than %s %d`, endParam, c.BatchEnd, startParam, c.BatchBegin)
+		}
+	}
+	return nil
+}
+
+// parseWorkloadQuote returns the quoting of fields named by q, which is that of
+// the quote parameter of workload URIs.
+func parseWorkloadQuote(q string) (csv.QuoteMode, error) {
+	switch q {
+	case ``, `minimal`:
+		return csv.QuoteMinimal, nil
+	case `always`:
+		return csv.QuoteAll, nil
+	case `never`:
+		return csv.QuoteNone, nil
+	}
+	return 0, errors.Errorf(`unsupported quote: %s`, q)
+}
+
+// validateWorkloadCompression checks that c names a supported compression
+// codec for generated rows. The empty string means no compression.
+func validateWorkloadCompression(c string) error {
+	switch c {
+	case ``, `gzip`:
+		return nil
+	}
+	return errors.Errorf(`unsupported compression: %s`, c)
+}
+
+// WorkloadTableURI returns a workload URI that reads the given table with the
+// rest of the configuration taken from conf. It is the inverse of
+// ParseWorkloadConfig.
+func WorkloadTableURI(conf *roachpb.ExternalStorage_Workload, table string) string {
+	q := url.Values{`version`: []string{conf.Version}}
+	if conf.BatchBegin != 0 {
+		q.Set(`row-start`, strconv.FormatInt(conf.BatchBegin, 10))
+	}
+	if conf.BatchEnd != 0 {
+		q.Set(`row-end`, strconv.FormatInt(conf.BatchEnd, 10))
+	}
+	if conf.MaxBytes != 0 {
+		q.Set(`max-bytes`, strconv.FormatInt(conf.MaxBytes, 10))
+	}
+	if conf.HeaderOnly {
+		q.Set(`header-only`, `true`)
+	}
+	if conf.Header {
+		q.Set(`header`, `true`)
+	}
+	if conf.Compression != `` {
+		q.Set(`compress`, conf.Compression)
+	}
+	if conf.Parallelism != 0 {
+		q.Set(`parallelism`, strconv.FormatInt(int64(conf.Parallelism), 10))
+	}
+	if conf.Delimiter != `` {
+		q.Set(`delimiter`, conf.Delimiter)
+	}
+	if conf.NullAs != `` {
+		q.Set(`null-as`, conf.NullAs)
+	}
+	if conf.Quote != `` {
+		q.Set(`quote`, conf.Quote)
+	}
+	if len(conf.Widths) > 0 {
+		widths := make([]string, len(conf.Widths))
+		for i, w := range conf.Widths {
+			widths[i] = strconv.FormatInt(int64(w), 10)
+		}
+		q.Set(`widths`, strings.Join(widths, `,`))
+	}
+	if conf.Truncate {
+		q.Set(`truncate`, `true`)
+	}
+	for _, f := range conf.Flags {
+		kv := strings.SplitN(strings.TrimPrefix(f, `--`), `=`, 2)
+		if len(kv) == 2 {
+			q.Add(kv[0], kv[1])
+		}
+	}
+	// Each part of the path is escaped, as a table name may contain a slash.
+	parts := []string{conf.Format, conf.Generator}
+	if table != `` {
+		parts = append(parts, table)
+	}
+	escaped := make([]string, len(parts))
+	for i := range parts {
+		escaped[i] = url.PathEscape(parts[i])
+	}
+	u := url.URL{
+		Scheme:   `workload`,
+		Path:     `/` + strings.Join(parts, `/`),
+		RawPath:  `/` + strings.Join(escaped, `/`),
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
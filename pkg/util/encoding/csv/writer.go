@@ -20,8 +20,28 @@ import (
 	"strings"
 	"unicode"
 	"unicode/utf8"
+
+	"github.com/cockroachdb/errors"
+)
+
+// A QuoteMode controls which fields a Writer encloses in quotes.
+type QuoteMode int
+
+const (
+	// QuoteMinimal quotes only the fields that need quotes. It is the default.
+	QuoteMinimal QuoteMode = iota
+	// QuoteAll quotes every field, including empty ones.
+	QuoteAll
+	// QuoteNone never quotes fields. Records with a field that cannot be read
+	// back unquoted, as it contains the field delimiter, a quote or a newline,
+	// fail to be written with ErrQuoteRequired.
+	QuoteNone
 )
 
+// ErrQuoteRequired is returned when writing a field that must be quoted with a
+// Writer whose Quote is QuoteNone.
+var ErrQuoteRequired = errors.New("field must be quoted")
+
 // A Writer writes records to a CSV encoded file.
 //
 // As returned by NewWriter, a Writer writes records terminated by a
@@ -31,9 +51,12 @@ import (
 // Comma is the field delimiter.
 //
 // If UseCRLF is true, the Writer ends each record with \r\n instead of \n.
+//
+// Quote controls which fields are quoted.
 type Writer struct {
-	Comma   rune // Field delimiter (set to ',' by NewWriter)
-	UseCRLF bool // True to use \r\n as the line terminator
+	Comma   rune      // Field delimiter (set to ',' by NewWriter)
+	UseCRLF bool      // True to use \r\n as the line terminator
+	Quote   QuoteMode // Which fields to quote (QuoteMinimal by default)
 	w       *bufio.Writer
 }
 
@@ -51,6 +74,14 @@ func (w *Writer) Write(record []string) error {
 	if !validDelim(w.Comma) {
 		return errInvalidDelim
 	}
+	if w.Quote == QuoteNone {
+		// Check the whole record first so that none of it is written.
+		for _, field := range record {
+			if w.fieldRequiresQuotes(field) {
+				return errors.Wrapf(ErrQuoteRequired, "writing %q", field)
+			}
+		}
+	}
 
 	for n, field := range record {
 		if n > 0 {
@@ -61,7 +92,8 @@ func (w *Writer) Write(record []string) error {
 
 		// If we don't have to have a quoted field then just
 		// write out the field and continue to the next field.
-		if !w.fieldNeedsQuotes(field) {
+		quote := w.Quote == QuoteAll || (w.Quote == QuoteMinimal && w.fieldNeedsQuotes(field))
+		if !quote {
 			if _, err := w.w.WriteString(field); err != nil {
 				return err
 			}
@@ -146,10 +178,17 @@ func (w *Writer) fieldNeedsQuotes(field string) bool {
 	if field == "" {
 		return false
 	}
-	if field == `\.` || strings.ContainsRune(field, w.Comma) || strings.ContainsAny(field, "\"\r\n") {
+	if field == `\.` || w.fieldRequiresQuotes(field) {
 		return true
 	}
 
 	r1, _ := utf8.DecodeRuneInString(field)
 	return unicode.IsSpace(r1)
 }
+
+// fieldRequiresQuotes reports whether our field cannot be read back
+// unless it is enclosed in quotes: whether it has a Comma, a quote
+// or a newline.
+func (w *Writer) fieldRequiresQuotes(field string) bool {
+	return strings.ContainsRune(field, w.Comma) || strings.ContainsAny(field, "\"\r\n")
+}
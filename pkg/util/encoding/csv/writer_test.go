@@ -25,6 +25,7 @@ var writeTests = []struct {
 	Input   [][]string
 	Output  string
 	UseCRLF bool
+	Quote   QuoteMode
 }{
 	{Input: [][]string{{"abc"}}, Output: "abc\n"},
 	{Input: [][]string{{"abc"}}, Output: "abc\r\n", UseCRLF: true},
@@ -50,6 +51,9 @@ var writeTests = []struct {
 	{Input: [][]string{{"a", "a", ""}}, Output: "a,a,\n"},
 	{Input: [][]string{{"a", "a", "a"}}, Output: "a,a,a\n"},
 	{Input: [][]string{{`\.`}}, Output: "\"\\.\"\n"},
+	{Input: [][]string{{"abc", "", " a", `a"b`, "a,b"}}, Output: `"abc",""," a","a""b","a,b"` + "\n", Quote: QuoteAll},
+	{Input: [][]string{{""}, {"a\nb"}}, Output: "\"\"\r\n\"a\r\nb\"\r\n", UseCRLF: true, Quote: QuoteAll},
+	{Input: [][]string{{"abc", "", " a", `\.`}}, Output: `abc,, a,\.` + "\n", Quote: QuoteNone},
 }
 
 func TestWrite(t *testing.T) {
@@ -57,6 +61,7 @@ func TestWrite(t *testing.T) {
 		b := &bytes.Buffer{}
 		f := NewWriter(b)
 		f.UseCRLF = tt.UseCRLF
+		f.Quote = tt.Quote
 		err := f.WriteAll(tt.Input)
 		if err != nil {
 			t.Errorf("Unexpected error: %s\n", err)
@@ -68,6 +73,37 @@ func TestWrite(t *testing.T) {
 	}
 }
 
+func TestWriteQuoteNone(t *testing.T) {
+	for _, field := range []string{"a,b", `a"b`, "a\nb", "a\rb"} {
+		b := &bytes.Buffer{}
+		f := NewWriter(b)
+		f.Quote = QuoteNone
+		err := f.Write([]string{"ok", field})
+		if !errors.Is(err, ErrQuoteRequired) {
+			t.Errorf("%q: expected ErrQuoteRequired, got %v", field, err)
+		}
+		f.Flush()
+		if b.Len() != 0 {
+			t.Errorf("%q: expected nothing to be written, got %q", field, b.String())
+		}
+	}
+
+	// The delimiter is what cannot be written unquoted, not a comma.
+	b := &bytes.Buffer{}
+	f := NewWriter(b)
+	f.Comma = '|'
+	f.Quote = QuoteNone
+	if err := f.WriteAll([][]string{{"a,b", "c"}}); err != nil {
+		t.Errorf("Unexpected error: %s\n", err)
+	}
+	if out, want := b.String(), "a,b|c\n"; out != want {
+		t.Errorf("out=%q want %q", out, want)
+	}
+	if err := f.Write([]string{"a|b"}); !errors.Is(err, ErrQuoteRequired) {
+		t.Errorf("expected ErrQuoteRequired, got %v", err)
+	}
+}
+
 type errorWriter struct{}
 
 func (e errorWriter) Write(b []byte) (int, error) {
@@ -87,6 +87,8 @@ type csvRowsReader struct {
 	a        bufalloc.ByteAllocator
 
 	stringsBuf []string
+	// null, if non-empty, overrides the field written for NULL values.
+	null string
 }
 
 func (r *csvRowsReader) Read(p []byte) (n int, err error) {
@@ -112,6 +114,10 @@ func (r *csvRowsReader) Read(p []byte) (n int, err error) {
 		}
 		for rowIdx, numRows := 0, r.cb.Length(); rowIdx < numRows; rowIdx++ {
 			for colIdx, col := range r.cb.ColVecs() {
+				if r.null != `` && col.Nulls().NullAt(rowIdx) {
+					r.stringsBuf[colIdx] = r.null
+					continue
+				}
 				r.stringsBuf[colIdx] = colDatumToCSVString(col, rowIdx)
 			}
 			if err := r.csvW.Write(r.stringsBuf); err != nil {
@@ -122,15 +128,42 @@ func (r *csvRowsReader) Read(p []byte) (n int, err error) {
 	}
 }
 
+// CSVRowsReaderOptions configures the output of a reader returned by
+// NewCSVRowsReaderWithOptions. The zero value is the default CSV output.
+type CSVRowsReaderOptions struct {
+	// Comma is the field delimiter. If zero, it defaults to ','.
+	Comma rune
+	// Null is the field written for NULL values. If empty, it defaults to NULL.
+	Null string
+	// Quote controls which fields are quoted. It defaults to quoting only the
+	// fields that need it.
+	Quote csv.QuoteMode
+}
+
 // NewCSVRowsReader returns an io.Reader that outputs the initial data of the
 // given table as CSVs. If batchEnd is the zero-value it defaults to the end of
-// the table.
+// the table. The output only has the rows of the table, with no header row.
 func NewCSVRowsReader(t Table, batchStart, batchEnd int) io.Reader {
+	return NewCSVRowsReaderWithOptions(t, batchStart, batchEnd, CSVRowsReaderOptions{})
+}
+
+// NewCSVRowsReaderWithOptions is like NewCSVRowsReader but allows configuring
+// the output format.
+func NewCSVRowsReaderWithOptions(
+	t Table, batchStart, batchEnd int, opts CSVRowsReaderOptions,
+) io.Reader {
 	if batchEnd == 0 {
 		batchEnd = t.InitialRows.NumBatches
 	}
 	r := &csvRowsReader{t: t, batchStart: batchStart, batchEnd: batchEnd, batchIdx: batchStart}
 	r.csvW = csv.NewWriter(&r.buf)
+	if opts.Comma != 0 {
+		r.csvW.Comma = opts.Comma
+	}
+	r.csvW.Quote = opts.Quote
+	if opts.Null != `` {
+		r.null = opts.Null
+	}
 	return r
 }
 
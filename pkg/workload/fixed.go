@@ -0,0 +1,159 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package workload
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cockroachdb/cockroach/pkg/col/coldata"
+	"github.com/cockroachdb/cockroach/pkg/util/bufalloc"
+	"github.com/cockroachdb/errors"
+)
+
+// ErrFieldTooWide is returned for a field of fixed-width output that is wider
+// than its column, unless fields are truncated.
+var ErrFieldTooWide = errors.New("field is wider than its column")
+
+// FixedWidthOptions configures fixed-width output.
+type FixedWidthOptions struct {
+	// Widths are the widths of the columns in characters, in the order they
+	// are generated.
+	Widths []int
+	// Truncate, if true, truncates the fields that are wider than their
+	// column to its width rather than failing with ErrFieldTooWide.
+	Truncate bool
+	// Null is the field written for NULL values. If empty, it defaults to NULL.
+	Null string
+}
+
+// AppendFixedWidthRow appends the fields of a row to buf as a line of
+// fixed-width output and returns the extended buffer. Each field is padded
+// with trailing spaces to the width of its column, and named by columnNames in
+// errors. Fields cannot contain newlines, which would split the row.
+func AppendFixedWidthRow(
+	buf []byte, fields, columnNames []string, opts FixedWidthOptions,
+) ([]byte, error) {
+	if len(fields) != len(opts.Widths) {
+		return nil, errors.Errorf(`%d fields were given but %d widths`, len(fields), len(opts.Widths))
+	}
+	for i, field := range fields {
+		if strings.ContainsAny(field, "\r\n") {
+			return nil, errors.Errorf(`value %q of column %s contains a newline`, field,
+				columnNames[i])
+		}
+		width := opts.Widths[i]
+		n := utf8.RuneCountInString(field)
+		if n > width {
+			if !opts.Truncate {
+				return nil, errors.Wrapf(ErrFieldTooWide,
+					`value %q of column %s has %d characters but its width is %d`,
+					field, columnNames[i], n, width)
+			}
+			// Cut the field at the end of its width-th character.
+			for j := range field {
+				if width == 0 {
+					field = field[:j]
+					break
+				}
+				width--
+			}
+			n = opts.Widths[i]
+		}
+		buf = append(buf, field...)
+		for ; n < opts.Widths[i]; n++ {
+			buf = append(buf, ' ')
+		}
+	}
+	return append(buf, '\n'), nil
+}
+
+type fixedWidthRowsReader struct {
+	t                    Table
+	columnNames          []string
+	batchStart, batchEnd int
+	opts                 FixedWidthOptions
+
+	buf bytes.Buffer
+
+	batchIdx int
+	cb       coldata.Batch
+	a        bufalloc.ByteAllocator
+
+	stringsBuf []string
+	rowBuf     []byte
+}
+
+// NewFixedWidthRowsReader returns an io.Reader that outputs the initial data of
+// the given table as fixed-width rows, as written by AppendFixedWidthRow. The
+// columns are named by columnNames, which must be in the same order as the
+// columns generated for the table, as must opts.Widths. If batchEnd is the
+// zero-value it defaults to the end of the table.
+func NewFixedWidthRowsReader(
+	t Table, columnNames []string, batchStart, batchEnd int, opts FixedWidthOptions,
+) io.Reader {
+	if batchEnd == 0 {
+		batchEnd = t.InitialRows.NumBatches
+	}
+	if opts.Null == `` {
+		opts.Null = `NULL`
+	}
+	return &fixedWidthRowsReader{
+		t: t, columnNames: columnNames, batchStart: batchStart, batchEnd: batchEnd, opts: opts,
+		batchIdx: batchStart,
+	}
+}
+
+func (r *fixedWidthRowsReader) Read(p []byte) (n int, err error) {
+	if r.cb == nil {
+		r.cb = coldata.NewMemBatchWithCapacity(nil /* typs */, 0 /* capacity */, coldata.StandardColumnFactory)
+	}
+
+	for {
+		if r.buf.Len() > 0 {
+			return r.buf.Read(p)
+		}
+		r.buf.Reset()
+		if r.batchIdx == r.batchEnd {
+			return 0, io.EOF
+		}
+		r.a = r.a[:0]
+		r.t.InitialRows.FillBatch(r.batchIdx, r.cb, &r.a)
+		r.batchIdx++
+		numCols := r.cb.Width()
+		if numCols != len(r.columnNames) {
+			return 0, errors.Errorf(`table %s generated %d columns but %d column names were given`,
+				r.t.Name, numCols, len(r.columnNames))
+		}
+		if cap(r.stringsBuf) < numCols {
+			r.stringsBuf = make([]string, numCols)
+		} else {
+			r.stringsBuf = r.stringsBuf[:numCols]
+		}
+		for rowIdx, numRows := 0, r.cb.Length(); rowIdx < numRows; rowIdx++ {
+			for colIdx, col := range r.cb.ColVecs() {
+				if col.Nulls().NullAt(rowIdx) {
+					r.stringsBuf[colIdx] = r.opts.Null
+					continue
+				}
+				r.stringsBuf[colIdx] = colDatumToCSVString(col, rowIdx)
+			}
+			if r.rowBuf, err = AppendFixedWidthRow(
+				r.rowBuf[:0], r.stringsBuf, r.columnNames, r.opts,
+			); err != nil {
+				return 0, errors.Wrapf(err, `table %s`, r.t.Name)
+			}
+			r.buf.Write(r.rowBuf)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package workload_test
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/workload"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFixedWidthRowsReader(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rows := [][]interface{}{
+		{true, 1, `short`},
+		{nil, -20, `exactly 10`},
+		{false, nil, `héllo, "wörld"`},
+	}
+	table := workload.Table{
+		Name: `t`,
+		InitialRows: workload.TypedTuples(len(rows),
+			[]*types.T{types.Bool, types.Int, types.Bytes},
+			func(rowIdx int) []interface{} { return rows[rowIdx] },
+		),
+	}
+	names := []string{`b`, `i`, `s`}
+	read := func(batchStart, batchEnd int, opts workload.FixedWidthOptions) (string, error) {
+		b, err := ioutil.ReadAll(workload.NewFixedWidthRowsReader(table, names, batchStart, batchEnd, opts))
+		return string(b), err
+	}
+
+	t.Run("aligned", func(t *testing.T) {
+		out, err := read(0, 2, workload.FixedWidthOptions{Widths: []int{5, 4, 10}})
+		require.NoError(t, err)
+		require.Equal(t, "true 1   short     \nNULL -20 exactly 10\n", out)
+		for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+			require.Len(t, line, 19)
+		}
+
+		out, err = read(0, 2, workload.FixedWidthOptions{Widths: []int{5, 4, 10}, Null: `-`})
+		require.NoError(t, err)
+		require.Equal(t, "true 1   short     \n-    -20 exactly 10\n", out)
+	})
+
+	t.Run("overflow", func(t *testing.T) {
+		_, err := read(0, 0, workload.FixedWidthOptions{Widths: []int{5, 4, 10}})
+		require.True(t, errors.Is(err, workload.ErrFieldTooWide), "%v", err)
+		require.EqualError(t, err, `table t: value "héllo, \"wörld\"" of column s has 14 characters `+
+			`but its width is 10: field is wider than its column`)
+
+		// Widths count characters rather than bytes, so truncation does not
+		// split them.
+		out, err := read(0, 0, workload.FixedWidthOptions{Widths: []int{5, 3, 7}, Truncate: true})
+		require.NoError(t, err)
+		require.Equal(t, "true 1  short  \nNULL -20exactly\nfalseNULhéllo, \n", out)
+	})
+
+	t.Run("newline", func(t *testing.T) {
+		_, err := workload.AppendFixedWidthRow(nil, []string{"a\nb"}, []string{`s`},
+			workload.FixedWidthOptions{Widths: []int{10}, Truncate: true})
+		require.EqualError(t, err, `value "a\nb" of column s contains a newline`)
+	})
+
+	t.Run("column mismatch", func(t *testing.T) {
+		_, err := read(0, 0, workload.FixedWidthOptions{Widths: []int{5, 4}})
+		require.EqualError(t, err, `table t: 3 fields were given but 2 widths`)
+	})
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package workload
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/cockroachdb/cockroach/pkg/col/coldata"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/util/bufalloc"
+	"github.com/cockroachdb/errors"
+)
+
+type jsonRowsReader struct {
+	t                    Table
+	columnNames          [][]byte
+	batchStart, batchEnd int
+
+	buf bytes.Buffer
+
+	batchIdx int
+	cb       coldata.Batch
+	a        bufalloc.ByteAllocator
+}
+
+// NewJSONRowsReader returns an io.Reader that outputs the initial data of the
+// given table as newline-delimited JSON, one object per row. The keys of each
+// object are given by columnNames, which must be in the same order as the
+// columns generated for the table. If batchEnd is the zero-value it defaults to
+// the end of the table.
+func NewJSONRowsReader(t Table, columnNames []string, batchStart, batchEnd int) io.Reader {
+	if batchEnd == 0 {
+		batchEnd = t.InitialRows.NumBatches
+	}
+	r := &jsonRowsReader{t: t, batchStart: batchStart, batchEnd: batchEnd, batchIdx: batchStart}
+	for _, name := range columnNames {
+		// Marshaling a string cannot fail.
+		encoded, _ := json.Marshal(name)
+		r.columnNames = append(r.columnNames, encoded)
+	}
+	return r
+}
+
+func (r *jsonRowsReader) Read(p []byte) (n int, err error) {
+	if r.cb == nil {
+		r.cb = coldata.NewMemBatchWithCapacity(nil /* typs */, 0 /* capacity */, coldata.StandardColumnFactory)
+	}
+
+	for {
+		if r.buf.Len() > 0 {
+			return r.buf.Read(p)
+		}
+		r.buf.Reset()
+		if r.batchIdx == r.batchEnd {
+			return 0, io.EOF
+		}
+		r.a = r.a[:0]
+		r.t.InitialRows.FillBatch(r.batchIdx, r.cb, &r.a)
+		r.batchIdx++
+		if numCols := r.cb.Width(); numCols != len(r.columnNames) {
+			return 0, errors.Errorf(`table %s generated %d columns but %d column names were given`,
+				r.t.Name, numCols, len(r.columnNames))
+		}
+		for rowIdx, numRows := 0, r.cb.Length(); rowIdx < numRows; rowIdx++ {
+			r.buf.WriteByte('{')
+			for colIdx, col := range r.cb.ColVecs() {
+				if colIdx > 0 {
+					r.buf.WriteByte(',')
+				}
+				r.buf.Write(r.columnNames[colIdx])
+				r.buf.WriteByte(':')
+				appendColDatumJSON(&r.buf, col, rowIdx)
+			}
+			r.buf.WriteString("}\n")
+		}
+	}
+}
+
+// appendColDatumJSON writes the JSON representation of the given datum to buf.
+// SQL NULL is written as JSON null. Floats that have no JSON representation
+// (NaN and infinities) are written as strings, as are bytes, which are written
+// in the hex format of BYTES if they are not valid UTF-8.
+func appendColDatumJSON(buf *bytes.Buffer, col coldata.Vec, rowIdx int) {
+	if col.Nulls().NullAt(rowIdx) {
+		buf.WriteString(`null`)
+		return
+	}
+	switch col.CanonicalTypeFamily() {
+	case types.BoolFamily:
+		buf.WriteString(strconv.FormatBool(col.Bool()[rowIdx]))
+	case types.IntFamily:
+		buf.WriteString(strconv.FormatInt(col.Int64()[rowIdx], 10))
+	case types.FloatFamily:
+		f := col.Float64()[rowIdx]
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			buf.WriteString(strconv.Quote(strconv.FormatFloat(f, 'f', -1, 64)))
+			return
+		}
+		buf.WriteString(strconv.FormatFloat(f, 'f', -1, 64))
+	case types.BytesFamily:
+		// JSON strings are text, which json.Marshal would otherwise make of
+		// invalid UTF-8 by replacing it, so such bytes are written in the hex
+		// format of BYTES instead.
+		b := col.Bytes().Get(rowIdx)
+		s := string(b)
+		if !utf8.Valid(b) {
+			s = `\x` + hex.EncodeToString(b)
+		}
+		// Marshaling a string cannot fail.
+		encoded, _ := json.Marshal(s)
+		buf.Write(encoded)
+	default:
+		panic(fmt.Sprintf(`unhandled type %s`, col.Type()))
+	}
+}
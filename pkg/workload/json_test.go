@@ -0,0 +1,83 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package workload_test
+
+import (
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/workload"
+	"github.com/cockroachdb/cockroach/pkg/workload/bank"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONRowsReader(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	t.Run("bank", func(t *testing.T) {
+		table := bank.FromRows(10).Tables()[0]
+		r := workload.NewJSONRowsReader(table, []string{`id`, `balance`, `payload`}, 1, 3)
+		b, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		expected := `
+{"id":1,"balance":0,"payload":"initial-vOpikzTTWxvMqnkpfEIVXgGyhZNDqvpVqpNnHawruAcIVltgbnIEIGmCDJcnkVkfVmAcutkMvRACFuUBPsZTemTDSfZT"}
+{"id":2,"balance":0,"payload":"initial-qMvoPeRiOBXvdVQxhZUfdmehETKPXyBaVWxzMqwiStIkxfoDFygYxIDyXiaVEarcwMboFhBlCAapvKijKAyjEAhRBNZz"}
+`
+		require.Equal(t, strings.TrimSpace(expected), strings.TrimSpace(string(b)))
+	})
+
+	t.Run("types", func(t *testing.T) {
+		ts := time.Date(2021, 2, 3, 4, 5, 6, 7000, time.UTC)
+		rows := [][]interface{}{
+			{true, 1, 1.5, `a "quoted"` + "\nstring", ts},
+			{nil, nil, nil, nil, nil},
+			{false, -2, math.Inf(1), ``, ts},
+		}
+		table := workload.Table{
+			InitialRows: workload.TypedTuples(len(rows),
+				[]*types.T{types.Bool, types.Int, types.Float, types.Bytes, types.Bytes},
+				func(rowIdx int) []interface{} { return rows[rowIdx] },
+			),
+		}
+		r := workload.NewJSONRowsReader(table, []string{`b`, `i`, `f`, `s`, `ts`}, 0, 0)
+		b, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		expected := `
+{"b":true,"i":1,"f":1.5,"s":"a \"quoted\"\nstring","ts":"2021-02-03 04:05:06.000007+00:00"}
+{"b":null,"i":null,"f":null,"s":null,"ts":null}
+{"b":false,"i":-2,"f":"+Inf","s":"","ts":"2021-02-03 04:05:06.000007+00:00"}
+`
+		require.Equal(t, strings.TrimSpace(expected), strings.TrimSpace(string(b)))
+	})
+
+	t.Run("invalid utf8", func(t *testing.T) {
+		rows := [][]interface{}{{"valid \u00e9"}, {"\xff\x00ab"}}
+		table := workload.Table{
+			InitialRows: workload.TypedTuples(len(rows), []*types.T{types.Bytes},
+				func(rowIdx int) []interface{} { return rows[rowIdx] },
+			),
+		}
+		b, err := ioutil.ReadAll(workload.NewJSONRowsReader(table, []string{`s`}, 0, 0))
+		require.NoError(t, err)
+		require.Equal(t, "{\"s\":\"valid \u00e9\"}\n{\"s\":\"\\\\xff006162\"}\n", string(b))
+	})
+
+	t.Run("column mismatch", func(t *testing.T) {
+		table := bank.FromRows(10).Tables()[0]
+		_, err := ioutil.ReadAll(workload.NewJSONRowsReader(table, []string{`id`}, 0, 0))
+		require.EqualError(t, err, `table bank generated 3 columns but 1 column names were given`)
+	})
+}
@@ -116,6 +116,10 @@ type Hooks struct {
 	Partition func(*gosql.DB) error
 }
 
+// Unversioned is the Version of a generator that does not version its data,
+// which workload URIs may then omit the version of.
+const Unversioned = "unversioned"
+
 // Meta is used to register a Generator at init time and holds meta information
 // about this generator, including a name, description, and a function to create
 // instances of it.
@@ -128,6 +132,8 @@ type Meta struct {
 	Details string
 	// Version is a semantic version for this generator. It should be bumped
 	// whenever InitialRowFn or InitialRowCount change for any of the tables.
+	// Generators that do not version their data leave it empty or set it to
+	// Unversioned.
 	Version string
 	// PublicFacing indicates that this workload is also intended for use by
 	// users doing their own testing and evaluations. This allows hiding workloads
@@ -389,7 +395,12 @@ func Register(m Meta) {
 func Get(name string) (Meta, error) {
 	m, ok := registered[name]
 	if !ok {
-		return Meta{}, errors.Errorf("unknown generator: %s", name)
+		var names []string
+		for _, gen := range Registered() {
+			names = append(names, gen.Name)
+		}
+		return Meta{}, errors.WithHintf(errors.Errorf("unknown generator: %s", name),
+			"available generators: %s", strings.Join(names, ", "))
 	}
 	return m, nil
 }
@@ -11,11 +11,13 @@
 package workload_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/workload"
+	"github.com/cockroachdb/errors"
 )
 
 func TestGet(t *testing.T) {
@@ -23,9 +25,13 @@ func TestGet(t *testing.T) {
 	if _, err := workload.Get(`bank`); err != nil {
 		t.Errorf(`expected success got: %+v`, err)
 	}
-	if _, err := workload.Get(`nope`); !testutils.IsError(err, `unknown generator`) {
+	_, err := workload.Get(`nope`)
+	if !testutils.IsError(err, `unknown generator`) {
 		t.Errorf(`expected "unknown generator" error got: %+v`, err)
 	}
+	if hint := errors.FlattenHints(err); !strings.Contains(hint, `bank`) {
+		t.Errorf(`expected hint listing bank got: %s`, hint)
+	}
 }
 
 func TestApproxDatumSize(t *testing.T) {